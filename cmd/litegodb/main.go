@@ -10,11 +10,13 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"text/tabwriter"
 )
 
 func main() {
-	// CLI flag: --url
+	// CLI flags: --url, --db
 	url := flag.String("url", "http://localhost:8080", "LiteGoDB server URL")
+	database := flag.String("db", "", "database to run queries against; the server's default if empty")
 	flag.Parse()
 
 	fmt.Println("Connected to LiteGoDB at", *url)
@@ -38,7 +40,15 @@ func main() {
 			break
 		}
 
-		resp, err := sendSQL(*url, query)
+		// Every query is a separate request, so USE is remembered here and sent with
+		// the queries that follow.
+		if fields := strings.Fields(strings.TrimSuffix(query, ";")); len(fields) == 2 && strings.EqualFold(fields[0], "use") {
+			*database = strings.Trim(fields[1], "`")
+			fmt.Println("Using database", *database)
+			continue
+		}
+
+		resp, err := sendSQL(*url, *database, query)
 		if err != nil {
 			fmt.Println("❌", err)
 			continue
@@ -48,11 +58,19 @@ func main() {
 	}
 }
 
-func sendSQL(url, query string) (string, error) {
+func sendSQL(url, database, query string) (string, error) {
 	reqBody := map[string]string{"query": query}
 	bodyBytes, _ := json.Marshal(reqBody)
 
-	resp, err := http.Post(url+"/sql", "application/json", bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest(http.MethodPost, url+"/sql", bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if database != "" {
+		req.Header.Set("X-LiteGoDB-Database", database)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to send request: %w", err)
 	}
@@ -63,5 +81,41 @@ func sendSQL(url, query string) (string, error) {
 		return "", fmt.Errorf("server error: %s", string(body))
 	}
 
-	return string(body), nil
+	return formatResult(body), nil
+}
+
+// formatResult renders the rows returned by a SELECT on a table with a schema as a table,
+// and any other response as it came.
+func formatResult(body []byte) string {
+	var resp struct {
+		Result struct {
+			Columns []string        `json:"columns"`
+			Rows    [][]interface{} `json:"rows"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Result.Columns == nil {
+		return strings.TrimSpace(string(body))
+	}
+
+	var out strings.Builder
+	w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(resp.Result.Columns, "\t"))
+	for _, row := range resp.Result.Rows {
+		cells := make([]string, len(row))
+		for i, value := range row {
+			switch value := value.(type) {
+			case nil:
+				cells[i] = "NULL"
+			case string:
+				cells[i] = value
+			default:
+				encoded, _ := json.Marshal(value)
+				cells[i] = string(encoded)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+	fmt.Fprintf(&out, "(%d rows)", len(resp.Result.Rows))
+	return out.String()
 }
@@ -9,13 +9,12 @@ import (
 
 func main() {
 
-	db, cfg, err := litegodb.Open("config.yaml")
+	dbs, cfg, err := litegodb.OpenDatabases("config.yaml")
 	if err != nil {
 		log.Fatalf("Failed to open database: %v", err)
 	}
-	defer db.Close()
 
-	server := server.NewServer(db, cfg)
+	server := server.NewServerWithDatabases(dbs, cfg)
 
 	if err := server.Start(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vacuumHandler compacts the database file. Requests keep being served while it runs.
+func (s *Server) vacuumHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := database(r).Vacuum()
+	if err != nil {
+		http.Error(w, "Vacuum failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// checkpointHandler checkpoints the database and reports the checkpoint LSN.
+func (s *Server) checkpointHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lsn, err := database(r).Checkpoint()
+	if err != nil {
+		http.Error(w, "Checkpoint failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]uint64{"lsn": lsn})
+}
+
+// backupHandler writes a backup of the database file under the server's backup_dir, with
+// the relative path given in the request, and reports its LSN. Without a backup_dir,
+// backups can only be taken from Go or the command line.
+func (s *Server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "Missing backup path", http.StatusBadRequest)
+		return
+	}
+	if s.Cfg.Server.BackupDir == "" {
+		http.Error(w, "Backups over HTTP need server.backup_dir", http.StatusForbidden)
+		return
+	}
+	path, err := backupPath(s.Cfg.Server.BackupDir, req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lsn, err := database(r).Backup(path)
+	if err != nil {
+		http.Error(w, "Backup failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]uint64{"lsn": lsn})
+}
+
+// backupPath returns the path of the backup called name under dir, creating the
+// directories it is in. The name must stay under dir: it cannot be absolute or go up
+// with "..".
+func backupPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("backup path %q must be relative to the backup directory", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("backup path %q must not contain ..", name)
+		}
+	}
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return path, nil
+}
+
+// replicationHandler reports the replication role of the database and, for a replica,
+// how far it is behind its primary.
+func (s *Server) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := database(r).ReplicationStatus()
+	if err != nil {
+		http.Error(w, "Replication status failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// promoteHandler turns a replica into a primary that accepts writes.
+func (s *Server) promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := database(r).Promote(); err != nil {
+		http.Error(w, "Promote failed: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	status, err := database(r).ReplicationStatus()
+	if err != nil {
+		http.Error(w, "Replication status failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+)
+
+// databaseKey is the request context key of the database a request is for.
+type databaseKey struct{}
+
+// withAuth serves a request with the database it names, if the request is authorized
+// to use it: with the server's token, which grants every database, or with the token of
+// the database. A database with a token of its own needs one of the two even when the
+// server has none; without either token configured, every request is authorized.
+func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := databaseName(r)
+		if !s.authorized(r, name) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		db, err := s.Databases.Get(name)
+		if err != nil {
+			if errors.Is(err, litegodb.ErrDatabaseNotFound) {
+				http.Error(w, "Database not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), databaseKey{}, db)))
+	}
+}
+
+// withAdmin is like withAuth, for endpoints that also need the server's token when one
+// is configured.
+func (s *Server) withAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authorized reports whether a request may use the database called name.
+func (s *Server) authorized(r *http.Request, name string) bool {
+	// Database names are case-insensitive, and configured ones are lowercased.
+	token := s.Cfg.Databases[strings.ToLower(name)].AuthToken
+	serverToken := s.Cfg.Server.AuthToken
+	if serverToken == "" && token == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	return serverToken != "" && header == "Bearer "+serverToken ||
+		token != "" && header == "Bearer "+token
+}
+
+// isAdmin reports whether a request carries the server's token, or needs none.
+func (s *Server) isAdmin(r *http.Request) bool {
+	expected := s.Cfg.Server.AuthToken
+	return expected == "" || r.Header.Get("Authorization") == "Bearer "+expected
+}
+
+// databaseName returns the name of the database a request is for: the one in its
+// X-LiteGoDB-Database header or "db" query parameter, or the default one.
+func databaseName(r *http.Request) string {
+	name := r.Header.Get(litegodb.DatabaseHeader)
+	if name == "" {
+		name = r.URL.Query().Get("db")
+	}
+	if name == "" {
+		return litegodb.DefaultDatabase
+	}
+	return name
+}
+
+// database returns the database a request authorized by withAuth is for.
+func database(r *http.Request) litegodb.DB {
+	return r.Context().Value(databaseKey{}).(litegodb.DB)
+}
+
+// grant gives the queries of a request the databases it is authorized to use, and lets
+// it create databases and run VACUUM if it carries the server's token.
+type grant struct {
+	s *Server
+	r *http.Request
+}
+
+func (g grant) Get(name string) (litegodb.DB, error) {
+	if name == "" {
+		name = databaseName(g.r)
+	}
+	if !g.s.authorized(g.r, name) {
+		return nil, fmt.Errorf("not authorized to use database %s", name)
+	}
+	return g.s.Databases.Get(name)
+}
+
+func (g grant) Create(name string) (litegodb.DB, error) {
+	if !g.s.isAdmin(g.r) {
+		return nil, fmt.Errorf("creating databases needs the server's auth token")
+	}
+	return g.s.Databases.Create(name)
+}
+
+func (g grant) CheckAdmin() error {
+	if !g.s.isAdmin(g.r) {
+		return fmt.Errorf("administrative statements need the server's auth token")
+	}
+	return nil
+}
+
+func (g grant) Names() []string {
+	var names []string
+	for _, name := range g.s.Databases.Names() {
+		if g.s.authorized(g.r, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
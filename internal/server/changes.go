@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// changesHandler streams the changes made after the LSN in the "from" query parameter to
+// the tables listed in "table" parameters, or to every table. Changes are sent as
+// newline-delimited JSON, or as server-sent events when the client accepts
+// text/event-stream; an event stream reconnecting with Last-Event-ID resumes after it.
+func (s *Server) changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	from := r.URL.Query().Get("from")
+	if id := r.Header.Get("Last-Event-ID"); sse && id != "" {
+		from = id
+	}
+	var fromLSN uint64
+	if from != "" {
+		var err error
+		if fromLSN, err = strconv.ParseUint(from, 10, 64); err != nil {
+			http.Error(w, "Invalid LSN", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, err := database(r).Subscribe(fromLSN, r.URL.Query()["table"]...)
+	if err != nil {
+		http.Error(w, "Subscribe failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				if err := sub.Err(); err != nil {
+					writeStreamError(w, sse, err)
+					flusher.Flush()
+				}
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				writeStreamError(w, sse, err)
+				return
+			}
+			if sse {
+				fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", event.LSN, data)
+			} else {
+				w.Write(append(data, '\n'))
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeStreamError ends a change stream with the error that stopped it.
+func writeStreamError(w http.ResponseWriter, sse bool, err error) {
+	if sse {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		return
+	}
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Write(append(data, '\n'))
+}
@@ -2,28 +2,15 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/rafaelmgr12/litegodb/internal/sqlparser"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
 )
 
-func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		expected := s.Cfg.Server.AuthToken
-		if expected == "" {
-			next(w, r)
-			return
-		}
-		token := r.Header.Get("Authorization")
-		if token != "Bearer "+expected {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next(w, r)
-	}
-}
-
 func (s *Server) pingHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("pong"))
 }
@@ -46,7 +33,15 @@ func (s *Server) putHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.DB.Put(req.Table, req.Key, req.Value); err != nil {
+	if err := database(r).Put(req.Table, req.Key, req.Value); err != nil {
+		if errors.Is(err, litegodb.ErrReadOnly) {
+			http.Error(w, "Read-only replica", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, litegodb.ErrInvalidRow) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Put failed", http.StatusInternalServerError)
 		return
 	}
@@ -69,7 +64,7 @@ func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	val, found, err := s.DB.Get(table, key)
+	val, found, err := database(r).Get(table, key)
 	if err != nil {
 		http.Error(w, "DB Get error", http.StatusInternalServerError)
 		return
@@ -94,7 +89,11 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.DB.Delete(req.Table, req.Key); err != nil {
+	if err := database(r).Delete(req.Table, req.Key); err != nil {
+		if errors.Is(err, litegodb.ErrReadOnly) {
+			http.Error(w, "Read-only replica", http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Delete failed", http.StatusInternalServerError)
 		return
 	}
@@ -102,6 +101,60 @@ func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// BatchRequest is the body of a /batch request: writes applied atomically, in order.
+type BatchRequest struct {
+	Ops []litegodb.BatchOp `json:"ops"`
+}
+
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	batch, err := writeBatch(req.Ops)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := database(r).Write(batch); err != nil {
+		if errors.Is(err, litegodb.ErrReadOnly) {
+			http.Error(w, "Read-only replica", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, litegodb.ErrInvalidRow) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Batch failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeBatch returns the batch of the given writes, which must be puts or deletes.
+func writeBatch(ops []litegodb.BatchOp) (*litegodb.WriteBatch, error) {
+	batch := litegodb.NewWriteBatch()
+	for i, op := range ops {
+		switch op.Op {
+		case "put":
+			batch.Put(op.Table, op.Key, op.Value)
+		case "delete":
+			batch.Delete(op.Table, op.Key)
+		default:
+			return nil, fmt.Errorf("invalid operation %q in write %d", op.Op, i)
+		}
+	}
+	return batch, nil
+}
+
 func (s *Server) sqlHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Query string `json:"query"`
@@ -117,7 +170,7 @@ func (s *Server) sqlHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := sqlparser.ParseAndExecute(req.Query, s.DB)
+	result, err := sqlparser.ParseAndExecuteIn(req.Query, grant{s, r}, databaseName(r))
 	if err != nil {
 		http.Error(w, "SQL execution error: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -17,19 +17,32 @@ import (
 )
 
 type Server struct {
-	DB          litegodb.DB
+	DB          litegodb.DB         // The default database.
+	Databases   *litegodb.Databases // Every database served, by name.
 	Cfg         *litegodb.Config
 	mux         *http.ServeMux
 	connections map[*websocket.Conn]bool
 	connMutex   sync.Mutex
+	closing     chan struct{} // Closed on shutdown to end the change streams.
 }
 
 func NewServer(db litegodb.DB, cfg *litegodb.Config) *Server {
+	return NewServerWithDatabases(litegodb.SingleDatabase(db), cfg)
+}
+
+// NewServerWithDatabases returns a server for several databases, such as the ones opened
+// by litegodb.OpenDatabases. Requests name the database they are for in the
+// X-LiteGoDB-Database header or the "db" query parameter, and use the default one
+// otherwise.
+func NewServerWithDatabases(dbs *litegodb.Databases, cfg *litegodb.Config) *Server {
+	db, _ := dbs.Get(litegodb.DefaultDatabase)
 	s := &Server{
 		DB:          db,
+		Databases:   dbs,
 		Cfg:         cfg,
 		mux:         http.NewServeMux(),
 		connections: make(map[*websocket.Conn]bool),
+		closing:     make(chan struct{}),
 	}
 	s.routes()
 	return s
@@ -40,8 +53,21 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("/put", s.withAuth(s.putHandler))
 	s.mux.HandleFunc("/get", s.withAuth(s.getHandler))
 	s.mux.HandleFunc("/delete", s.withAuth(s.deleteHandler))
+	s.mux.HandleFunc("/batch", s.withAuth(s.batchHandler))
 	s.mux.HandleFunc("/sql", s.withAuth(s.sqlHandler))
-	s.mux.HandleFunc("/ws", s.wsHandler)
+	s.mux.HandleFunc("/changes", s.withAuth(s.changesHandler))
+	s.mux.HandleFunc("/admin/vacuum", s.withAdmin(s.vacuumHandler))
+	s.mux.HandleFunc("/admin/checkpoint", s.withAdmin(s.checkpointHandler))
+	s.mux.HandleFunc("/admin/backup", s.withAdmin(s.backupHandler))
+	s.mux.HandleFunc("/admin/promote", s.withAdmin(s.promoteHandler))
+	s.mux.HandleFunc("/replication", s.withAuth(s.replicationHandler))
+	s.mux.HandleFunc("/ws", s.withAuth(s.wsHandler))
+}
+
+// Handler returns the handler serving the server's endpoints, for embedding the server
+// in another HTTP server.
+func (s *Server) Handler() http.Handler {
+	return s.setupHandler()
 }
 
 func (s *Server) setupHandler() http.Handler {
@@ -76,7 +102,8 @@ func (s *Server) Start() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// First close WebSocket connections
+	// First end the change streams and close WebSocket connections
+	close(s.closing)
 	s.shutdownConnections()
 
 	// Then shutdown HTTP server
@@ -84,8 +111,8 @@ func (s *Server) Start() error {
 		log.Fatalf("HTTP server shutdown error: %v", err)
 	}
 
-	// Finally close the database
-	if err := s.DB.Close(); err != nil {
+	// Finally close the databases
+	if err := s.Databases.Close(); err != nil {
 		log.Printf("Database close error: %v", err)
 	}
 
@@ -3,9 +3,12 @@ package server
 import (
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/rafaelmgr12/litegodb/internal/sqlparser"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
 )
 
 var upgrader = websocket.Upgrader{
@@ -13,16 +16,34 @@ var upgrader = websocket.Upgrader{
 }
 
 type WSRequest struct {
-	Op    string `json:"op"`
-	Table string `json:"table"`
-	Key   int    `json:"key"`
-	Value string `json:"value,omitempty"`
+	Op     string   `json:"op"`
+	Table  string   `json:"table"`
+	Key    int      `json:"key"`
+	Value  string   `json:"value,omitempty"`
+	From   uint64   `json:"from,omitempty"`   // LSN to stream changes after, for "subscribe"
+	Tables []string `json:"tables,omitempty"` // Tables to stream changes of, for "subscribe"; all if empty
+	Tx     uint64   `json:"tx,omitempty"`     // Transaction to run "put", "get" and "delete" in, and to end with "commit" or "rollback"
+	Query  string   `json:"query,omitempty"`  // SQL query, for "sql"
+
+	Optimistic bool `json:"optimistic,omitempty"` // Validate the transaction's reads on commit, for "begin"
+
+	Ops []litegodb.BatchOp `json:"ops,omitempty"` // Writes applied atomically, for "batch"
 }
 
 type WSResponse struct {
-	Status  string `json:"status"`
-	Value   string `json:"value,omitempty"`
-	Message string `json:"message,omitempty"`
+	Status  string                `json:"status"`
+	Value   string                `json:"value,omitempty"`
+	Message string                `json:"message,omitempty"`
+	Event   *litegodb.ChangeEvent `json:"event,omitempty"`  // A change streamed after "subscribe"
+	Tx      uint64                `json:"tx,omitempty"`     // Transaction started by "begin"
+	Result  interface{}           `json:"result,omitempty"` // Result of "sql"
+}
+
+// kvStore is what "put", "get" and "delete" run against: the database or a transaction.
+type kvStore interface {
+	Put(table string, key int, value string) error
+	Get(table string, key int) (string, bool, error)
+	Delete(table string, key int) error
 }
 
 func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,12 +58,42 @@ func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
 	s.connections[conn] = true
 	s.connMutex.Unlock()
 
+	// Changes are streamed while requests are served, and a connection takes one writer at a time.
+	var writeMu sync.Mutex
+	write := func(resp WSResponse) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(resp)
+	}
+	var sub litegodb.Subscription
+
+	// Transactions stay open across requests until committed or rolled back, or until
+	// the connection closes, which rolls them back.
+	txs := make(map[uint64]litegodb.Tx)
+	var lastTx uint64
+	session, err := sqlparser.NewDatabaseSession(grant{s, r}, databaseName(r))
+	if err != nil {
+		log.Printf("WebSocket session error: %v", err)
+		conn.Close()
+		return
+	}
+
 	defer func() {
+		if sub != nil {
+			sub.Close()
+		}
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+		session.Close()
+
 		// Unregister connection
 		s.connMutex.Lock()
 		delete(s.connections, conn)
 		s.connMutex.Unlock()
 
+		writeMu.Lock()
+		defer writeMu.Unlock()
 		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "closing connection"))
 		time.Sleep(1 * time.Second)
 		conn.Close()
@@ -62,17 +113,32 @@ func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var resp WSResponse
+		var started litegodb.Subscription // Streamed once the response is written.
+
+		db := session.DB() // The database selected with USE.
+		var store kvStore = db
+		if req.Tx != 0 {
+			tx, ok := txs[req.Tx]
+			if !ok {
+				if err := write(WSResponse{Status: "error", Message: "unknown transaction"}); err != nil {
+					log.Printf("WebSocket write error: %v", err)
+					break
+				}
+				continue
+			}
+			store = tx
+		}
 
 		switch req.Op {
 		case "put":
-			err := s.DB.Put(req.Table, req.Key, req.Value)
+			err := store.Put(req.Table, req.Key, req.Value)
 			if err != nil {
 				resp = WSResponse{Status: "error", Message: err.Error()}
 			} else {
 				resp = WSResponse{Status: "ok"}
 			}
 		case "get":
-			val, found, err := s.DB.Get(req.Table, req.Key)
+			val, found, err := store.Get(req.Table, req.Key)
 			if err != nil {
 				resp = WSResponse{Status: "error", Message: err.Error()}
 			} else if !found {
@@ -81,21 +147,105 @@ func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
 				resp = WSResponse{Status: "ok", Value: val}
 			}
 		case "delete":
-			err := s.DB.Delete(req.Table, req.Key)
+			err := store.Delete(req.Table, req.Key)
+			if err != nil {
+				resp = WSResponse{Status: "error", Message: err.Error()}
+			} else {
+				resp = WSResponse{Status: "ok"}
+			}
+		case "batch":
+			batch, err := writeBatch(req.Ops)
+			if err == nil {
+				err = db.Write(batch)
+			}
 			if err != nil {
 				resp = WSResponse{Status: "error", Message: err.Error()}
 			} else {
 				resp = WSResponse{Status: "ok"}
 			}
+		case "begin":
+			begin := db.Begin
+			if req.Optimistic {
+				begin = db.BeginOptimistic
+			}
+			tx, err := begin()
+			if err != nil {
+				resp = WSResponse{Status: "error", Message: err.Error()}
+				break
+			}
+			lastTx++
+			txs[lastTx] = tx
+			resp = WSResponse{Status: "ok", Tx: lastTx}
+		case "commit", "rollback":
+			tx, ok := txs[req.Tx]
+			if !ok {
+				resp = WSResponse{Status: "error", Message: "no transaction given"}
+				break
+			}
+			delete(txs, req.Tx)
+			var err error
+			if req.Op == "commit" {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				resp = WSResponse{Status: "error", Message: err.Error()}
+			} else {
+				resp = WSResponse{Status: "ok"}
+			}
+		case "sql":
+			result, err := session.Execute(req.Query)
+			if err != nil {
+				resp = WSResponse{Status: "error", Message: err.Error()}
+			} else {
+				resp = WSResponse{Status: "ok", Result: result}
+			}
 		case "ping":
 			resp = WSResponse{Status: "ok", Message: "pong"}
+		case "subscribe":
+			if sub != nil {
+				resp = WSResponse{Status: "error", Message: "already subscribed"}
+				break
+			}
+			var err error
+			if sub, err = db.Subscribe(req.From, req.Tables...); err != nil {
+				sub = nil
+				resp = WSResponse{Status: "error", Message: err.Error()}
+				break
+			}
+			resp = WSResponse{Status: "ok"}
+			started = sub
+		case "unsubscribe":
+			if sub != nil {
+				sub.Close()
+				sub = nil
+			}
+			resp = WSResponse{Status: "ok"}
 		default:
 			resp = WSResponse{Status: "error", Message: "unknown operation"}
 		}
 
-		if err := conn.WriteJSON(resp); err != nil {
+		if err := write(resp); err != nil {
 			log.Printf("WebSocket write error: %v", err)
 			break
 		}
+		if started != nil {
+			go streamChanges(started, write)
+		}
+	}
+}
+
+// streamChanges writes the changes of a subscription to a WebSocket connection until the
+// subscription ends, then reports why it ended unless it was closed.
+func streamChanges(sub litegodb.Subscription, write func(WSResponse) error) {
+	for event := range sub.Events() {
+		if err := write(WSResponse{Status: "ok", Event: &event}); err != nil {
+			sub.Close()
+			return
+		}
+	}
+	if err := sub.Err(); err != nil {
+		_ = write(WSResponse{Status: "error", Message: err.Error()})
 	}
 }
@@ -0,0 +1,136 @@
+package sqlparser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+)
+
+// createDatabaseStmt is a CREATE DATABASE statement.
+type createDatabaseStmt struct {
+	database    string
+	ifNotExists bool
+}
+
+// createDatabase matches CREATE DATABASE statements, whose IF NOT EXISTS the MySQL parser
+// drops.
+var createDatabase = regexp.MustCompile("(?is)^\\s*CREATE\\s+(?:DATABASE|SCHEMA)\\s+(IF\\s+NOT\\s+EXISTS\\s+)?`?([A-Za-z_][A-Za-z0-9_]*)`?\\s*;?\\s*$")
+
+// parseCreateDatabase parses query if it is a CREATE DATABASE statement.
+func parseCreateDatabase(query string) (*createDatabaseStmt, bool) {
+	m := createDatabase.FindStringSubmatch(query)
+	if m == nil {
+		return nil, false
+	}
+	return &createDatabaseStmt{database: m[2], ifNotExists: m[1] != ""}, true
+}
+
+func handleCreateDatabase(stmt *createDatabaseStmt, dbs Databases) (interface{}, error) {
+	if _, err := dbs.Create(stmt.database); err != nil {
+		if stmt.ifNotExists && errors.Is(err, litegodb.ErrDatabaseExists) {
+			return "exists", nil
+		}
+		return nil, fmt.Errorf("failed to create database: %w", err)
+	}
+	return "created", nil
+}
+
+// tableName matches a table name, optionally qualified with a database name, capturing both.
+const tableName = "(?:`?([A-Za-z_][A-Za-z0-9_]*)`?\\.)?`?([A-Za-z_][A-Za-z0-9_]*)`?"
+
+// createTableStmt is a CREATE TABLE statement.
+type createTableStmt struct {
+	database    string // Database the table name is qualified with, if any.
+	table       string
+	ifNotExists bool
+	columns     string // Column definitions, as written between the parentheses.
+}
+
+// createTable matches CREATE TABLE statements. They are parsed here rather than by the
+// MySQL parser, whose grammar lacks types such as BOOL and which drops the column
+// definitions of the statements it cannot parse.
+var createTable = regexp.MustCompile("(?is)^\\s*CREATE\\s+TABLE\\s+(IF\\s+NOT\\s+EXISTS\\s+)?" + tableName + "\\s*\\((.*)\\)\\s*;?\\s*$")
+
+// parseCreateTable parses query if it is a CREATE TABLE statement.
+func parseCreateTable(query string) (*createTableStmt, bool) {
+	m := createTable.FindStringSubmatch(query)
+	if m == nil {
+		return nil, false
+	}
+	return &createTableStmt{database: m[2], table: m[3], ifNotExists: m[1] != "", columns: m[4]}, true
+}
+
+func handleCreateTable(stmt *createTableStmt, db litegodb.DB) (interface{}, error) {
+	s, err := litegodb.ParseSchema(stmt.columns)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.ifNotExists {
+		if _, err := db.Schema(stmt.table); err == nil {
+			return "exists", nil
+		}
+	}
+	if err := db.CreateTableWithSchema(stmt.table, s); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+	return "created", nil
+}
+
+// alterTableStmt is an ALTER TABLE statement.
+type alterTableStmt struct {
+	database string // Database the table name is qualified with, if any.
+	table    string
+	action   string // What follows the table name, such as "RENAME TO people".
+}
+
+// alterTable matches ALTER TABLE statements, which the MySQL parser reads without the
+// columns and options they change.
+var alterTable = regexp.MustCompile("(?is)^\\s*ALTER\\s+TABLE\\s+" + tableName + "\\s+(.*?)\\s*;?\\s*$")
+
+// The actions of ALTER TABLE.
+var (
+	renameTo   = regexp.MustCompile("(?is)^RENAME\\s+(?:(?:TO|AS)\\s+)?`?([A-Za-z_][A-Za-z0-9_]*)`?$")
+	addColumn  = regexp.MustCompile("(?is)^ADD\\s+(?:COLUMN\\s+)?(.+)$")
+	dropColumn = regexp.MustCompile("(?is)^DROP\\s+(?:COLUMN\\s+)?`?([A-Za-z_][A-Za-z0-9_]*)`?$")
+	setOption  = regexp.MustCompile("(?is)^(?:SET\\s+)?([A-Za-z_]+)\\s*=\\s*'?([^']*)'?$")
+)
+
+// parseAlterTable parses query if it is an ALTER TABLE statement.
+func parseAlterTable(query string) (*alterTableStmt, bool) {
+	m := alterTable.FindStringSubmatch(query)
+	if m == nil {
+		return nil, false
+	}
+	return &alterTableStmt{database: m[1], table: m[2], action: m[3]}, true
+}
+
+// handleAlterTable renames a table, adds or drops a column of a table with a schema, or
+// sets a table option. The only option is compression, the codec of the table's pages.
+func handleAlterTable(stmt *alterTableStmt, db litegodb.DB) (interface{}, error) {
+	var err error
+	if m := renameTo.FindStringSubmatch(stmt.action); m != nil {
+		err = db.RenameTable(stmt.table, m[1])
+	} else if m := dropColumn.FindStringSubmatch(stmt.action); m != nil {
+		err = db.DropColumn(stmt.table, m[1])
+	} else if m := addColumn.FindStringSubmatch(stmt.action); m != nil {
+		column, perr := litegodb.ParseColumn(m[1])
+		if perr != nil {
+			return nil, perr
+		}
+		err = db.AddColumn(stmt.table, column)
+	} else if m := setOption.FindStringSubmatch(stmt.action); m != nil {
+		if !strings.EqualFold(m[1], "compression") {
+			return nil, fmt.Errorf("unknown table option %s", m[1])
+		}
+		err = db.SetCompression(stmt.table, m[2])
+	} else {
+		return nil, fmt.Errorf("unsupported ALTER TABLE action: %s", stmt.action)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to alter table: %w", err)
+	}
+	return "altered", nil
+}
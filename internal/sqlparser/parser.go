@@ -9,33 +9,79 @@ import (
 	"github.com/xwb1989/sqlparser"
 )
 
+// store is what statements read and write: the database, or a transaction of a Session.
+type store interface {
+	Put(table string, key int, value string) error
+	Get(table string, key int) (string, bool, error)
+	Delete(table string, key int) error
+}
+
+// ResultSet is the result of a SELECT on a table with a schema: the selected columns, and
+// a row of typed values for each row found.
+type ResultSet struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// ParseAndExecute runs a single query against db. Transactions need a Session, which
+// keeps them open between queries.
 func ParseAndExecute(query string, db litegodb.DB) (interface{}, error) {
-	stmt, err := sqlparser.Parse(query)
+	return (&Session{dbs: litegodb.SingleDatabase(db), db: db, single: true}).Execute(query)
+}
+
+// ParseAndExecuteIn runs a single query like ParseAndExecute, against the database called
+// database among dbs, or the default one if database is empty. The query can name the
+// other databases of dbs in qualified table names, and create new ones.
+func ParseAndExecuteIn(query string, dbs Databases, database string) (interface{}, error) {
+	s, err := NewDatabaseSession(dbs, database)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse query: %w", err)
+		return nil, err
 	}
+	s.single = true
+	return s.Execute(query)
+}
 
+// execute runs a statement that reads and writes st, looking up tables in db.
+func execute(stmt sqlparser.Statement, db litegodb.DB, st store) (interface{}, error) {
 	switch stmt := stmt.(type) {
+	case *sqlparser.Begin, *sqlparser.Commit, *sqlparser.Rollback:
+		return nil, fmt.Errorf("transactions need a session, such as a WebSocket connection")
 	case *sqlparser.Insert:
-		return handleInsert(stmt, db)
+		return handleInsert(stmt, db, st)
 	case *sqlparser.Select:
-		return handleSelect(stmt, db)
+		return handleSelect(stmt, db, st)
 	case *sqlparser.Delete:
-		return handleDelete(stmt, db)
+		return handleDelete(stmt, db, st)
 	default:
 		return nil, fmt.Errorf("unsupported SQL statement")
 	}
 }
 
-func handleInsert(stmt *sqlparser.Insert, db litegodb.DB) (interface{}, error) {
+// tableSchema returns the schema of a table, or nil for a key-value table or one that
+// does not exist yet, which a key-value write creates.
+func tableSchema(db litegodb.DB, table string) *litegodb.Schema {
+	s, err := db.Schema(table)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func handleInsert(stmt *sqlparser.Insert, db litegodb.DB, st store) (interface{}, error) {
 	table := stmt.Table.Name.String()
-	rows := stmt.Rows.(sqlparser.Values)
+	rows, ok := stmt.Rows.(sqlparser.Values)
+	if !ok {
+		return nil, fmt.Errorf("only INSERT ... VALUES is supported")
+	}
 
 	if len(rows) != 1 {
 		return nil, fmt.Errorf("only single row insert is supported")
 	}
 
 	vals := rows[0]
+	if s := tableSchema(db, table); s != nil {
+		return insertRow(table, s, stmt.Columns, vals, st)
+	}
 
 	var key int
 	var value string
@@ -81,50 +127,136 @@ func handleInsert(stmt *sqlparser.Insert, db litegodb.DB) (interface{}, error) {
 		}
 	}
 
-	if err := db.Put(table, key, value); err != nil {
+	if err := st.Put(table, key, value); err != nil {
 		return nil, fmt.Errorf("failed to put value: %w", err)
 	}
 
 	return "inserted", nil
 }
 
-func handleSelect(stmt *sqlparser.Select, db litegodb.DB) (interface{}, error) {
-	table := stmt.From[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.String()
-
-	var key int
-	foundKey := false
-
-	// Parse WHERE key = X
-	if stmt.Where != nil {
-		compExpr, ok := stmt.Where.Expr.(*sqlparser.ComparisonExpr)
-		if !ok {
-			return nil, fmt.Errorf("unsupported where clause")
+// insertRow inserts a row into a table with a schema. Columns left out take their
+// default, or are NULL if they have none.
+func insertRow(table string, s *litegodb.Schema, columns sqlparser.Columns, vals sqlparser.ValTuple, st store) (interface{}, error) {
+	cols := s.Columns()
+	positions := make([]int, len(vals))
+	if len(columns) == 0 {
+		if len(vals) != len(cols) {
+			return nil, fmt.Errorf("expected %d values (%s)", len(cols), strings.Join(s.Names(), ", "))
 		}
-
-		leftCol := compExpr.Left.(*sqlparser.ColName).Name.String()
-		rightVal := compExpr.Right.(*sqlparser.SQLVal)
-
-		if strings.ToLower(leftCol) != "key" {
-			return nil, fmt.Errorf("only WHERE key = ... supported")
+		for i := range positions {
+			positions[i] = i
+		}
+	} else {
+		if len(vals) != len(columns) {
+			return nil, fmt.Errorf("expected %d values, got %d", len(columns), len(vals))
+		}
+		for i, col := range columns {
+			if positions[i] = s.Index(col.String()); positions[i] < 0 {
+				return nil, fmt.Errorf("unknown column %s in table %s", col.String(), table)
+			}
 		}
+	}
 
-		k, err := strconv.Atoi(string(rightVal.Val))
+	row := make(litegodb.Row, len(cols))
+	for i, col := range cols {
+		row[i] = col.Default
+	}
+	for i, expr := range vals {
+		value, err := columnValue(expr, cols[positions[i]])
 		if err != nil {
-			return nil, fmt.Errorf("invalid key value")
+			return nil, err
 		}
+		row[positions[i]] = value
+	}
+	tuple, err := s.Encode(row)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := st.Put(table, int(row[s.Key()].(int64)), tuple); err != nil {
+		return nil, fmt.Errorf("failed to put value: %w", err)
+	}
+	return "inserted", nil
+}
 
-		key = k
-		foundKey = true
+// columnValue returns the value of a literal for a column, or an error if its type does
+// not match the column's. BOOL columns also take 0 and 1, as in MySQL.
+func columnValue(expr sqlparser.Expr, col litegodb.Column) (interface{}, error) {
+	negative := false
+	if unary, ok := expr.(*sqlparser.UnaryExpr); ok && unary.Operator == sqlparser.UMinusStr {
+		negative, expr = true, unary.Expr
 	}
 
-	if !foundKey {
-		return nil, fmt.Errorf("WHERE clause with key is required")
+	switch v := expr.(type) {
+	case *sqlparser.NullVal:
+		if !negative {
+			return nil, nil
+		}
+	case sqlparser.BoolVal:
+		if col.Type == litegodb.TypeBool && !negative {
+			return bool(v), nil
+		}
+	case *sqlparser.SQLVal:
+		switch {
+		case v.Type == sqlparser.IntVal && col.Type == litegodb.TypeInt:
+			text := string(v.Val)
+			if negative {
+				text = "-" + text
+			}
+			n, err := strconv.ParseInt(text, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s for column %s: %w", text, col.Name, err)
+			}
+			return n, nil
+		case v.Type == sqlparser.IntVal && col.Type == litegodb.TypeBool && !negative:
+			switch string(v.Val) {
+			case "0":
+				return false, nil
+			case "1":
+				return true, nil
+			}
+		case v.Type == sqlparser.StrVal && col.Type == litegodb.TypeText && !negative:
+			return string(v.Val), nil
+		}
 	}
+	return nil, fmt.Errorf("invalid value %s for %s column %s", sqlparser.String(expr), col.Type, col.Name)
+}
+
+func handleSelect(stmt *sqlparser.Select, db litegodb.DB, st store) (interface{}, error) {
+	table := stmt.From[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.String()
+	s := tableSchema(db, table)
 
-	value, found, err := db.Get(table, key)
+	keyColumn := "key"
+	if s != nil {
+		keyColumn = s.Names()[s.Key()]
+	}
+	key, err := whereKey(stmt.Where, keyColumn)
 	if err != nil {
 		return nil, err
 	}
+
+	var value string
+	var found bool
+	switch stmt.Lock {
+	case "":
+		value, found, err = st.Get(table, key)
+	case sqlparser.ForUpdateStr:
+		// Inside a transaction the key stays locked until it ends; on its own the
+		// statement is a plain read.
+		if tx, ok := st.(litegodb.Tx); ok {
+			value, found, err = tx.GetForUpdate(table, key)
+		} else {
+			value, found, err = st.Get(table, key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported locking clause:%s", stmt.Lock)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		return selectRow(stmt.SelectExprs, s, key, value, found)
+	}
 	if !found {
 		return nil, fmt.Errorf("key not found")
 	}
@@ -135,42 +267,109 @@ func handleSelect(stmt *sqlparser.Select, db litegodb.DB) (interface{}, error) {
 	}, nil
 }
 
-func handleDelete(stmt *sqlparser.Delete, db litegodb.DB) (interface{}, error) {
-	table := stmt.TableExprs[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.String()
-
-	var key int
-	foundKey := false
-
-	if stmt.Where != nil {
-		compExpr, ok := stmt.Where.Expr.(*sqlparser.ComparisonExpr)
-		if !ok {
-			return nil, fmt.Errorf("unsupported where clause")
+// selectRow returns the selected columns of the row stored under key in a table with a
+// schema, if it was found.
+func selectRow(exprs sqlparser.SelectExprs, s *litegodb.Schema, key int, value string, found bool) (*ResultSet, error) {
+	var positions []int
+	for _, expr := range exprs {
+		switch expr := expr.(type) {
+		case *sqlparser.StarExpr:
+			for i := range s.Columns() {
+				positions = append(positions, i)
+			}
+		case *sqlparser.AliasedExpr:
+			col, ok := expr.Expr.(*sqlparser.ColName)
+			if !ok {
+				return nil, fmt.Errorf("only columns can be selected")
+			}
+			i := s.Index(col.Name.String())
+			if i < 0 {
+				return nil, fmt.Errorf("unknown column %s", col.Name.String())
+			}
+			positions = append(positions, i)
+		default:
+			return nil, fmt.Errorf("unsupported select expression %s", sqlparser.String(expr))
 		}
+	}
 
-		leftCol := compExpr.Left.(*sqlparser.ColName).Name.String()
-		rightVal := compExpr.Right.(*sqlparser.SQLVal)
+	names := s.Names()
+	result := &ResultSet{Columns: make([]string, len(positions)), Rows: [][]interface{}{}}
+	for i, pos := range positions {
+		result.Columns[i] = names[pos]
+	}
+	if !found {
+		return result, nil
+	}
 
-		if strings.ToLower(leftCol) != "key" {
-			return nil, fmt.Errorf("only WHERE key = ... supported")
-		}
+	row, err := s.Decode(key, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode row %d: %w", key, err)
+	}
+	values := make([]interface{}, len(positions))
+	for i, pos := range positions {
+		values[i] = row[pos]
+	}
+	result.Rows = append(result.Rows, values)
+	return result, nil
+}
 
-		k, err := strconv.Atoi(string(rightVal.Val))
-		if err != nil {
-			return nil, fmt.Errorf("invalid key value")
-		}
+func handleDelete(stmt *sqlparser.Delete, db litegodb.DB, st store) (interface{}, error) {
+	table := stmt.TableExprs[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.String()
 
-		key = k
-		foundKey = true
+	keyColumn := "key"
+	if s := tableSchema(db, table); s != nil {
+		keyColumn = s.Names()[s.Key()]
 	}
-
-	if !foundKey {
-		return nil, fmt.Errorf("WHERE clause with key is required")
+	key, err := whereKey(stmt.Where, keyColumn)
+	if err != nil {
+		return nil, err
 	}
 
-	err := db.Delete(table, key)
+	err = st.Delete(table, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to delete key: %w", err)
 	}
 
 	return "deleted", nil
 }
+
+// whereKey returns the key of a WHERE clause of the form column = X, where column is the
+// key column: "key" for a key-value table, the primary key for a table with a schema.
+func whereKey(where *sqlparser.Where, column string) (int, error) {
+	if where == nil {
+		return 0, fmt.Errorf("WHERE clause with %s is required", column)
+	}
+
+	compExpr, ok := where.Expr.(*sqlparser.ComparisonExpr)
+	if !ok || compExpr.Operator != sqlparser.EqualStr {
+		return 0, fmt.Errorf("unsupported where clause")
+	}
+
+	leftCol, ok := compExpr.Left.(*sqlparser.ColName)
+	if !ok || !strings.EqualFold(leftCol.Name.String(), column) {
+		return 0, fmt.Errorf("only WHERE %s = ... supported", column)
+	}
+
+	rightVal, ok := compExpr.Right.(*sqlparser.SQLVal)
+	if !ok {
+		return 0, fmt.Errorf("invalid key value")
+	}
+	key, err := strconv.Atoi(string(rightVal.Val))
+	if err != nil {
+		return 0, fmt.Errorf("invalid key value")
+	}
+	return key, nil
+}
+
+func isVacuum(query string) bool {
+	stmt := strings.TrimSuffix(strings.TrimSpace(query), ";")
+	return strings.EqualFold(strings.TrimSpace(stmt), "vacuum")
+}
+
+func handleVacuum(db litegodb.DB) (interface{}, error) {
+	stats, err := db.Vacuum()
+	if err != nil {
+		return nil, fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return stats, nil
+}
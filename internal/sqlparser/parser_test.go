@@ -1,18 +1,80 @@
 package sqlparser_test
 
 import (
+	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/rafaelmgr12/litegodb/internal/sqlparser"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockDB struct {
-	store map[string]map[int]string
+	store    map[string]map[int]string
+	schemas  map[string]*litegodb.Schema
+	codecs   map[string]string
+	vacuumed int
+	begun    []*mockTx // Transactions started, in order.
 }
 
 func newMockDB() *mockDB {
-	return &mockDB{store: make(map[string]map[int]string)}
+	return &mockDB{store: make(map[string]map[int]string), schemas: make(map[string]*litegodb.Schema), codecs: make(map[string]string)}
+}
+
+func (m *mockDB) CreateTableWithSchema(table string, s *litegodb.Schema) error {
+	if _, ok := m.store[table]; ok {
+		return fmt.Errorf("table %s already exists", table)
+	}
+	m.store[table] = make(map[int]string)
+	m.schemas[table] = s
+	return nil
+}
+
+func (m *mockDB) Schema(table string) (*litegodb.Schema, error) {
+	if _, ok := m.store[table]; !ok {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	return m.schemas[table], nil
+}
+
+func (m *mockDB) RenameTable(table, newName string) error {
+	if _, ok := m.store[table]; !ok {
+		return fmt.Errorf("table %s does not exist", table)
+	}
+	m.store[newName], m.schemas[newName] = m.store[table], m.schemas[table]
+	delete(m.store, table)
+	delete(m.schemas, table)
+	return nil
+}
+
+func (m *mockDB) AddColumn(table string, column litegodb.Column) error {
+	return m.alterSchema(table, func(s *litegodb.Schema) (*litegodb.Schema, error) { return s.AddColumn(column) })
+}
+
+func (m *mockDB) DropColumn(table, column string) error {
+	return m.alterSchema(table, func(s *litegodb.Schema) (*litegodb.Schema, error) { return s.DropColumn(column) })
+}
+
+func (m *mockDB) alterSchema(table string, change func(*litegodb.Schema) (*litegodb.Schema, error)) error {
+	if m.schemas[table] == nil {
+		return fmt.Errorf("table %s has no schema to alter", table)
+	}
+	s, err := change(m.schemas[table])
+	if err != nil {
+		return err
+	}
+	m.schemas[table] = s
+	return nil
+}
+
+func (m *mockDB) SetCompression(table, codec string) error {
+	if _, ok := m.store[table]; !ok {
+		return fmt.Errorf("table %s does not exist", table)
+	}
+	m.codecs[table] = codec
+	return nil
 }
 
 func (m *mockDB) Put(table string, key int, value string) error {
@@ -41,12 +103,103 @@ func (m *mockDB) Delete(table string, key int) error {
 	return nil
 }
 
+func (m *mockDB) Write(batch *litegodb.WriteBatch) error {
+	return nil
+}
+
+func (m *mockDB) Begin() (litegodb.Tx, error) {
+	tx := &mockTx{db: m, writes: make(map[string]map[int]*string)}
+	m.begun = append(m.begun, tx)
+	return tx, nil
+}
+
+func (m *mockDB) BeginOptimistic() (litegodb.Tx, error) { return m.Begin() }
+func (m *mockDB) Update(fn func(tx litegodb.Tx) error) error {
+	tx, _ := m.Begin()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// mockTx buffers writes until Commit; a nil value is a delete. It records the keys it
+// locks for update.
+type mockTx struct {
+	db     *mockDB
+	writes map[string]map[int]*string
+	locked []string
+}
+
+func (tx *mockTx) Put(table string, key int, value string) error {
+	if tx.writes[table] == nil {
+		tx.writes[table] = make(map[int]*string)
+	}
+	tx.writes[table][key] = &value
+	return nil
+}
+
+func (tx *mockTx) Get(table string, key int) (string, bool, error) {
+	if value, ok := tx.writes[table][key]; ok {
+		if value == nil {
+			return "", false, nil
+		}
+		return *value, true, nil
+	}
+	return tx.db.Get(table, key)
+}
+
+func (tx *mockTx) GetForUpdate(table string, key int) (string, bool, error) {
+	tx.locked = append(tx.locked, fmt.Sprintf("%s/%d", table, key))
+	return tx.Get(table, key)
+}
+
+func (tx *mockTx) Lock(table string, key int, mode litegodb.LockMode) error { return nil }
+func (tx *mockTx) LockTable(table string, mode litegodb.LockMode) error     { return nil }
+
+func (tx *mockTx) Delete(table string, key int) error {
+	if tx.writes[table] == nil {
+		tx.writes[table] = make(map[int]*string)
+	}
+	tx.writes[table][key] = nil
+	return nil
+}
+
+func (tx *mockTx) Commit() error {
+	for table, writes := range tx.writes {
+		for key, value := range writes {
+			if value == nil {
+				tx.db.Delete(table, key)
+			} else {
+				tx.db.Put(table, key, *value)
+			}
+		}
+	}
+	return nil
+}
+
+func (tx *mockTx) Rollback() error { return nil }
+
 func (m *mockDB) Flush(table string) error                   { return nil }
 func (m *mockDB) CreateTable(table string, degree int) error { return nil }
 func (m *mockDB) DropTable(table string) error               { return nil }
 func (m *mockDB) Load() error                                { return nil }
 func (m *mockDB) Close() error                               { return nil }
 
+func (m *mockDB) Checkpoint() (uint64, error)        { return 0, nil }
+func (m *mockDB) Backup(path string) (uint64, error) { return 0, nil }
+func (m *mockDB) Subscribe(fromLSN uint64, tables ...string) (litegodb.Subscription, error) {
+	return nil, nil
+}
+func (m *mockDB) ReplicationStatus() (litegodb.ReplicationStatus, error) {
+	return litegodb.ReplicationStatus{Role: "primary"}, nil
+}
+func (m *mockDB) Promote() error { return nil }
+
+func (m *mockDB) Vacuum() (litegodb.VacuumStats, error) {
+	m.vacuumed++
+	return litegodb.VacuumStats{PagesBefore: 10, PagesAfter: 4, PagesMoved: 2}, nil
+}
+
 func TestParseAndExecute_InsertSelectDelete(t *testing.T) {
 	db := newMockDB()
 
@@ -90,3 +243,286 @@ func TestParseAndExecute_InvalidQueries(t *testing.T) {
 	_, err = sqlparser.ParseAndExecute(badSyntax, db)
 	assert.Error(t, err)
 }
+
+func TestParseAndExecute_Vacuum(t *testing.T) {
+	db := newMockDB()
+
+	res, err := sqlparser.ParseAndExecute("VACUUM", db)
+	assert.NoError(t, err)
+	assert.Equal(t, litegodb.VacuumStats{PagesBefore: 10, PagesAfter: 4, PagesMoved: 2}, res)
+
+	_, err = sqlparser.ParseAndExecute(" vacuum; ", db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, db.vacuumed)
+
+	_, err = sqlparser.ParseAndExecute("VACUUM users", db)
+	assert.Error(t, err)
+}
+
+func TestSession_Transactions(t *testing.T) {
+	db := newMockDB()
+	session := sqlparser.NewSession(db)
+
+	_, err := sqlparser.ParseAndExecute("BEGIN", db)
+	assert.Error(t, err, "BEGIN without a session")
+
+	res, err := session.Execute("BEGIN")
+	assert.NoError(t, err)
+	assert.Equal(t, "begun", res)
+	_, err = session.Execute("START TRANSACTION")
+	assert.Error(t, err, "nested transaction")
+
+	_, err = session.Execute("INSERT INTO accounts (`key`, `value`) VALUES (1, '60')")
+	assert.NoError(t, err)
+	_, err = session.Execute("INSERT INTO accounts (`key`, `value`) VALUES (2, '40')")
+	assert.NoError(t, err)
+
+	// The session sees its writes before the commit; the database does not.
+	res, err = session.Execute("SELECT `key`, `value` FROM accounts WHERE `key` = 1")
+	assert.NoError(t, err)
+	assert.Equal(t, "60", res.(map[string]interface{})["value"])
+	_, found, _ := db.Get("accounts", 1)
+	assert.False(t, found)
+
+	res, err = session.Execute("COMMIT")
+	assert.NoError(t, err)
+	assert.Equal(t, "committed", res)
+	value, _, _ := db.Get("accounts", 2)
+	assert.Equal(t, "40", value)
+
+	_, err = session.Execute("BEGIN")
+	assert.NoError(t, err)
+	_, err = session.Execute("DELETE FROM accounts WHERE `key` = 1")
+	assert.NoError(t, err)
+	res, err = session.Execute("ROLLBACK")
+	assert.NoError(t, err)
+	assert.Equal(t, "rolled back", res)
+	_, found, _ = db.Get("accounts", 1)
+	assert.True(t, found)
+
+	_, err = session.Execute("COMMIT")
+	assert.Error(t, err, "COMMIT without a transaction")
+	assert.NoError(t, session.Close())
+}
+
+func TestSession_SelectForUpdate(t *testing.T) {
+	db := newMockDB()
+	db.Put("accounts", 1, "60")
+	session := sqlparser.NewSession(db)
+
+	// Outside a transaction the lock ends with the statement.
+	res, err := sqlparser.ParseAndExecute("SELECT * FROM accounts WHERE `key` = 1 FOR UPDATE", db)
+	assert.NoError(t, err)
+	assert.Equal(t, "60", res.(map[string]interface{})["value"])
+
+	_, err = session.Execute("BEGIN")
+	assert.NoError(t, err)
+	res, err = session.Execute("SELECT * FROM accounts WHERE `key` = 1 FOR UPDATE")
+	assert.NoError(t, err)
+	assert.Equal(t, "60", res.(map[string]interface{})["value"])
+	_, err = session.Execute("SELECT * FROM accounts WHERE `key` = 1 LOCK IN SHARE MODE")
+	assert.Error(t, err)
+	assert.Len(t, db.begun, 1)
+	assert.Equal(t, []string{"accounts/1"}, db.begun[0].locked)
+	assert.NoError(t, session.Close())
+}
+
+func TestParseAndExecute_TypedTable(t *testing.T) {
+	db := newMockDB()
+
+	res, err := sqlparser.ParseAndExecute("CREATE TABLE users (id INT PRIMARY KEY, name TEXT NOT NULL, age INT, active BOOL)", db)
+	require.NoError(t, err)
+	assert.Equal(t, "created", res)
+	_, err = sqlparser.ParseAndExecute("CREATE TABLE users (id INT PRIMARY KEY)", db)
+	assert.Error(t, err)
+	res, err = sqlparser.ParseAndExecute("create table if not exists users (id int primary key)", db)
+	require.NoError(t, err)
+	assert.Equal(t, "exists", res)
+	_, err = sqlparser.ParseAndExecute("CREATE TABLE bad (name TEXT)", db)
+	assert.Error(t, err, "a table needs a primary key")
+
+	_, err = sqlparser.ParseAndExecute("INSERT INTO users (id, name, age, active) VALUES (1, 'alice', 30, true)", db)
+	require.NoError(t, err)
+	_, err = sqlparser.ParseAndExecute("INSERT INTO users VALUES (-2, 'bob', NULL, 0)", db)
+	require.NoError(t, err)
+	_, err = sqlparser.ParseAndExecute("INSERT INTO users (name, id) VALUES ('carol', 3)", db)
+	require.NoError(t, err)
+
+	for query, message := range map[string]string{
+		"INSERT INTO users (id, name, age) VALUES (4, 'dave', 'forty')":  "invalid value 'forty' for INT column age",
+		"INSERT INTO users (id, name, active) VALUES (4, 'dave', 'yes')": "invalid value 'yes' for BOOL column active",
+		"INSERT INTO users (id, age) VALUES (4, 40)":                     "column name cannot be NULL",
+		"INSERT INTO users (name) VALUES ('dave')":                       "column id cannot be NULL",
+		"INSERT INTO users (id, email) VALUES (4, 'dave@example.com')":   "unknown column email",
+		"INSERT INTO users VALUES (4, 'dave')":                           "expected 4 values",
+	} {
+		_, err := sqlparser.ParseAndExecute(query, db)
+		assert.ErrorContains(t, err, message, query)
+	}
+
+	res, err = sqlparser.ParseAndExecute("SELECT name, age FROM users WHERE id = 1", db)
+	require.NoError(t, err)
+	assert.Equal(t, &sqlparser.ResultSet{Columns: []string{"name", "age"}, Rows: [][]interface{}{{"alice", int64(30)}}}, res)
+
+	res, err = sqlparser.ParseAndExecute("SELECT * FROM users WHERE id = -2", db)
+	require.NoError(t, err)
+	assert.Equal(t, &sqlparser.ResultSet{
+		Columns: []string{"id", "name", "age", "active"},
+		Rows:    [][]interface{}{{int64(-2), "bob", nil, false}},
+	}, res)
+
+	res, err = sqlparser.ParseAndExecute("SELECT active, id FROM users WHERE id = 3", db)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{nil, int64(3)}}, res.(*sqlparser.ResultSet).Rows)
+
+	res, err = sqlparser.ParseAndExecute("SELECT name FROM users WHERE id = 9", db)
+	require.NoError(t, err)
+	assert.Empty(t, res.(*sqlparser.ResultSet).Rows)
+
+	_, err = sqlparser.ParseAndExecute("SELECT email FROM users WHERE id = 1", db)
+	assert.ErrorContains(t, err, "unknown column email")
+	_, err = sqlparser.ParseAndExecute("SELECT name FROM users WHERE `key` = 1", db)
+	assert.ErrorContains(t, err, "only WHERE id = ... supported")
+
+	res, err = sqlparser.ParseAndExecute("DELETE FROM users WHERE id = 1", db)
+	require.NoError(t, err)
+	assert.Equal(t, "deleted", res)
+	res, err = sqlparser.ParseAndExecute("SELECT name FROM users WHERE id = 1", db)
+	require.NoError(t, err)
+	assert.Empty(t, res.(*sqlparser.ResultSet).Rows)
+}
+
+func TestParseAndExecute_AlterTable(t *testing.T) {
+	db := newMockDB()
+	_, err := sqlparser.ParseAndExecute("CREATE TABLE users (id INT PRIMARY KEY, name TEXT, age INT)", db)
+	require.NoError(t, err)
+	_, err = sqlparser.ParseAndExecute("INSERT INTO users (id, name, age) VALUES (1, 'alice', 30)", db)
+	require.NoError(t, err)
+
+	for _, query := range []string{
+		"ALTER TABLE users ADD COLUMN active BOOL NOT NULL DEFAULT true",
+		"alter table users add email TEXT",
+		"ALTER TABLE users DROP COLUMN age",
+		"ALTER TABLE users RENAME TO people;",
+		"ALTER TABLE people SET compression = 'lz'",
+	} {
+		res, err := sqlparser.ParseAndExecute(query, db)
+		require.NoError(t, err, query)
+		assert.Equal(t, "altered", res, query)
+	}
+	assert.Equal(t, "lz", db.codecs["people"])
+
+	// The existing row reads the added columns as their defaults.
+	res, err := sqlparser.ParseAndExecute("SELECT * FROM people WHERE id = 1", db)
+	require.NoError(t, err)
+	assert.Equal(t, &sqlparser.ResultSet{
+		Columns: []string{"id", "name", "active", "email"},
+		Rows:    [][]interface{}{{int64(1), "alice", true, nil}},
+	}, res)
+	_, err = sqlparser.ParseAndExecute("INSERT INTO people (id, name) VALUES (2, 'bob')", db)
+	require.NoError(t, err)
+	res, err = sqlparser.ParseAndExecute("SELECT active FROM people WHERE id = 2", db)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{{true}}, res.(*sqlparser.ResultSet).Rows)
+
+	for query, message := range map[string]string{
+		"ALTER TABLE people DROP COLUMN id":                "cannot drop primary key",
+		"ALTER TABLE people ADD COLUMN score INT NOT NULL": "needs a default",
+		"ALTER TABLE people ADD COLUMN score DECIMAL":      "unknown column type",
+		"ALTER TABLE people SET ttl = 3600":                "unknown table option ttl",
+		"ALTER TABLE people MODIFY name INT":               "unsupported ALTER TABLE action",
+		"ALTER TABLE users RENAME TO others":               "table users does not exist",
+	} {
+		_, err := sqlparser.ParseAndExecute(query, db)
+		assert.ErrorContains(t, err, message, query)
+	}
+}
+
+// mockDatabases is a set of mock databases by name.
+type mockDatabases map[string]*mockDB
+
+func (d mockDatabases) Get(name string) (litegodb.DB, error) {
+	if name == "" {
+		name = litegodb.DefaultDatabase
+	}
+	db, ok := d[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", litegodb.ErrDatabaseNotFound, name)
+	}
+	return db, nil
+}
+
+func (d mockDatabases) Create(name string) (litegodb.DB, error) {
+	if _, ok := d[name]; ok {
+		return nil, fmt.Errorf("%w: %s", litegodb.ErrDatabaseExists, name)
+	}
+	d[name] = newMockDB()
+	return d[name], nil
+}
+
+func (d mockDatabases) Names() []string {
+	var names []string
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSession_Databases(t *testing.T) {
+	dbs := mockDatabases{litegodb.DefaultDatabase: newMockDB()}
+	session, err := sqlparser.NewDatabaseSession(dbs, "")
+	assert.NoError(t, err)
+
+	res, err := session.Execute("CREATE DATABASE analytics")
+	assert.NoError(t, err)
+	assert.Equal(t, "created", res)
+	_, err = session.Execute("CREATE DATABASE analytics")
+	assert.ErrorIs(t, err, litegodb.ErrDatabaseExists)
+	res, err = session.Execute("CREATE DATABASE IF NOT EXISTS analytics")
+	assert.NoError(t, err)
+	assert.Equal(t, "exists", res)
+
+	res, err = session.Execute("SHOW DATABASES")
+	assert.NoError(t, err)
+	assert.Equal(t, &sqlparser.ResultSet{
+		Columns: []string{"database"},
+		Rows:    [][]interface{}{{"analytics"}, {litegodb.DefaultDatabase}},
+	}, res)
+
+	// Qualified table names reach other databases without switching to them.
+	_, err = session.Execute("INSERT INTO analytics.events (`key`, `value`) VALUES (1, 'click')")
+	assert.NoError(t, err)
+	value, _, _ := dbs["analytics"].Get("events", 1)
+	assert.Equal(t, "click", value)
+	_, found, _ := dbs[litegodb.DefaultDatabase].Get("events", 1)
+	assert.False(t, found)
+	_, err = session.Execute("SELECT * FROM missing.events WHERE `key` = 1")
+	assert.ErrorIs(t, err, litegodb.ErrDatabaseNotFound)
+
+	res, err = session.Execute("USE analytics")
+	assert.NoError(t, err)
+	assert.Equal(t, "using analytics", res)
+	res, err = session.Execute("SELECT `key`, `value` FROM events WHERE `key` = 1")
+	assert.NoError(t, err)
+	assert.Equal(t, "click", res.(map[string]interface{})["value"])
+	_, err = session.Execute("CREATE TABLE `default`.users (id INT PRIMARY KEY, name TEXT)")
+	assert.NoError(t, err)
+	assert.Contains(t, dbs[litegodb.DefaultDatabase].schemas, "users")
+
+	// A transaction stays in the database it began in.
+	_, err = session.Execute("BEGIN")
+	assert.NoError(t, err)
+	_, err = session.Execute("DELETE FROM `default`.users WHERE `key` = 1")
+	assert.EqualError(t, err, "a transaction cannot span databases")
+	_, err = session.Execute("USE `default`")
+	assert.Error(t, err)
+	assert.NoError(t, session.Close())
+
+	// Single queries cannot switch databases, but can name them.
+	_, err = sqlparser.ParseAndExecuteIn("USE `default`", dbs, "analytics")
+	assert.Error(t, err)
+	res, err = sqlparser.ParseAndExecuteIn("SELECT `key`, `value` FROM analytics.events WHERE `key` = 1", dbs, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "click", res.(map[string]interface{})["value"])
+}
@@ -0,0 +1,220 @@
+package sqlparser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/xwb1989/sqlparser"
+)
+
+// Databases gives queries access to databases by name: the ones selected with USE or
+// named in qualified table names, such as analytics.events, and the ones created with
+// CREATE DATABASE. *litegodb.Databases implements it; a server can narrow it down to the
+// databases a client may use.
+type Databases interface {
+	Get(name string) (litegodb.DB, error)
+	Create(name string) (litegodb.DB, error)
+	Names() []string
+}
+
+// AdminChecker is implemented by Databases that let only some clients run administrative
+// statements, such as VACUUM. CheckAdmin returns an error if the queries using them may
+// not; without it, they may.
+type AdminChecker interface {
+	CheckAdmin() error
+}
+
+// Session runs queries against a database like ParseAndExecute, and keeps the transaction
+// started by BEGIN (or START TRANSACTION) open across queries until COMMIT or ROLLBACK.
+// USE switches the database later queries run against.
+// A Session must not be used from several goroutines at once.
+type Session struct {
+	dbs    Databases
+	db     litegodb.DB // Current database, selected with USE.
+	tx     litegodb.Tx // Open transaction, if any, in the current database.
+	single bool        // Runs a single query, without transactions or USE.
+}
+
+// NewSession returns a session on db with no transaction open.
+func NewSession(db litegodb.DB) *Session {
+	return &Session{dbs: litegodb.SingleDatabase(db), db: db}
+}
+
+// NewDatabaseSession returns a session on the database called database among dbs, or
+// on the default one if database is empty.
+func NewDatabaseSession(dbs Databases, database string) (*Session, error) {
+	db, err := dbs.Get(database)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{dbs: dbs, db: db}, nil
+}
+
+// DB returns the current database of the session.
+func (s *Session) DB() litegodb.DB {
+	return s.db
+}
+
+// Execute runs a query, inside the open transaction if there is one.
+func (s *Session) Execute(query string) (interface{}, error) {
+	if isVacuum(query) {
+		if admin, ok := s.dbs.(AdminChecker); ok {
+			if err := admin.CheckAdmin(); err != nil {
+				return nil, err
+			}
+		}
+		return handleVacuum(s.db)
+	}
+	if create, ok := parseCreateDatabase(query); ok {
+		return handleCreateDatabase(create, s.dbs)
+	}
+	// Tables are created and altered right away, inside a transaction or not.
+	if create, ok := parseCreateTable(query); ok {
+		db, err := s.target(create.database)
+		if err != nil {
+			return nil, err
+		}
+		return handleCreateTable(create, db)
+	}
+	if alter, ok := parseAlterTable(query); ok {
+		db, err := s.target(alter.database)
+		if err != nil {
+			return nil, err
+		}
+		return handleAlterTable(alter, db)
+	}
+
+	stmt, err := sqlparser.Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query: %w", err)
+	}
+
+	switch stmt := stmt.(type) {
+	case *sqlparser.Use:
+		return s.use(stmt.DBName.String())
+	case *sqlparser.Show:
+		if stmt.Type == "databases" {
+			result := &ResultSet{Columns: []string{"database"}, Rows: [][]interface{}{}}
+			for _, name := range s.dbs.Names() {
+				result.Rows = append(result.Rows, []interface{}{name})
+			}
+			return result, nil
+		}
+	case *sqlparser.Begin, *sqlparser.Commit, *sqlparser.Rollback:
+		if !s.single {
+			return s.transaction(stmt)
+		}
+	}
+
+	db, err := s.target(qualifier(stmt))
+	if err != nil {
+		return nil, err
+	}
+	if s.tx == nil {
+		return execute(stmt, db, db)
+	}
+	if db != s.db {
+		return nil, fmt.Errorf("a transaction cannot span databases")
+	}
+	result, err := execute(stmt, s.db, s.tx)
+	var deadlock *litegodb.DeadlockError
+	if errors.As(err, &deadlock) {
+		// The transaction was rolled back to break the deadlock.
+		s.tx = nil
+	}
+	return result, err
+}
+
+// use makes the database called name the current one.
+func (s *Session) use(name string) (interface{}, error) {
+	if s.single {
+		return nil, fmt.Errorf("USE needs a session, such as a WebSocket connection")
+	}
+	if s.tx != nil {
+		return nil, fmt.Errorf("cannot change database inside a transaction")
+	}
+	db, err := s.dbs.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+	return "using " + name, nil
+}
+
+// target returns the database a statement is for: the one its table name is qualified
+// with, or the current one.
+func (s *Session) target(database string) (litegodb.DB, error) {
+	if database == "" {
+		return s.db, nil
+	}
+	return s.dbs.Get(database)
+}
+
+// transaction begins, commits or rolls back the transaction of the session.
+func (s *Session) transaction(stmt sqlparser.Statement) (interface{}, error) {
+	switch stmt.(type) {
+	case *sqlparser.Begin:
+		if s.tx != nil {
+			return nil, fmt.Errorf("a transaction is already open")
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return nil, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		s.tx = tx
+		return "begun", nil
+	case *sqlparser.Commit:
+		if s.tx == nil {
+			return nil, fmt.Errorf("no transaction is open")
+		}
+		tx := s.tx
+		s.tx = nil
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit: %w", err)
+		}
+		return "committed", nil
+	default:
+		if s.tx == nil {
+			return nil, fmt.Errorf("no transaction is open")
+		}
+		tx := s.tx
+		s.tx = nil
+		if err := tx.Rollback(); err != nil {
+			return nil, fmt.Errorf("failed to roll back: %w", err)
+		}
+		return "rolled back", nil
+	}
+}
+
+// Close rolls back the open transaction, if any.
+func (s *Session) Close() error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	s.tx = nil
+	return tx.Rollback()
+}
+
+// qualifier returns the database the table of a statement is qualified with, if any.
+func qualifier(stmt sqlparser.Statement) string {
+	var exprs sqlparser.TableExprs
+	switch stmt := stmt.(type) {
+	case *sqlparser.Insert:
+		return stmt.Table.Qualifier.String()
+	case *sqlparser.Select:
+		exprs = stmt.From
+	case *sqlparser.Delete:
+		exprs = stmt.TableExprs
+	}
+	if len(exprs) == 0 {
+		return ""
+	}
+	if aliased, ok := exprs[0].(*sqlparser.AliasedTableExpr); ok {
+		if name, ok := aliased.Expr.(sqlparser.TableName); ok {
+			return name.Qualifier.String()
+		}
+	}
+	return ""
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"slices"
 	"sync"
 )
 
@@ -14,7 +16,9 @@ type Node struct {
 	children []*Node       // Children nodes (nil if leaf).
 	isLeaf   bool          // Whether the node is a leaf.
 	degree   int           // Minimum degree (defines the order of the tree).
-	id       int32         // Unique identifier for the node.
+	id       int32         // Unique identifier for the node. Zero until the node is first persisted.
+	dirty    bool          // Whether the node changed since it was last persisted.
+	lsn      uint64        // LSN of the last logged change to the node, or 0.
 }
 
 func (n *Node) Keys() []int {
@@ -41,6 +45,11 @@ func (n *Node) ID() int32 {
 	return n.id
 }
 
+// LSN returns the LSN of the last logged change to the node.
+func (n *Node) LSN() uint64 {
+	return n.lsn
+}
+
 func NewNodeComplete(id int32, keys []int, values []interface{}, children []*Node, isLeaf bool, degree int) *Node {
 	return &Node{
 		keys:     keys,
@@ -61,9 +70,11 @@ func NewNode(id int32, degree int) *Node {
 
 // BTree represents the overall B-Tree.
 type BTree struct {
-	root   *Node      // Root node of the tree.
-	degree int        // Minimum degree.
-	mutex  sync.Mutex // Mutex for thread-safety
+	root     *Node      // Root node of the tree.
+	degree   int        // Minimum degree.
+	mutex    sync.Mutex // Mutex for thread-safety
+	released []int32    // Pages of persisted nodes removed from the tree since the last Persist.
+	lsn      uint64     // LSN of the change being applied, stamped on every node it modifies.
 }
 
 // NewBTree creates a new B-Tree with the specified degree.
@@ -78,6 +89,7 @@ func NewBTree(degree int) *BTree {
 			children: make([]*Node, 0, 2*degree),
 			isLeaf:   true,
 			degree:   degree,
+			dirty:    true,
 		},
 		degree: degree,
 	}
@@ -101,8 +113,42 @@ func (t *BTree) SetRoot(root *Node) {
 
 // Insert inserts a key-value pair into the B-Tree.
 func (t *BTree) Insert(key int, value interface{}) {
+	t.InsertAt(key, value, 0)
+}
+
+// InsertAt inserts a key-value pair like Insert, stamping every node it modifies
+// with lsn, the LSN of the logged change.
+func (t *BTree) InsertAt(key int, value interface{}, lsn uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.insert(key, value, lsn)
+}
+
+// Write is a put of Value, or a delete if Delete is set, applied by ApplyAt.
+type Write struct {
+	Key    int
+	Value  interface{}
+	Delete bool
+}
+
+// ApplyAt applies writes in order as a single change, stamping every node they modify
+// with lsn. Readers and Persist see either none of the writes or all of them.
+func (t *BTree) ApplyAt(writes []Write, lsn uint64) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+	for _, w := range writes {
+		if w.Delete {
+			t.lsn = lsn
+			t.delete(t.root, w.Key)
+		} else {
+			t.insert(w.Key, w.Value, lsn)
+		}
+	}
+}
+
+// insert inserts a key-value pair. The caller holds the mutex.
+func (t *BTree) insert(key int, value interface{}, lsn uint64) {
+	t.lsn = lsn
 	if value == nil {
 		panic("value cannot be nil")
 	}
@@ -113,6 +159,8 @@ func (t *BTree) Insert(key int, value interface{}) {
 			children: make([]*Node, 0, 2*t.degree),
 			isLeaf:   true,
 			degree:   t.degree,
+			dirty:    true,
+			lsn:      t.lsn,
 		}
 	}
 	root := t.root
@@ -125,6 +173,7 @@ func (t *BTree) Insert(key int, value interface{}) {
 			children: make([]*Node, 0, 2*t.degree),
 			isLeaf:   false,
 			degree:   t.degree,
+			dirty:    true,
 		}
 		t.root = newRoot
 		newRoot.children = append(newRoot.children, root)
@@ -143,7 +192,11 @@ func (t *BTree) splitChild(parent *Node, childIndex int) {
 		children: make([]*Node, 0, t.degree),
 		isLeaf:   child.isLeaf,
 		degree:   t.degree,
+		dirty:    true,
+		lsn:      t.lsn,
 	}
+	t.touch(parent)
+	t.touch(child)
 
 	// Median index
 	mid := t.degree - 1
@@ -184,6 +237,7 @@ func (t *BTree) splitChild(parent *Node, childIndex int) {
 
 func (t *BTree) insertNonFull(node *Node, key int, value interface{}) {
 	i := len(node.keys) - 1
+	t.touch(node)
 
 	if node.isLeaf {
 
@@ -215,11 +269,20 @@ func (t *BTree) insertNonFull(node *Node, key int, value interface{}) {
 		for i >= 0 && key < node.keys[i] {
 			i--
 		}
+		// The key may already live in this internal node
+		if i >= 0 && key == node.keys[i] {
+			node.values[i] = value
+			return
+		}
 		i++
 
 		// if the children is full, split it
 		if len(node.children[i].keys) == 2*t.degree-1 {
 			t.splitChild(node, i)
+			if key == node.keys[i] {
+				node.values[i] = value
+				return
+			}
 			if key > node.keys[i] {
 				i++
 			}
@@ -253,14 +316,74 @@ func (t *BTree) searchNode(node *Node, key int) (interface{}, bool) {
 	return t.searchNode(node.children[i], key)
 }
 
+// Ascend calls fn with every key and value in ascending key order, until fn returns false.
+// fn must not modify the tree.
+func (t *BTree) Ascend(fn func(key int, value interface{}) bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.ascendNode(t.root, fn)
+}
+
+func (t *BTree) ascendNode(node *Node, fn func(key int, value interface{}) bool) bool {
+	for i, key := range node.keys {
+		if !node.isLeaf && !t.ascendNode(node.children[i], fn) {
+			return false
+		}
+		if !fn(key, node.values[i]) {
+			return false
+		}
+	}
+	if !node.isLeaf && len(node.children) > len(node.keys) {
+		return t.ascendNode(node.children[len(node.keys)], fn)
+	}
+	return true
+}
+
 // Delete deletes a key from the B-Tree.
 func (t *BTree) Delete(key int) {
+	t.DeleteAt(key, 0)
+}
+
+// DeleteAt deletes a key like Delete, stamping every node it modifies with lsn,
+// the LSN of the logged change.
+func (t *BTree) DeleteAt(key int, lsn uint64) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+	t.lsn = lsn
 
 	t.delete(t.root, key)
 }
 
+// PageLSN returns the LSN of the node a search for key ends at: the node holding
+// the key, or the leaf it would be inserted into. Every change to the key stamps
+// that node, so a logged change to the key with an LSN at or below the result is
+// already reflected in the tree.
+func (t *BTree) PageLSN(key int) uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	node := t.root
+	for {
+		i := 0
+		for i < len(node.keys) && key > node.keys[i] {
+			i++
+		}
+		if (i < len(node.keys) && key == node.keys[i]) || node.isLeaf {
+			return node.lsn
+		}
+		node = node.children[i]
+	}
+}
+
+// touch marks a node modified by the change being applied.
+func (t *BTree) touch(node *Node) {
+	node.dirty = true
+	if t.lsn > node.lsn {
+		node.lsn = t.lsn
+	}
+}
+
 // Serialize serializes the B-Tree to a byte slice.
 func (t *BTree) Serialize() ([]byte, error) {
 	t.mutex.Lock()
@@ -270,6 +393,103 @@ func (t *BTree) Serialize() ([]byte, error) {
 
 }
 
+// Persist writes every node changed since the last call to a freshly allocated page,
+// children before their parents, so the pages of the previous version stay intact
+// until the caller commits the new root. It returns the page ID of the root and
+// the pages of the previous version that are no longer referenced; those may only
+// be reused after the new root is durable.
+func (t *BTree) Persist(allocate func() (int32, error), write func(id int32, data []byte) error) (int32, []int32, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err := t.persistNode(t.root, allocate, write); err != nil {
+		return 0, nil, err
+	}
+
+	released := t.released
+	t.released = nil
+	return t.root.id, released, nil
+}
+
+func (t *BTree) persistNode(node *Node, allocate func() (int32, error), write func(id int32, data []byte) error) error {
+	// A clean node never has dirty descendants: any change below it marks the whole path.
+	if !node.dirty && node.id != 0 {
+		return nil
+	}
+
+	for _, child := range node.children {
+		if err := t.persistNode(child, allocate, write); err != nil {
+			return err
+		}
+	}
+
+	id, err := allocate()
+	if err != nil {
+		return err
+	}
+	if node.id != 0 {
+		t.released = append(t.released, node.id)
+	}
+	node.id = id
+
+	data, err := t.serializeNode(node)
+	if err != nil {
+		return err
+	}
+	if err := write(id, data); err != nil {
+		return err
+	}
+	node.dirty = false
+	return nil
+}
+
+// Relocate marks every persisted node stored at or beyond the given page ID, along
+// with its ancestors, so the next Persist moves them to newly allocated pages.
+// It returns the number of nodes that will be rewritten.
+func (t *BTree) Relocate(from int32) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	marked := 0
+	var walk func(node *Node) bool
+	walk = func(node *Node) bool {
+		move := node.id >= from
+		for _, child := range node.children {
+			if walk(child) {
+				move = true
+			}
+		}
+		if move {
+			node.dirty = true
+			marked++
+		}
+		return move
+	}
+	walk(t.root)
+	return marked
+}
+
+// PageIDs returns the IDs of the pages holding the tree's persisted nodes. Pages of
+// nodes that left the tree since the last Persist are included: the committed version
+// still references them until the next one replaces it.
+func (t *BTree) PageIDs() []int32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ids := slices.Clone(t.released)
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if node.id != 0 {
+			ids = append(ids, node.id)
+		}
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(t.root)
+	return ids
+}
+
 // Deserialize deserializes a byte slice to reconstruct the B-Tree.
 func Deserialize(data []byte, fetchPage func(int32) ([]byte, error)) (*BTree, error) {
 	buffer := bytes.NewReader(data)
@@ -338,8 +558,15 @@ func Deserialize(data []byte, fetchPage func(int32) ([]byte, error)) (*BTree, er
 		children = append(children, childTree.root)
 	}
 
+	// Nodes written before pages carried an LSN end here; they read as LSN 0.
+	var lsn uint64
+	if err := binary.Read(buffer, binary.LittleEndian, &lsn); err != nil && err != io.EOF {
+		return nil, err
+	}
+
 	tree := NewBTree(int(degree))
 	tree.root = NewNodeComplete(id, keys, values, children, isLeaf, int(degree))
+	tree.root.lsn = lsn
 	return tree, nil
 }
 
@@ -391,11 +618,16 @@ func (t *BTree) serializeNode(node *Node) ([]byte, error) {
 		}
 	}
 
+	if err := binary.Write(buffer, binary.LittleEndian, node.lsn); err != nil {
+		return nil, err
+	}
+
 	return buffer.Bytes(), nil
 }
 
 func (t *BTree) delete(node *Node, key int) error {
 	idx := 0
+	t.touch(node)
 
 	// Find the key in the current node
 	for idx < len(node.keys) && node.keys[idx] < key {
@@ -421,7 +653,7 @@ func (t *BTree) delete(node *Node, key int) error {
 
 		// Ensure the child has enough keys
 		if len(node.children[idx].keys) < t.degree {
-			t.ensureChildHasEnoughKeys(node, idx)
+			idx = t.ensureChildHasEnoughKeys(node, idx)
 		}
 
 		t.delete(node.children[idx], key)
@@ -450,6 +682,8 @@ func (t *BTree) deleteInternalNodeKey(node *Node, key, idx int) {
 func (t *BTree) borrowFromLeft(node *Node, idx int) {
 	child := node.children[idx]
 	sibling := node.children[idx-1]
+	t.touch(child)
+	t.touch(sibling)
 
 	child.keys = append([]int{node.keys[idx-1]}, child.keys...)
 	child.values = append([]interface{}{node.values[idx-1]}, child.values...)
@@ -469,6 +703,8 @@ func (t *BTree) borrowFromLeft(node *Node, idx int) {
 func (t *BTree) borrowFromRight(node *Node, idx int) {
 	child := node.children[idx]
 	sibling := node.children[idx+1]
+	t.touch(child)
+	t.touch(sibling)
 
 	child.keys = append(child.keys, node.keys[idx])
 	child.values = append(child.values, node.values[idx])
@@ -513,42 +749,48 @@ func (t *BTree) getSuccessor(node *Node, idx int) struct {
 	}{key: current.keys[0], value: current.values[0]}
 }
 
-func (t *BTree) ensureChildHasEnoughKeys(node *Node, idx int) {
+// ensureChildHasEnoughKeys refills the child at idx by borrowing or merging and
+// returns the index of the child that now covers the same key range.
+func (t *BTree) ensureChildHasEnoughKeys(node *Node, idx int) int {
 	child := node.children[idx]
 
 	// Special case: if this is the root and it has only one child
 	if node == t.root && len(node.children) == 1 {
 		// Merge the root with its only child
 		t.root = child
-		return
+		t.release(node)
+		return idx
 	}
 
 	// Try to borrow from left sibling if it exists and has enough keys
 	if idx > 0 && len(node.children[idx-1].keys) >= t.degree {
 		t.borrowFromLeft(node, idx)
-		return
+		return idx
 	}
 
 	// Try to borrow from right sibling if it exists and has enough keys
 	if idx < len(node.children)-1 && len(node.children[idx+1].keys) >= t.degree {
 		t.borrowFromRight(node, idx)
-		return
+		return idx
 	}
 
 	// If we can't borrow, we need to merge
 	// If we're at the first child, merge with the right sibling
 	if idx == 0 {
 		t.merge(node, 0)
-	} else {
-		// Otherwise, merge with the left sibling
-		t.merge(node, idx-1)
+		return 0
 	}
+
+	// Otherwise, merge with the left sibling
+	t.merge(node, idx-1)
+	return idx - 1
 }
 
 func (t *BTree) merge(parent *Node, idx int) {
 	// Special case for root with single child
 	if parent == t.root && len(parent.children) == 1 {
 		t.root = parent.children[0]
+		t.release(parent)
 		return
 	}
 
@@ -558,6 +800,9 @@ func (t *BTree) merge(parent *Node, idx int) {
 
 	left := parent.children[idx]
 	right := parent.children[idx+1]
+	t.touch(left)
+	t.touch(parent)
+	t.release(right)
 
 	// Merge keys and values from parent and right into left
 	left.keys = append(left.keys, parent.keys[idx])
@@ -578,5 +823,14 @@ func (t *BTree) merge(parent *Node, idx int) {
 	// If root becomes empty after merging, make the merged node the new root
 	if parent == t.root && len(parent.keys) == 0 {
 		t.root = left
+		t.release(parent)
+	}
+}
+
+// release records that a node left the tree so its page can be reused once the
+// tree is persisted without it.
+func (t *BTree) release(node *Node) {
+	if node.id != 0 {
+		t.released = append(t.released, node.id)
 	}
 }
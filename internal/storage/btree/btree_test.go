@@ -2,6 +2,7 @@ package btree_test
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -134,6 +135,45 @@ func TestBTreeSearchNonExistentKeys(t *testing.T) {
 	}
 }
 
+func TestBTreeAscend(t *testing.T) {
+	tree := btree.NewBTree(2)
+	keys := rand.New(rand.NewSource(1)).Perm(200)
+	for _, key := range keys {
+		tree.Insert(key, fmt.Sprint(key))
+	}
+	for key := 0; key < 200; key += 3 {
+		tree.Delete(key)
+	}
+
+	var got []int
+	tree.Ascend(func(key int, value interface{}) bool {
+		if value != fmt.Sprint(key) {
+			t.Fatalf("key %d has value %v", key, value)
+		}
+		got = append(got, key)
+		return true
+	})
+	var want []int
+	for key := 0; key < 200; key++ {
+		if key%3 != 0 {
+			want = append(want, key)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("ascended %v, want %v", got, want)
+	}
+
+	// Returning false stops the walk.
+	got = got[:0]
+	tree.Ascend(func(key int, value interface{}) bool {
+		got = append(got, key)
+		return len(got) < 5
+	})
+	if !slices.Equal(got, want[:5]) {
+		t.Fatalf("ascended %v, want %v", got, want[:5])
+	}
+}
+
 func TestBTreeDuplicates(t *testing.T) {
 	btree := btree.NewBTree(2)
 
@@ -273,3 +313,222 @@ func generateRandomString(length int, charset string) string {
 
 	return sb.String()
 }
+
+func TestBTreePersistCopyOnWrite(t *testing.T) {
+	bt := btree.NewBTree(3)
+	for i := 0; i < 200; i++ {
+		bt.Insert(i, fmt.Sprintf("value%d", i))
+	}
+
+	pages := make(map[int32][]byte)
+	next := int32(0)
+	allocate := func() (int32, error) {
+		next++
+		return next, nil
+	}
+	write := func(id int32, data []byte) error {
+		if _, exists := pages[id]; exists {
+			return fmt.Errorf("page %d written twice", id)
+		}
+		pages[id] = append([]byte(nil), data...)
+		return nil
+	}
+	fetch := func(id int32) ([]byte, error) {
+		data, ok := pages[id]
+		if !ok {
+			return nil, fmt.Errorf("page %d not found", id)
+		}
+		return data, nil
+	}
+
+	oldRoot, released, err := bt.Persist(allocate, write)
+	if err != nil {
+		t.Fatalf("failed to persist B-tree: %v", err)
+	}
+	if len(released) != 0 {
+		t.Fatalf("expected no released pages on first persist, got %v", released)
+	}
+
+	// Persisting again without changes writes nothing.
+	written := len(pages)
+	root, _, err := bt.Persist(allocate, write)
+	if err != nil {
+		t.Fatalf("failed to persist B-tree: %v", err)
+	}
+	if root != oldRoot || len(pages) != written {
+		t.Fatalf("expected an unchanged tree to keep root %d, got %d with %d new pages", oldRoot, root, len(pages)-written)
+	}
+
+	for i := 0; i < 200; i += 3 {
+		bt.Insert(i, fmt.Sprintf("updated%d", i))
+	}
+	for i := 1; i < 200; i += 3 {
+		bt.Delete(i)
+	}
+	newRoot, released, err := bt.Persist(allocate, write)
+	if err != nil {
+		t.Fatalf("failed to persist B-tree: %v", err)
+	}
+	if newRoot == oldRoot || len(released) == 0 {
+		t.Fatalf("expected a new root and released pages, got root %d and %v", newRoot, released)
+	}
+
+	// The previous version is still intact on its own pages.
+	previous, err := btree.Deserialize(pages[oldRoot], fetch)
+	if err != nil {
+		t.Fatalf("failed to deserialize previous version: %v", err)
+	}
+	current, err := btree.Deserialize(pages[newRoot], fetch)
+	if err != nil {
+		t.Fatalf("failed to deserialize new version: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		if value, found := previous.Search(i); !found || value != fmt.Sprintf("value%d", i) {
+			t.Fatalf("previous version: expected value%d for key %d, got %v (found %v)", i, i, value, found)
+		}
+
+		value, found := current.Search(i)
+		switch i % 3 {
+		case 0:
+			if !found || value != fmt.Sprintf("updated%d", i) {
+				t.Fatalf("new version: expected updated%d for key %d, got %v (found %v)", i, i, value, found)
+			}
+		case 1:
+			if found {
+				t.Fatalf("new version: key %d found after deletion", i)
+			}
+		default:
+			if !found || value != fmt.Sprintf("value%d", i) {
+				t.Fatalf("new version: expected value%d for key %d, got %v (found %v)", i, i, value, found)
+			}
+		}
+	}
+}
+
+func TestBTreePageIDsKeepReleasedPages(t *testing.T) {
+	bt := btree.NewBTree(3)
+	for i := 0; i < 100; i++ {
+		bt.Insert(i, fmt.Sprintf("value%d", i))
+	}
+
+	next := int32(0)
+	allocate := func() (int32, error) {
+		next++
+		return next, nil
+	}
+	write := func(int32, []byte) error { return nil }
+	if _, _, err := bt.Persist(allocate, write); err != nil {
+		t.Fatalf("failed to persist B-tree: %v", err)
+	}
+	committed := bt.PageIDs()
+
+	// Deleting most keys merges nodes away, but their pages still hold the committed
+	// version until the next Persist replaces it.
+	for i := 0; i < 90; i++ {
+		bt.Delete(i)
+	}
+	live := make(map[int32]bool)
+	for _, id := range bt.PageIDs() {
+		live[id] = true
+	}
+	for _, id := range committed {
+		if !live[id] {
+			t.Fatalf("page %d of the committed version missing from PageIDs", id)
+		}
+	}
+
+	_, released, err := bt.Persist(allocate, write)
+	if err != nil {
+		t.Fatalf("failed to persist B-tree: %v", err)
+	}
+	for _, id := range bt.PageIDs() {
+		if slices.Contains(released, id) {
+			t.Fatalf("released page %d still reported after persisting", id)
+		}
+	}
+}
+
+func TestBTreeOverwriteDoesNotDuplicateKeys(t *testing.T) {
+	bt := btree.NewBTree(2)
+	for i := 0; i < 100; i++ {
+		bt.Insert(i, "first")
+	}
+	for i := 0; i < 100; i++ {
+		bt.Insert(i, "second")
+	}
+	for i := 0; i < 100; i++ {
+		bt.Delete(i)
+		if value, found := bt.Search(i); found {
+			t.Fatalf("key %d still found after deleting it, value %v", i, value)
+		}
+	}
+}
+
+func TestBTreePageLSNSurvivesPersist(t *testing.T) {
+	bt := btree.NewBTree(3)
+	for i := 0; i < 100; i++ {
+		bt.InsertAt(i, fmt.Sprintf("value%d", i), uint64(i+1))
+	}
+	bt.DeleteAt(50, 101)
+
+	// Every change stamps the node it leaves the key in, or the leaf it was removed from.
+	for i := 0; i < 100; i++ {
+		if lsn := bt.PageLSN(i); lsn < uint64(i+1) {
+			t.Fatalf("Expected the node of key %d stamped at LSN %d or later, got %d", i, i+1, lsn)
+		}
+	}
+	if lsn := bt.PageLSN(50); lsn != 101 {
+		t.Fatalf("Expected the leaf of the deleted key stamped at LSN 101, got %d", lsn)
+	}
+
+	pages := make(map[int32][]byte)
+	next := int32(0)
+	_, _, err := bt.Persist(func() (int32, error) {
+		next++
+		return next, nil
+	}, func(id int32, data []byte) error {
+		pages[id] = append([]byte(nil), data...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+
+	restored, err := btree.Deserialize(pages[bt.Root().ID()], func(id int32) ([]byte, error) {
+		return pages[id], nil
+	})
+	if err != nil {
+		t.Fatalf("Deserialize failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if got, want := restored.PageLSN(i), bt.PageLSN(i); got != want {
+			t.Fatalf("Expected key %d on a page stamped at LSN %d, got %d", i, want, got)
+		}
+	}
+}
+
+func TestBTreeApplyAtStampsEveryWrite(t *testing.T) {
+	bt := btree.NewBTree(3)
+	for i := 0; i < 50; i++ {
+		bt.InsertAt(i, fmt.Sprintf("value%d", i), uint64(i+1))
+	}
+
+	writes := []btree.Write{{Key: 10, Value: "ten"}, {Key: 20, Delete: true}, {Key: 60, Value: "sixty"}, {Key: 10, Value: "TEN"}}
+	bt.ApplyAt(writes, 100)
+
+	if value, found := bt.Search(10); !found || value != "TEN" {
+		t.Fatalf("Expected the last write to key 10, got %v", value)
+	}
+	if _, found := bt.Search(20); found {
+		t.Fatalf("Expected key 20 to be deleted")
+	}
+	if value, found := bt.Search(60); !found || value != "sixty" {
+		t.Fatalf("Expected key 60 to be inserted, got %v", value)
+	}
+	for _, key := range []int{10, 20, 60} {
+		if lsn := bt.PageLSN(key); lsn != 100 {
+			t.Fatalf("Expected the node of key %d stamped at LSN 100, got %d", key, lsn)
+		}
+	}
+}
@@ -4,14 +4,21 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
 )
 
 // Catalog manages the metadata of all tables in the database.
 type Catalog struct {
-	mu     sync.RWMutex
-	tables map[string]*TableMetadata
-	disk   disk.DiskManager
+	mu       sync.RWMutex
+	tables   map[string]*TableMetadata
+	disk     disk.DiskManager
+	commitMu sync.Mutex // Serializes commits and guards meta, chain and checkpointLSN.
+	meta     meta       // Last committed state.
+	chain    []int32    // Pages holding the catalog of the last committed state.
+
+	checkpointLSN uint64 // Checkpoint LSN the next Save commits.
 }
 
 // NewCatalog creates a new in-memory catalog instance.
@@ -24,6 +31,12 @@ func NewCatalog(disk disk.DiskManager) *Catalog {
 
 // CreateTable adds a new table to the catalog.
 func (c *Catalog) CreateTable(name string, degree int32, rootID int32) error {
+	return c.CreateTableAt(name, degree, rootID, 0)
+}
+
+// CreateTableAt adds a new table to the catalog like CreateTable, recording the LSN of
+// the log record that created it.
+func (c *Catalog) CreateTableAt(name string, degree int32, rootID int32, lsn uint64) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -32,20 +45,109 @@ func (c *Catalog) CreateTable(name string, degree int32, rootID int32) error {
 	}
 
 	c.tables[name] = &TableMetadata{
-		Name:   name,
-		Degree: degree,
-		RootID: rootID,
+		Name:      name,
+		Degree:    degree,
+		RootID:    rootID,
+		CreateLSN: lsn,
+	}
+
+	return nil
+}
+
+// SetCompression changes the codec used for a table's pages.
+// Pages already on disk keep their codec until they are rewritten.
+func (c *Catalog) SetCompression(name string, codec compression.Codec) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, exists := c.tables[name]
+	if !exists {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+
+	meta.Compression = codec
+	return nil
+}
+
+// SetRoot records the page holding the root of a table's B-Tree.
+// The change becomes durable with the next Save.
+func (c *Catalog) SetRoot(name string, rootID int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, exists := c.tables[name]
+	if !exists {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+
+	meta.RootID = rootID
+	return nil
+}
+
+// SetSchema records the typed columns of a table.
+// The change becomes durable with the next Save.
+func (c *Catalog) SetSchema(name string, s *schema.Schema) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, exists := c.tables[name]
+	if !exists {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+
+	meta.Schema = s
+	return nil
+}
+
+// SetOption sets a per-table option, or removes it if value is empty.
+// The change becomes durable with the next Save.
+func (c *Catalog) SetOption(name, option, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, exists := c.tables[name]
+	if !exists {
+		return fmt.Errorf("table %s does not exist", name)
 	}
 
+	if value == "" {
+		delete(meta.Options, option)
+		return nil
+	}
+	if meta.Options == nil {
+		meta.Options = make(map[string]string)
+	}
+	meta.Options[option] = value
 	return nil
 }
 
-// Get retrieves the metadata of a table by its name.
+// SetStat records a per-table statistic.
+// The change becomes durable with the next Save.
+func (c *Catalog) SetStat(name, stat string, value int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, exists := c.tables[name]
+	if !exists {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+
+	if meta.Stats == nil {
+		meta.Stats = make(map[string]int64)
+	}
+	meta.Stats[stat] = value
+	return nil
+}
+
+// Get retrieves a copy of the metadata of a table by its name.
 func (c *Catalog) Get(name string) (*TableMetadata, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	t, ok := c.tables[name]
-	return t, ok
+	if !ok {
+		return nil, false
+	}
+	return t.clone(), true
 }
 
 // List return the names of all registered tables.
@@ -74,6 +176,27 @@ func (c *Catalog) DropTable(name string) error {
 	return nil
 }
 
+// RenameTable gives a table a new name, recording the LSN of the log record that renamed
+// it as the one that created the table under that name.
+func (c *Catalog) RenameTable(name, newName string, lsn uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, exists := c.tables[name]
+	if !exists {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+	if _, exists := c.tables[newName]; exists {
+		return fmt.Errorf("table %s already exists", newName)
+	}
+
+	delete(c.tables, name)
+	meta.Name = newName
+	meta.CreateLSN = lsn
+	c.tables[newName] = meta
+	return nil
+}
+
 // All returns a copy of the internal table metadata map.
 // This prevents external code from modifying the internal catalog state.
 func (c *Catalog) All() map[string]*TableMetadata {
@@ -82,11 +205,7 @@ func (c *Catalog) All() map[string]*TableMetadata {
 
 	copy := make(map[string]*TableMetadata, len(c.tables))
 	for name, meta := range c.tables {
-		copy[name] = &TableMetadata{
-			Name:   meta.Name,
-			RootID: meta.RootID,
-			Degree: meta.Degree,
-		}
+		copy[name] = meta.clone()
 	}
 	return copy
 }
@@ -1,10 +1,15 @@
 package catalog_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/rafaelmgr12/litegodb/internal/storage/catalog"
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -94,6 +99,26 @@ func TestCatalog_DropNonExistentTable(t *testing.T) {
 	assert.Equal(t, "table non_existent does not exist", err.Error())
 }
 
+func TestCatalog_RenameTable(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.CreateTableAt("users", 3, 1, 5))
+	require.NoError(t, cat.CreateTable("orders", 3, 2))
+
+	assert.EqualError(t, cat.RenameTable("users", "orders", 9), "table orders already exists")
+	assert.EqualError(t, cat.RenameTable("missing", "other", 9), "table missing does not exist")
+
+	require.NoError(t, cat.RenameTable("users", "people", 9))
+	_, ok := cat.Get("users")
+	assert.False(t, ok)
+	meta, ok := cat.Get("people")
+	require.True(t, ok)
+	assert.Equal(t, "people", meta.Name)
+	assert.Equal(t, int32(1), meta.RootID)
+	assert.Equal(t, uint64(9), meta.CreateLSN)
+}
+
 func TestCatalog_SaveAndLoad(t *testing.T) {
 	cat, cleanup := setupCatalog(t)
 	defer cleanup()
@@ -115,3 +140,193 @@ func TestCatalog_SaveAndLoad(t *testing.T) {
 
 	require.NoError(t, dm.Close())
 }
+
+func TestCatalog_SaveAndLoadCompression(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.CreateTable("events", 3, 1))
+	require.NoError(t, cat.SetCompression("events", compression.Flate))
+	require.Error(t, cat.SetCompression("missing", compression.LZ))
+	require.NoError(t, cat.Save())
+
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+
+	cat2 := catalog.NewCatalog(dm)
+	require.NoError(t, cat2.Load())
+
+	meta, ok := cat2.Get("events")
+	require.True(t, ok)
+	assert.Equal(t, compression.Flate, meta.Compression)
+}
+
+func TestCatalog_LoadFallsBackToPreviousMetaPage(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.CreateTable("users", 3, 5))
+	require.NoError(t, cat.Save()) // Sequence 1 goes to meta page B.
+	require.NoError(t, cat.CreateTable("orders", 3, 7))
+	require.NoError(t, cat.Save()) // Sequence 2 goes to meta page A.
+
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+
+	// Simulate a torn write of the newest meta page.
+	torn := disk.NewFilePage(0)
+	torn.SetData([]byte("LGDB garbage"))
+	require.NoError(t, dm.WritePage(torn))
+
+	cat2 := catalog.NewCatalog(dm)
+	require.NoError(t, cat2.Load())
+
+	_, ok := cat2.Get("users")
+	assert.True(t, ok)
+	_, ok = cat2.Get("orders")
+	assert.False(t, ok, "state from the torn commit must not be visible")
+}
+
+func TestCatalog_LoadFailsWithoutValidMetaPage(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.CreateTable("users", 3, 5))
+	require.NoError(t, cat.Save())
+	require.NoError(t, cat.Save())
+
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+
+	for _, id := range []int32{0, 1} {
+		page := disk.NewFilePage(id)
+		page.SetData([]byte("corrupted"))
+		require.NoError(t, dm.WritePage(page))
+	}
+
+	require.Error(t, catalog.NewCatalog(dm).Load())
+}
+
+func TestCatalog_CheckpointLSN(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.CreateTable("users", 3, 5))
+	cat.SetCheckpointLSN(42)
+	assert.Equal(t, uint64(0), cat.CheckpointLSN(), "staged LSN must not count until saved")
+	require.NoError(t, cat.Save())
+	assert.Equal(t, uint64(42), cat.CheckpointLSN())
+
+	// Later commits keep the checkpoint LSN.
+	require.NoError(t, cat.CreateTable("orders", 3, 7))
+	require.NoError(t, cat.Save())
+
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+
+	cat2 := catalog.NewCatalog(dm)
+	require.NoError(t, cat2.Load())
+	assert.Equal(t, uint64(42), cat2.CheckpointLSN())
+}
+
+func TestCatalog_CreateLSNPersists(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.CreateTableAt("users", 3, 5, 17))
+	require.NoError(t, cat.CreateTable("orders", 3, 7))
+	require.NoError(t, cat.Save())
+
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+
+	cat2 := catalog.NewCatalog(dm)
+	require.NoError(t, cat2.Load())
+	users, ok := cat2.Get("users")
+	require.True(t, ok)
+	assert.Equal(t, uint64(17), users.CreateLSN)
+	orders, ok := cat2.Get("orders")
+	require.True(t, ok)
+	assert.Equal(t, uint64(0), orders.CreateLSN)
+}
+
+func TestCatalog_SaveAndLoadManyTables(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	const tables = 3000
+	for i := 0; i < tables; i++ {
+		name := fmt.Sprintf("table_%04d_%s", i, strings.Repeat("x", 40))
+		require.NoError(t, cat.CreateTableAt(name, 3, int32(i+10), uint64(i)))
+	}
+	name := fmt.Sprintf("table_%04d_%s", 1234, strings.Repeat("x", 40))
+	require.NoError(t, cat.SetOption(name, "comment", "kept across restarts"))
+	require.NoError(t, cat.SetStat(name, "keys", 99))
+	require.Error(t, cat.SetStat("missing", "keys", 1))
+	require.NoError(t, cat.Save())
+
+	pages := cat.Pages()
+	assert.Greater(t, len(pages), 3, "the catalog should span several pages")
+	require.NoError(t, cat.Save())
+	assert.Len(t, cat.Pages(), len(pages))
+
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+
+	cat2 := catalog.NewCatalog(dm)
+	require.NoError(t, cat2.Load())
+	assert.Len(t, cat2.List(), tables)
+	assert.ElementsMatch(t, cat.Pages(), cat2.Pages())
+
+	meta, ok := cat2.Get(name)
+	require.True(t, ok)
+	assert.Equal(t, int32(1244), meta.RootID)
+	assert.Equal(t, uint64(1234), meta.CreateLSN)
+	assert.Equal(t, map[string]string{"comment": "kept across restarts"}, meta.Options)
+	assert.Equal(t, map[string]int64{"keys": 99}, meta.Stats)
+
+	// Copies handed out do not share the catalog's maps.
+	meta.Options["comment"] = "changed"
+	meta, _ = cat2.Get(name)
+	assert.Equal(t, "kept across restarts", meta.Options["comment"])
+}
+
+func TestCatalog_MigratesSinglePageCatalog(t *testing.T) {
+	cat, cleanup := setupCatalog(t)
+	defer cleanup()
+
+	require.NoError(t, cat.Save())
+	legacyPage := cat.Pages()[2]
+
+	// Overwrite the catalog with a page in the format of earlier versions: the version
+	// marker, the number of tables, then name, root, degree, codec and create LSN.
+	var buf bytes.Buffer
+	for _, v := range []any{int32(-2), int32(1), int32(5), []byte("users"), int32(7), int32(3), byte(compression.Flate), uint64(12)} {
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, v))
+	}
+	dm, err := disk.NewFileDiskManager(testDBFile)
+	require.NoError(t, err)
+	defer dm.Close()
+	page := disk.NewFilePage(legacyPage)
+	page.SetData(buf.Bytes())
+	require.NoError(t, dm.WritePage(page))
+
+	cat2 := catalog.NewCatalog(dm)
+	require.NoError(t, cat2.Load())
+	assert.NotContains(t, cat2.Pages(), legacyPage, "the catalog should be rewritten on open")
+
+	cat3 := catalog.NewCatalog(dm)
+	require.NoError(t, cat3.Load())
+	meta, ok := cat3.Get("users")
+	require.True(t, ok)
+	assert.Equal(t, int32(7), meta.RootID)
+	assert.Equal(t, int32(3), meta.Degree)
+	assert.Equal(t, compression.Flate, meta.Compression)
+	assert.Equal(t, uint64(12), meta.CreateLSN)
+}
@@ -1,5 +1,12 @@
 package catalog
 
+import (
+	"maps"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
+)
+
 // TableMetadata holds persistent metadata for a user-defined table.
 // It allows recovery and reconstruction of the table state during database load.
 type TableMetadata struct {
@@ -11,4 +18,35 @@ type TableMetadata struct {
 
 	// Degree is the degree (minimum branching factor) of the B-Tree.
 	Degree int32
+
+	// Compression is the codec used for the table's pages.
+	Compression compression.Codec
+
+	// CreateLSN is the LSN of the log record that created the table, or 0 if unknown.
+	// Logged changes below it belong to an earlier table with the same name.
+	CreateLSN uint64
+
+	// Options holds per-table settings by name, such as those given when the table was
+	// created. It is nil when the table has none.
+	Options map[string]string
+
+	// Stats holds per-table statistics by name, such as key counts kept for planning.
+	// It is nil when the table has none.
+	Stats map[string]int64
+
+	// Schema describes the typed columns of the table's rows, or is nil for a table that
+	// maps keys to plain string values. It is shared by copies, as it never changes.
+	Schema *schema.Schema
+}
+
+// clone returns a copy of the metadata that shares no maps with it.
+func (m *TableMetadata) clone() *TableMetadata {
+	clone := *m
+	if m.Options != nil {
+		clone.Options = maps.Clone(m.Options)
+	}
+	if m.Stats != nil {
+		clone.Stats = maps.Clone(m.Stats)
+	}
+	return &clone
 }
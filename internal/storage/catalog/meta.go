@@ -0,0 +1,87 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// The database keeps two meta pages at fixed locations. Each commit writes the
+// meta page that does not hold the current state, so a crash while writing it
+// leaves the other one, and the state it points to, intact. On load the valid
+// meta page with the highest sequence number wins.
+const (
+	metaPageA int32 = 0
+	metaPageB int32 = 1
+
+	metaMagic   = "LGDB"
+	metaVersion = 2
+
+	// metaSize is magic (4), version (4), sequence (8), catalog page (4),
+	// checkpoint LSN (8) and checksum (4).
+	metaSize = 32
+
+	// metaSizeV1 is the size of version 1 meta pages, which have no checkpoint LSN.
+	metaSizeV1 = 24
+)
+
+// meta is the root of a committed database state.
+type meta struct {
+	seq           uint64 // Incremented by every commit.
+	catalogPage   int32  // Page holding the catalog, or 0 if no table was ever committed.
+	checkpointLSN uint64 // Every logged change up to this LSN is in the committed tables.
+}
+
+// slot returns the meta page a state with this sequence number is written to.
+func (m meta) slot() int32 {
+	if m.seq%2 == 0 {
+		return metaPageA
+	}
+	return metaPageB
+}
+
+func (m meta) encode() []byte {
+	buf := make([]byte, metaSize)
+	copy(buf[0:4], metaMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], metaVersion)
+	binary.LittleEndian.PutUint64(buf[8:16], m.seq)
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(m.catalogPage))
+	binary.LittleEndian.PutUint64(buf[20:28], m.checkpointLSN)
+	binary.LittleEndian.PutUint32(buf[28:32], crc32.ChecksumIEEE(buf[:28]))
+	return buf
+}
+
+func decodeMeta(data []byte) (meta, error) {
+	if len(data) < metaSizeV1 {
+		return meta{}, fmt.Errorf("meta page too short")
+	}
+	if !bytes.Equal(data[0:4], []byte(metaMagic)) {
+		return meta{}, fmt.Errorf("invalid meta page magic")
+	}
+
+	version := binary.LittleEndian.Uint32(data[4:8])
+	size := metaSize
+	switch version {
+	case 1:
+		size = metaSizeV1
+	case metaVersion:
+		if len(data) < metaSize {
+			return meta{}, fmt.Errorf("meta page too short")
+		}
+	default:
+		return meta{}, fmt.Errorf("unsupported meta page version %d", version)
+	}
+	if crc32.ChecksumIEEE(data[:size-4]) != binary.LittleEndian.Uint32(data[size-4:size]) {
+		return meta{}, fmt.Errorf("meta page checksum mismatch")
+	}
+
+	m := meta{
+		seq:         binary.LittleEndian.Uint64(data[8:16]),
+		catalogPage: int32(binary.LittleEndian.Uint32(data[16:20])),
+	}
+	if version == metaVersion {
+		m.checkpointLSN = binary.LittleEndian.Uint64(data[20:28])
+	}
+	return m, nil
+}
@@ -3,95 +3,493 @@ package catalog
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
 )
 
-const catalogPageID int32 = 0
-
-// Save persists the current catalog state to disk.
+// Save atomically commits the current catalog state to disk.
+//
+// Every page the catalog refers to must already have been written. Save writes
+// the catalog to a chain of new pages, syncs, and only then switches the inactive
+// meta page to the first of them and syncs again, so a crash at any point leaves
+// either the previous or the new state on disk. The pages of the previous catalog
+// are freed once the switch is durable.
 func (c *Catalog) Save() error {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	return c.save()
+}
+
+// save commits the catalog like Save. The caller holds commitMu.
+func (c *Catalog) save() error {
+	if err := c.reserveMetaPages(); err != nil {
+		return err
+	}
+
+	chain, err := c.writeChain(c.encode())
+	if err != nil {
+		return err
+	}
+	if err := c.disk.Sync(); err != nil {
+		return err
+	}
+
+	next := meta{seq: c.meta.seq + 1, catalogPage: chain[0], checkpointLSN: c.checkpointLSN}
+	metaPage := disk.NewFilePage(next.slot())
+	metaPage.SetData(next.encode())
+	if err := c.disk.WritePage(metaPage); err != nil {
+		return err
+	}
+	if err := c.disk.Sync(); err != nil {
+		return err
+	}
 
-	buf := new(bytes.Buffer)
+	previous := c.chain
+	c.meta, c.chain = next, chain
+	for _, id := range previous {
+		c.disk.FreePage(id)
+	}
+	return nil
+}
 
-	if err := binary.Write(buf, binary.LittleEndian, int32(len(c.tables))); err != nil {
+// Load reads the most recently committed catalog state from disk and rebuilds the in-memory map.
+// A database whose meta pages were never written is treated as empty.
+func (c *Catalog) Load() error {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	if err := c.reserveMetaPages(); err != nil {
 		return err
 	}
 
-	for _, meta := range c.tables {
-		nameBytes := []byte(meta.Name)
-		nameLen := int32(len(nameBytes))
+	current, err := c.readMeta()
+	if err != nil {
+		return err
+	}
 
-		if err := binary.Write(buf, binary.LittleEndian, nameLen); err != nil {
+	tables := make(map[string]*TableMetadata)
+	var chain []int32
+	legacy := false
+	if current.catalogPage != 0 {
+		var data []byte
+		if data, chain, legacy, err = c.readChain(current.catalogPage); err != nil {
 			return err
 		}
+		if tables, err = decodeTables(data); err != nil {
+			return fmt.Errorf("failed to decode catalog at page %d: %w", current.catalogPage, err)
+		}
+	}
 
-		if _, err := buf.Write(nameBytes); err != nil {
-			return err
+	c.mu.Lock()
+	c.tables = tables
+	c.mu.Unlock()
+	c.meta, c.chain = current, chain
+	c.checkpointLSN = current.checkpointLSN
+
+	// A catalog written as a single page by an earlier version is rewritten as a chain
+	// right away, so it can grow past one page.
+	if legacy {
+		if err := c.save(); err != nil {
+			return fmt.Errorf("failed to migrate catalog: %w", err)
 		}
+	}
+	return nil
+}
 
-		if err := binary.Write(buf, binary.LittleEndian, int32(meta.RootID)); err != nil {
+// SetCheckpointLSN sets the checkpoint LSN recorded by the next Save. The caller must
+// make sure every change logged up to lsn is in the tables that Save commits.
+func (c *Catalog) SetCheckpointLSN(lsn uint64) {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	c.checkpointLSN = lsn
+}
+
+// CheckpointLSN returns the checkpoint LSN of the committed state. Logged changes up to
+// it are already in the committed tables and need no replay.
+func (c *Catalog) CheckpointLSN() uint64 {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	return c.meta.checkpointLSN
+}
+
+// Pages returns the IDs of the pages used by the committed catalog state.
+func (c *Catalog) Pages() []int32 {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	return append([]int32{metaPageA, metaPageB}, c.chain...)
+}
+
+// reserveMetaPages makes sure the meta pages are allocated so they are never
+// handed out for other data.
+func (c *Catalog) reserveMetaPages() error {
+	for c.disk.GetLastAllocatedPageID() < metaPageB {
+		if _, err := c.disk.AllocatePage(); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		if err := binary.Write(buf, binary.LittleEndian, int32(meta.Degree)); err != nil {
-			return err
+// readMeta returns the valid meta page with the highest sequence number.
+func (c *Catalog) readMeta() (meta, error) {
+	var current meta
+	found, written := false, false
+
+	for _, id := range []int32{metaPageA, metaPageB} {
+		page, err := c.disk.ReadPage(id)
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if err == nil && isZero(page.Data()) {
+			continue
+		}
+		written = true
+		if err != nil {
+			continue
+		}
+
+		m, err := decodeMeta(page.Data())
+		if err != nil {
+			continue
+		}
+		if !found || m.seq > current.seq {
+			current, found = m, true
 		}
 	}
 
-	page := disk.NewFilePage(catalogPageID)
-	page.SetData(buf.Bytes())
-	return c.disk.WritePage(page)
+	if written && !found {
+		return meta{}, fmt.Errorf("no valid meta page found")
+	}
+	return current, nil
 }
 
-// Load reads the catalog state from disk and rebuilds the in-memory map.
-func (c *Catalog) Load() error {
-	page, err := c.disk.ReadPage(catalogPageID)
-	if err != nil {
-		return err
+// The catalog is stored as a byte stream split over a chain of pages, each starting
+// with chainMarker, the ID of the next page (0 on the last one) and the length of the
+// part of the stream it holds:
+//
+//	marker int32 | next int32 | length uint32 | stream[length]
+//
+// The stream holds the number of tables, then one entry per table in name order. Each
+// entry is prefixed with its length, so fields added later are skipped by older readers:
+//
+//	name | root int32 | degree int32 | codec byte | create LSN uint64 | options | stats | schema
+//
+// where strings are a uint32 length and the bytes, options a uint32 count of name and
+// value strings, stats a uint32 count of name strings and int64 values, and schema a
+// string of column definitions, empty for a table without one. Entries written before
+// tables had schemas end with the stats.
+//
+// Earlier versions wrote the catalog to a single page, without the chain header: it
+// started with the number of tables, or with legacyVersionMarker followed by the number
+// of tables when every entry ends with its create LSN.
+const (
+	chainMarker         int32 = -3
+	legacyVersionMarker int32 = -2
+
+	chainHeaderSize = 12
+	chainChunkSize  = disk.MaxPageDataSize - chainHeaderSize
+)
+
+// writeChain writes data to a chain of newly allocated pages and returns their IDs.
+// The pages are freed again if it fails.
+func (c *Catalog) writeChain(data []byte) (chain []int32, err error) {
+	defer func() {
+		if err != nil {
+			for _, id := range chain {
+				c.disk.FreePage(id)
+			}
+		}
+	}()
+
+	count := max(1, (len(data)+chainChunkSize-1)/chainChunkSize)
+	for range count {
+		page, err := c.disk.AllocatePage()
+		if err != nil {
+			return chain, err
+		}
+		chain = append(chain, page.ID())
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.tables = make(map[string]*TableMetadata)
+	for i, id := range chain {
+		chunk := data[min(i*chainChunkSize, len(data)):min((i+1)*chainChunkSize, len(data))]
+		var next int32
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+		buf := make([]byte, chainHeaderSize+len(chunk))
+		marker := chainMarker
+		binary.LittleEndian.PutUint32(buf[0:4], uint32(marker))
+		binary.LittleEndian.PutUint32(buf[4:8], uint32(next))
+		binary.LittleEndian.PutUint32(buf[8:12], uint32(len(chunk)))
+		copy(buf[chainHeaderSize:], chunk)
+
+		page := disk.NewFilePage(id)
+		page.SetData(buf)
+		if err := c.disk.WritePage(page); err != nil {
+			return chain, err
+		}
+	}
+	return chain, nil
+}
 
-	buf := bytes.NewReader(page.Data())
+// readChain reads the catalog stream starting at page first and returns it with the IDs
+// of its pages. A catalog written as a single page by an earlier version is converted to
+// the current stream format and reported as legacy.
+func (c *Catalog) readChain(first int32) (data []byte, chain []int32, legacy bool, err error) {
+	seen := make(map[int32]bool)
+	for id := first; id != 0; {
+		if seen[id] {
+			return nil, nil, false, fmt.Errorf("catalog page %d is linked twice", id)
+		}
+		seen[id] = true
+
+		page, err := c.disk.ReadPage(id)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		buf := page.Data()
+		if len(buf) < 4 {
+			return nil, nil, false, fmt.Errorf("catalog page %d is too short", id)
+		}
+		if marker := int32(binary.LittleEndian.Uint32(buf[0:4])); marker != chainMarker {
+			if id != first {
+				return nil, nil, false, fmt.Errorf("catalog page %d is not part of a chain", id)
+			}
+			tables, err := decodeLegacyTables(buf)
+			if err != nil {
+				return nil, nil, false, fmt.Errorf("failed to decode catalog page %d: %w", id, err)
+			}
+			return encodeTables(tables), []int32{id}, true, nil
+		}
+
+		length := int(binary.LittleEndian.Uint32(buf[8:12]))
+		if length > len(buf)-chainHeaderSize {
+			return nil, nil, false, fmt.Errorf("catalog page %d: invalid length %d", id, length)
+		}
+		data = append(data, buf[chainHeaderSize:chainHeaderSize+length]...)
+		chain = append(chain, id)
+		id = int32(binary.LittleEndian.Uint32(buf[4:8]))
+	}
+	return data, chain, false, nil
+}
+
+func (c *Catalog) encode() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return encodeTables(c.tables)
+}
+
+// encodeTables returns the catalog stream of the given tables.
+func encodeTables(tables map[string]*TableMetadata) []byte {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(names)))
+	for _, name := range names {
+		meta := tables[name]
+		entry := appendString(nil, meta.Name)
+		entry = binary.LittleEndian.AppendUint32(entry, uint32(meta.RootID))
+		entry = binary.LittleEndian.AppendUint32(entry, uint32(meta.Degree))
+		entry = append(entry, byte(meta.Compression))
+		entry = binary.LittleEndian.AppendUint64(entry, meta.CreateLSN)
+
+		entry = binary.LittleEndian.AppendUint32(entry, uint32(len(meta.Options)))
+		for _, key := range slices.Sorted(maps.Keys(meta.Options)) {
+			entry = appendString(entry, key)
+			entry = appendString(entry, meta.Options[key])
+		}
+		entry = binary.LittleEndian.AppendUint32(entry, uint32(len(meta.Stats)))
+		for _, key := range slices.Sorted(maps.Keys(meta.Stats)) {
+			entry = appendString(entry, key)
+			entry = binary.LittleEndian.AppendUint64(entry, uint64(meta.Stats[key]))
+		}
+		var definitions string
+		if meta.Schema != nil {
+			definitions = meta.Schema.Definition()
+		}
+		entry = appendString(entry, definitions)
+
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry)))
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// decodeTables decodes a catalog stream.
+func decodeTables(data []byte) (map[string]*TableMetadata, error) {
+	r := &streamReader{data: data}
+	count := r.uint32()
+	tables := make(map[string]*TableMetadata)
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		entry := &streamReader{data: r.bytes(int(r.uint32()))}
+		meta := &TableMetadata{
+			Name:        entry.string(),
+			RootID:      int32(entry.uint32()),
+			Degree:      int32(entry.uint32()),
+			Compression: compression.Codec(entry.byte()),
+			CreateLSN:   entry.uint64(),
+		}
+		if n := entry.uint32(); n > 0 && entry.err == nil {
+			meta.Options = make(map[string]string)
+			for j := uint32(0); j < n && entry.err == nil; j++ {
+				key := entry.string()
+				meta.Options[key] = entry.string()
+			}
+		}
+		if n := entry.uint32(); n > 0 && entry.err == nil {
+			meta.Stats = make(map[string]int64)
+			for j := uint32(0); j < n && entry.err == nil; j++ {
+				key := entry.string()
+				meta.Stats[key] = int64(entry.uint64())
+			}
+		}
+		if len(entry.data) > 0 {
+			if definitions := entry.string(); definitions != "" && entry.err == nil {
+				s, err := schema.Parse(definitions)
+				if err != nil {
+					return nil, fmt.Errorf("table %s: %w", meta.Name, err)
+				}
+				meta.Schema = s
+			}
+		}
+		if entry.err != nil {
+			return nil, fmt.Errorf("table entry %d: %w", i, entry.err)
+		}
+		tables[meta.Name] = meta
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return tables, nil
+}
+
+// streamReader reads the fields of a catalog stream, remembering the first error.
+type streamReader struct {
+	data []byte
+	err  error
+}
+
+func (r *streamReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *streamReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *streamReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *streamReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *streamReader) string() string {
+	return string(r.bytes(int(r.uint32())))
+}
+
+// decodeLegacyTables decodes a catalog page written by an earlier version.
+func decodeLegacyTables(data []byte) (map[string]*TableMetadata, error) {
+	tables := make(map[string]*TableMetadata)
+	buf := bytes.NewReader(data)
 
 	var count int32
 	if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
-		return err
+		return nil, err
+	}
+	versioned := count == legacyVersionMarker
+	if versioned {
+		if err := binary.Read(buf, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
 	}
 
 	for i := int32(0); i < count; i++ {
 		var nameLen int32
 		if err := binary.Read(buf, binary.LittleEndian, &nameLen); err != nil {
-			return err
+			return nil, err
 		}
 
 		nameBytes := make([]byte, nameLen)
-		if _, err := buf.Read(nameBytes); err != nil {
-			return err
+		if _, err := io.ReadFull(buf, nameBytes); err != nil {
+			return nil, err
 		}
 
 		var rootID int32
 		if err := binary.Read(buf, binary.LittleEndian, &rootID); err != nil {
-			return err
+			return nil, err
 		}
 
 		var degree int32
 		if err := binary.Read(buf, binary.LittleEndian, &degree); err != nil {
-			return err
+			return nil, err
+		}
+
+		codec, err := buf.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		var createLSN uint64
+		if versioned {
+			if err := binary.Read(buf, binary.LittleEndian, &createLSN); err != nil {
+				return nil, err
+			}
 		}
 
 		name := string(nameBytes)
-		c.tables[name] = &TableMetadata{
-			Name:   name,
-			RootID: rootID,
-			Degree: degree,
+		tables[name] = &TableMetadata{
+			Name:        name,
+			RootID:      rootID,
+			Degree:      degree,
+			Compression: compression.Codec(codec),
+			CreateLSN:   createLSN,
 		}
 	}
 
-	return nil
+	return tables, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
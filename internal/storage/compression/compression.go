@@ -0,0 +1,122 @@
+// Package compression implements the codecs used to compress page payloads.
+// All codecs are pure Go so the database has no cgo dependencies.
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Codec identifies a compression algorithm. Its value is persisted in page headers
+// and in the catalog, so existing values must never be renumbered.
+type Codec uint8
+
+const (
+	// None stores data uncompressed.
+	None Codec = 0
+	// LZ is a fast, snappy-style LZ77 codec that favours speed over ratio.
+	LZ Codec = 1
+	// Flate is DEFLATE from the standard library. It is slower than LZ but compresses further.
+	Flate Codec = 2
+)
+
+// ErrCorrupt is returned when compressed data cannot be decoded.
+var ErrCorrupt = errors.New("compression: corrupt input")
+
+// ParseCodec returns the codec with the given name. The empty string selects None.
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return None, nil
+	case "lz", "snappy":
+		return LZ, nil
+	case "flate", "deflate":
+		return Flate, nil
+	default:
+		return None, fmt.Errorf("compression: unknown codec %q", name)
+	}
+}
+
+// String returns the canonical name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case LZ:
+		return "lz"
+	case Flate:
+		return "flate"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// Compress encodes src with the given codec.
+func Compress(c Codec, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case LZ:
+		return lzEncode(src), nil
+	case Flate:
+		return flateEncode(src)
+	default:
+		return nil, fmt.Errorf("compression: unknown codec %d", c)
+	}
+}
+
+// Decompress decodes src, which must have been produced by Compress with the same codec.
+// It fails with ErrCorrupt if the decoded data would exceed limit bytes.
+func Decompress(c Codec, src []byte, limit int) ([]byte, error) {
+	switch c {
+	case None:
+		if len(src) > limit {
+			return nil, ErrCorrupt
+		}
+		return src, nil
+	case LZ:
+		return lzDecode(src, limit)
+	case Flate:
+		return flateDecode(src, limit)
+	default:
+		return nil, fmt.Errorf("compression: unknown codec %d", c)
+	}
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func flateEncode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func flateDecode(src []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	dst, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil || len(dst) > limit {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
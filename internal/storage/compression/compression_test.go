@@ -0,0 +1,154 @@
+package compression_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var codecs = []compression.Codec{compression.None, compression.LZ, compression.Flate}
+
+// jsonValues returns n realistic JSON documents like the ones applications store as values.
+func jsonValues(n int) [][]byte {
+	rng := rand.New(rand.NewSource(42))
+	cities := []string{"São Paulo", "Lisbon", "Berlin", "Austin", "Toronto"}
+	plans := []string{"free", "pro", "enterprise"}
+
+	values := make([][]byte, n)
+	for i := range values {
+		doc := map[string]interface{}{
+			"id":         i,
+			"name":       fmt.Sprintf("Customer %d", rng.Intn(100000)),
+			"email":      fmt.Sprintf("customer%d@example.com", rng.Intn(100000)),
+			"active":     rng.Intn(2) == 1,
+			"plan":       plans[rng.Intn(len(plans))],
+			"created_at": fmt.Sprintf("2024-%02d-%02dT%02d:%02d:00Z", rng.Intn(12)+1, rng.Intn(28)+1, rng.Intn(24), rng.Intn(60)),
+			"address": map[string]string{
+				"street": fmt.Sprintf("%d Main Street", rng.Intn(1000)),
+				"city":   cities[rng.Intn(len(cities))],
+			},
+			"tags": []string{"newsletter", plans[rng.Intn(len(plans))], "beta"},
+		}
+		values[i], _ = json.Marshal(doc)
+	}
+	return values
+}
+
+// pageOfJSON joins JSON values until the result is about the size of a page.
+func pageOfJSON() []byte {
+	var buf bytes.Buffer
+	for _, v := range jsonValues(64) {
+		if buf.Len()+len(v) > 4096 {
+			break
+		}
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repetitive": bytes.Repeat([]byte("litegodb "), 500),
+		"zeros":      make([]byte, 4096),
+		"random":     random,
+		"json":       pageOfJSON(),
+	}
+
+	for _, codec := range codecs {
+		for name, input := range inputs {
+			t.Run(codec.String()+"/"+name, func(t *testing.T) {
+				compressed, err := compression.Compress(codec, input)
+				require.NoError(t, err)
+
+				decompressed, err := compression.Decompress(codec, compressed, len(input))
+				require.NoError(t, err)
+				assert.Equal(t, len(input), len(decompressed))
+				assert.True(t, bytes.Equal(input, decompressed))
+			})
+		}
+	}
+}
+
+func TestCompressionShrinksJSON(t *testing.T) {
+	input := pageOfJSON()
+	for _, codec := range []compression.Codec{compression.LZ, compression.Flate} {
+		compressed, err := compression.Compress(codec, input)
+		require.NoError(t, err)
+		assert.Less(t, len(compressed), len(input)/2, "codec %s", codec)
+	}
+}
+
+func TestDecompressRejectsCorruptInput(t *testing.T) {
+	// A copy whose offset points before the start of the output.
+	_, err := compression.Decompress(compression.LZ, []byte{0x80, 0x05}, 4096)
+	assert.ErrorIs(t, err, compression.ErrCorrupt)
+
+	// A literal run longer than the remaining input.
+	_, err = compression.Decompress(compression.LZ, []byte{0x10, 'a'}, 4096)
+	assert.ErrorIs(t, err, compression.ErrCorrupt)
+
+	_, err = compression.Decompress(compression.Flate, []byte("not deflate"), 4096)
+	assert.ErrorIs(t, err, compression.ErrCorrupt)
+
+	// Output larger than the limit.
+	compressed, err := compression.Compress(compression.LZ, make([]byte, 1000))
+	require.NoError(t, err)
+	_, err = compression.Decompress(compression.LZ, compressed, 999)
+	assert.ErrorIs(t, err, compression.ErrCorrupt)
+}
+
+func TestParseCodec(t *testing.T) {
+	for _, codec := range codecs {
+		parsed, err := compression.ParseCodec(codec.String())
+		require.NoError(t, err)
+		assert.Equal(t, codec, parsed)
+	}
+
+	parsed, err := compression.ParseCodec("")
+	require.NoError(t, err)
+	assert.Equal(t, compression.None, parsed)
+
+	_, err = compression.ParseCodec("brotli")
+	assert.Error(t, err)
+}
+
+func BenchmarkCompress(b *testing.B) {
+	input := pageOfJSON()
+	for _, codec := range codecs {
+		b.Run(codec.String(), func(b *testing.B) {
+			var compressed []byte
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				compressed, _ = compression.Compress(codec, input)
+			}
+			b.ReportMetric(float64(len(input))/float64(len(compressed)), "ratio")
+			b.ReportMetric(float64(len(compressed)), "bytes/page")
+		})
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	input := pageOfJSON()
+	for _, codec := range codecs {
+		compressed, _ := compression.Compress(codec, input)
+		b.Run(codec.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if _, err := compression.Decompress(codec, compressed, len(input)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
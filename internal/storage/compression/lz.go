@@ -0,0 +1,99 @@
+package compression
+
+import "encoding/binary"
+
+// The LZ format is a sequence of elements, each starting with a tag byte:
+//
+//	0xxxxxxx  literal run of x+1 bytes (1..128) that follow the tag
+//	1xxxxxxx  copy of x+4 bytes (4..131) from an earlier position; a uvarint
+//	          backwards offset follows the tag
+//
+// Copies may overlap the bytes they produce, which encodes runs cheaply.
+const (
+	lzMinMatch   = 4
+	lzMaxMatch   = lzMinMatch + 0x7f
+	lzMaxLiteral = 0x80
+	lzHashBits   = 14
+)
+
+func lzHash(v uint32) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+// lzEncode greedily replaces repeated 4-byte sequences with copies, using a hash
+// table of the last position each sequence was seen at.
+func lzEncode(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	var table [1 << lzHashBits]int32 // Position+1 of the last occurrence; 0 means empty.
+
+	literalStart := 0
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(v)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i++
+			continue
+		}
+
+		n := lzMinMatch
+		for i+n < len(src) && n < lzMaxMatch && src[candidate+n] == src[i+n] {
+			n++
+		}
+
+		dst = lzAppendLiterals(dst, src[literalStart:i])
+		dst = append(dst, 0x80|byte(n-lzMinMatch))
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+
+		i += n
+		literalStart = i
+	}
+
+	return lzAppendLiterals(dst, src[literalStart:])
+}
+
+func lzAppendLiterals(dst, literals []byte) []byte {
+	for len(literals) > 0 {
+		n := min(len(literals), lzMaxLiteral)
+		dst = append(dst, byte(n-1))
+		dst = append(dst, literals[:n]...)
+		literals = literals[n:]
+	}
+	return dst
+}
+
+func lzDecode(src []byte, limit int) ([]byte, error) {
+	dst := make([]byte, 0, min(limit, 4*len(src)))
+
+	for i := 0; i < len(src); {
+		tag := src[i]
+		i++
+
+		if tag&0x80 == 0 {
+			n := int(tag) + 1
+			if i+n > len(src) || len(dst)+n > limit {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[i:i+n]...)
+			i += n
+			continue
+		}
+
+		n := int(tag&0x7f) + lzMinMatch
+		offset, width := binary.Uvarint(src[i:])
+		if width <= 0 || offset == 0 || offset > uint64(len(dst)) || len(dst)+n > limit {
+			return nil, ErrCorrupt
+		}
+		i += width
+
+		start := len(dst) - int(offset)
+		for k := 0; k < n; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+
+	return dst, nil
+}
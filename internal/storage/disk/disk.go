@@ -4,7 +4,8 @@ package disk
 // It abstracts the underlying storage mechanism and provides a consistent interface for managing pages.
 type DiskManager interface {
 	// AllocatePage allocates a new page and returns it.
-	// The page is assigned a unique ID.
+	// The page is assigned a unique ID. Free pages are reused lowest ID first,
+	// which keeps live data toward the start of the storage.
 	AllocatePage() (Page, error)
 
 	// WritePage writes the given page to the storage medium.
@@ -20,6 +21,13 @@ type DiskManager interface {
 	// FreePage adds the page ID back to the freelist, making it available for future allocation.
 	FreePage(id int32)
 
+	// Truncate shrinks the storage to its first numPages pages and forgets the free
+	// pages beyond it. The caller must ensure none of the discarded pages are in use.
+	Truncate(numPages int32) error
+
+	// Sync flushes all written pages to stable storage.
+	Sync() error
+
 	// Close closes the DiskManager, releasing any open resources.
 	Close() error
 }
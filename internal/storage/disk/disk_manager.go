@@ -3,40 +3,67 @@
 package disk
 
 import (
+	"encoding/binary"
+	"fmt"
 	"os"
 	"sync"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
 	"github.com/rafaelmgr12/litegodb/internal/storage/freelist"
 )
 
 // FileDiskManager is a concrete implementation of the DiskManager interface.
 // It uses a file to persist pages.
 type FileDiskManager struct {
-	file   *os.File
-	mu     sync.Mutex
-	fl     *freelist.Freelist
-	nextID int32
+	file     *os.File
+	mu       sync.Mutex
+	fl       *freelist.Freelist
+	nextID   int32
+	cipher   *encryption.Cipher // nil when pages are stored in plaintext.
+	slotSize int64              // Size of a page on disk, including encryption overhead.
 }
 
 // NewFileDiskManager creates a new FileDiskManager instance.
 // It initializes the storage file and determines the next available page ID.
 func NewFileDiskManager(filePath string) (*FileDiskManager, error) {
+	return newFileDiskManager(filePath, nil)
+}
+
+// NewEncryptedFileDiskManager creates a FileDiskManager that encrypts every page with the given cipher.
+// Each page is authenticated together with its ID, so a page copied to another slot fails to read.
+// A new slot is written with an encrypted empty page when it is allocated, so no slot legitimately
+// holds zeros, and a zeroed slot fails to read too.
+func NewEncryptedFileDiskManager(filePath string, c *encryption.Cipher) (*FileDiskManager, error) {
+	if c == nil {
+		return nil, fmt.Errorf("encrypted disk manager requires a cipher")
+	}
+	return newFileDiskManager(filePath, c)
+}
+
+func newFileDiskManager(filePath string, c *encryption.Cipher) (*FileDiskManager, error) {
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	slotSize := int64(PageSize)
+	if c != nil {
+		slotSize += int64(c.Overhead())
+	}
+
 	// Calculate the next ID based on the file size.
 	info, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	nextID := int32(info.Size() / PageSize)
+	nextID := int32(info.Size() / slotSize)
 	return &FileDiskManager{
-		file:   file,
-		fl:     freelist.NewFreelist(),
-		nextID: nextID,
+		file:     file,
+		fl:       freelist.NewFreelist(),
+		nextID:   nextID,
+		cipher:   c,
+		slotSize: slotSize,
 	}, nil
 }
 
@@ -52,15 +79,17 @@ func (dm *FileDiskManager) AllocatePage() (Page, error) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
-	var pageID int32
-	if id, ok := dm.fl.GetFreePage(); ok {
-		pageID = id
-	} else {
-		pageID = dm.nextID
-		dm.nextID++
+	if id, ok := dm.fl.GetLowestFreePage(); ok {
+		return NewFilePage(id), nil
 	}
 
-	page := NewFilePage(pageID)
+	page := NewFilePage(dm.nextID)
+	if dm.cipher != nil {
+		if err := dm.writePage(page); err != nil {
+			return nil, err
+		}
+	}
+	dm.nextID++
 	return page, nil
 }
 
@@ -68,13 +97,24 @@ func (dm *FileDiskManager) AllocatePage() (Page, error) {
 func (dm *FileDiskManager) WritePage(page Page) error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
+	return dm.writePage(page)
+}
 
+// writePage writes a page to its slot. The caller holds mu.
+func (dm *FileDiskManager) writePage(page Page) error {
 	data, err := page.Serialize()
 	if err != nil {
 		return err
 	}
 
-	offset := int64(page.ID()) * PageSize
+	if dm.cipher != nil {
+		data, err = dm.cipher.Seal(data, pageAAD(page.ID()))
+		if err != nil {
+			return err
+		}
+	}
+
+	offset := int64(page.ID()) * dm.slotSize
 	_, err = dm.file.WriteAt(data, offset)
 	return err
 }
@@ -84,14 +124,25 @@ func (dm *FileDiskManager) ReadPage(id int32) (Page, error) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
-	offset := int64(id) * PageSize
-	data := make([]byte, PageSize)
+	offset := int64(id) * dm.slotSize
+	data := make([]byte, dm.slotSize)
 	_, err := dm.file.ReadAt(data, offset)
 	if err != nil {
 		return nil, err
 	}
 
 	page := NewFilePage(id)
+	if dm.cipher != nil {
+		// Allocation writes every slot, so zeros are not a page but a page wiped out.
+		if isZero(data) {
+			return nil, fmt.Errorf("page %d: zeroed slot: %w", id, encryption.ErrAuthFailed)
+		}
+		data, err = dm.cipher.Open(data, pageAAD(id))
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", id, err)
+		}
+	}
+
 	err = page.Deserialize(data)
 	if err != nil {
 		return nil, err
@@ -114,7 +165,44 @@ func (dm *FileDiskManager) FreePage(id int32) {
 	dm.fl.Add(id)
 }
 
+// Truncate shrinks the file to its first numPages pages.
+func (dm *FileDiskManager) Truncate(numPages int32) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if numPages < 0 || numPages > dm.nextID {
+		return fmt.Errorf("cannot truncate to %d pages, file has %d", numPages, dm.nextID)
+	}
+	if err := dm.file.Truncate(int64(numPages) * dm.slotSize); err != nil {
+		return err
+	}
+	dm.nextID = numPages
+	dm.fl.RemoveFrom(numPages)
+	return nil
+}
+
+// Sync commits the contents of the file to stable storage.
+func (dm *FileDiskManager) Sync() error {
+	return dm.file.Sync()
+}
+
 // Close closes the underlying file.
 func (dm *FileDiskManager) Close() error {
 	return dm.file.Close()
 }
+
+// pageAAD returns the additional authenticated data binding an encrypted page to its slot.
+func pageAAD(id int32) []byte {
+	aad := make([]byte, 4)
+	binary.LittleEndian.PutUint32(aad, uint32(id))
+	return aad
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -1,10 +1,14 @@
 package disk_test
 
 import (
+	"bytes"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
 )
 
 func setupFileDiskManager(t *testing.T) (*disk.FileDiskManager, func()) {
@@ -120,3 +124,205 @@ func TestFreePage(t *testing.T) {
 		t.Fatalf("expected page ID %d, got %d", page.ID(), freePage.ID())
 	}
 }
+
+func TestTruncate(t *testing.T) {
+	dm, cleanup := setupFileDiskManager(t)
+	defer cleanup()
+
+	for i := 0; i < 4; i++ {
+		page, err := dm.AllocatePage()
+		if err != nil {
+			t.Fatalf("error allocating page: %v", err)
+		}
+		if err := dm.WritePage(page); err != nil {
+			t.Fatalf("error writing page: %v", err)
+		}
+	}
+	dm.FreePage(1)
+	dm.FreePage(3)
+
+	if err := dm.Truncate(2); err != nil {
+		t.Fatalf("error truncating: %v", err)
+	}
+	if last := dm.GetLastAllocatedPageID(); last != 1 {
+		t.Fatalf("expected last allocated page 1, got %d", last)
+	}
+	if _, err := dm.ReadPage(2); err == nil {
+		t.Fatalf("expected reading a truncated page to fail")
+	}
+
+	// Page 1 is still free; page 3 is gone with the truncated tail.
+	page, err := dm.AllocatePage()
+	if err != nil {
+		t.Fatalf("error allocating page: %v", err)
+	}
+	if page.ID() != 1 {
+		t.Fatalf("expected page ID 1, got %d", page.ID())
+	}
+	page, err = dm.AllocatePage()
+	if err != nil {
+		t.Fatalf("error allocating page: %v", err)
+	}
+	if page.ID() != 2 {
+		t.Fatalf("expected page ID 2, got %d", page.ID())
+	}
+
+	if err := dm.Truncate(10); err == nil {
+		t.Fatalf("expected truncating beyond the end to fail")
+	}
+}
+
+func setupEncryptedDiskManager(t *testing.T, path string, key byte) *disk.FileDiskManager {
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{key}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("error creating cipher: %v", err)
+	}
+	dm, err := disk.NewEncryptedFileDiskManager(path, c)
+	if err != nil {
+		t.Fatalf("error creating disk manager: %v", err)
+	}
+	return dm
+}
+
+func TestEncryptedWriteReadPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	dm := setupEncryptedDiskManager(t, path, 1)
+
+	page, _ := dm.AllocatePage()
+	data := []byte("customer secret")
+	page.SetData(data)
+	if err := dm.WritePage(page); err != nil {
+		t.Fatalf("error writing page: %v", err)
+	}
+	dm.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if bytes.Contains(raw, data) {
+		t.Fatalf("expected page data to be encrypted on disk")
+	}
+
+	dm = setupEncryptedDiskManager(t, path, 1)
+	defer dm.Close()
+
+	if dm.NextID() != 1 {
+		t.Fatalf("expected next ID 1 after reopen, got %d", dm.NextID())
+	}
+
+	readPage, err := dm.ReadPage(page.ID())
+	if err != nil {
+		t.Fatalf("error reading page: %v", err)
+	}
+	if string(readPage.Data()[:len(data)]) != string(data) {
+		t.Errorf("Expected data %s, got %s", data, readPage.Data())
+	}
+}
+
+func TestEncryptedReadWithWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	dm := setupEncryptedDiskManager(t, path, 1)
+
+	page, _ := dm.AllocatePage()
+	page.SetData([]byte("customer secret"))
+	if err := dm.WritePage(page); err != nil {
+		t.Fatalf("error writing page: %v", err)
+	}
+	dm.Close()
+
+	dm = setupEncryptedDiskManager(t, path, 2)
+	defer dm.Close()
+
+	if _, err := dm.ReadPage(page.ID()); !errors.Is(err, encryption.ErrAuthFailed) {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+}
+
+func TestEncryptedPageSwapIsDetected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	dm := setupEncryptedDiskManager(t, path, 1)
+
+	for _, text := range []string{"page zero", "page one"} {
+		page, _ := dm.AllocatePage()
+		page.SetData([]byte(text))
+		if err := dm.WritePage(page); err != nil {
+			t.Fatalf("error writing page: %v", err)
+		}
+	}
+	dm.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	slot := len(raw) / 2
+	swapped := append(append([]byte{}, raw[slot:]...), raw[:slot]...)
+	if err := os.WriteFile(path, swapped, 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	dm = setupEncryptedDiskManager(t, path, 1)
+	defer dm.Close()
+
+	for id := int32(0); id < 2; id++ {
+		if _, err := dm.ReadPage(id); !errors.Is(err, encryption.ErrAuthFailed) {
+			t.Fatalf("expected swapped page %d to fail authentication, got %v", id, err)
+		}
+	}
+}
+
+func TestEncryptedUnwrittenPageReadsEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	dm := setupEncryptedDiskManager(t, path, 1)
+	defer dm.Close()
+
+	first, _ := dm.AllocatePage()
+	second, _ := dm.AllocatePage()
+	second.SetData([]byte("written"))
+	if err := dm.WritePage(second); err != nil {
+		t.Fatalf("error writing page: %v", err)
+	}
+
+	page, err := dm.ReadPage(first.ID())
+	if err != nil {
+		t.Fatalf("error reading unwritten page: %v", err)
+	}
+	if !bytes.Equal(page.Data(), make([]byte, disk.PageSize)) {
+		t.Fatalf("expected unwritten page to be empty")
+	}
+}
+
+func TestEncryptedZeroedPageIsDetected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+	dm := setupEncryptedDiskManager(t, path, 1)
+
+	for _, text := range []string{"page zero", "page one"} {
+		page, _ := dm.AllocatePage()
+		page.SetData([]byte(text))
+		if err := dm.WritePage(page); err != nil {
+			t.Fatalf("error writing page: %v", err)
+		}
+	}
+	dm.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	slot := len(raw) / 2
+	copy(raw[:slot], make([]byte, slot))
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	dm = setupEncryptedDiskManager(t, path, 1)
+	defer dm.Close()
+
+	if _, err := dm.ReadPage(0); !errors.Is(err, encryption.ErrAuthFailed) {
+		t.Fatalf("expected zeroed page to fail authentication, got %v", err)
+	}
+	if _, err := dm.ReadPage(1); err != nil {
+		t.Fatalf("error reading intact page: %v", err)
+	}
+}
@@ -1,18 +1,32 @@
 package disk
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 )
 
 const PageSize = 4096
 
+// pageHeaderSize is the size of the header at the start of every serialized page:
+// page ID (4 bytes), codec (1 byte), reserved (3 bytes) and stored payload length (4 bytes).
+const pageHeaderSize = 12
+
+// MaxPageDataSize is the largest payload a page can store uncompressed.
+const MaxPageDataSize = PageSize - pageHeaderSize
+
+// MaxCompressedPageDataSize is the largest logical payload a page with a codec may hold.
+// Such a page can only be written if its data compresses to at most MaxPageDataSize bytes.
+const MaxCompressedPageDataSize = 4 * PageSize
+
 // FilePage is a concrete implementation of the Page interface.
 // It stores a fixed-size structure that supports serialization and deserialization.
 type FilePage struct {
-	id   int32  // Unique identifier of the page.
-	data []byte // Data stored in the page.
+	id    int32             // Unique identifier of the page.
+	data  []byte            // Data stored in the page.
+	size  int               // Number of meaningful bytes in data.
+	codec compression.Codec // Codec used to compress data when the page is serialized.
 }
 
 // NewFilePage creates a new empty page with the given ID.
@@ -39,25 +53,62 @@ func (p *FilePage) Data() []byte {
 	return p.data
 }
 
+// Codec returns the codec used to compress the page on disk.
+func (p *FilePage) Codec() compression.Codec {
+	return p.codec
+}
+
+// SetCodec selects the codec used to compress the page when it is serialized.
+// It must be called before SetData to store more than PageSize bytes.
+func (p *FilePage) SetCodec(codec compression.Codec) {
+	p.codec = codec
+}
+
 // SetData sets the data for the page.
-// If the data exceeds the fixed page size, it panics.
+// If the data exceeds the fixed page size, it panics. Pages with a codec
+// may instead hold up to MaxCompressedPageDataSize bytes.
 func (p *FilePage) SetData(data []byte) {
-	if len(data) > PageSize {
+	limit := PageSize
+	if p.codec != compression.None {
+		limit = MaxCompressedPageDataSize
+	}
+	if len(data) > limit {
 		panic(fmt.Sprintf("data exceeds page size: %d bytes", len(data)))
 	}
-	copy(p.data, data)
+	if len(data) > len(p.data) {
+		p.data = make([]byte, len(data))
+	}
+	n := copy(p.data, data)
+	clear(p.data[n:])
+	p.size = len(data)
 }
 
 // Serialize converts the page into a byte slice for storage.
-// The first part of the slice contains the page ID, followed by the page data.
+// The slice starts with the page header followed by the payload, compressed with
+// the page codec when that makes it smaller. Data that does not compress is stored as is.
 func (p *FilePage) Serialize() ([]byte, error) {
-	buffer := make([]byte, PageSize)
-	idBuffer := make([]byte, 4)
+	payload := p.data[:p.size]
+	codec := compression.None
 
-	binary.LittleEndian.PutUint32(idBuffer, uint32(p.id))
-	copy(buffer[:4], idBuffer)
+	if p.codec != compression.None && len(payload) > 0 {
+		compressed, err := compression.Compress(p.codec, payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(payload) {
+			payload, codec = compressed, p.codec
+		}
+	}
 
-	copy(buffer[4:], p.data)
+	if len(payload) > MaxPageDataSize {
+		return nil, fmt.Errorf("page %d: %d bytes (%s) exceed page capacity of %d bytes", p.id, len(payload), codec, MaxPageDataSize)
+	}
+
+	buffer := make([]byte, PageSize)
+	binary.LittleEndian.PutUint32(buffer[0:4], uint32(p.id))
+	buffer[4] = byte(codec)
+	binary.LittleEndian.PutUint32(buffer[8:12], uint32(len(payload)))
+	copy(buffer[pageHeaderSize:], payload)
 
 	return buffer, nil
 }
@@ -68,13 +119,22 @@ func (p *FilePage) Deserialize(data []byte) error {
 	if len(data) != PageSize {
 		return fmt.Errorf("invalid page size: expected %d, got %d", PageSize, len(data))
 	}
-	buffer := bytes.NewReader(data)
-	if err := binary.Read(buffer, binary.LittleEndian, &p.id); err != nil {
-		return err
+
+	id := int32(binary.LittleEndian.Uint32(data[0:4]))
+	codec := compression.Codec(data[4])
+	length := int(binary.LittleEndian.Uint32(data[8:12]))
+	if length > MaxPageDataSize {
+		return fmt.Errorf("page %d: invalid payload length %d", id, length)
 	}
-	p.data = make([]byte, PageSize)
-	if _, err := buffer.Read(p.data); err != nil {
-		return err
+
+	payload, err := compression.Decompress(codec, data[pageHeaderSize:pageHeaderSize+length], MaxCompressedPageDataSize)
+	if err != nil {
+		return fmt.Errorf("page %d: %w", id, err)
 	}
+
+	p.id = id
+	p.codec = codec
+	p.data = make([]byte, max(PageSize, len(payload)))
+	p.size = copy(p.data, payload)
 	return nil
 }
@@ -1,8 +1,12 @@
 package disk_test
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
 	"testing"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
 )
 
@@ -72,3 +76,99 @@ func TestSerializeDeserialize(t *testing.T) {
 		t.Errorf("Expected data %s, got %s", data, newPage.Data())
 	}
 }
+
+func TestSerializeDeserializeCompressed(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"name":"litegodb","active":true}`), 300) // Larger than a page.
+
+	for _, codec := range []compression.Codec{compression.LZ, compression.Flate} {
+		page := disk.NewFilePage(7)
+		page.SetCodec(codec)
+		page.SetData(data)
+
+		serialized, err := page.Serialize()
+		if err != nil {
+			t.Fatalf("Serialize failed for %s: %s", codec, err)
+		}
+		if len(serialized) != disk.PageSize {
+			t.Fatalf("expected serialized page of %d bytes, got %d", disk.PageSize, len(serialized))
+		}
+
+		newPage := disk.NewFilePage(0)
+		if err := newPage.Deserialize(serialized); err != nil {
+			t.Fatalf("Deserialize failed for %s: %s", codec, err)
+		}
+		if newPage.ID() != 7 || newPage.Codec() != codec {
+			t.Errorf("expected page 7 with codec %s, got page %d with codec %s", codec, newPage.ID(), newPage.Codec())
+		}
+		if !bytes.Equal(newPage.Data()[:len(data)], data) {
+			t.Errorf("data mismatch after round trip with codec %s", codec)
+		}
+	}
+}
+
+func TestSerializeIncompressibleDataIsStoredRaw(t *testing.T) {
+	data := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	page := disk.NewFilePage(1)
+	page.SetCodec(compression.LZ)
+	page.SetData(data)
+
+	serialized, err := page.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize failed: %s", err)
+	}
+
+	newPage := disk.NewFilePage(0)
+	if err := newPage.Deserialize(serialized); err != nil {
+		t.Fatalf("Deserialize failed: %s", err)
+	}
+	if newPage.Codec() != compression.None {
+		t.Errorf("expected incompressible page to be stored raw, got codec %s", newPage.Codec())
+	}
+	if !bytes.Equal(newPage.Data()[:len(data)], data) {
+		t.Errorf("data mismatch after round trip")
+	}
+}
+
+func TestSerializeRejectsOversizedPayload(t *testing.T) {
+	page := disk.NewFilePage(1)
+	page.SetData(make([]byte, disk.PageSize))
+	if _, err := page.Serialize(); err == nil {
+		t.Errorf("expected uncompressed page larger than %d bytes to fail", disk.MaxPageDataSize)
+	}
+
+	random := make([]byte, disk.PageSize*2)
+	rand.New(rand.NewSource(1)).Read(random)
+	page = disk.NewFilePage(1)
+	page.SetCodec(compression.Flate)
+	page.SetData(random)
+	if _, err := page.Serialize(); err == nil {
+		t.Errorf("expected incompressible data larger than a page to fail")
+	}
+}
+
+func BenchmarkSerializeJSONPage(b *testing.B) {
+	var data []byte
+	for i := 0; len(data) < 3*disk.PageSize; i++ {
+		data = append(data, fmt.Sprintf(`{"id":%d,"email":"customer%d@example.com","plan":"pro","tags":["newsletter","beta"]}`, i, i*7919%100000)...)
+	}
+
+	for _, codec := range []compression.Codec{compression.LZ, compression.Flate} {
+		b.Run(codec.String(), func(b *testing.B) {
+			page := disk.NewFilePage(1)
+			page.SetCodec(codec)
+			page.SetData(data)
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				serialized, err := page.Serialize()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := disk.NewFilePage(0).Deserialize(serialized); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+)
+
+// Rekey re-encrypts every page of the database file at path, replacing oldCipher with newCipher.
+// Either cipher may be nil to convert a plaintext file to an encrypted one or back.
+// The file is rewritten into a temporary copy which replaces the original only once it is complete,
+// so the database must not be open while Rekey runs.
+func Rekey(path string, oldCipher, newCipher *encryption.Cipher) error {
+	src, err := newFileDiskManager(path, oldCipher)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := path + ".rekey"
+	_ = os.Remove(tmpPath)
+
+	dst, err := newFileDiskManager(tmpPath, newCipher)
+	if err != nil {
+		return err
+	}
+
+	if err := copyPages(src, dst); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := dst.file.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func copyPages(src, dst *FileDiskManager) error {
+	for id := int32(0); id < src.NextID(); id++ {
+		page, err := src.ReadPage(id)
+		if err != nil {
+			return fmt.Errorf("failed to read page %d: %w", id, err)
+		}
+		// Unwritten plaintext slots deserialize with ID 0; keep them in place.
+		page.SetId(id)
+		if err := dst.WritePage(page); err != nil {
+			return fmt.Errorf("failed to write page %d: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package disk_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+)
+
+func newTestCipher(t *testing.T, key byte) *encryption.Cipher {
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{key}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("error creating cipher: %v", err)
+	}
+	return c
+}
+
+func TestRekey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rekey.db")
+
+	dm, err := disk.NewFileDiskManager(path)
+	if err != nil {
+		t.Fatalf("error creating disk manager: %v", err)
+	}
+	texts := []string{"alpha", "beta", "gamma"}
+	for _, text := range texts {
+		page, _ := dm.AllocatePage()
+		page.SetData([]byte(text))
+		if err := dm.WritePage(page); err != nil {
+			t.Fatalf("error writing page: %v", err)
+		}
+	}
+	dm.Close()
+
+	oldCipher := newTestCipher(t, 1)
+	newCipher := newTestCipher(t, 2)
+
+	// Encrypt the plaintext file, then rotate to a new key.
+	if err := disk.Rekey(path, nil, oldCipher); err != nil {
+		t.Fatalf("error encrypting file: %v", err)
+	}
+	if err := disk.Rekey(path, oldCipher, newCipher); err != nil {
+		t.Fatalf("error rotating key: %v", err)
+	}
+
+	if err := disk.Rekey(path, oldCipher, newCipher); !errors.Is(err, encryption.ErrAuthFailed) {
+		t.Fatalf("expected rekey with a stale key to fail authentication, got %v", err)
+	}
+
+	dm, err = disk.NewEncryptedFileDiskManager(path, newCipher)
+	if err != nil {
+		t.Fatalf("error reopening disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	for i, text := range texts {
+		page, err := dm.ReadPage(int32(i))
+		if err != nil {
+			t.Fatalf("error reading page %d: %v", i, err)
+		}
+		if string(page.Data()[:len(text)]) != text {
+			t.Errorf("expected page %d to hold %q, got %q", i, text, page.Data()[:len(text)])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package encryption provides the authenticated encryption used to protect
+// pages and log records at rest.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size in bytes of an AES-256 key.
+const KeySize = 32
+
+// ErrAuthFailed is returned when a ciphertext fails authentication, either
+// because it was tampered with, bound to different additional data, or sealed
+// with another key.
+var ErrAuthFailed = errors.New("encryption: message authentication failed")
+
+// Cipher seals and opens messages with AES-GCM.
+// Every message gets a fresh random nonce which is stored in front of the ciphertext.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a Cipher from a 16, 24 or 32 byte AES key.
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: invalid key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Overhead returns the number of bytes a sealed message is longer than its plaintext.
+func (c *Cipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// Seal encrypts and authenticates plaintext, binding it to additionalData.
+// The returned slice is laid out as nonce || ciphertext || tag.
+func (c *Cipher) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open authenticates and decrypts a message produced by Seal.
+// The same additionalData used to seal the message must be supplied.
+func (c *Cipher) Open(sealed, additionalData []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize+c.aead.Overhead() {
+		return nil, ErrAuthFailed
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
+
+// LoadKey reads an encryption key from the file at path or, when path is empty,
+// from the environment variable envVar. It returns a nil key when neither is set.
+func LoadKey(path, envVar string) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: failed to read key file: %w", err)
+		}
+		return ParseKey(data)
+	}
+
+	if envVar != "" {
+		value, ok := os.LookupEnv(envVar)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("encryption: environment variable %s is not set", envVar)
+		}
+		return ParseKey([]byte(value))
+	}
+
+	return nil, nil
+}
+
+// ParseKey decodes a KeySize key given as hex or base64, ignoring surrounding whitespace,
+// or as raw bytes. Text is never taken for a raw key, even when it is KeySize bytes long,
+// such as a passphrase or a key with a trailing newline: raw keys are binary, as read from
+// a key file of random bytes.
+func ParseKey(data []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if len(data) == KeySize && !isText(data) {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("encryption: key must be %d bytes encoded as hex or base64, or raw binary bytes", KeySize)
+}
+
+// isText reports whether data holds only printable ASCII and whitespace.
+func isText(data []byte) bool {
+	for _, b := range data {
+		if (b < 0x20 || b > 0x7e) && b != '\t' && b != '\n' && b != '\r' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package encryption_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, encryption.KeySize)
+}
+
+func TestSealOpen(t *testing.T) {
+	c, err := encryption.NewCipher(testKey(1))
+	require.NoError(t, err)
+
+	plaintext := []byte("customer data")
+	sealed, err := c.Seal(plaintext, []byte("page-1"))
+	require.NoError(t, err)
+	assert.Len(t, sealed, len(plaintext)+c.Overhead())
+	assert.False(t, bytes.Contains(sealed, plaintext))
+
+	opened, err := c.Open(sealed, []byte("page-1"))
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, opened)
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	c, err := encryption.NewCipher(testKey(1))
+	require.NoError(t, err)
+
+	sealed, err := c.Seal([]byte("customer data"), []byte("page-1"))
+	require.NoError(t, err)
+
+	_, err = c.Open(sealed, []byte("page-2"))
+	assert.ErrorIs(t, err, encryption.ErrAuthFailed)
+
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = c.Open(sealed, []byte("page-1"))
+	assert.ErrorIs(t, err, encryption.ErrAuthFailed)
+
+	_, err = c.Open([]byte("short"), nil)
+	assert.ErrorIs(t, err, encryption.ErrAuthFailed)
+
+	other, err := encryption.NewCipher(testKey(2))
+	require.NoError(t, err)
+	sealed, err = c.Seal([]byte("customer data"), nil)
+	require.NoError(t, err)
+	_, err = other.Open(sealed, nil)
+	assert.ErrorIs(t, err, encryption.ErrAuthFailed)
+}
+
+func TestLoadKey(t *testing.T) {
+	key := testKey(7)
+
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600))
+
+	loaded, err := encryption.LoadKey(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+
+	t.Setenv("LITEGODB_TEST_KEY", base64.StdEncoding.EncodeToString(key))
+	loaded, err = encryption.LoadKey("", "LITEGODB_TEST_KEY")
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+
+	loaded, err = encryption.LoadKey("", "")
+	require.NoError(t, err)
+	assert.Nil(t, loaded)
+
+	_, err = encryption.LoadKey("", "LITEGODB_TEST_MISSING_KEY")
+	assert.Error(t, err)
+
+	_, err = encryption.ParseKey([]byte("too short"))
+	assert.Error(t, err)
+
+	// Text of KeySize bytes is not a raw key: not a 32-character passphrase, nor a
+	// 31-character one ending in a newline.
+	_, err = encryption.ParseKey([]byte("correct horse battery staple 123"))
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("correct horse battery staple 12\n"), 0600))
+	_, err = encryption.LoadKey(path, "")
+	assert.Error(t, err)
+
+	// A binary key file is read as raw bytes.
+	require.NoError(t, os.WriteFile(path, key, 0600))
+	loaded, err = encryption.LoadKey(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, key, loaded)
+}
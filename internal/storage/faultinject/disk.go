@@ -0,0 +1,211 @@
+package faultinject
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+)
+
+// DiskManager is a disk.DiskManager whose unsynced page writes are subject to the
+// crashes of its Injector.
+type DiskManager struct {
+	in *Injector
+	dm disk.DiskManager
+
+	// Pages written since the last sync, in order, and the content each page had
+	// at the last sync. A page that did not exist yet has an empty image.
+	pending []pageWrite
+	base    map[int32]pageImage
+}
+
+type pageWrite struct {
+	id    int32
+	image pageImage
+}
+
+// pageImage is a copy of the content of a page.
+type pageImage struct {
+	codec compression.Codec
+	data  []byte
+}
+
+// imageOf copies the content of a page. Page data is padded with zeros up to the page
+// size, so trailing zeros are left out; reading the page back pads it the same way.
+func imageOf(page disk.Page) pageImage {
+	var codec compression.Codec
+	if p, ok := page.(interface{ Codec() compression.Codec }); ok {
+		codec = p.Codec()
+	}
+	data := bytes.TrimRight(page.Data(), "\x00")
+	return pageImage{codec: codec, data: append([]byte(nil), data...)}
+}
+
+func (img pageImage) page(id int32) disk.Page {
+	page := disk.NewFilePage(id)
+	page.SetCodec(img.codec)
+	if img.data != nil {
+		page.SetData(img.data)
+	}
+	return page
+}
+
+// AllocatePage allocates a page from the wrapped disk manager.
+func (d *DiskManager) AllocatePage() (disk.Page, error) {
+	d.in.mu.Lock()
+	defer d.in.mu.Unlock()
+	if d.in.crashed {
+		return nil, ErrCrashed
+	}
+	return d.dm.AllocatePage()
+}
+
+// WritePage writes the page through to the wrapped disk manager and remembers it until the next Sync.
+func (d *DiskManager) WritePage(page disk.Page) error {
+	d.in.mu.Lock()
+	defer d.in.mu.Unlock()
+	if d.in.crashed {
+		return ErrCrashed
+	}
+
+	id := page.ID()
+	if _, ok := d.base[id]; !ok {
+		var img pageImage
+		if old, err := d.dm.ReadPage(id); err == nil {
+			img = imageOf(old)
+		}
+		d.base[id] = img
+	}
+
+	if err := d.dm.WritePage(page); err != nil {
+		return err
+	}
+	d.pending = append(d.pending, pageWrite{id: id, image: imageOf(page)})
+
+	if d.in.write() {
+		d.in.crashLocked(d.in.fault)
+		return ErrCrashed
+	}
+	return nil
+}
+
+// ReadPage reads a page from the wrapped disk manager.
+func (d *DiskManager) ReadPage(id int32) (disk.Page, error) {
+	d.in.mu.Lock()
+	defer d.in.mu.Unlock()
+	if d.in.crashed {
+		return nil, ErrCrashed
+	}
+	return d.dm.ReadPage(id)
+}
+
+// GetLastAllocatedPageID returns the last page ID allocated by the wrapped disk manager.
+func (d *DiskManager) GetLastAllocatedPageID() int32 {
+	return d.dm.GetLastAllocatedPageID()
+}
+
+// FreePage returns a page to the freelist of the wrapped disk manager.
+func (d *DiskManager) FreePage(id int32) {
+	d.dm.FreePage(id)
+}
+
+// Truncate truncates the wrapped disk manager. Remembered writes to the discarded pages are forgotten.
+func (d *DiskManager) Truncate(numPages int32) error {
+	d.in.mu.Lock()
+	defer d.in.mu.Unlock()
+	if d.in.crashed {
+		return ErrCrashed
+	}
+
+	if err := d.dm.Truncate(numPages); err != nil {
+		return err
+	}
+	pending := d.pending[:0]
+	for _, w := range d.pending {
+		if w.id < numPages {
+			pending = append(pending, w)
+		}
+	}
+	d.pending = pending
+	for id := range d.base {
+		if id >= numPages {
+			delete(d.base, id)
+		}
+	}
+	return nil
+}
+
+// Sync syncs the wrapped disk manager, making every write so far survive a crash.
+func (d *DiskManager) Sync() error {
+	d.in.mu.Lock()
+	defer d.in.mu.Unlock()
+	if d.in.crashed {
+		return ErrCrashed
+	}
+
+	if err := d.dm.Sync(); err != nil {
+		return err
+	}
+	d.pending = nil
+	clear(d.base)
+	return nil
+}
+
+// Close closes the wrapped disk manager.
+func (d *DiskManager) Close() error {
+	d.in.mu.Lock()
+	defer d.in.mu.Unlock()
+	if d.in.crashed {
+		// The crash already closed it.
+		return nil
+	}
+	return d.dm.Close()
+}
+
+// crash rewrites every page written since the last sync with the content the fault leaves
+// it with, then closes the wrapped disk manager.
+func (d *DiskManager) crash(fault Fault, rng *rand.Rand) error {
+	kept, torn := keep(fault, len(d.pending), rng)
+
+	final := make(map[int32]pageImage, len(d.base))
+	for id, img := range d.base {
+		final[id] = img
+	}
+	for i, w := range d.pending {
+		switch {
+		case i == torn:
+			final[w.id] = tear(final[w.id], w.image, rng)
+		case kept[i]:
+			final[w.id] = w.image
+		}
+	}
+
+	var firstErr error
+	for id, img := range final {
+		if err := d.dm.WritePage(img.page(id)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := d.dm.Sync(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := d.dm.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	d.pending = nil
+	clear(d.base)
+	return firstErr
+}
+
+// tear returns the content of a page whose write of next over prev stopped part way.
+func tear(prev, next pageImage, rng *rand.Rand) pageImage {
+	data := make([]byte, max(len(prev.data), len(next.data)))
+	copy(data, prev.data)
+	cut := rng.Intn(len(next.data) + 1)
+	copy(data[:cut], next.data[:cut])
+	if next.codec == compression.None && len(data) > disk.MaxPageDataSize {
+		data = data[:disk.MaxPageDataSize]
+	}
+	return pageImage{codec: next.codec, data: data}
+}
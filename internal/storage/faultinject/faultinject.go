@@ -0,0 +1,182 @@
+// Package faultinject simulates crashes of the storage stack for recovery testing.
+//
+// An Injector wraps the disk manager and the log file of one database. Writes reach the
+// underlying storage right away, so reads behave normally, but every write made since the
+// last sync is remembered. When the injector crashes, at a chosen write or on demand, those
+// unsynced writes are dropped, torn or partially applied according to the Fault, exactly as
+// a power failure could leave them, and every later operation fails with ErrCrashed. The
+// files can then be reopened to check what recovery makes of them.
+package faultinject
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// ErrCrashed is returned by every operation on a wrapped file after the injector crashed.
+var ErrCrashed = errors.New("faultinject: storage crashed")
+
+// Fault selects what happens to the writes that were not synced when the crash occurs.
+type Fault int
+
+const (
+	// ProcessCrash keeps every write, as when only the process dies and the OS survives.
+	ProcessCrash Fault = iota
+	// DropUnsynced loses every write made since the last sync.
+	DropUnsynced
+	// TornWrite keeps the unsynced writes except the last one, which is only partially written.
+	TornWrite
+	// ReorderUnsynced keeps a random subset of the unsynced writes, regardless of the order they were made in.
+	ReorderUnsynced
+)
+
+// Faults lists every fault, for tests that exercise them all.
+var Faults = []Fault{ProcessCrash, DropUnsynced, TornWrite, ReorderUnsynced}
+
+func (f Fault) String() string {
+	switch f {
+	case ProcessCrash:
+		return "process-crash"
+	case DropUnsynced:
+		return "drop-unsynced"
+	case TornWrite:
+		return "torn-write"
+	case ReorderUnsynced:
+		return "reorder-unsynced"
+	default:
+		return fmt.Sprintf("fault(%d)", int(f))
+	}
+}
+
+// target is a wrapped file that can be crashed.
+type target interface {
+	crash(fault Fault, rng *rand.Rand) error
+}
+
+// Injector coordinates the wrapped files of one database, so a crash hits all of them at once.
+type Injector struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	targets []target
+
+	writes  int   // Writes made through the wrapped files so far.
+	crashAt int   // Write that triggers the crash, or 0 to crash only on demand.
+	fault   Fault // Fault applied when the crash is triggered by a write.
+	crashed bool
+	err     error // First error met while applying the crash.
+}
+
+// NewInjector creates an injector whose random choices are derived from seed.
+func NewInjector(seed int64) *Injector {
+	return &Injector{rng: rand.New(rand.NewSource(seed))}
+}
+
+// CrashAt arranges for the injector to crash with the given fault when the n-th write
+// through any wrapped file is made, counting from 1. That write is issued but not synced,
+// so it is subject to the fault, and the operation making it fails with ErrCrashed.
+func (in *Injector) CrashAt(n int, fault Fault) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.crashAt = n
+	in.fault = fault
+}
+
+// Crash crashes the injector now with the given fault. It returns the first error met
+// while applying the fault to the underlying files, including one from an earlier crash.
+func (in *Injector) Crash(fault Fault) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.crashLocked(fault)
+	return in.err
+}
+
+// Crashed reports whether the injector has crashed.
+func (in *Injector) Crashed() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.crashed
+}
+
+// Writes returns the number of writes made through the wrapped files.
+func (in *Injector) Writes() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.writes
+}
+
+// Err returns the first error met while applying a crash to the underlying files.
+func (in *Injector) Err() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.err
+}
+
+// WrapDiskManager wraps a disk manager so its writes are subject to the injector's crashes.
+// Its signature matches the WrapDiskManager option of litegodb.Options.
+func (in *Injector) WrapDiskManager(dm disk.DiskManager) disk.DiskManager {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	d := &DiskManager{in: in, dm: dm, base: make(map[int32]pageImage)}
+	in.targets = append(in.targets, d)
+	return d
+}
+
+// WrapFile wraps a log file so its writes are subject to the injector's crashes.
+// Its signature matches the WrapLogFile option of litegodb.Options.
+func (in *Injector) WrapFile(f kvstore.LogFile) kvstore.LogFile {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	w := &File{in: in, f: f, synced: -1}
+	in.targets = append(in.targets, w)
+	return w
+}
+
+// write counts a write made through a wrapped file. It returns true if the
+// write must crash the injector once it has been issued. The caller holds mu.
+func (in *Injector) write() bool {
+	in.writes++
+	return in.crashAt > 0 && in.writes == in.crashAt
+}
+
+// crashLocked applies the fault to every wrapped file. The caller holds mu.
+func (in *Injector) crashLocked(fault Fault) {
+	if in.crashed {
+		return
+	}
+	in.crashed = true
+	for _, t := range in.targets {
+		if err := t.crash(fault, in.rng); err != nil && in.err == nil {
+			in.err = err
+		}
+	}
+}
+
+// keep returns which of n unsynced writes survive the fault, and for TornWrite the
+// index of the write that is torn, or -1.
+func keep(fault Fault, n int, rng *rand.Rand) ([]bool, int) {
+	kept := make([]bool, n)
+	torn := -1
+	switch fault {
+	case ProcessCrash:
+		for i := range kept {
+			kept[i] = true
+		}
+	case TornWrite:
+		for i := range kept {
+			kept[i] = true
+		}
+		if n > 0 {
+			torn = n - 1
+		}
+	case ReorderUnsynced:
+		for i := range kept {
+			kept[i] = rng.Intn(2) == 0
+		}
+	}
+	return kept, torn
+}
@@ -0,0 +1,208 @@
+package faultinject_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/faultinject"
+)
+
+func writePage(t *testing.T, dm disk.DiskManager, id int32, content string) error {
+	t.Helper()
+	page := disk.NewFilePage(id)
+	page.SetData([]byte(content))
+	return dm.WritePage(page)
+}
+
+func readPage(t *testing.T, path string, id int32) []byte {
+	t.Helper()
+	dm, err := disk.NewFileDiskManager(path)
+	if err != nil {
+		t.Fatalf("error reopening disk manager: %v", err)
+	}
+	defer dm.Close()
+
+	page, err := dm.ReadPage(id)
+	if err != nil {
+		t.Fatalf("error reading page %d: %v", id, err)
+	}
+	return bytes.TrimRight(page.Data(), "\x00")
+}
+
+func openDisk(t *testing.T, in *faultinject.Injector) (disk.DiskManager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.db")
+	fdm, err := disk.NewFileDiskManager(path)
+	if err != nil {
+		t.Fatalf("error creating disk manager: %v", err)
+	}
+	dm := in.WrapDiskManager(fdm)
+	for i := 0; i < 2; i++ {
+		if _, err := dm.AllocatePage(); err != nil {
+			t.Fatalf("error allocating page: %v", err)
+		}
+	}
+	return dm, path
+}
+
+func TestDiskManagerFaults(t *testing.T) {
+	tests := []struct {
+		fault faultinject.Fault
+		check func(t *testing.T, page1 []byte)
+	}{
+		{faultinject.ProcessCrash, func(t *testing.T, page1 []byte) {
+			if string(page1) != "unsynced" {
+				t.Fatalf("expected the unsynced write to survive, got %q", page1)
+			}
+		}},
+		{faultinject.DropUnsynced, func(t *testing.T, page1 []byte) {
+			if string(page1) != "synced" {
+				t.Fatalf("expected the synced content, got %q", page1)
+			}
+		}},
+		{faultinject.TornWrite, func(t *testing.T, page1 []byte) {
+			// The page starts with the new content and continues with the old one.
+			prev, next := []byte("synced\x00\x00"), []byte("unsynced")
+			for cut := 0; cut <= len(next); cut++ {
+				torn := append(append([]byte(nil), next[:cut]...), prev[cut:]...)
+				if bytes.Equal(page1, bytes.TrimRight(torn, "\x00")) {
+					return
+				}
+			}
+			t.Fatalf("expected a mix of both writes, got %q", page1)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fault.String(), func(t *testing.T) {
+			in := faultinject.NewInjector(1)
+			dm, path := openDisk(t, in)
+
+			if err := writePage(t, dm, 0, "committed"); err != nil {
+				t.Fatalf("error writing page: %v", err)
+			}
+			if err := writePage(t, dm, 1, "synced"); err != nil {
+				t.Fatalf("error writing page: %v", err)
+			}
+			if err := dm.Sync(); err != nil {
+				t.Fatalf("error syncing: %v", err)
+			}
+			if err := writePage(t, dm, 1, "unsynced"); err != nil {
+				t.Fatalf("error writing page: %v", err)
+			}
+
+			if err := in.Crash(tt.fault); err != nil {
+				t.Fatalf("error crashing: %v", err)
+			}
+			if err := writePage(t, dm, 1, "after"); !errors.Is(err, faultinject.ErrCrashed) {
+				t.Fatalf("expected ErrCrashed after the crash, got %v", err)
+			}
+
+			if got := readPage(t, path, 0); string(got) != "committed" {
+				t.Fatalf("expected synced page 0 to survive, got %q", got)
+			}
+			tt.check(t, readPage(t, path, 1))
+		})
+	}
+}
+
+func TestCrashAt(t *testing.T) {
+	in := faultinject.NewInjector(1)
+	dm, path := openDisk(t, in)
+	in.CrashAt(2, faultinject.DropUnsynced)
+
+	if err := writePage(t, dm, 0, "first"); err != nil {
+		t.Fatalf("error writing page: %v", err)
+	}
+	if err := writePage(t, dm, 1, "second"); !errors.Is(err, faultinject.ErrCrashed) {
+		t.Fatalf("expected the second write to crash, got %v", err)
+	}
+	if !in.Crashed() || in.Writes() != 2 {
+		t.Fatalf("expected a crash after 2 writes, crashed=%v writes=%d", in.Crashed(), in.Writes())
+	}
+
+	if got := readPage(t, path, 0); len(got) != 0 {
+		t.Fatalf("expected unsynced page 0 to be dropped, got %q", got)
+	}
+}
+
+func openLog(t *testing.T, in *faultinject.Injector) (*faultinject.File, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal.log")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("error opening log: %v", err)
+	}
+	return in.WrapFile(f).(*faultinject.File), path
+}
+
+func TestFileFaults(t *testing.T) {
+	tests := []struct {
+		fault faultinject.Fault
+		check func(t *testing.T, content string)
+	}{
+		{faultinject.ProcessCrash, func(t *testing.T, content string) {
+			if content != "synced|one|two|" {
+				t.Fatalf("expected every write to survive, got %q", content)
+			}
+		}},
+		{faultinject.DropUnsynced, func(t *testing.T, content string) {
+			if content != "synced|" {
+				t.Fatalf("expected only the synced write, got %q", content)
+			}
+		}},
+		{faultinject.TornWrite, func(t *testing.T, content string) {
+			if len(content) < len("synced|one|") || len(content) > len("synced|one|two|") ||
+				content[:len("synced|one|")] != "synced|one|" {
+				t.Fatalf("expected the last write to be torn, got %q", content)
+			}
+		}},
+		{faultinject.ReorderUnsynced, func(t *testing.T, content string) {
+			if content[:len("synced|")] != "synced|" {
+				t.Fatalf("expected the synced write to survive, got %q", content)
+			}
+			for _, candidate := range []string{"synced|", "synced|one|", "synced|\x00\x00\x00\x00two|", "synced|one|two|"} {
+				if content == candidate {
+					return
+				}
+			}
+			t.Fatalf("unexpected content %q", content)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fault.String(), func(t *testing.T) {
+			in := faultinject.NewInjector(7)
+			f, path := openLog(t, in)
+
+			if _, err := f.Write([]byte("synced|")); err != nil {
+				t.Fatalf("error writing: %v", err)
+			}
+			if err := f.Sync(); err != nil {
+				t.Fatalf("error syncing: %v", err)
+			}
+			for _, record := range []string{"one|", "two|"} {
+				if _, err := f.Write([]byte(record)); err != nil {
+					t.Fatalf("error writing: %v", err)
+				}
+			}
+
+			if err := in.Crash(tt.fault); err != nil {
+				t.Fatalf("error crashing: %v", err)
+			}
+			if _, err := f.Write([]byte("after|")); !errors.Is(err, faultinject.ErrCrashed) {
+				t.Fatalf("expected ErrCrashed after the crash, got %v", err)
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("error reading log: %v", err)
+			}
+			tt.check(t, string(content))
+		})
+	}
+}
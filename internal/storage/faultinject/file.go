@@ -0,0 +1,165 @@
+package faultinject
+
+import (
+	"io"
+	"math/rand"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// File is a kvstore.LogFile whose unsynced writes are subject to the crashes of its Injector.
+// It assumes the file is written by appending, as the log is.
+type File struct {
+	in *Injector
+	f  kvstore.LogFile
+
+	synced  int64    // Size of the file at the last sync, or -1 before it is known.
+	pending [][]byte // Writes appended since the last sync, in order.
+}
+
+// Read reads from the wrapped file.
+func (w *File) Read(p []byte) (int, error) {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	if w.in.crashed {
+		return 0, ErrCrashed
+	}
+	return w.f.Read(p)
+}
+
+// Seek sets the offset of the wrapped file.
+func (w *File) Seek(offset int64, whence int) (int64, error) {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	if w.in.crashed {
+		return 0, ErrCrashed
+	}
+	return w.f.Seek(offset, whence)
+}
+
+// Write appends p to the wrapped file and remembers it until the next Sync.
+func (w *File) Write(p []byte) (int, error) {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	if w.in.crashed {
+		return 0, ErrCrashed
+	}
+	if err := w.syncedSize(); err != nil {
+		return 0, err
+	}
+
+	n, err := w.f.Write(p)
+	w.pending = append(w.pending, append([]byte(nil), p[:n]...))
+	if err != nil {
+		return n, err
+	}
+
+	if w.in.write() {
+		w.in.crashLocked(w.in.fault)
+		return n, ErrCrashed
+	}
+	return n, nil
+}
+
+// Sync syncs the wrapped file, making every write so far survive a crash.
+func (w *File) Sync() error {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	if w.in.crashed {
+		return ErrCrashed
+	}
+
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.synced = -1
+	w.pending = nil
+	return nil
+}
+
+// Truncate truncates the wrapped file. The new size is treated as synced.
+func (w *File) Truncate(size int64) error {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	if w.in.crashed {
+		return ErrCrashed
+	}
+
+	if err := w.f.Truncate(size); err != nil {
+		return err
+	}
+	w.synced = -1
+	w.pending = nil
+	return nil
+}
+
+// Close closes the wrapped file.
+func (w *File) Close() error {
+	w.in.mu.Lock()
+	defer w.in.mu.Unlock()
+	if w.in.crashed {
+		// The crash already closed it.
+		return nil
+	}
+	return w.f.Close()
+}
+
+// syncedSize records the size of the file before the first write after a sync.
+func (w *File) syncedSize() error {
+	if w.synced >= 0 {
+		return nil
+	}
+
+	offset, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size, err := w.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	w.synced = size
+	return nil
+}
+
+// crash cuts the file back to its synced size, appends what the fault keeps of the
+// unsynced writes, and closes the wrapped file. A write that is lost while a later one
+// is kept leaves a hole of zeros, as unwritten blocks of a file read back.
+func (w *File) crash(fault Fault, rng *rand.Rand) error {
+	defer w.f.Close()
+	if w.synced < 0 || len(w.pending) == 0 {
+		return nil
+	}
+
+	kept, torn := keep(fault, len(w.pending), rng)
+	last := -1
+	for i := range w.pending {
+		if kept[i] {
+			last = i
+		}
+	}
+
+	if err := w.f.Truncate(w.synced); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(w.synced, io.SeekStart); err != nil {
+		return err
+	}
+	for i := 0; i <= last; i++ {
+		data := w.pending[i]
+		switch {
+		case i == torn:
+			data = data[:rng.Intn(len(data)+1)]
+		case !kept[i]:
+			data = make([]byte, len(data))
+		}
+		if _, err := w.f.Write(data); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	return w.f.Sync()
+}
@@ -10,20 +10,27 @@ import (
 type Freelist struct {
 	mu    sync.Mutex
 	pages []int32
+	free  map[int32]struct{} // Set of the IDs in pages, to ignore duplicate frees.
 }
 
 // NewFreelist creates a new empty Freelist.
 func NewFreelist() *Freelist {
 	return &Freelist{
 		pages: make([]int32, 0),
+		free:  make(map[int32]struct{}),
 	}
 }
 
 // Add adds a page ID to the Freelist.
+// Adding a page that is already free has no effect, so a page is never handed out twice.
 func (f *Freelist) Add(id int32) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if _, ok := f.free[id]; ok {
+		return
+	}
+	f.free[id] = struct{}{}
 	f.pages = append(f.pages, id)
 }
 
@@ -37,9 +44,48 @@ func (f *Freelist) GetFreePage() (int32, bool) {
 	}
 	pageID := f.pages[len(f.pages)-1]
 	f.pages = f.pages[:len(f.pages)-1]
+	delete(f.free, pageID)
 	return pageID, true
 }
 
+// GetLowestFreePage retrieves and removes the free page with the lowest ID.
+// Returns the page ID and true if available, otherwise 0 and false.
+func (f *Freelist) GetLowestFreePage() (int32, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.pages) == 0 {
+		return 0, false
+	}
+
+	lowest := 0
+	for i, id := range f.pages {
+		if id < f.pages[lowest] {
+			lowest = i
+		}
+	}
+	pageID := f.pages[lowest]
+	f.pages = append(f.pages[:lowest], f.pages[lowest+1:]...)
+	delete(f.free, pageID)
+	return pageID, true
+}
+
+// RemoveFrom removes every page ID greater than or equal to id from the freelist.
+// It is used when the storage is truncated and those pages no longer exist.
+func (f *Freelist) RemoveFrom(id int32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kept := f.pages[:0]
+	for _, pageID := range f.pages {
+		if pageID < id {
+			kept = append(kept, pageID)
+		} else {
+			delete(f.free, pageID)
+		}
+	}
+	f.pages = kept
+}
+
 // Serializes converts the freelist into a byte slice for storage
 func (f *Freelist) Serialize() ([]byte, error) {
 	f.mu.Lock()
@@ -65,7 +111,7 @@ func Deserialize(data []byte) (*Freelist, error) {
 		if err := binary.Read(buffer, binary.LittleEndian, &pageID); err != nil {
 			return nil, err
 		}
-		freelist.pages = append(freelist.pages, pageID)
+		freelist.Add(pageID)
 	}
 	return freelist, nil
 }
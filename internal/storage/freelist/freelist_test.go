@@ -113,3 +113,60 @@ func TestFreelist_ConcurrentAddAndGet(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestFreelist_AddIgnoresDuplicates(t *testing.T) {
+	fl := freelist.NewFreelist()
+
+	fl.Add(7)
+	fl.Add(7)
+
+	if fl.Len() != 1 {
+		t.Fatalf("expected freelist length 1, got %d", fl.Len())
+	}
+
+	fl.GetFreePage()
+	fl.Add(7)
+	if fl.Len() != 1 {
+		t.Errorf("expected a page handed out and freed again to be reusable, got length %d", fl.Len())
+	}
+}
+
+func TestFreelist_GetLowestFreePage(t *testing.T) {
+	fl := freelist.NewFreelist()
+
+	fl.Add(5)
+	fl.Add(2)
+	fl.Add(9)
+
+	for _, expected := range []int32{2, 5, 9} {
+		pageID, ok := fl.GetLowestFreePage()
+		if !ok || pageID != expected {
+			t.Errorf("expected pageID %d, got %d, ok: %v", expected, pageID, ok)
+		}
+	}
+
+	if pageID, ok := fl.GetLowestFreePage(); ok {
+		t.Errorf("expected no free page, got %d", pageID)
+	}
+}
+
+func TestFreelist_RemoveFrom(t *testing.T) {
+	fl := freelist.NewFreelist()
+
+	fl.Add(3)
+	fl.Add(8)
+	fl.Add(1)
+	fl.Add(5)
+
+	fl.RemoveFrom(5)
+
+	if fl.Len() != 2 {
+		t.Fatalf("expected freelist length 2, got %d", fl.Len())
+	}
+	for _, expected := range []int32{1, 3} {
+		pageID, ok := fl.GetLowestFreePage()
+		if !ok || pageID != expected {
+			t.Errorf("expected pageID %d, got %d, ok: %v", expected, pageID, ok)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+)
+
+// Backup copies the database file, page by page, to dst, which must be empty, and returns
+// the LSN of the last change the copy holds. It checkpoints first, so the copy holds exactly
+// the changes up to that LSN, and replaying the log segments written from then on brings it
+// forward; see Restore.
+//
+// Writes continue while the pages are copied; flushes, checkpoints and vacuums wait.
+func (kv *BTreeKVStore) Backup(dst disk.DiskManager) (uint64, error) {
+	if err := kv.FlushAll(); err != nil {
+		return 0, err
+	}
+
+	kv.writeMu.Lock()
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+	lsn, err := kv.checkpointLocked()
+	// Later writes only reach the file through commits, which need flushMu.
+	kv.writeMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	for id := int32(0); id <= kv.diskManager.GetLastAllocatedPageID(); id++ {
+		page, err := kv.diskManager.ReadPage(id)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read page %d: %w", id, err)
+		}
+		// Unwritten slots read back with ID 0; keep them in place.
+		page.SetId(id)
+		if err := dst.WritePage(page); err != nil {
+			return 0, fmt.Errorf("failed to write page %d: %w", id, err)
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// RestoreTarget bounds the changes Restore replays. A zero field sets no bound.
+type RestoreTarget struct {
+	LSN  uint64    // LSN of the last change to replay.
+	Time time.Time // Only changes logged at or before this time are replayed.
+}
+
+// errTargetReached stops the replay of a segment once the restore target is passed.
+var errTargetReached = errors.New("restore target reached")
+
+// Restore brings a store opened on a base backup forward to target by replaying the log
+// segments found in dirs, such as the archive directory and the log directory of the
+// database the backup was taken from. Segments present in several directories are read once.
+// The store must be freshly loaded, with nothing written to it.
+//
+// The result is checkpointed at the last change replayed, whose LSN is returned, so the
+// store continues numbering its log from there.
+func (kv *BTreeKVStore) Restore(dirs []string, target RestoreTarget) (uint64, error) {
+	kv.writeMu.Lock()
+	defer kv.writeMu.Unlock()
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+
+	start := kv.catalog.CheckpointLSN()
+	if kv.log.LastLSN() != start {
+		return 0, fmt.Errorf("restore needs a store with nothing logged since its backup")
+	}
+	if target.LSN != 0 && target.LSN < start {
+		return 0, fmt.Errorf("the backup was taken at LSN %d, after the target LSN %d", start, target.LSN)
+	}
+
+	segments, paths, err := findSegments(dirs)
+	if err != nil {
+		return 0, err
+	}
+
+	last := start
+	reached := false
+	for i, seg := range segments {
+		// Skip segments whose records are all in the backup already.
+		if i+1 < len(segments) && segments[i+1].base <= start {
+			continue
+		}
+		if seg.base > last {
+			return 0, fmt.Errorf("the log is missing the records after LSN %d", last)
+		}
+
+		_, _, err := ReadSegment(paths[seg.name], kv.log.opts.Cipher, func(entry *LogEntry) error {
+			if entry.LSN <= last {
+				return nil
+			}
+			if target.LSN != 0 && entry.LSN > target.LSN {
+				return errTargetReached
+			}
+			if !target.Time.IsZero() {
+				if entry.Time.IsZero() {
+					return fmt.Errorf("record at LSN %d has no time to compare with the target", entry.LSN)
+				}
+				if entry.Time.After(target.Time) {
+					return errTargetReached
+				}
+			}
+			kv.redo(entry)
+			last = entry.LSN
+			return nil
+		})
+		if err == errTargetReached {
+			reached = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if target.LSN != 0 && !reached && last < target.LSN {
+		return 0, fmt.Errorf("the log ends at LSN %d, before the target LSN %d", last, target.LSN)
+	}
+
+	kv.catalog.SetCheckpointLSN(last)
+	if err := kv.commit(kv.tableNames(), true); err != nil {
+		return 0, err
+	}
+	if err := kv.log.Reset(last); err != nil {
+		return 0, err
+	}
+	kv.feed.reset(last)
+	return last, nil
+}
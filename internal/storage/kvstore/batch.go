@@ -0,0 +1,26 @@
+package kvstore
+
+import "fmt"
+
+// WriteBatch applies a list of "PUT" and "DELETE" entries atomically, as a single commit
+// record: after a crash either all of them are recovered or none. When a key is written
+// more than once, its last write wins. Every table written must exist.
+func (kv *BTreeKVStore) WriteBatch(writes []*LogEntry) error {
+	tx := kv.batch()
+	for _, w := range writes {
+		var err error
+		switch w.Operation {
+		case "PUT":
+			err = tx.Put(w.Table, w.Key, w.Value)
+		case "DELETE":
+			err = tx.Delete(w.Table, w.Key)
+		default:
+			err = fmt.Errorf("unsupported batch operation %q", w.Operation)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,58 @@
+package kvstore_test
+
+import (
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openSegmentedStore(t, dir, 0, "")
+	for _, table := range []string{"users", "emails"} {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	if err := store.Put("users", 3, "carol"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	before := store.LastLSN()
+
+	err := store.WriteBatch([]*kvstore.LogEntry{
+		{Operation: "PUT", Table: "users", Key: 1, Value: "alice"},
+		{Operation: "PUT", Table: "emails", Key: 1, Value: "alice@example.com"},
+		{Operation: "PUT", Table: "users", Key: 2, Value: "bob"},
+		{Operation: "PUT", Table: "users", Key: 1, Value: "alicia"},
+		{Operation: "DELETE", Table: "users", Key: 3},
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	if store.LastLSN() != before+1 {
+		t.Fatalf("Expected a single record, got LSNs %d to %d", before, store.LastLSN())
+	}
+
+	// Invalid batches are rejected before anything is logged.
+	for _, invalid := range [][]*kvstore.LogEntry{
+		{{Operation: "PUT", Table: "users", Key: 4, Value: "dave"}, {Operation: "PUT", Table: "missing", Key: 1}},
+		{{Operation: "PUT", Table: "users", Key: 4, Value: "dave"}, {Operation: "DROP_TABLE", Table: "users"}},
+	} {
+		if err := store.WriteBatch(invalid); err == nil {
+			t.Fatalf("Expected an invalid batch to fail")
+		}
+	}
+	if store.LastLSN() != before+1 {
+		t.Fatalf("Expected failed batches not to be logged, got LSN %d", store.LastLSN())
+	}
+
+	// Crash: the store is abandoned without closing it.
+	recovered, diskManager := openSegmentedStore(t, dir, 0, "")
+	defer diskManager.Close()
+	defer recovered.Close()
+	assertGet(t, recovered, "users", 1, "alicia")
+	assertGet(t, recovered, "users", 2, "bob")
+	assertGet(t, recovered, "emails", 1, "alice@example.com")
+	assertNotFound(t, recovered, "users", 3)
+	assertNotFound(t, recovered, "users", 4)
+}
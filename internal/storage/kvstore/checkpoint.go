@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"fmt"
+	"time"
+)
+
+// Checkpoint commits every table together with the LSN of the last logged change, then
+// closes the active log segment and removes every segment it covers, so the next Load only
+// replays changes made after the checkpoint.
+// It returns the checkpoint LSN.
+//
+// The bulk of the changes is flushed while writes continue; writers only wait while the
+// changes made during that flush are committed and the old segments are removed.
+func (kv *BTreeKVStore) Checkpoint() (uint64, error) {
+	if err := kv.FlushAll(); err != nil {
+		return 0, err
+	}
+
+	kv.writeMu.Lock()
+	defer kv.writeMu.Unlock()
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+	return kv.checkpointLocked()
+}
+
+// checkpointLocked commits the checkpoint. The caller holds writeMu and flushMu.
+func (kv *BTreeKVStore) checkpointLocked() (uint64, error) {
+	lsn := kv.log.LastLSN()
+	if lsn == kv.catalog.CheckpointLSN() {
+		return lsn, nil
+	}
+
+	// Every change up to lsn is applied in memory: writers hold writeMu from queueing a
+	// change until it is applied. The checkpoint must not cover changes whose records
+	// could still fail to reach the log, so it waits for them first.
+	if err := kv.log.wait(lsn); err != nil {
+		return 0, err
+	}
+	kv.catalog.SetCheckpointLSN(lsn)
+	if err := kv.commit(kv.tableNames(), true); err != nil {
+		return 0, err
+	}
+	if err := kv.log.DiscardThrough(lsn); err != nil {
+		return 0, fmt.Errorf("checkpoint at LSN %d committed but the log was not reset: %w", lsn, err)
+	}
+	return lsn, nil
+}
+
+// StartPeriodicCheckpoint checkpoints the store every interval, and as soon as the log
+// grows past maxLogSize bytes. A zero interval or size disables that trigger.
+func (kv *BTreeKVStore) StartPeriodicCheckpoint(interval time.Duration, maxLogSize int64) {
+	kv.maxLogSize.Store(maxLogSize)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	go func() {
+		for {
+			select {
+			case <-tick:
+			case <-kv.checkpointCh:
+			}
+			if _, err := kv.Checkpoint(); err != nil {
+				fmt.Printf("Warning: checkpoint failed: %v\n", err)
+			}
+		}
+	}()
+}
+
+// checkLogSize wakes the checkpoint goroutine once the log outgrows its size limit.
+func (kv *BTreeKVStore) checkLogSize() {
+	if max := kv.maxLogSize.Load(); max > 0 && kv.log.Size() >= max {
+		select {
+		case kv.checkpointCh <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package kvstore
+
+import (
+	"fmt"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/btree"
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
+)
+
+// Changes to the tables themselves are logged like data changes, in the same sequence,
+// so replaying the log rebuilds the catalog together with the tables:
+//
+//	CREATE_TABLE  Table, Key: degree, Value: codec, Schema: column definitions
+//	DROP_TABLE    Table
+//	ALTER_TABLE   Table, Value: codec or empty, Schema: column definitions or empty
+//	RENAME_TABLE  Table, Value: new name
+//
+// The catalog records the LSN that created each table, or renamed it to its name, which
+// tells the records of a table from those of an earlier one with the same name.
+
+// logDDL checks a change to the tables, logs it and applies it in memory, then waits
+// until its record is written. Only changes that pass the check are logged.
+func (kv *BTreeKVStore) logDDL(entry *LogEntry) error {
+	kv.writeMu.Lock()
+	kv.flushMu.Lock()
+	err := kv.checkDDL(entry)
+	if err == nil {
+		_, err = kv.log.enqueue(entry)
+	}
+	if err == nil {
+		err = kv.applyDDL(entry)
+		kv.feed.publish(entry)
+	}
+	kv.flushMu.Unlock()
+	kv.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return kv.awaitLog(entry.LSN)
+}
+
+// checkDDL returns an error if a change to the tables cannot be applied.
+func (kv *BTreeKVStore) checkDDL(entry *LogEntry) error {
+	meta, exists := kv.catalog.Get(entry.Table)
+	switch entry.Operation {
+	case "CREATE_TABLE":
+		if exists {
+			return fmt.Errorf("table %s already exists", entry.Table)
+		}
+		if entry.Key < 2 {
+			return fmt.Errorf("invalid degree %d for table %s", entry.Key, entry.Table)
+		}
+	case "DROP_TABLE", "ALTER_TABLE", "RENAME_TABLE":
+		if !exists {
+			return fmt.Errorf("table %s does not exist", entry.Table)
+		}
+	default:
+		return fmt.Errorf("unknown table operation %q", entry.Operation)
+	}
+
+	switch entry.Operation {
+	case "CREATE_TABLE", "ALTER_TABLE":
+		if _, err := compression.ParseCodec(entry.Value); err != nil {
+			return err
+		}
+	case "RENAME_TABLE":
+		if entry.Value == "" {
+			return fmt.Errorf("missing new name for table %s", entry.Table)
+		}
+		if _, taken := kv.catalog.Get(entry.Value); taken {
+			return fmt.Errorf("table %s already exists", entry.Value)
+		}
+	}
+	if entry.Schema != "" {
+		s, err := schema.Parse(entry.Schema)
+		if err != nil {
+			return err
+		}
+		// Rows are not rewritten, so a new schema must read the ones written before.
+		if entry.Operation == "ALTER_TABLE" {
+			if meta.Schema == nil {
+				return fmt.Errorf("table %s has no schema to alter", entry.Table)
+			}
+			if err := meta.Schema.Compatible(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyDDL applies a checked change to the tables in memory. The catalog reaches disk
+// with the next commit; the pages of a dropped table are freed by it. The caller must
+// hold writeMu and flushMu, so no commit sees the change half applied.
+func (kv *BTreeKVStore) applyDDL(entry *LogEntry) error {
+	switch entry.Operation {
+	case "CREATE_TABLE":
+		codec, err := compression.ParseCodec(entry.Value)
+		if err != nil {
+			return err
+		}
+		if err := kv.catalog.CreateTableAt(entry.Table, int32(entry.Key), 0, entry.LSN); err != nil {
+			return err
+		}
+		if err := kv.catalog.SetCompression(entry.Table, codec); err != nil {
+			return err
+		}
+		if entry.Schema != "" {
+			s, err := schema.Parse(entry.Schema)
+			if err != nil {
+				return err
+			}
+			if err := kv.catalog.SetSchema(entry.Table, s); err != nil {
+				return err
+			}
+		}
+		kv.tablesMu.Lock()
+		kv.tables[entry.Table] = btree.NewBTree(entry.Key)
+		kv.tablesMu.Unlock()
+
+	case "DROP_TABLE":
+		bt, err := kv.table(entry.Table)
+		if err != nil {
+			return err
+		}
+		if err := kv.catalog.DropTable(entry.Table); err != nil {
+			return err
+		}
+		kv.tablesMu.Lock()
+		delete(kv.tables, entry.Table)
+		kv.tablesMu.Unlock()
+		kv.dropped = append(kv.dropped, bt.PageIDs()...)
+
+	case "ALTER_TABLE":
+		if entry.Value != "" {
+			codec, err := compression.ParseCodec(entry.Value)
+			if err != nil {
+				return err
+			}
+			if err := kv.catalog.SetCompression(entry.Table, codec); err != nil {
+				return err
+			}
+		}
+		if entry.Schema != "" {
+			s, err := schema.Parse(entry.Schema)
+			if err != nil {
+				return err
+			}
+			return kv.catalog.SetSchema(entry.Table, s)
+		}
+
+	case "RENAME_TABLE":
+		if err := kv.catalog.RenameTable(entry.Table, entry.Value, entry.LSN); err != nil {
+			return err
+		}
+		kv.tablesMu.Lock()
+		kv.tables[entry.Value] = kv.tables[entry.Table]
+		delete(kv.tables, entry.Table)
+		kv.tablesMu.Unlock()
+	}
+	return nil
+}
+
+// redoDDL replays a logged change to the tables unless the catalog already reflects it:
+// a table created at or after the record's LSN was created by it or by a later record.
+func (kv *BTreeKVStore) redoDDL(entry *LogEntry) bool {
+	if meta, ok := kv.catalog.Get(entry.Table); ok && meta.CreateLSN >= entry.LSN {
+		return false
+	}
+	if kv.checkDDL(entry) != nil {
+		return false
+	}
+	return kv.applyDDL(entry) == nil
+}
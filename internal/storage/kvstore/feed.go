@@ -0,0 +1,276 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// feedBufferSize is the number of recent changes the change feed keeps in memory.
+// Subscribers further behind read their changes back from the log segments.
+const feedBufferSize = 4096
+
+// ErrChangesNotRetained ends a subscription whose next change is no longer in the log
+// directory or the archive.
+var ErrChangesNotRetained = errors.New("kvstore: changes no longer retained in the log")
+
+// errStoreClosed ends the subscriptions of a store that is closed.
+var errStoreClosed = errors.New("kvstore: store closed")
+
+// errSubscriptionClosed stops the delivery of changes to a closed subscription.
+var errSubscriptionClosed = errors.New("subscription closed")
+
+// changeFeed hands logged changes to subscribers once their records are written.
+type changeFeed struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	recent []*LogEntry // Changes logged lately, in LSN order, without gaps.
+	lsn    uint64      // LSN of the last change written to the log.
+	closed bool
+}
+
+func newChangeFeed(lsn uint64) *changeFeed {
+	f := &changeFeed{lsn: lsn}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// publish adds a change queued in the log. Changes must be published in LSN order.
+func (f *changeFeed) publish(entry *LogEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.recent = append(f.recent, entry)
+	if len(f.recent) > 2*feedBufferSize {
+		f.recent = slices.Clone(f.recent[len(f.recent)-feedBufferSize:])
+	}
+}
+
+// written records that every change up to lsn is written to the log.
+func (f *changeFeed) written(lsn uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if lsn > f.lsn {
+		f.lsn = lsn
+		f.cond.Broadcast()
+	}
+}
+
+// reset forgets the changes in memory after the log was renumbered from lsn.
+func (f *changeFeed) reset(lsn uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.recent = nil
+	f.lsn = lsn
+	f.cond.Broadcast()
+}
+
+// close ends every subscription.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	f.cond.Broadcast()
+}
+
+// changesAfter waits until a change after the given LSN is written, or the subscription is
+// stopped, and returns the written changes that follow it. If they are no longer in memory
+// it returns none, along with the LSN of the last written change.
+func (f *changeFeed) changesAfter(after uint64, sub *Subscription) ([]*LogEntry, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for f.lsn <= after && !f.closed && !sub.stopped {
+		f.cond.Wait()
+	}
+	if sub.stopped {
+		return nil, 0, errSubscriptionClosed
+	}
+	if f.closed {
+		return nil, 0, errStoreClosed
+	}
+
+	if len(f.recent) == 0 || f.recent[0].LSN > after+1 {
+		return nil, f.lsn, nil
+	}
+	first := f.recent[0].LSN
+	end := min(int(f.lsn-first+1), len(f.recent))
+	return slices.Clone(f.recent[after+1-first : end]), f.lsn, nil
+}
+
+// Subscription streams the changes logged by a store; see Subscribe.
+type Subscription struct {
+	kv      *BTreeKVStore
+	tables  map[string]bool // Tables whose changes are delivered; all of them if empty.
+	events  chan *LogEntry
+	done    chan struct{}
+	stopped bool // Set by Close. Guarded by the feed's mutex.
+	err     error
+}
+
+// Subscribe streams every change logged after the given LSN, to the listed tables or to
+// all of them, in LSN order: writes, with the value each key had before, and the creation,
+// alteration and removal of tables. Changes are delivered once their records are written
+// to the log, so a subscriber that stores the LSN of the last change it handled can resume
+// from it, even after a restart.
+//
+// Recent changes are served from memory; older ones are read back from the segments in
+// the log directory and the archive. A subscription that needs changes no longer there
+// ends with ErrChangesNotRetained.
+func (kv *BTreeKVStore) Subscribe(after uint64, tables ...string) *Subscription {
+	sub := &Subscription{
+		kv:     kv,
+		tables: make(map[string]bool, len(tables)),
+		events: make(chan *LogEntry),
+		done:   make(chan struct{}),
+	}
+	for _, table := range tables {
+		sub.tables[table] = true
+	}
+	go sub.run(after)
+	return sub
+}
+
+// Events returns the channel the changes are delivered on. It is closed when the
+// subscription ends. The entries are shared with other subscribers and must not be modified.
+func (s *Subscription) Events() <-chan *LogEntry {
+	return s.events
+}
+
+// Err returns the error that ended the subscription once Events is closed, or nil if
+// it was closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	f := s.kv.feed
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+		f.cond.Broadcast()
+	}
+}
+
+func (s *Subscription) run(after uint64) {
+	defer close(s.events)
+
+	for {
+		changes, lsn, err := s.kv.feed.changesAfter(after, s)
+		if err == nil && changes == nil {
+			after, err = s.kv.readChanges(after, lsn, s.deliver)
+		}
+		for _, entry := range changes {
+			if err = s.deliver(entry); err != nil {
+				break
+			}
+			after = entry.LSN
+		}
+		if err != nil {
+			if err != errSubscriptionClosed {
+				s.err = err
+			}
+			return
+		}
+	}
+}
+
+// deliver hands a change to the subscriber if it is to one of its tables. A commit is
+// handed over with the changes to those tables only.
+func (s *Subscription) deliver(entry *LogEntry) error {
+	if entry = s.filter(entry); entry == nil {
+		return nil
+	}
+	select {
+	case s.events <- entry:
+		return nil
+	case <-s.done:
+		return errSubscriptionClosed
+	}
+}
+
+// filter returns the part of a change to the subscriber's tables, or nil if there is none.
+func (s *Subscription) filter(entry *LogEntry) *LogEntry {
+	if len(s.tables) == 0 {
+		return entry
+	}
+	if entry.Operation != "COMMIT" {
+		if !s.tables[entry.Table] {
+			return nil
+		}
+		return entry
+	}
+
+	var changes []*LogEntry
+	for _, change := range entry.Changes {
+		if s.tables[change.Table] {
+			changes = append(changes, change)
+		}
+	}
+	switch len(changes) {
+	case 0:
+		return nil
+	case len(entry.Changes):
+		return entry
+	}
+	filtered := *entry
+	filtered.Changes = changes
+	return &filtered
+}
+
+// readChanges reads the changes after LSN after, up to through, back from the segments in
+// the log directory and the archive, and passes them to fn. It returns the LSN of the last
+// change read.
+func (kv *BTreeKVStore) readChanges(after, through uint64, fn func(*LogEntry) error) (uint64, error) {
+	// A checkpoint archives segments before it removes them, so listing the log directory
+	// first finds every segment in one of the two.
+	dirs := []string{kv.log.dir}
+	if kv.log.opts.ArchiveDir != "" {
+		dirs = append(dirs, kv.log.opts.ArchiveDir)
+	}
+	segments, paths, err := findSegments(dirs)
+	if err != nil {
+		return after, err
+	}
+
+	for i, seg := range segments {
+		// Skip segments whose records were all delivered already.
+		if i+1 < len(segments) && segments[i+1].base <= after {
+			continue
+		}
+		if seg.base > after {
+			break
+		}
+
+		// The active segment may end with a record still being written, so reading
+		// stops at the last one known to be complete.
+		_, _, err := ReadSegment(paths[seg.name], kv.log.opts.Cipher, func(entry *LogEntry) error {
+			if entry.LSN <= after {
+				return nil
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+			after = entry.LSN
+			if after == through {
+				return errTargetReached
+			}
+			return nil
+		})
+		if err == errTargetReached {
+			return after, nil
+		}
+		if err != nil {
+			return after, err
+		}
+	}
+	return after, fmt.Errorf("%w: the changes after LSN %d are missing", ErrChangesNotRetained, after)
+}
@@ -0,0 +1,148 @@
+package kvstore_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// nextChange returns the next change of a subscription, failing the test if none comes.
+func nextChange(t *testing.T, sub *kvstore.Subscription) *kvstore.LogEntry {
+	t.Helper()
+	select {
+	case entry, ok := <-sub.Events():
+		if !ok {
+			t.Fatalf("Subscription ended: %v", sub.Err())
+		}
+		return entry
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a change")
+	}
+	return nil
+}
+
+func TestSubscribeStreamsChanges(t *testing.T) {
+	store, diskManager := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer diskManager.Close()
+	defer store.Close()
+
+	sub := store.Subscribe(0, "watched")
+	defer sub.Close()
+
+	for _, table := range []string{"watched", "ignored"} {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := store.Put(table, 1, "one"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := store.Put(table, 1, "uno"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := store.Delete(table, 1); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	if entry := nextChange(t, sub); entry.Operation != "CREATE_TABLE" || entry.Table != "watched" {
+		t.Fatalf("Expected the creation of the table first, got %+v", entry)
+	}
+	first := nextChange(t, sub)
+	if first.Operation != "PUT" || first.Value != "one" || first.OldValue != nil || first.Time.IsZero() {
+		t.Fatalf("Expected the first put without an old value, got %+v", first)
+	}
+	update := nextChange(t, sub)
+	if update.Value != "uno" || update.OldValue == nil || *update.OldValue != "one" || update.LSN != first.LSN+1 {
+		t.Fatalf("Expected the update with the old value, got %+v", update)
+	}
+	if entry := nextChange(t, sub); entry.Operation != "DELETE" || entry.OldValue == nil || *entry.OldValue != "uno" {
+		t.Fatalf("Expected the delete with the old value, got %+v", entry)
+	}
+
+	// Changes to other tables are left out.
+	if err := store.Put("watched", 2, "two"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if entry := nextChange(t, sub); entry.Table != "watched" || entry.Key != 2 {
+		t.Fatalf("Expected the next change to the watched table, got %+v", entry)
+	}
+}
+
+func TestSubscribeResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := filepath.Join(dir, "archive")
+	store, diskManager := openSegmentedStore(t, dir, 512, archiveDir)
+
+	table := "feed"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for key := 0; key < 50; key++ {
+		if err := store.Put(table, key, fmt.Sprintf("value%d", key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	// The checkpoint of Close removes the segments from the log directory; the archive keeps them.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	diskManager.Close()
+
+	reopened, diskManager := openSegmentedStore(t, dir, 512, archiveDir)
+	defer diskManager.Close()
+	defer reopened.Close()
+
+	// A subscriber that handled the changes up to LSN 11 picks up from there.
+	sub := reopened.Subscribe(11, table)
+	defer sub.Close()
+	for key := 10; key < 50; key++ {
+		entry := nextChange(t, sub)
+		if entry.Key != key || entry.LSN != uint64(key+2) {
+			t.Fatalf("Expected key %d at LSN %d, got %+v", key, key+2, entry)
+		}
+	}
+	if err := reopened.Put(table, 100, "live"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if entry := nextChange(t, sub); entry.Key != 100 || entry.Value != "live" {
+		t.Fatalf("Expected the new change after the retained ones, got %+v", entry)
+	}
+}
+
+func TestSubscribeFailsWithoutRetainedChanges(t *testing.T) {
+	dir := t.TempDir()
+	store, diskManager := openSegmentedStore(t, dir, 0, "")
+	if err := store.CreateTableName("gone", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := store.Put("gone", 1, "one"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// Without an archive, the checkpoint of Close discards the changes for good.
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	diskManager.Close()
+
+	reopened, diskManager := openSegmentedStore(t, dir, 0, "")
+	defer diskManager.Close()
+	defer reopened.Close()
+
+	sub := reopened.Subscribe(0)
+	defer sub.Close()
+	select {
+	case entry, ok := <-sub.Events():
+		if ok {
+			t.Fatalf("Expected no change to be delivered, got %+v", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the subscription to end")
+	}
+	if err := sub.Err(); !errors.Is(err, kvstore.ErrChangesNotRetained) {
+		t.Fatalf("Expected ErrChangesNotRetained, got %v", err)
+	}
+}
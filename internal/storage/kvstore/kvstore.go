@@ -3,128 +3,238 @@ package kvstore
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rafaelmgr12/litegodb/internal/storage/btree"
 	"github.com/rafaelmgr12/litegodb/internal/storage/catalog"
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
 )
 
 // BTreeKVStore represents a key-value store backed by a B-Tree and persistent storage.
 type BTreeKVStore struct {
 	tables      map[string]*btree.BTree
 	tablesMu    sync.RWMutex
+	flushMu     sync.Mutex // Serializes flushes so roots reach the catalog in the order they were written.
+	writeMu     sync.Mutex // Held by writers from queueing a change in the log until it is applied, so changes apply in LSN order.
 	diskManager disk.DiskManager
-	log         *AppendOnlyLog
+	log         *SegmentedLog
 	catalog     *catalog.Catalog
+
+	checkpointCh chan struct{} // Wakes the checkpoint goroutine when the log outgrows maxLogSize.
+	maxLogSize   atomic.Int64  // Log size in bytes that triggers a checkpoint, or 0.
+
+	recovery RecoveryStats // What the last Load replayed from the log.
+	dropped  []int32       // Pages of tables dropped since the last commit, which frees them. Guarded by flushMu.
+	feed     *changeFeed   // Changes handed to subscribers.
+	versions *versionStore // Versions replaced while snapshots are active.
+	locks    *lockManager  // Key and table locks of transactions and writers.
 }
 
-// NewBTreeKVStore initializes a new KVStore with a B-Tree, DiskManager, and AppendOnlyLog.
-func NewBTreeKVStore(degree int, diskManager disk.DiskManager, logFilename string) (*BTreeKVStore, error) {
-	log, err := NewAppendOnlyLog(logFilename)
+// Options holds optional settings for a BTreeKVStore.
+// The zero value gives a plaintext store.
+type Options struct {
+	// Cipher encrypts every record written to the append-only log. Nil disables log encryption.
+	Cipher *encryption.Cipher
+
+	// SyncWrites makes every Put and Delete wait until its log record is on stable storage.
+	// Without it a write survives a process crash but may be lost on power failure.
+	SyncWrites bool
+
+	// SegmentSize is the size in bytes a log segment reaches before the next one is started.
+	// Zero means DefaultSegmentSize.
+	SegmentSize int64
+
+	// ArchiveDir, if set, receives a copy of every log segment once it is closed.
+	ArchiveDir string
+
+	// WrapLogFile, if set, wraps the file backing each log segment.
+	WrapLogFile func(LogFile) LogFile
+
+	// LockTimeout is how long a transaction or write waits for a lock before failing with
+	// ErrLockTimeout. Zero waits until the lock is granted or a deadlock is detected.
+	LockTimeout time.Duration
+}
+
+// NewBTreeKVStore initializes a new KVStore with a B-Tree, DiskManager, and a SegmentedLog
+// kept in the directory logDir.
+func NewBTreeKVStore(degree int, diskManager disk.DiskManager, logDir string) (*BTreeKVStore, error) {
+	return NewBTreeKVStoreWithOptions(degree, diskManager, logDir, Options{})
+}
+
+// NewBTreeKVStoreWithOptions initializes a new KVStore like NewBTreeKVStore, applying the given options.
+func NewBTreeKVStoreWithOptions(degree int, diskManager disk.DiskManager, logDir string, opts Options) (*BTreeKVStore, error) {
+	log, err := openSegmentedLog(logDir, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	cat := catalog.NewCatalog(diskManager)
-	_ = cat.Load()
+	if err := cat.Load(); err != nil {
+		log.Close()
+		return nil, fmt.Errorf("failed to load catalog: %w", err)
+	}
 
 	return &BTreeKVStore{
-		tables:      make(map[string]*btree.BTree),
-		diskManager: diskManager,
-		log:         log,
-		catalog:     cat,
+		tables:       make(map[string]*btree.BTree),
+		diskManager:  diskManager,
+		log:          log,
+		catalog:      cat,
+		checkpointCh: make(chan struct{}, 1),
+		feed:         newChangeFeed(log.LastLSN()),
+		versions:     newVersionStore(),
+		locks:        newLockManager(opts.LockTimeout),
 	}, nil
 }
 
+// CreateTableName creates a new table whose pages are stored uncompressed.
 func (kv *BTreeKVStore) CreateTableName(name string, degree int) error {
-	if _, exists := kv.catalog.Get(name); exists {
-		return fmt.Errorf("table %s already exists", name)
-	}
+	return kv.CreateTableWithCompression(name, degree, compression.None)
+}
 
-	bt := btree.NewBTree(degree)
+// CreateTableWithCompression creates a new table whose pages are compressed with the given codec.
+func (kv *BTreeKVStore) CreateTableWithCompression(name string, degree int, codec compression.Codec) error {
+	return kv.createTable(&LogEntry{Operation: "CREATE_TABLE", Table: name, Key: degree, Value: codec.String()})
+}
 
-	kv.tablesMu.Lock()
-	kv.tables[name] = bt
-	defer kv.tablesMu.Unlock()
+// CreateTableWithSchema creates a new table whose rows have the typed columns of s. Its
+// keys are the values of the primary key, and its values the other columns encoded with
+// s.Encode.
+func (kv *BTreeKVStore) CreateTableWithSchema(name string, degree int, codec compression.Codec, s *schema.Schema) error {
+	return kv.createTable(&LogEntry{Operation: "CREATE_TABLE", Table: name, Key: degree, Value: codec.String(), Schema: s.Definition()})
+}
 
-	page, err := kv.diskManager.AllocatePage()
-	if err != nil {
-		return err
+// TableSchema returns the schema of a table, or nil if its values are plain strings.
+func (kv *BTreeKVStore) TableSchema(name string) (*schema.Schema, error) {
+	meta, ok := kv.catalog.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("table %s does not exist", name)
 	}
-	rootID := page.ID()
+	return meta.Schema, nil
+}
 
-	err = kv.catalog.CreateTable(name, rootID, int32(degree))
-	if err != nil {
+func (kv *BTreeKVStore) createTable(entry *LogEntry) error {
+	if err := kv.logDDL(entry); err != nil {
 		return err
 	}
 
-	return kv.catalog.Save()
-
+	// The root page is assigned when the empty tree is first flushed.
+	return kv.Flush(entry.Table)
 }
 
-// Put inserts or updates a key-value pair in the KVStore.
-func (kv *BTreeKVStore) Put(table string, key int, value string) error {
-	kv.tablesMu.RLock()
-	bt, exists := kv.tables[table]
-	kv.tablesMu.RUnlock()
+// SetCompression changes the codec used for a table's pages.
+// It applies to pages written from now on; existing pages stay readable as they are.
+func (kv *BTreeKVStore) SetCompression(name string, codec compression.Codec) error {
+	return kv.alterTable(&LogEntry{Operation: "ALTER_TABLE", Table: name, Value: codec.String()})
+}
 
-	if !exists {
+func (kv *BTreeKVStore) alterTable(entry *LogEntry) error {
+	if err := kv.logDDL(entry); err != nil {
+		return err
+	}
 
-		meta, ok := kv.catalog.Get(table)
-		if !ok {
-			return fmt.Errorf("table %s does not exist", table)
-		}
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+	return kv.catalog.Save()
+}
 
-		rootPage, err := kv.diskManager.ReadPage(meta.RootID)
-		if err != nil {
-			return err
-		}
+// AddColumn adds a column to a table with a schema. Rows already stored are not
+// rewritten: they read the new column as its default.
+func (kv *BTreeKVStore) AddColumn(name string, column schema.Column) error {
+	return kv.alterSchema(name, func(s *schema.Schema) (*schema.Schema, error) {
+		return s.AddColumn(column)
+	})
+}
 
-		bt, err = btree.Deserialize(rootPage.Data(), kv.GetPageDataByID)
-		if err != nil {
-			return err
-		}
+// DropColumn removes a column from a table with a schema. Rows already stored keep
+// their value for it until they are written again.
+func (kv *BTreeKVStore) DropColumn(name, column string) error {
+	return kv.alterSchema(name, func(s *schema.Schema) (*schema.Schema, error) {
+		return s.DropColumn(column)
+	})
+}
 
-		kv.tablesMu.Lock()
-		kv.tables[table] = bt
-		kv.tablesMu.Unlock()
+// alterSchema replaces the schema of a table with the one change returns for it. It
+// waits until no transaction holds a lock in the table, so none writes rows of the old
+// schema once the new one is in place.
+func (kv *BTreeKVStore) alterSchema(name string, change func(*schema.Schema) (*schema.Schema, error)) error {
+	owner := kv.locks.newOwner()
+	defer kv.locks.release(owner)
+	if err := kv.locks.acquire(owner, tableResource(name), LockExclusive); err != nil {
+		return err
+	}
 
+	current, err := kv.TableSchema(name)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf("table %s has no schema to alter", name)
 	}
-	entry := &LogEntry{Operation: "PUT", Key: key, Value: value, Table: table}
-	if err := kv.log.Append(entry); err != nil {
+	s, err := change(current)
+	if err != nil {
 		return err
 	}
+	return kv.alterTable(&LogEntry{Operation: "ALTER_TABLE", Table: name, Schema: s.Definition()})
+}
 
-	bt.Insert(key, value)
-	return kv.Flush(table)
+// RenameTable gives a table a new name. It waits until no transaction holds a lock in
+// the table.
+func (kv *BTreeKVStore) RenameTable(name, newName string) error {
+	owner := kv.locks.newOwner()
+	defer kv.locks.release(owner)
+	if err := kv.locks.acquire(owner, tableResource(name), LockExclusive); err != nil {
+		return err
+	}
+	return kv.renameTable(&LogEntry{Operation: "RENAME_TABLE", Table: name, Value: newName})
 }
 
-// Get retrieves the value associated with a key.
-func (kv *BTreeKVStore) Get(table string, key int) (string, bool, error) {
-	kv.tablesMu.RLock()
-	bt, exists := kv.tables[table]
-	kv.tablesMu.RUnlock()
+// renameTable logs a rename, then commits the tree under its new name at once. Records
+// logged before the rename name the table by its old name, which replay no longer
+// finds once the catalog with the new name is committed, so the changes they hold must
+// reach disk with it.
+func (kv *BTreeKVStore) renameTable(entry *LogEntry) error {
+	if err := kv.logDDL(entry); err != nil {
+		return err
+	}
 
-	if !exists {
-		meta, ok := kv.catalog.Get(table)
-		if !ok {
-			return "", false, fmt.Errorf("table %s does not exists", table)
-		}
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+	return kv.commit([]string{entry.Value}, true)
+}
 
-		rootPage, err := kv.diskManager.ReadPage(meta.RootID)
-		if err != nil {
-			return "", false, err
-		}
+// Put inserts or updates a key-value pair in the KVStore.
+// The change is durable once it is in the log; the tree reaches disk with the next Flush.
+// It waits while a transaction holds a lock on the key or its table.
+func (kv *BTreeKVStore) Put(table string, key int, value string) error {
+	return kv.withKeyLock(table, key, func() error {
+		return kv.put(&LogEntry{Operation: "PUT", Key: key, Value: value, Table: table})
+	})
+}
 
-		bt, err = btree.Deserialize(rootPage.Data(), kv.GetPageDataByID)
-		if err != nil {
-			return "", false, err
-		}
+func (kv *BTreeKVStore) put(entry *LogEntry) error {
+	bt, err := kv.table(entry.Table)
+	if err != nil {
+		return err
+	}
 
-		kv.tablesMu.Lock()
-		kv.tables[table] = bt
-		kv.tablesMu.Unlock()
+	lsn, err := kv.logAndApply(bt, entry, func(lsn uint64) {
+		bt.InsertAt(entry.Key, entry.Value, lsn)
+	})
+	if err != nil {
+		return err
+	}
+	return kv.awaitLog(lsn)
+}
+
+// Get retrieves the value associated with a key.
+func (kv *BTreeKVStore) Get(table string, key int) (string, bool, error) {
+	bt, err := kv.table(table)
+	if err != nil {
+		return "", false, err
 	}
 
 	value, found := bt.Search(key)
@@ -135,81 +245,150 @@ func (kv *BTreeKVStore) Get(table string, key int) (string, bool, error) {
 }
 
 // Delete removes a key-value pair from the KVStore.
+// Like Put, it is durable once logged and reaches the tree on disk with the next Flush,
+// and waits for the locks of transactions.
 func (kv *BTreeKVStore) Delete(table string, key int) error {
-	kv.tablesMu.RLock()
-	bt, exists := kv.tables[table]
-	kv.tablesMu.RUnlock()
+	return kv.withKeyLock(table, key, func() error {
+		return kv.delete(&LogEntry{Operation: "DELETE", Table: table, Key: key})
+	})
+}
 
-	if !exists {
-		meta, ok := kv.catalog.Get(table)
-		if !ok {
-			return fmt.Errorf("table %s does not exist", table)
-		}
+func (kv *BTreeKVStore) delete(entry *LogEntry) error {
+	bt, err := kv.table(entry.Table)
+	if err != nil {
+		return err
+	}
 
-		rootPage, err := kv.diskManager.ReadPage(meta.RootID)
-		if err != nil {
-			return err
-		}
-		bt, err := btree.Deserialize(rootPage.Data(), kv.GetPageDataByID)
-		if err != nil {
-			return err
-		}
+	lsn, err := kv.logAndApply(bt, entry, func(lsn uint64) {
+		bt.DeleteAt(entry.Key, lsn)
+	})
+	if err != nil {
+		return err
+	}
+	return kv.awaitLog(lsn)
+}
 
-		kv.tablesMu.Lock()
-		kv.tables[table] = bt
-		kv.tablesMu.Unlock()
+// logAndApply queues entry, a change to bt, in the log and applies the change in memory,
+// returning the LSN of its record, which apply receives to stamp the pages it changes.
+// The record also carries the value the key had before, for the change feed. Concurrent
+// writers are group committed: the record is written by the log's flusher together with
+// those of other writers, and awaitLog waits for it.
+func (kv *BTreeKVStore) logAndApply(bt *btree.BTree, entry *LogEntry, apply func(lsn uint64)) (uint64, error) {
+	kv.writeMu.Lock()
+	defer kv.writeMu.Unlock()
+
+	if old, found := bt.Search(entry.Key); found {
+		value := old.(string)
+		entry.OldValue = &value
 	}
+	lsn, err := kv.log.enqueue(entry)
+	if err != nil {
+		return 0, err
+	}
+	kv.versions.record(entry)
+	apply(lsn)
+	kv.feed.publish(entry)
+	return lsn, nil
+}
 
-	entry := &LogEntry{Operation: "DELETE", Table: table, Key: key}
-	if err := kv.log.Append(entry); err != nil {
+// awaitLog waits until the record with the given LSN is written to the log.
+func (kv *BTreeKVStore) awaitLog(lsn uint64) error {
+	if err := kv.log.wait(lsn); err != nil {
 		return err
 	}
-	bt.Delete(key)
-	return kv.Flush(table)
+	kv.feed.written(lsn)
+	kv.checkLogSize()
+	return nil
 }
 
 // Flush saves the in-memory B-Tree structure to disk.
+//
+// Nodes changed since the last flush are written to new pages, leaving the pages of
+// the committed tree untouched, and the new root is then committed through the catalog.
+// A crash at any point therefore leaves either the old or the new tree on disk.
+// Pages of the old tree are only reused after the commit.
 func (kv *BTreeKVStore) Flush(table string) error {
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+
 	kv.tablesMu.RLock()
-	bt, exists := kv.tables[table]
+	_, exists := kv.tables[table]
 	kv.tablesMu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("table %s does not exist", table)
 	}
+	return kv.commit([]string{table}, false)
+}
 
-	meta, ok := kv.catalog.Get(table)
-	if !ok {
-		return fmt.Errorf("table %s not registered on catalog", table)
+// commit persists the given tables and commits their new roots with a single catalog save.
+// The catalog is saved even if no root changed when force is set. The caller must hold flushMu.
+func (kv *BTreeKVStore) commit(tables []string, force bool) error {
+	released := kv.dropped
+	changed := force || len(released) > 0
+
+	for _, table := range tables {
+		kv.tablesMu.RLock()
+		bt, exists := kv.tables[table]
+		kv.tablesMu.RUnlock()
+		if !exists {
+			continue
+		}
+
+		meta, ok := kv.catalog.Get(table)
+		if !ok {
+			return fmt.Errorf("table %s not registered on catalog", table)
+		}
+
+		rootID, freed, err := bt.Persist(kv.allocatePageID, func(id int32, data []byte) error {
+			page := disk.NewFilePage(id)
+			page.SetCodec(meta.Compression)
+			page.SetData(data)
+			return kv.diskManager.WritePage(page)
+		})
+		if err != nil {
+			return err
+		}
+		if rootID == meta.RootID && len(freed) == 0 {
+			continue
+		}
+
+		if err := kv.catalog.SetRoot(table, rootID); err != nil {
+			return err
+		}
+		released = append(released, freed...)
+		changed = true
 	}
 
-	data, err := bt.Serialize()
-	if err != nil {
+	if !changed {
+		return nil
+	}
+	// A page may hold a change applied while its record was still queued. The record must
+	// be written before the page is committed, or a crash could keep part of a transaction.
+	if err := kv.log.wait(kv.log.LastLSN()); err != nil {
 		return err
 	}
-	page := disk.NewFilePage(meta.RootID)
-	page.SetData(data)
-
-	if err := kv.diskManager.WritePage(page); err != nil {
+	if err := kv.catalog.Save(); err != nil {
 		return err
 	}
 
-	return kv.catalog.Save()
+	for _, id := range released {
+		kv.diskManager.FreePage(id)
+	}
+	kv.dropped = nil
+	return nil
 }
 
-// Load restores the KVStore state by replaying the append-only log.
+// Load restores the KVStore state from the committed tables and the log.
+// Only changes logged after the last checkpoint are replayed, and of those only the
+// ones the committed pages do not reflect yet; see redo.
 func (kv *BTreeKVStore) Load() error {
 	if err := kv.catalog.Load(); err != nil {
 		return err
 	}
 
 	for name, meta := range kv.catalog.All() {
-		rootPage, err := kv.diskManager.ReadPage(meta.RootID)
-		if err != nil {
-			return err
-		}
-
-		bt, err := btree.Deserialize(rootPage.Data(), kv.GetPageDataByID)
+		bt, err := kv.readTable(meta)
 		if err != nil {
 			return err
 		}
@@ -218,48 +397,199 @@ func (kv *BTreeKVStore) Load() error {
 		kv.tablesMu.Unlock()
 	}
 
+	kv.reclaimUnreachablePages()
+
 	entries, err := kv.log.Replay()
 	if err != nil {
 		return err
 	}
 
+	// Replayed changes to the tables need the same locks as logged ones.
+	kv.writeMu.Lock()
+	defer kv.writeMu.Unlock()
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+
+	// The log is only reset up to a committed checkpoint, so a later start means the
+	// database file is older than the log and the changes in between are lost.
+	checkpoint := kv.catalog.CheckpointLSN()
+	if base := kv.log.baseLSN(); base > checkpoint {
+		return fmt.Errorf("log starts after LSN %d but the database was checkpointed at LSN %d", base, checkpoint)
+	}
+
+	var stats RecoveryStats
 	for _, entry := range entries {
+		if entry.LSN <= checkpoint {
+			continue
+		}
+		if kv.redo(entry) {
+			stats.Replayed++
+		} else {
+			stats.Skipped++
+		}
+	}
+	kv.recovery = stats
 
-		kv.tablesMu.RLock()
-		bt, ok := kv.tables[entry.Table]
-		kv.tablesMu.RUnlock()
+	// A log ending before the checkpoint only holds changes the tables already have,
+	// as when a crash interrupted the reset that follows a checkpoint. New records must
+	// be numbered after the checkpoint.
+	if kv.log.LastLSN() < checkpoint {
+		if err := kv.log.Reset(checkpoint); err != nil {
+			return err
+		}
+	}
+	kv.feed.reset(kv.log.LastLSN())
+	return nil
+}
 
-		if !ok {
-			meta, ok := kv.catalog.Get(entry.Table)
-			if !ok {
-				continue
+// redo applies a logged change to the tables in memory and reports whether it did.
+// Every page is stamped with the LSN of the last change to it, so a change whose LSN
+// is at or below that of the page covering its key already reached disk and is skipped.
+// Changes to tables that no longer exist, or to an earlier table of the same name, are
+// ignored. Changes to the tables themselves are replayed in order with the data; see redoDDL.
+// The caller must hold writeMu and flushMu.
+func (kv *BTreeKVStore) redo(entry *LogEntry) bool {
+	switch entry.Operation {
+	case "CREATE_TABLE", "DROP_TABLE", "ALTER_TABLE", "RENAME_TABLE":
+		return kv.redoDDL(entry)
+	case "COMMIT":
+		// The record was written whole or not at all, so the transaction is replayed
+		// whole, but for the changes its pages already hold. The changes share an LSN, so
+		// those are picked out before replaying any stamps the pages with it.
+		var trees []*btree.BTree
+		var changes []*LogEntry
+		for _, change := range entry.Changes {
+			if bt := kv.redoTarget(change); bt != nil {
+				trees, changes = append(trees, bt), append(changes, change)
 			}
+		}
+		for i, change := range changes {
+			redoChange(trees[i], change)
+		}
+		return len(changes) > 0
+	}
 
-			rootPage, err := kv.diskManager.ReadPage(meta.RootID)
-			if err != nil {
-				return err
-			}
+	bt := kv.redoTarget(entry)
+	if bt == nil {
+		return false
+	}
+	redoChange(bt, entry)
+	return true
+}
 
-			bt, err = btree.Deserialize(rootPage.Data(), kv.GetPageDataByID)
-			if err != nil {
-				return err
-			}
+// redoTarget returns the tree a logged put or delete is to be replayed on, or nil if it
+// is to be skipped.
+func (kv *BTreeKVStore) redoTarget(entry *LogEntry) *btree.BTree {
+	if meta, ok := kv.catalog.Get(entry.Table); !ok || meta.CreateLSN > entry.LSN {
+		return nil
+	}
+	bt, err := kv.table(entry.Table)
+	if err != nil {
+		return nil
+	}
+	if bt.PageLSN(entry.Key) >= entry.LSN {
+		return nil
+	}
+	return bt
+}
 
-			kv.tablesMu.Lock()
-			kv.tables[entry.Table] = bt
-			kv.tablesMu.Unlock()
-		}
+// redoChange applies a logged put or delete to bt.
+func redoChange(bt *btree.BTree, entry *LogEntry) {
+	if entry.Operation == "DELETE" {
+		bt.DeleteAt(entry.Key, entry.LSN)
+	} else {
+		bt.InsertAt(entry.Key, entry.Value, entry.LSN)
+	}
+}
+
+// RecoveryStats counts what the last Load did with the log records written after the
+// checkpoint.
+type RecoveryStats struct {
+	Replayed int // Records applied to the tables.
+	Skipped  int // Records already reflected in the committed pages, or for dropped tables.
+}
+
+// RecoveryStats returns what the last Load did with the log.
+func (kv *BTreeKVStore) RecoveryStats() RecoveryStats {
+	return kv.recovery
+}
+
+// table returns the B-Tree of a table, reading it from disk on first use.
+func (kv *BTreeKVStore) table(name string) (*btree.BTree, error) {
+	kv.tablesMu.RLock()
+	bt, exists := kv.tables[name]
+	kv.tablesMu.RUnlock()
+	if exists {
+		return bt, nil
+	}
+
+	meta, ok := kv.catalog.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("table %s does not exist", name)
+	}
+
+	bt, err := kv.readTable(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	kv.tablesMu.Lock()
+	defer kv.tablesMu.Unlock()
+	if existing, ok := kv.tables[name]; ok {
+		return existing, nil
+	}
+	kv.tables[name] = bt
+	return bt, nil
+}
+
+// readTable reads a table's committed B-Tree from disk.
+func (kv *BTreeKVStore) readTable(meta *catalog.TableMetadata) (*btree.BTree, error) {
+	if meta.RootID == 0 {
+		return btree.NewBTree(int(meta.Degree)), nil
+	}
+
+	rootPage, err := kv.diskManager.ReadPage(meta.RootID)
+	if err != nil {
+		return nil, err
+	}
+	return btree.Deserialize(rootPage.Data(), kv.GetPageDataByID)
+}
 
-		switch entry.Operation {
-		case "PUT":
-			bt.Insert(entry.Key, entry.Value)
-		case "DELETE":
-			bt.Delete(entry.Key)
+// reclaimUnreachablePages returns every page not referenced by the catalog or a
+// loaded table to the freelist. The freelist lives in memory only, so pages freed
+// before a restart, or written by a commit that never completed, are found here.
+func (kv *BTreeKVStore) reclaimUnreachablePages() {
+	reachable := make(map[int32]struct{})
+	for _, id := range kv.livePages() {
+		reachable[id] = struct{}{}
+	}
+
+	for id := int32(0); id <= kv.diskManager.GetLastAllocatedPageID(); id++ {
+		if _, ok := reachable[id]; !ok {
+			kv.diskManager.FreePage(id)
 		}
 	}
+}
 
-	return nil
+// livePages returns the IDs of the pages referenced by the catalog and the loaded tables,
+// including those of tables dropped since the last commit.
+func (kv *BTreeKVStore) livePages() []int32 {
+	pages := append(kv.catalog.Pages(), kv.dropped...)
+
+	kv.tablesMu.RLock()
+	defer kv.tablesMu.RUnlock()
+	for _, bt := range kv.tables {
+		pages = append(pages, bt.PageIDs()...)
+	}
+	return pages
+}
 
+func (kv *BTreeKVStore) allocatePageID() (int32, error) {
+	page, err := kv.diskManager.AllocatePage()
+	if err != nil {
+		return 0, err
+	}
+	return page.ID(), nil
 }
 
 // GetPageDataByID retrieves the raw page data for a given page ID.
@@ -271,44 +601,70 @@ func (kv *BTreeKVStore) GetPageDataByID(pageID int32) ([]byte, error) {
 	return page.Data(), nil
 }
 
-// Close releases resources held by the KVStore.
+// Close checkpoints the KVStore, so the next Load has nothing to replay, and releases
+// the resources it holds.
 func (kv *BTreeKVStore) Close() error {
+	kv.feed.close()
+	if _, err := kv.Checkpoint(); err != nil {
+		return err
+	}
 	if err := kv.log.Close(); err != nil {
 		return err
 	}
 	return kv.diskManager.Close()
 }
 
+// FlushAll flushes every loaded table, committing them together.
+func (kv *BTreeKVStore) FlushAll() error {
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+
+	return kv.commit(kv.tableNames(), false)
+}
+
+// tableNames returns the names of the loaded tables.
+func (kv *BTreeKVStore) tableNames() []string {
+	kv.tablesMu.RLock()
+	defer kv.tablesMu.RUnlock()
+
+	names := make([]string, 0, len(kv.tables))
+	for table := range kv.tables {
+		names = append(names, table)
+	}
+	return names
+}
+
 // StartPeriodicFlush periodically saves the B-Tree to disk at the specified interval.
 func (kv *BTreeKVStore) StartPeriodicFlush(interval time.Duration) {
 
 	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
-			kv.tablesMu.RLock()
-			for table := range kv.tables {
-				kv.Flush(table)
-			}
-			kv.tablesMu.RUnlock()
+			kv.FlushAll()
 		}
 	}()
 }
 
 // DropTable removes a table from the KVStore and the catalog.
+// The table's pages are freed once the catalog without it is committed. It waits until no
+// transaction holds a lock in the table.
 func (kv *BTreeKVStore) DropTable(name string) error {
-	kv.tablesMu.Lock()
-	defer kv.tablesMu.Unlock()
-
-	if _, exists := kv.tables[name]; !exists {
-		return fmt.Errorf("table %s does not exist", name)
+	owner := kv.locks.newOwner()
+	defer kv.locks.release(owner)
+	if err := kv.locks.acquire(owner, tableResource(name), LockExclusive); err != nil {
+		return err
 	}
+	return kv.dropTable(&LogEntry{Operation: "DROP_TABLE", Table: name})
+}
 
-	if err := kv.catalog.DropTable(name); err != nil {
+func (kv *BTreeKVStore) dropTable(entry *LogEntry) error {
+	if err := kv.logDDL(entry); err != nil {
 		return err
 	}
 
-	delete(kv.tables, name)
-	return nil
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+	return kv.commit(nil, true)
 }
 
 // IsTableExists checks if a table exists in the KVStore.
@@ -321,6 +677,6 @@ func SerializeNodeForTest(bt *btree.BTree) ([]byte, error) {
 	return bt.Serialize()
 }
 
-func DeserializeNodeForTest(data []byte, fetchPageData func(int32) ([]byte, error)) (*btree.BTree, error) {
-	return btree.Deserialize(data, fetchPageData)
+func DeserializeNodeForTest(data []byte, fetchPage func(int32) ([]byte, error)) (*btree.BTree, error) {
+	return btree.Deserialize(data, fetchPage)
 }
@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/rafaelmgr12/litegodb/internal/storage/btree"
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
 	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
 )
 
 const (
@@ -33,7 +39,7 @@ func setupTestKVStore(t *testing.T) (*kvstore.BTreeKVStore, func()) {
 		store.Close()
 		diskManager.Close()
 		os.Remove(dbFile)
-		os.Remove(logFile)
+		os.RemoveAll(logFile)
 	}
 
 	return store, cleanup
@@ -177,7 +183,7 @@ func TestPeriodicFlush(t *testing.T) {
 	logFile := "test_periodic_flush.log"
 	store, _ := kvstore.NewBTreeKVStore(3, diskManager, logFile)
 	defer os.Remove("test_periodic_flush.db")
-	defer os.Remove(logFile)
+	defer os.RemoveAll(logFile)
 	defer store.Close()
 
 	table := "flush_table"
@@ -212,6 +218,233 @@ func TestDropTable(t *testing.T) {
 	}
 }
 
+// failingSyncDisk fails every sync once failing is set, so no commit completes.
+type failingSyncDisk struct {
+	disk.DiskManager
+	failing bool
+}
+
+func (d *failingSyncDisk) Sync() error {
+	if d.failing {
+		return fmt.Errorf("sync failed")
+	}
+	return d.DiskManager.Sync()
+}
+
+// TestTableChangesReplayedFromLog crashes before creating and dropping tables reaches the
+// catalog on disk: the log alone recreates the catalog, and the data of a table is told
+// apart from that of an earlier table with the same name.
+func TestTableChangesReplayedFromLog(t *testing.T) {
+	diskManager, err := disk.NewFileDiskManager(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	defer os.Remove(dbFile)
+	defer os.RemoveAll(logFile)
+	failing := &failingSyncDisk{DiskManager: diskManager}
+	store, err := kvstore.NewBTreeKVStore(3, failing, logFile)
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+
+	for _, table := range []string{"dropped", "reused"} {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := store.Put(table, 1, "old"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.DropTable("reused"); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	if err := store.CreateTableName("reused", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := store.Put("reused", 2, "new"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// From here on nothing reaches the database file.
+	failing.failing = true
+	if err := store.CreateTableName("created", 3); err == nil {
+		t.Fatalf("Expected the commit of the new table to fail")
+	}
+	if err := store.Put("created", 1, "logged"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.DropTable("dropped"); err == nil {
+		t.Fatalf("Expected the commit of the drop to fail")
+	}
+	diskManager.Close()
+
+	reopened := reopenStore(t)
+	defer reopened.Close()
+	assertGet(t, reopened, "created", 1, "logged")
+	if reopened.IsTableExists("dropped") {
+		t.Fatalf("Expected table dropped to stay dropped")
+	}
+	assertNotFound(t, reopened, "reused", 1)
+	assertGet(t, reopened, "reused", 2, "new")
+}
+
+// TestTableSchemaPersists checks that the schema of a table survives a restart, whether
+// the table reached the catalog on disk or is only recreated from the log.
+func TestTableSchemaPersists(t *testing.T) {
+	diskManager, err := disk.NewFileDiskManager(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	defer os.Remove(dbFile)
+	defer os.RemoveAll(logFile)
+	failing := &failingSyncDisk{DiskManager: diskManager}
+	store, err := kvstore.NewBTreeKVStore(3, failing, logFile)
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+
+	users, err := schema.Parse("id INT PRIMARY KEY, name TEXT, active BOOL")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if err := store.CreateTableWithSchema("users", 3, compression.None, users); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	row, _ := users.Encode(schema.Row{int64(1), "alice", true})
+	if err := store.Put("users", 1, row); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// The second table only reaches the log.
+	failing.failing = true
+	events, _ := schema.Parse("id INT PRIMARY KEY, kind TEXT NOT NULL")
+	if err := store.CreateTableWithSchema("events", 3, compression.None, events); err == nil {
+		t.Fatalf("Expected the commit of the new table to fail")
+	}
+	diskManager.Close()
+
+	reopened := reopenStore(t)
+	defer reopened.Close()
+	for table, expected := range map[string]*schema.Schema{"users": users, "events": events} {
+		s, err := reopened.TableSchema(table)
+		if err != nil || s == nil || s.String() != expected.String() {
+			t.Fatalf("Expected table %s to have schema %q, got %v (%v)", table, expected, s, err)
+		}
+	}
+	assertGet(t, reopened, "users", 1, row)
+
+	if err := reopened.CreateTableName("plain", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if s, err := reopened.TableSchema("plain"); err != nil || s != nil {
+		t.Fatalf("Expected no schema for a key-value table, got %v (%v)", s, err)
+	}
+	if _, err := reopened.TableSchema("missing"); err == nil {
+		t.Fatalf("Expected an error for a missing table")
+	}
+}
+
+// TestAlterTableReplayedFromLog renames a table and changes its columns without the
+// catalog reaching disk: the log alone redoes the changes, and rows written before them
+// read with the new schema.
+func TestAlterTableReplayedFromLog(t *testing.T) {
+	diskManager, err := disk.NewFileDiskManager(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	defer os.Remove(dbFile)
+	defer os.RemoveAll(logFile)
+	failing := &failingSyncDisk{DiskManager: diskManager}
+	store, err := kvstore.NewBTreeKVStore(3, failing, logFile)
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+
+	users, _ := schema.Parse("id INT PRIMARY KEY, name TEXT, age INT")
+	if err := store.CreateTableWithSchema("users", 3, compression.None, users); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	row, _ := users.Encode(schema.Row{int64(1), "alice", int64(30)})
+	if err := store.Put("users", 1, row); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.CreateTableName("plain", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := store.RenameTable("users", "plain"); err == nil {
+		t.Fatalf("Expected renaming onto an existing table to fail")
+	}
+	if err := store.AddColumn("plain", schema.Column{Name: "age", Type: schema.Int}); err == nil {
+		t.Fatalf("Expected adding a column to a table without a schema to fail")
+	}
+	if err := store.DropColumn("users", "id"); err == nil {
+		t.Fatalf("Expected dropping the primary key to fail")
+	}
+	if err := store.AddColumn("users", schema.Column{Name: "active", Type: schema.Bool, NotNull: true}); err == nil {
+		t.Fatalf("Expected adding a NOT NULL column without a default to fail")
+	}
+
+	// From here on the changes only reach the log.
+	failing.failing = true
+	if err := store.RenameTable("users", "people"); err == nil {
+		t.Fatalf("Expected the commit of the renamed table to fail")
+	}
+	if err := store.AddColumn("people", schema.Column{Name: "active", Type: schema.Bool, NotNull: true, Default: true}); err == nil {
+		t.Fatalf("Expected the commit of the new column to fail")
+	}
+	if err := store.DropColumn("people", "age"); err == nil {
+		t.Fatalf("Expected the commit of the dropped column to fail")
+	}
+	people, err := store.TableSchema("people")
+	if err != nil || people == nil {
+		t.Fatalf("Expected the renamed table to have a schema, got %v (%v)", people, err)
+	}
+	if expected := "id INT PRIMARY KEY, name TEXT, active BOOL NOT NULL DEFAULT TRUE"; people.String() != expected {
+		t.Fatalf("Expected schema %q, got %q", expected, people.String())
+	}
+	row, _ = people.Encode(schema.Row{int64(2), "bob", false})
+	if err := store.Put("people", 2, row); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	diskManager.Close()
+
+	reopened := reopenStore(t)
+	if reopened.IsTableExists("users") {
+		t.Fatalf("Expected table users to be renamed")
+	}
+	s, err := reopened.TableSchema("people")
+	if err != nil || s == nil || s.Definition() != people.Definition() {
+		t.Fatalf("Expected schema %q, got %v (%v)", people.Definition(), s, err)
+	}
+	for key, expected := range map[int]schema.Row{
+		1: {int64(1), "alice", true},
+		2: {int64(2), "bob", false},
+	} {
+		value, found, err := reopened.Get("people", key)
+		if err != nil || !found {
+			t.Fatalf("Expected key %d in table people, got %v (%v)", key, found, err)
+		}
+		row, err := s.Decode(key, value)
+		if err != nil || !reflect.DeepEqual(row, expected) {
+			t.Fatalf("Expected row %v, got %v (%v)", expected, row, err)
+		}
+	}
+
+	// A rename commits the table, so it survives a reopen without the log.
+	if err := reopened.RenameTable("people", "members"); err != nil {
+		t.Fatalf("RenameTable failed: %v", err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	os.RemoveAll(logFile)
+	reopened = reopenStore(t)
+	defer reopened.Close()
+	if _, found, err := reopened.Get("members", 2); err != nil || !found {
+		t.Fatalf("Expected key 2 in table members, got %v (%v)", found, err)
+	}
+}
+
 func TestConcurrentPutAndFlush(t *testing.T) {
 	tree := btree.NewBTree(3)
 
@@ -264,6 +497,7 @@ func TestSerializeDeterministicOutput(t *testing.T) {
 }
 
 func assertGet(t *testing.T, store *kvstore.BTreeKVStore, table string, key int, expected string) {
+	t.Helper()
 	value, found, err := store.Get(table, key)
 	if err != nil {
 		t.Fatalf("GET failed: %v", err)
@@ -282,3 +516,510 @@ func assertNotFound(t *testing.T, store *kvstore.BTreeKVStore, table string, key
 		t.Fatalf("Expected key %d to be missing, found value '%s'", key, value)
 	}
 }
+
+func TestCompressedTable(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	table := "documents"
+	if err := store.CreateTableWithCompression(table, 3, compression.LZ); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// Together these values are larger than a page and only fit once compressed.
+	value := strings.Repeat(`{"status":"active","plan":"enterprise"},`, 40)
+	for key := 1; key <= 5; key++ {
+		if err := store.Put(table, key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.Flush(table); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	diskManager, _ := disk.NewFileDiskManager(dbFile)
+	reopened, err := kvstore.NewBTreeKVStore(3, diskManager, logFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+
+	for key := 1; key <= 5; key++ {
+		assertGet(t, reopened, table, key, value)
+	}
+}
+
+func TestFlushCommitsWholeTree(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	table := "multi_level"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	for key := 0; key < 500; key++ {
+		if err := store.Put(table, key, fmt.Sprintf("value%d", key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.Flush(table); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Overwrites and deletes after the first commit only rewrite the changed nodes.
+	for key := 0; key < 500; key += 2 {
+		if err := store.Put(table, key, fmt.Sprintf("updated%d", key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for key := 1; key < 500; key += 4 {
+		if err := store.Delete(table, key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	if err := store.Flush(table); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Reopen without replaying the log so only the committed tree is read.
+	diskManager, _ := disk.NewFileDiskManager(dbFile)
+	reopened, err := kvstore.NewBTreeKVStore(3, diskManager, logFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+
+	for key := 0; key < 500; key++ {
+		switch {
+		case key%2 == 0:
+			assertGet(t, reopened, table, key, fmt.Sprintf("updated%d", key))
+		case key%4 == 1:
+			assertNotFound(t, reopened, table, key)
+		default:
+			assertGet(t, reopened, table, key, fmt.Sprintf("value%d", key))
+		}
+	}
+}
+
+func TestUnflushedChangesRecoveredFromLog(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	table := "pending"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := store.Put(table, 1, "flushed"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Flush(table); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := store.Put(table, 2, "logged"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	diskManager, _ := disk.NewFileDiskManager(dbFile)
+	reopened, err := kvstore.NewBTreeKVStore(3, diskManager, logFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+
+	assertGet(t, reopened, table, 1, "flushed")
+	assertNotFound(t, reopened, table, 2)
+
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	assertGet(t, reopened, table, 1, "flushed")
+	assertGet(t, reopened, table, 2, "logged")
+}
+
+// TestRedoSkipsChangesOnFlushedPages crashes with one table flushed part way through the
+// writes and the other never flushed: only the changes missing from the pages are replayed.
+func TestRedoSkipsChangesOnFlushedPages(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	tables := []string{"flushed", "pending"}
+	for _, table := range tables {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	put := func(key int, value string) {
+		for _, table := range tables {
+			if err := store.Put(table, key, value); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+	}
+
+	for key := 0; key < 20; key++ {
+		put(key, fmt.Sprintf("v1-%d", key))
+	}
+	if err := store.Flush("flushed"); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for key := 0; key < 5; key++ {
+		put(key, fmt.Sprintf("v2-%d", key))
+	}
+	if err := store.Delete("flushed", 10); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	reopened := reopenStore(t)
+	defer reopened.Close()
+
+	// The CREATE TABLE records were committed by the tables' first flush.
+	stats := reopened.RecoveryStats()
+	if stats.Skipped != 22 || stats.Replayed != 31 {
+		t.Fatalf("Expected 22 records skipped and 31 replayed, got %+v", stats)
+	}
+	for _, table := range tables {
+		for key := 0; key < 20; key++ {
+			want := fmt.Sprintf("v1-%d", key)
+			if key < 5 {
+				want = fmt.Sprintf("v2-%d", key)
+			}
+			if table == "flushed" && key == 10 {
+				assertNotFound(t, reopened, table, key)
+				continue
+			}
+			assertGet(t, reopened, table, key, want)
+		}
+	}
+}
+
+func TestVacuumShrinksFile(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	// The kept table is written after the dropped one, so its pages sit at the end of the file.
+	for _, table := range []string{"dropped", "kept"} {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		for key := 0; key < 2000; key++ {
+			if err := store.Put(table, key, fmt.Sprintf("%s%d", table, key)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		if err := store.Flush(table); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+
+	if err := store.DropTable("dropped"); err != nil {
+		t.Fatalf("DropTable failed: %v", err)
+	}
+	for key := 0; key < 2000; key++ {
+		if key%10 == 0 {
+			continue
+		}
+		if err := store.Delete("kept", key); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	before := fileSize(t, dbFile)
+
+	// Reads keep being served while the vacuum runs.
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, found, err := store.Get("kept", 100); err != nil || !found {
+				t.Errorf("Get during vacuum: found=%v err=%v", found, err)
+				return
+			}
+		}
+	}()
+
+	stats, err := store.Vacuum()
+	close(done)
+	readers.Wait()
+	if err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+
+	after := fileSize(t, dbFile)
+	if after >= before {
+		t.Fatalf("Expected file to shrink, got %d bytes before and %d after", before, after)
+	}
+	if after != int64(stats.PagesAfter)*disk.PageSize {
+		t.Fatalf("Expected %d pages after vacuum, file is %d bytes", stats.PagesAfter, after)
+	}
+	if stats.PagesBefore <= stats.PagesAfter || stats.PagesMoved == 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// Reopen without replaying the log so only the vacuumed file is read.
+	diskManager, _ := disk.NewFileDiskManager(dbFile)
+	reopened, err := kvstore.NewBTreeKVStore(3, diskManager, logFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+
+	if reopened.IsTableExists("dropped") {
+		t.Fatalf("Dropped table is back after vacuum")
+	}
+	for key := 0; key < 2000; key++ {
+		if key%10 == 0 {
+			assertGet(t, reopened, "kept", key, fmt.Sprintf("kept%d", key))
+		} else {
+			assertNotFound(t, reopened, "kept", key)
+		}
+	}
+
+	// A second vacuum has nothing left to move.
+	again, err := reopened.Vacuum()
+	if err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	if again.PagesMoved != 0 || again.PagesAfter != stats.PagesAfter {
+		t.Fatalf("Expected an already compact file to stay as is, got %+v", again)
+	}
+}
+
+func TestManyTablesSurviveReopen(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	// Far more tables than fit in a single catalog page.
+	const tables = 1000
+	for i := 0; i < tables; i++ {
+		table := fmt.Sprintf("table_with_a_rather_long_name_%04d", i)
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table %s: %v", table, err)
+		}
+		if err := store.Put(table, i, table); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.FlushAll(); err != nil {
+		t.Fatalf("FlushAll failed: %v", err)
+	}
+	if _, err := store.Vacuum(); err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+
+	reopened := reopenStore(t)
+	defer reopened.Close()
+	for _, i := range []int{0, 999, tables - 1} {
+		table := fmt.Sprintf("table_with_a_rather_long_name_%04d", i)
+		assertGet(t, reopened, table, i, table)
+	}
+}
+
+// reopenStore opens the files of a store that was abandoned without closing, as after a crash.
+func reopenStore(t *testing.T) *kvstore.BTreeKVStore {
+	t.Helper()
+	diskManager, err := disk.NewFileDiskManager(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen DiskManager: %v", err)
+	}
+	store, err := kvstore.NewBTreeKVStore(3, diskManager, logFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return store
+}
+
+func TestCheckpointTruncatesLog(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	table := "checkpointed"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for key := 0; key < 100; key++ {
+		if err := store.Put(table, key, fmt.Sprintf("value%d", key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	sizeBefore := logSize(t, logFile)
+
+	lsn, err := store.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	// The CREATE TABLE record comes first.
+	if lsn != 101 {
+		t.Fatalf("Expected checkpoint LSN 101, got %d", lsn)
+	}
+	if size := logSize(t, logFile); size >= sizeBefore/10 {
+		t.Fatalf("Expected the log to be emptied, it went from %d to %d bytes", sizeBefore, size)
+	}
+
+	if err := store.Delete(table, 5); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	reopened := reopenStore(t)
+	defer reopened.Close()
+	assertGet(t, reopened, table, 4, "value4")
+	assertNotFound(t, reopened, table, 5)
+	assertGet(t, reopened, table, 99, "value99")
+}
+
+func TestCheckpointSurvivesInterruptedLogReset(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	table := "checkpointed"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for key := 0; key < 10; key++ {
+		if err := store.Put(table, key, "before"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if _, err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	// A crash after the covered segments were removed, before the next one was created,
+	// leaves no log at all; it starts over numbered from the start.
+	if err := os.RemoveAll(logFile); err != nil {
+		t.Fatalf("Failed to remove log: %v", err)
+	}
+
+	reopened := reopenStore(t)
+	if err := reopened.Put(table, 1, "after"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// The new write is numbered after the checkpoint, so it is not mistaken for a change
+	// the checkpoint already covers.
+	again := reopenStore(t)
+	defer again.Close()
+	assertGet(t, again, table, 0, "before")
+	assertGet(t, again, table, 1, "after")
+}
+
+func TestCheckpointTriggeredByLogSize(t *testing.T) {
+	store, cleanup := setupTestKVStore(t)
+	defer cleanup()
+
+	table := "busy"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	store.StartPeriodicCheckpoint(0, 4096)
+
+	for key := 0; key < 200; key++ {
+		if err := store.Put(table, key, strings.Repeat("x", 100)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for logSize(t, logFile) >= 4096 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a checkpoint to trim the log, it is %d bytes", logSize(t, logFile))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slowSyncFile counts the syncs of a log file and makes each one take a while, as on a disk.
+type slowSyncFile struct {
+	kvstore.LogFile
+	syncs atomic.Int32
+}
+
+func (f *slowSyncFile) Sync() error {
+	f.syncs.Add(1)
+	time.Sleep(5 * time.Millisecond)
+	return f.LogFile.Sync()
+}
+
+func TestConcurrentWritesShareSyncs(t *testing.T) {
+	diskManager, err := disk.NewFileDiskManager(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	var logFileWrapper *slowSyncFile
+	store, err := kvstore.NewBTreeKVStoreWithOptions(3, diskManager, logFile, kvstore.Options{
+		SyncWrites: true,
+		WrapLogFile: func(f kvstore.LogFile) kvstore.LogFile {
+			logFileWrapper = &slowSyncFile{LogFile: f}
+			return logFileWrapper
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+	defer func() {
+		diskManager.Close()
+		os.Remove(dbFile)
+		os.RemoveAll(logFile)
+	}()
+
+	table := "grouped"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	before := logFileWrapper.syncs.Load()
+
+	const writers = 100
+	var wg sync.WaitGroup
+	for key := 0; key < writers; key++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			if err := store.Put(table, key, fmt.Sprintf("value%d", key)); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	// Writers arriving during a sync are batched into the next one.
+	if syncs := logFileWrapper.syncs.Load() - before; syncs >= writers/2 {
+		t.Fatalf("Expected concurrent writes to share syncs, got %d syncs for %d writes", syncs, writers)
+	}
+
+	reopened := reopenStore(t)
+	defer reopened.Close()
+	for key := 0; key < writers; key++ {
+		assertGet(t, reopened, table, key, fmt.Sprintf("value%d", key))
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	return info.Size()
+}
+
+// logSize returns the total size of the segments in a log directory.
+func logSize(t *testing.T, dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dir, err)
+	}
+	var size int64
+	for _, entry := range entries {
+		size += fileSize(t, filepath.Join(dir, entry.Name()))
+	}
+	return size
+}
@@ -0,0 +1,362 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LockMode is the mode a lock is held in.
+type LockMode int
+
+const (
+	// LockShared lets other owners read the locked key or table, but not write it.
+	LockShared LockMode = iota + 1
+	// LockExclusive keeps every other owner from locking the key or table.
+	LockExclusive
+
+	// Intention locks are taken on a table before locking one of its keys, so a table
+	// lock conflicts with the key locks held in it.
+	lockIntentShared
+	lockIntentExclusive
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case LockShared:
+		return "shared"
+	case LockExclusive:
+		return "exclusive"
+	case lockIntentShared:
+		return "intent shared"
+	case lockIntentExclusive:
+		return "intent exclusive"
+	default:
+		return fmt.Sprintf("LockMode(%d)", int(m))
+	}
+}
+
+// intent returns the mode to lock a table in before locking one of its keys in mode m.
+func (m LockMode) intent() LockMode {
+	if m == LockExclusive {
+		return lockIntentExclusive
+	}
+	return lockIntentShared
+}
+
+// compatible reports whether two owners can hold a lock in modes a and b at once.
+func compatible(a, b LockMode) bool {
+	switch {
+	case a == LockExclusive || b == LockExclusive:
+		return false
+	case a == lockIntentExclusive && b == LockShared, a == LockShared && b == lockIntentExclusive:
+		return false
+	default:
+		return true
+	}
+}
+
+// combine returns the weakest mode that grants both a and b, where 0 is no lock.
+func combine(a, b LockMode) LockMode {
+	switch {
+	case a == 0 || a == b:
+		return b
+	case b == 0:
+		return a
+	case a == lockIntentShared:
+		return b
+	case b == lockIntentShared:
+		return a
+	default:
+		// Shared with intent exclusive, or anything with exclusive.
+		return LockExclusive
+	}
+}
+
+// ErrLockTimeout is returned when a lock is not granted within the store's lock timeout.
+// The transaction stays open and may retry or roll back.
+var ErrLockTimeout = errors.New("kvstore: lock wait timed out")
+
+// DeadlockError is returned to the transaction chosen to break a deadlock. Of those waiting
+// for each other, the one holding the fewest locks is chosen, so the least work is undone;
+// of several holding as few, the youngest. The transaction is rolled back, releasing its
+// locks so the others can proceed.
+type DeadlockError struct {
+	Tx    uint64   // Transaction rolled back.
+	Cycle []uint64 // Transactions that were waiting for each other, each for the next.
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("kvstore: deadlock detected, transaction %d rolled back (waits-for cycle %v)", e.Tx, e.Cycle)
+}
+
+// lockResource is a lock target: a table, or a key of a table.
+type lockResource struct {
+	table string
+	key   int
+	whole bool // The whole table rather than a key.
+}
+
+func tableResource(table string) lockResource {
+	return lockResource{table: table, whole: true}
+}
+
+func keyResource(table string, key int) lockResource {
+	return lockResource{table: table, key: key}
+}
+
+func (r lockResource) String() string {
+	if r.whole {
+		return "table " + r.table
+	}
+	return fmt.Sprintf("key %d of table %s", r.key, r.table)
+}
+
+// lockWait is a lock an owner is waiting for.
+type lockWait struct {
+	resource lockResource
+	mode     LockMode
+	result   chan error // Receives nil once granted, or the error that ends the wait.
+}
+
+// lockManager grants shared and exclusive locks on tables and keys to owners: the
+// transactions, and the single writes made outside them. Locks are held until the owner
+// releases them all at once. An owner waits for one lock at a time; a wait that would
+// close a cycle in the waits-for graph is a deadlock, broken by aborting one owner in the
+// cycle as described for DeadlockError.
+//
+// Waits for a resource are granted in arrival order: a request waits behind the earlier
+// waits it conflicts with, even if the holders would let it through, so a stream of
+// shared lockers cannot starve an exclusive one. Upgrades of a lock already held go
+// first, since the owners ahead wait for the very lock being upgraded.
+type lockManager struct {
+	timeout   time.Duration // How long to wait for a lock; 0 waits until granted or aborted.
+	lastOwner atomic.Uint64
+
+	mu      sync.Mutex
+	holders map[lockResource]map[uint64]LockMode // Mode each owner holds a resource in.
+	held    map[uint64][]lockResource            // Resources each owner holds.
+	waiting map[uint64]*lockWait                 // Lock each blocked owner waits for.
+	queues  map[lockResource][]uint64            // Owners waiting for each resource, in the order they are granted.
+}
+
+func newLockManager(timeout time.Duration) *lockManager {
+	return &lockManager{
+		timeout: timeout,
+		holders: make(map[lockResource]map[uint64]LockMode),
+		held:    make(map[uint64][]lockResource),
+		waiting: make(map[uint64]*lockWait),
+		queues:  make(map[lockResource][]uint64),
+	}
+}
+
+// newOwner returns an owner ID. Later owners get higher IDs, so the youngest is the highest.
+func (lm *lockManager) newOwner() uint64 {
+	return lm.lastOwner.Add(1)
+}
+
+// acquire locks resource for owner in mode, waiting while other owners hold it in a
+// conflicting mode. A lock held in a weaker mode is upgraded.
+func (lm *lockManager) acquire(owner uint64, resource lockResource, mode LockMode) error {
+	lm.mu.Lock()
+	_, upgrade := lm.holders[resource][owner]
+	ahead := lm.queues[resource]
+	if upgrade {
+		ahead = nil
+	}
+	if lm.grant(owner, resource, mode, ahead) {
+		lm.mu.Unlock()
+		return nil
+	}
+
+	wait := &lockWait{resource: resource, mode: mode, result: make(chan error, 1)}
+	lm.waiting[owner] = wait
+	if upgrade {
+		lm.queues[resource] = append([]uint64{owner}, lm.queues[resource]...)
+	} else {
+		lm.queues[resource] = append(lm.queues[resource], owner)
+	}
+	if cycle := lm.cycle(owner); cycle != nil {
+		victim := cycle[0]
+		for _, o := range cycle[1:] {
+			if n, m := len(lm.held[o]), len(lm.held[victim]); n < m || n == m && o > victim {
+				victim = o
+			}
+		}
+		lm.endWait(victim, &DeadlockError{Tx: victim, Cycle: cycle})
+	}
+	lm.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if lm.timeout > 0 {
+		timer := time.NewTimer(lm.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-wait.result:
+		return err
+	case <-timeout:
+		lm.mu.Lock()
+		defer lm.mu.Unlock()
+		if lm.waiting[owner] != wait {
+			// Granted or aborted meanwhile.
+			return <-wait.result
+		}
+		lm.endWait(owner, nil)
+		return fmt.Errorf("%w for %s lock on %s", ErrLockTimeout, mode, resource)
+	}
+}
+
+// conflicts returns the owners that keep owner from locking resource in mode: those
+// holding it in a conflicting mode, and those of ahead, the owners queued before it,
+// waiting for a conflicting mode. The caller holds mu.
+func (lm *lockManager) conflicts(owner uint64, resource lockResource, mode LockMode, ahead []uint64) []uint64 {
+	holders := lm.holders[resource]
+	mode = combine(holders[owner], mode)
+	var owners []uint64
+	for other, held := range holders {
+		if other != owner && !compatible(mode, held) {
+			owners = append(owners, other)
+		}
+	}
+	for _, other := range ahead {
+		if !compatible(mode, combine(holders[other], lm.waiting[other].mode)) {
+			owners = append(owners, other)
+		}
+	}
+	return owners
+}
+
+// grant locks resource for owner in mode if nothing conflicts with it, holders or the
+// waits ahead of it, and reports whether it did. The caller holds mu.
+func (lm *lockManager) grant(owner uint64, resource lockResource, mode LockMode, ahead []uint64) bool {
+	if len(lm.conflicts(owner, resource, mode, ahead)) > 0 {
+		return false
+	}
+	holders := lm.holders[resource]
+	mode = combine(holders[owner], mode)
+	if holders == nil {
+		holders = make(map[uint64]LockMode)
+		lm.holders[resource] = holders
+	}
+	if _, ok := holders[owner]; !ok {
+		lm.held[owner] = append(lm.held[owner], resource)
+	}
+	holders[owner] = mode
+	return true
+}
+
+// blockers returns the owners a waiting owner waits for. The caller holds mu.
+func (lm *lockManager) blockers(owner uint64) []uint64 {
+	wait := lm.waiting[owner]
+	if wait == nil {
+		return nil
+	}
+	queue := lm.queues[wait.resource]
+	ahead := queue[:slices.Index(queue, owner)]
+	return lm.conflicts(owner, wait.resource, wait.mode, ahead)
+}
+
+// cycle returns the owners of a cycle in the waits-for graph that goes through owner,
+// starting with it, or nil if there is none. The caller holds mu.
+func (lm *lockManager) cycle(owner uint64) []uint64 {
+	visited := make(map[uint64]bool)
+	var path []uint64
+	var visit func(o uint64) bool
+	visit = func(o uint64) bool {
+		path = append(path, o)
+		for _, next := range lm.blockers(o) {
+			if next == owner {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(owner) {
+		return path
+	}
+	return nil
+}
+
+// endWait removes the wait of owner, sending err as its result unless err is nil, and
+// grants the waits queued behind it that it blocked. The caller holds mu.
+func (lm *lockManager) endWait(owner uint64, err error) {
+	wait := lm.waiting[owner]
+	delete(lm.waiting, owner)
+	if err != nil {
+		wait.result <- err
+	}
+	queue := slices.DeleteFunc(lm.queues[wait.resource], func(o uint64) bool { return o == owner })
+	lm.queues[wait.resource] = queue
+	lm.wake(wait.resource)
+}
+
+// wake grants, in queue order, the waits for resource that nothing conflicts with any
+// longer. The caller holds mu.
+func (lm *lockManager) wake(resource lockResource) {
+	var queue []uint64
+	for _, waiter := range lm.queues[resource] {
+		wait := lm.waiting[waiter]
+		if lm.grant(waiter, resource, wait.mode, queue) {
+			delete(lm.waiting, waiter)
+			wait.result <- nil
+		} else {
+			queue = append(queue, waiter)
+		}
+	}
+	if len(queue) == 0 {
+		delete(lm.queues, resource)
+	} else {
+		lm.queues[resource] = queue
+	}
+}
+
+// release releases every lock of owner and grants the waits they blocked.
+func (lm *lockManager) release(owner uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if _, ok := lm.waiting[owner]; ok {
+		lm.endWait(owner, ErrTxDone)
+	}
+	resources := lm.held[owner]
+	for _, resource := range resources {
+		delete(lm.holders[resource], owner)
+		if len(lm.holders[resource]) == 0 {
+			delete(lm.holders, resource)
+		}
+	}
+	delete(lm.held, owner)
+	for _, resource := range resources {
+		lm.wake(resource)
+	}
+}
+
+// lockKey locks a key for owner in mode, after locking its table with the matching intent.
+func (lm *lockManager) lockKey(owner uint64, table string, key int, mode LockMode) error {
+	if err := lm.acquire(owner, tableResource(table), mode.intent()); err != nil {
+		return err
+	}
+	return lm.acquire(owner, keyResource(table, key), mode)
+}
+
+// withKeyLock runs write, a change to a key made outside a transaction, holding an
+// exclusive lock on the key.
+func (kv *BTreeKVStore) withKeyLock(table string, key int, write func() error) error {
+	owner := kv.locks.newOwner()
+	defer kv.locks.release(owner)
+	if err := kv.locks.lockKey(owner, table, key, LockExclusive); err != nil {
+		return err
+	}
+	return write()
+}
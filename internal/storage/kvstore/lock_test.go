@@ -0,0 +1,258 @@
+package kvstore_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// openLockingStore opens a store in a temporary directory with the given lock timeout and
+// a table "accounts" holding keys 1 to 3.
+func openLockingStore(t *testing.T, timeout time.Duration) *kvstore.BTreeKVStore {
+	t.Helper()
+	dir := t.TempDir()
+	diskManager, err := disk.NewFileDiskManager(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	store, err := kvstore.NewBTreeKVStoreWithOptions(3, diskManager, filepath.Join(dir, "wal"), kvstore.Options{
+		LockTimeout: timeout,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		diskManager.Close()
+	})
+
+	if err := store.CreateTableName("accounts", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for key := 1; key <= 3; key++ {
+		if err := store.Put("accounts", key, "100"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	return store
+}
+
+func TestLocksConflictAndTimeOut(t *testing.T) {
+	store := openLockingStore(t, 50*time.Millisecond)
+
+	writer, reader := store.Begin(), store.Begin()
+	if err := writer.Lock("accounts", 1, kvstore.LockExclusive); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := reader.Lock("accounts", 1, kvstore.LockShared); !errors.Is(err, kvstore.ErrLockTimeout) {
+		t.Fatalf("Expected a shared lock to time out, got %v", err)
+	}
+	if err := reader.LockTable("accounts", kvstore.LockShared); !errors.Is(err, kvstore.ErrLockTimeout) {
+		t.Fatalf("Expected a table lock to time out, got %v", err)
+	}
+	if err := store.Put("accounts", 1, "0"); !errors.Is(err, kvstore.ErrLockTimeout) {
+		t.Fatalf("Expected a write to a locked key to time out, got %v", err)
+	}
+	if err := store.Put("accounts", 2, "0"); err != nil {
+		t.Fatalf("Put to another key failed: %v", err)
+	}
+	if err := writer.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	// Shared locks are held together and keep writers out.
+	other := store.Begin()
+	if err := reader.Lock("accounts", 1, kvstore.LockShared); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := other.LockTable("accounts", kvstore.LockShared); err != nil {
+		t.Fatalf("LockTable failed: %v", err)
+	}
+	if err := store.Delete("accounts", 3); !errors.Is(err, kvstore.ErrLockTimeout) {
+		t.Fatalf("Expected a write to a shared-locked table to time out, got %v", err)
+	}
+	if err := store.DropTable("accounts"); !errors.Is(err, kvstore.ErrLockTimeout) {
+		t.Fatalf("Expected dropping a locked table to time out, got %v", err)
+	}
+	reader.Rollback()
+	other.Rollback()
+	if err := store.Delete("accounts", 3); err != nil {
+		t.Fatalf("Delete failed once the locks were released: %v", err)
+	}
+}
+
+func TestGetLockedSerializesUpdates(t *testing.T) {
+	store := openLockingStore(t, 0)
+
+	tx := store.Begin()
+	if err := store.Put("accounts", 1, "90"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if value, _, _ := tx.Get("accounts", 1); value != "100" {
+		t.Fatalf("Expected the snapshot value, got %q", value)
+	}
+	value, _, err := tx.GetLocked("accounts", 1, kvstore.LockExclusive)
+	if err != nil || value != "90" {
+		t.Fatalf("Expected the latest value under the lock, got %q (%v)", value, err)
+	}
+
+	written := make(chan error, 1)
+	go func() { written <- store.Put("accounts", 1, "0") }()
+	select {
+	case err := <-written:
+		t.Fatalf("Expected the write to wait for the lock, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tx.Put("accounts", 1, "80")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit of a locked key failed: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	assertGet(t, store, "accounts", 1, "0")
+}
+
+// deadlock runs one goroutine per transaction, each locking its first key and then,
+// once every transaction holds its first key, the next one's. It returns the error of
+// each transaction's second lock.
+func deadlock(t *testing.T, txs []*kvstore.Tx) []error {
+	t.Helper()
+	errs := make([]error, len(txs))
+	var locked, wg sync.WaitGroup
+	locked.Add(len(txs))
+	for i, tx := range txs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tx.Lock("accounts", i+1, kvstore.LockExclusive); err != nil {
+				t.Errorf("First lock failed: %v", err)
+			}
+			locked.Done()
+			locked.Wait()
+			if errs[i] = tx.Lock("accounts", (i+1)%len(txs)+1, kvstore.LockExclusive); errs[i] == nil {
+				tx.Put("accounts", i+1, "moved")
+				errs[i] = tx.Commit()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Deadlock was not broken")
+	}
+	return errs
+}
+
+func TestDeadlockAbortsYoungest(t *testing.T) {
+	store := openLockingStore(t, 0)
+
+	for _, n := range []int{2, 3} {
+		txs := make([]*kvstore.Tx, n)
+		for i := range txs {
+			txs[i] = store.Begin()
+		}
+		errs := deadlock(t, txs)
+
+		victim := txs[n-1]
+		var deadlockErr *kvstore.DeadlockError
+		if !errors.As(errs[n-1], &deadlockErr) || deadlockErr.Tx != victim.ID() || len(deadlockErr.Cycle) != n {
+			t.Fatalf("Expected transaction %d to be aborted by a cycle of %d, got %v", victim.ID(), n, errs[n-1])
+		}
+		for i, err := range errs[:n-1] {
+			if err != nil {
+				t.Fatalf("Transaction %d failed: %v", txs[i].ID(), err)
+			}
+		}
+		if err := victim.Commit(); !errors.Is(err, kvstore.ErrTxDone) {
+			t.Fatalf("Expected the victim to be rolled back, got %v", err)
+		}
+		assertGet(t, store, "accounts", n, "100")
+		store.Put("accounts", 1, "100")
+		store.Put("accounts", 2, "100")
+	}
+}
+
+func TestDeadlockAbortsFewestLocks(t *testing.T) {
+	store := openLockingStore(t, 0)
+
+	// The younger transaction holds more locks, so the older one is aborted.
+	older, younger := store.Begin(), store.Begin()
+	if err := older.Lock("accounts", 1, kvstore.LockExclusive); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	for _, key := range []int{2, 3} {
+		if err := younger.Lock("accounts", key, kvstore.LockExclusive); err != nil {
+			t.Fatalf("Lock failed: %v", err)
+		}
+	}
+	locked := make(chan error, 1)
+	go func() { locked <- younger.Lock("accounts", 1, kvstore.LockExclusive) }()
+	time.Sleep(50 * time.Millisecond)
+
+	var deadlockErr *kvstore.DeadlockError
+	if err := older.Lock("accounts", 2, kvstore.LockExclusive); !errors.As(err, &deadlockErr) || deadlockErr.Tx != older.ID() {
+		t.Fatalf("Expected transaction %d to be aborted, got %v", older.ID(), err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatalf("Lock of the surviving transaction failed: %v", err)
+	}
+	younger.Rollback()
+}
+
+func TestLocksGrantedInOrder(t *testing.T) {
+	store := openLockingStore(t, 0)
+
+	// A shared lock requested after a waiting exclusive one waits behind it, though the
+	// holder would let it through.
+	reader, writer, late := store.Begin(), store.Begin(), store.Begin()
+	if err := reader.Lock("accounts", 1, kvstore.LockShared); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	granted := make(chan string, 2)
+	go func() {
+		if err := writer.Lock("accounts", 1, kvstore.LockExclusive); err != nil {
+			t.Errorf("Exclusive lock failed: %v", err)
+		}
+		granted <- "writer"
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		if err := late.Lock("accounts", 1, kvstore.LockShared); err != nil {
+			t.Errorf("Shared lock failed: %v", err)
+		}
+		granted <- "reader"
+	}()
+
+	select {
+	case who := <-granted:
+		t.Fatalf("Expected every lock to wait for the first reader, %s was granted", who)
+	case <-time.After(50 * time.Millisecond):
+	}
+	reader.Rollback()
+	if who := <-granted; who != "writer" {
+		t.Fatalf("Expected the writer to be granted first, got the %s", who)
+	}
+	select {
+	case <-granted:
+		t.Fatalf("Expected the late reader to wait for the writer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	writer.Rollback()
+	if who := <-granted; who != "reader" {
+		t.Fatalf("Expected the late reader to be granted, got the %s", who)
+	}
+	late.Rollback()
+}
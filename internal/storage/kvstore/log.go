@@ -2,82 +2,495 @@ package kvstore
 
 import (
 	"bufio"
-	"encoding/json"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
 )
 
 // LogEntry represents an operation in the append-only log.
 type LogEntry struct {
-	Operation string `json:"operation"` // "PUT" or "DELETE"
-	Key       int    `json:"key"`
-	Value     string `json:"value,omitempty"` // Only used for "PUT" operations
-	Table     string `json:"table"`           // Table name
+	LSN       uint64      `json:"-"`                 // Log sequence number, assigned when the entry is appended.
+	Time      time.Time   `json:"-"`                 // Time the entry was appended at; zero for entries of older logs.
+	Operation string      `json:"operation"`         // "PUT", "DELETE", "CREATE_TABLE", "DROP_TABLE", "ALTER_TABLE", "RENAME_TABLE" or "COMMIT"
+	Key       int         `json:"key"`               // Degree of the tree for "CREATE_TABLE"
+	Value     string      `json:"value,omitempty"`   // Value for "PUT", codec of the pages for "CREATE_TABLE" and "ALTER_TABLE", new name for "RENAME_TABLE"
+	Table     string      `json:"table"`             // Table name
+	OldValue  *string     `json:"-"`                 // Value the key had before a "PUT" or "DELETE"; nil if it had none, or in logs of older versions
+	Changes   []*LogEntry `json:"changes,omitempty"` // Puts and deletes of a "COMMIT", which share its LSN and time
+	Schema    string      `json:"schema,omitempty"`  // Column definitions for "CREATE_TABLE" and "ALTER_TABLE"; empty for no schema or no change
 }
 
-// Serialize converts a LogEntry to a byte slice for writing to the log.
+// Serialize encodes a LogEntry as an unencrypted log record carrying its LSN.
 func (entry *LogEntry) Serialize() ([]byte, error) {
-	return json.Marshal(entry)
+	return sealRecord(nil, entry.LSN, entry)
 }
 
-// DeserializeLogEntry converts a byte slice back into a LogEntry.
+// DeserializeLogEntry decodes a single unencrypted log record produced by Serialize.
 func DeserializeLogEntry(data []byte) (*LogEntry, error) {
-	var entry LogEntry
-	err := json.Unmarshal(data, &entry)
-	return &entry, err
+	if len(data) < recordHeaderSize || len(data) != recordHeaderSize+int(binary.LittleEndian.Uint32(data[0:4])) {
+		return nil, fmt.Errorf("%w: bad record length", ErrCorruptLog)
+	}
+	if crc32.ChecksumIEEE(data[8:]) != binary.LittleEndian.Uint32(data[4:8]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptLog)
+	}
+	rec := &logRecord{lsn: binary.LittleEndian.Uint64(data[8:16]), typ: recordType(data[16]), payload: data[recordHeaderSize:], version: logVersion}
+	return openRecord(nil, rec)
+}
+
+// LogFile is the file an AppendOnlyLog is stored in. *os.File implements it;
+// tests substitute wrappers that simulate crashes.
+type LogFile interface {
+	io.ReadWriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
 }
 
-// AppendOnlyLog manages an append-only log file.
+// AppendOnlyLog manages an append-only log file of binary records, each numbered
+// with a log sequence number (LSN) one higher than the record before it.
+//
+// Appends are group committed: each writer queues its record and waits, while a single
+// flusher goroutine writes everything queued so far with one write and, with SyncWrites,
+// one sync, then wakes the writers whose records it covered.
 type AppendOnlyLog struct {
-	file *os.File
+	mu     sync.Mutex // Guards the fields below; LSNs are assigned in queue order under it.
+	cond   *sync.Cond // Signaled when records are queued, written or the log is closed.
+	file   LogFile
+	cipher *encryption.Cipher // nil when records are stored in plaintext.
+	sync   bool               // Whether records are synced before their writers are woken.
+
+	base     uint64 // LSN preceding the first record in the file.
+	lsn      uint64 // LSN of the last record queued.
+	durable  uint64 // LSN of the last record written, and synced with SyncWrites.
+	size     int64  // Size of the file once the queued records are written.
+	pending  []byte // Records queued for the flusher.
+	flushing bool   // Whether the flusher is writing a batch.
+	closed   bool
+	done     chan struct{} // Closed when the flusher exits.
+	err      error         // Set when a write failed; later appends fail with it.
 }
 
 // NewAppendOnlyLog opens or creates the log file.
 func NewAppendOnlyLog(filename string) (*AppendOnlyLog, error) {
+	return openLog(filename, Options{})
+}
+
+// openLog opens the log file of a store configured with the given options.
+// A log in the old JSON format or an older binary version is converted first.
+func openLog(filename string, opts Options) (*AppendOnlyLog, error) {
+	if err := migrateLegacyLog(filename, opts.Cipher); err != nil {
+		return nil, fmt.Errorf("failed to migrate log %s: %w", filename, err)
+	}
+	if err := upgradeLog(filename, opts.Cipher); err != nil {
+		return nil, fmt.Errorf("failed to upgrade log %s: %w", filename, err)
+	}
+
 	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
-	return &AppendOnlyLog{file: file}, nil
+
+	var lf LogFile = file
+	if opts.WrapLogFile != nil {
+		lf = opts.WrapLogFile(lf)
+	}
+
+	log := &AppendOnlyLog{file: lf, cipher: opts.Cipher, sync: opts.SyncWrites, done: make(chan struct{})}
+	log.cond = sync.NewCond(&log.mu)
+	if err := log.recover(); err != nil {
+		lf.Close()
+		return nil, err
+	}
+	go log.flusher()
+	return log, nil
+}
+
+// NewEncryptedAppendOnlyLog opens or creates a log file whose records are encrypted with the given cipher.
+// The payload of each record is sealed individually; the framing stays in plaintext.
+func NewEncryptedAppendOnlyLog(filename string, c *encryption.Cipher) (*AppendOnlyLog, error) {
+	if c == nil {
+		return nil, fmt.Errorf("encrypted log requires a cipher")
+	}
+	return openLog(filename, Options{Cipher: c})
+}
+
+// recover prepares the log for appending. A new log gets its header, and a record left
+// partially written by a crash is cut off so new records follow the last complete one.
+func (log *AppendOnlyLog) recover() error {
+	size, err := log.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < logHeaderSize {
+		// A new log, or one whose header never fully reached the disk.
+		return log.reset(0)
+	}
+	return log.scan(nil)
+}
+
+// reset empties the log, whose next record gets LSN base+1.
+func (log *AppendOnlyLog) reset(base uint64) error {
+	if err := log.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := log.file.Write(encodeLogHeader(base)); err != nil {
+		return err
+	}
+	if err := log.file.Sync(); err != nil {
+		return err
+	}
+	log.base, log.lsn, log.durable, log.size = base, base, base, logHeaderSize
+	return nil
+}
+
+// scan reads every record of the log, passing the decoded entries to fn unless it is nil.
+// A torn record at the end is cut off; a damaged record before the end is an error.
+func (log *AppendOnlyLog) scan(fn func(*LogEntry)) error {
+	size, err := log.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	rr, err := newRecordReader(log.file, size)
+	if err != nil {
+		return err
+	}
+	log.base = rr.lsn
+
+	for {
+		rec, err := rr.next()
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord {
+			fmt.Printf("Warning: Discarding torn log record at offset %d\n", rr.off)
+			if err := log.file.Truncate(rr.off); err != nil {
+				return err
+			}
+			if err := log.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if fn != nil {
+			entry, err := openRecord(log.cipher, rec)
+			if err != nil {
+				return fmt.Errorf("%w: LSN %d: %v", ErrCorruptLog, rec.lsn, err)
+			}
+			fn(entry)
+		}
+	}
+
+	log.lsn, log.durable, log.size = rr.lsn, rr.lsn, rr.off
+	return nil
 }
 
-// Append writes a LogEntry to the log file.
+// Append writes a LogEntry to the log file and sets its LSN.
+// If the log was opened with SyncWrites, the entry is on stable storage when Append returns.
 func (log *AppendOnlyLog) Append(entry *LogEntry) error {
-	data, err := entry.Serialize()
+	lsn, err := log.enqueue(entry)
 	if err != nil {
 		return err
 	}
-	data = append(data, '\n') // Add newline for readability
-	_, err = log.file.Write(data)
-	return err
+	return log.wait(lsn)
+}
+
+// enqueue assigns the next LSN to an entry and queues its record for the flusher.
+// Records reach the file in the order they are queued. An entry that already has an LSN,
+// replicated from another log, keeps it and its time; it must be the next LSN.
+func (log *AppendOnlyLog) enqueue(entry *LogEntry) (uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if log.closed {
+		return 0, fmt.Errorf("log is closed")
+	}
+	if log.err != nil {
+		return 0, log.err
+	}
+
+	lsn := log.lsn + 1
+	if entry.LSN == 0 {
+		entry.Time = time.Now().Round(0) // Without the monotonic reading, so it compares equal once read back.
+	} else if entry.LSN != lsn {
+		return 0, fmt.Errorf("%w: got LSN %d, expected %d", ErrLSNOutOfOrder, entry.LSN, lsn)
+	}
+	record, err := sealRecord(log.cipher, lsn, entry)
+	if err != nil {
+		return 0, err
+	}
+	log.pending = append(log.pending, record...)
+	log.lsn, log.size = lsn, log.size+int64(len(record))
+	entry.LSN = lsn
+	log.cond.Broadcast()
+	return lsn, nil
+}
+
+// wait blocks until the record with the given LSN is written, and synced with SyncWrites.
+func (log *AppendOnlyLog) wait(lsn uint64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for log.durable < lsn && log.err == nil {
+		log.cond.Wait()
+	}
+	if log.durable < lsn {
+		return log.err
+	}
+	return nil
+}
+
+// flusher writes queued records in batches until the log is closed.
+func (log *AppendOnlyLog) flusher() {
+	defer close(log.done)
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for {
+		for len(log.pending) == 0 && !log.closed {
+			log.cond.Wait()
+		}
+		if len(log.pending) == 0 {
+			return
+		}
+
+		batch, last := log.pending, log.lsn
+		log.pending, log.flushing = nil, true
+		log.mu.Unlock()
+
+		_, err := log.file.Write(batch)
+		if err == nil && log.sync {
+			err = log.file.Sync()
+		}
+
+		log.mu.Lock()
+		log.flushing = false
+		if err != nil && log.err == nil {
+			// The writers of the batch may already have applied their changes, so the
+			// log cannot take further records that would follow the missing ones.
+			log.err = fmt.Errorf("log write failed: %w", err)
+		}
+		if err == nil {
+			log.durable = last
+		}
+		log.cond.Broadcast()
+	}
+}
+
+// drain waits until every queued record is written. The caller holds mu, and keeps the
+// flusher from starting another batch until it releases it.
+func (log *AppendOnlyLog) drain() error {
+	for (len(log.pending) > 0 || log.flushing) && log.err == nil {
+		log.cond.Wait()
+	}
+	return log.err
 }
 
 // Replay reads all log entries from the beginning of the file.
+// It stops at a record torn by a crash and fails with ErrCorruptLog on damage before it.
 func (log *AppendOnlyLog) Replay() ([]*LogEntry, error) {
-	_, err := log.file.Seek(0, 0) // Move to the beginning of the file
-	if err != nil {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if err := log.drain(); err != nil {
 		return nil, err
 	}
 
 	entries := []*LogEntry{}
-	scanner := bufio.NewScanner(log.file)
-	for scanner.Scan() {
-		entry, err := DeserializeLogEntry(scanner.Bytes())
-		if err != nil {
-			// Log the error and continue with the next entry
-			fmt.Printf("Warning: Skipping corrupted log entry: %v\n", err)
-			continue
-		}
+	err := log.scan(func(entry *LogEntry) {
 		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return entries, scanner.Err()
+	return entries, nil
+}
+
+// LastLSN returns the LSN of the last record appended to the log, or the LSN the log
+// was reset to if it holds no records.
+func (log *AppendOnlyLog) LastLSN() uint64 {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.lsn
+}
+
+// baseLSN returns the LSN preceding the first record in the log file.
+func (log *AppendOnlyLog) baseLSN() uint64 {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.base
 }
 
+// Size returns the size of the log file in bytes, counting records still being written.
+func (log *AppendOnlyLog) Size() int64 {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.size
+}
+
+// Reset discards every record of the log, once those still queued are written.
+// The next record appended gets LSN base+1.
+// A crash during Reset leaves either the old records or an empty log.
+func (log *AppendOnlyLog) Reset(base uint64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if err := log.drain(); err != nil {
+		return err
+	}
+	if err := log.reset(base); err != nil {
+		log.err = fmt.Errorf("log unusable after failed reset: %w", err)
+		return err
+	}
+	return nil
+}
+
+// WriteString appends raw bytes to the log, bypassing record framing. Tests use it to damage the log.
 func (log *AppendOnlyLog) WriteString(s string) (int, error) {
-	return log.file.WriteString(s)
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if err := log.drain(); err != nil {
+		return 0, err
+	}
+
+	n, err := io.WriteString(log.file, s)
+	log.size += int64(n)
+	return n, err
 }
 
-// Close closes the log file.
+// Close writes the records still queued, syncs and closes the log file.
 func (log *AppendOnlyLog) Close() error {
+	log.mu.Lock()
+	if log.closed {
+		log.mu.Unlock()
+		return log.file.Close()
+	}
+	log.closed = true
+	log.cond.Broadcast()
+	log.mu.Unlock()
+
+	<-log.done
+	if log.err != nil {
+		log.file.Close()
+		return log.err
+	}
+	if err := log.file.Sync(); err != nil {
+		log.file.Close()
+		return err
+	}
 	return log.file.Close()
 }
+
+// sealRecord encodes an entry as the record with the given LSN, encrypting its payload
+// when a cipher is given.
+func sealRecord(c *encryption.Cipher, lsn uint64, entry *LogEntry) ([]byte, error) {
+	typ, err := entry.recordType()
+	if err != nil {
+		return nil, err
+	}
+	payload := entry.payload()
+	if c != nil {
+		if payload, err = c.Seal(payload, recordAAD(lsn, typ)); err != nil {
+			return nil, err
+		}
+	}
+	return encodeRecord(lsn, typ, payload), nil
+}
+
+// openRecord reverses sealRecord for a record read back from the log.
+func openRecord(c *encryption.Cipher, rec *logRecord) (*LogEntry, error) {
+	payload := rec.payload
+	if c != nil {
+		var err error
+		if payload, err = c.Open(payload, recordAAD(rec.lsn, rec.typ)); err != nil {
+			return nil, err
+		}
+	}
+	return decodeEntry(rec.lsn, rec.typ, payload, rec.version)
+}
+
+// writeLogFile writes a new log file at filename holding the given entries, which keep
+// their LSNs. The first entry must have LSN base+1.
+func writeLogFile(filename string, base uint64, entries []*LogEntry, c *encryption.Cipher) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(f)
+	out.Write(encodeLogHeader(base))
+	for _, entry := range entries {
+		record, err := sealRecord(c, entry.LSN, entry)
+		if err != nil {
+			f.Close()
+			os.Remove(filename)
+			return err
+		}
+		out.Write(record)
+	}
+
+	if err := out.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(filename)
+		return err
+	}
+	return nil
+}
+
+// RekeyLog re-encrypts every record of the log at filename, replacing oldCipher with newCipher.
+// The log is either a single file or a directory of segments, each of which is rekeyed.
+// An archive of segments is a directory of segments too, and is rekeyed the same way.
+// Either cipher may be nil to convert between plaintext and encrypted logs.
+// Records that fail to decode are reported as an error rather than dropped.
+func RekeyLog(filename string, oldCipher, newCipher *encryption.Cipher) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return rekeyLogFile(filename, oldCipher, newCipher)
+	}
+
+	segments, err := listSegments(filename)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if err := rekeyLogFile(filepath.Join(filename, seg.name), oldCipher, newCipher); err != nil {
+			return fmt.Errorf("segment %s: %w", seg.name, err)
+		}
+	}
+	return nil
+}
+
+// rekeyLogFile re-encrypts the records of a single log file.
+func rekeyLogFile(filename string, oldCipher, newCipher *encryption.Cipher) error {
+	src, err := openLog(filename, Options{Cipher: oldCipher})
+	if err != nil {
+		return err
+	}
+	entries, err := src.Replay()
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	tmpName := filename + ".rekey"
+	if err := writeLogFile(tmpName, src.base, entries, newCipher); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
@@ -0,0 +1,165 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+)
+
+// Logs written before the binary record format hold one JSON-encoded LogEntry per line,
+// or, when encrypted, one base64-encoded sealed entry per line. They are converted to
+// binary records the first time they are opened, as are binary logs of version 1.
+
+// isLegacyLog reports whether the file at filename holds a log in the JSON format.
+// A missing or empty file, or one starting with the binary log magic, does not.
+func isLegacyLog(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// Any version of the binary format will do.
+	prefix := make([]byte, len(logMagic)-1)
+	n, err := io.ReadFull(f, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return n > 0 && !bytes.HasPrefix([]byte(logMagic), prefix[:n]), nil
+}
+
+// upgradeLog rewrites a binary log of an older version at filename in the current version,
+// so records appended to it share the format of the existing ones. Entries keep their LSNs,
+// and carry no time or old value if their version had none. A torn record at the end is
+// dropped, as on recovery.
+func upgradeLog(filename string, c *encryption.Cipher) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:7]) != logMagicPrefix || string(header[:8]) == logMagic {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rr, err := newRecordReader(f, info.Size())
+	if err != nil {
+		return err
+	}
+
+	entries := []*LogEntry{}
+	for {
+		rec, err := rr.next()
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := openRecord(c, rec)
+		if err != nil {
+			return fmt.Errorf("%w: LSN %d: %v", ErrCorruptLog, rec.lsn, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	tmpName := filename + ".migrate"
+	if err := writeLogFile(tmpName, binary.LittleEndian.Uint64(header[8:16]), entries, c); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// migrateLegacyLog rewrites a JSON log at filename as binary records numbered from LSN 1.
+// Logs already in the binary format are left untouched.
+func migrateLegacyLog(filename string, c *encryption.Cipher) error {
+	legacy, err := isLegacyLog(filename)
+	if err != nil || !legacy {
+		return err
+	}
+
+	entries, err := readLegacyLog(filename, c)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		entry.LSN = uint64(i + 1)
+	}
+
+	tmpName := filename + ".migrate"
+	if err := writeLogFile(tmpName, 0, entries, c); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// readLegacyLog reads every entry of a JSON log. Lines that fail to decode are skipped
+// with a warning, as the JSON reader always did, so the migrated log replays exactly
+// what the old one would have.
+func readLegacyLog(filename string, c *encryption.Cipher) ([]*LogEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*LogEntry{}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte("\n")); len(line) > 0 {
+			entry, derr := decodeLegacyLine(line, c)
+			if derr != nil {
+				fmt.Printf("Warning: Skipping corrupted log entry: %v\n", derr)
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeLegacyLine decodes one line of a JSON log.
+func decodeLegacyLine(line []byte, c *encryption.Cipher) (*LogEntry, error) {
+	if c != nil {
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return nil, err
+		}
+		if line, err = c.Open(sealed, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var entry LogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, err
+	}
+	if _, err := entry.recordType(); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
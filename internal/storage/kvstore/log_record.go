@@ -0,0 +1,404 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Log file layout:
+//
+//	file header:  magic [8]byte | base LSN uint64
+//	record:       length uint32 | crc uint32 | LSN uint64 | type uint8 | payload [length]byte
+//	payload:      time varint | table uvarint+bytes | key varint | value uvarint+bytes | old value [| schema uvarint+bytes]
+//
+// Integers are little endian. The CRC covers the LSN, the type and the payload. Records
+// carry consecutive LSNs starting right after the base LSN of the file. When the log is
+// encrypted the payload is sealed with the LSN and type as additional data, so a record
+// cannot be replayed at another position.
+//
+// The time is the Unix time in nanoseconds the record was appended at, or 0 if unknown.
+// The old value is the value the key had before the change, encoded as a uvarint of its
+// length plus one followed by its bytes, or a single 0 if the key had none. Only the
+// payloads of CREATE_TABLE and ALTER_TABLE records end with the schema, the column
+// definitions of the table, empty for a table without one or a schema left unchanged.
+//
+// The last byte of the magic is the format version. Version 1 payloads lack the time and
+// the old value, version 2 payloads the old value, version 3 payloads the schema, and
+// version 4 payloads the schema of ALTER_TABLE records.
+// Files of older versions are still read, and rewritten in the current version before
+// they are appended to.
+const (
+	logMagicPrefix   = "LGDBWAL"
+	logVersion       = 5
+	logMagic         = logMagicPrefix + "\x05"
+	logHeaderSize    = 16
+	recordHeaderSize = 17
+)
+
+// ErrCorruptLog is returned when a record in the middle of the log fails validation.
+// A damaged record at the very end of the log is a write cut short by a crash instead,
+// and is discarded without error.
+var ErrCorruptLog = errors.New("kvstore: corrupt log record")
+
+// ErrLSNOutOfOrder is returned when a replicated change does not follow the last one logged.
+var ErrLSNOutOfOrder = errors.New("kvstore: change out of LSN order")
+
+// recordType identifies the operation a log record holds.
+type recordType uint8
+
+const (
+	recordPut         recordType = 1
+	recordDelete      recordType = 2
+	recordCreateTable recordType = 3
+	recordDropTable   recordType = 4
+	recordAlterTable  recordType = 5
+	recordCommit      recordType = 6 // The puts and deletes of a transaction, applied together.
+	recordRenameTable recordType = 7
+)
+
+func (entry *LogEntry) recordType() (recordType, error) {
+	switch entry.Operation {
+	case "PUT":
+		return recordPut, nil
+	case "DELETE":
+		return recordDelete, nil
+	case "CREATE_TABLE":
+		return recordCreateTable, nil
+	case "DROP_TABLE":
+		return recordDropTable, nil
+	case "ALTER_TABLE":
+		return recordAlterTable, nil
+	case "COMMIT":
+		return recordCommit, nil
+	case "RENAME_TABLE":
+		return recordRenameTable, nil
+	default:
+		return 0, fmt.Errorf("unknown log operation %q", entry.Operation)
+	}
+}
+
+// payload encodes the time, table, key, value and old value of the entry, followed by
+// the schema for a table creation or alteration. A commit
+// record holds the number of changes after the time, then the type, table, key, value
+// and old value of each.
+func (entry *LogEntry) payload() []byte {
+	var nanos int64
+	if !entry.Time.IsZero() {
+		nanos = entry.Time.UnixNano()
+	}
+	buf := make([]byte, 0, 5*binary.MaxVarintLen64+len(entry.Table)+len(entry.Value))
+	buf = binary.AppendVarint(buf, nanos)
+	if entry.Operation == "CREATE_TABLE" || entry.Operation == "ALTER_TABLE" {
+		buf = entry.appendChange(buf)
+		buf = binary.AppendUvarint(buf, uint64(len(entry.Schema)))
+		return append(buf, entry.Schema...)
+	}
+	if entry.Operation != "COMMIT" {
+		return entry.appendChange(buf)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Changes)))
+	for _, change := range entry.Changes {
+		typ := recordPut
+		if change.Operation == "DELETE" {
+			typ = recordDelete
+		}
+		buf = change.appendChange(append(buf, byte(typ)))
+	}
+	return buf
+}
+
+// appendChange appends the table, key, value and old value of the entry to buf.
+func (entry *LogEntry) appendChange(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Table)))
+	buf = append(buf, entry.Table...)
+	buf = binary.AppendVarint(buf, int64(entry.Key))
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Value)))
+	buf = append(buf, entry.Value...)
+	if entry.OldValue == nil {
+		return binary.AppendUvarint(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(*entry.OldValue))+1)
+	return append(buf, *entry.OldValue...)
+}
+
+// decodeEntry rebuilds a LogEntry from the type and payload of a record written in the
+// given version of the format.
+func decodeEntry(lsn uint64, typ recordType, payload []byte, version byte) (*LogEntry, error) {
+	entry := &LogEntry{LSN: lsn}
+	switch typ {
+	case recordPut:
+		entry.Operation = "PUT"
+	case recordDelete:
+		entry.Operation = "DELETE"
+	case recordCreateTable:
+		entry.Operation = "CREATE_TABLE"
+	case recordDropTable:
+		entry.Operation = "DROP_TABLE"
+	case recordAlterTable:
+		entry.Operation = "ALTER_TABLE"
+	case recordCommit:
+		entry.Operation = "COMMIT"
+	case recordRenameTable:
+		entry.Operation = "RENAME_TABLE"
+	default:
+		return nil, fmt.Errorf("unknown record type %d", typ)
+	}
+
+	buf := bytes.NewReader(payload)
+	if version >= 2 {
+		nanos, err := binary.ReadVarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		if nanos != 0 {
+			entry.Time = time.Unix(0, nanos)
+		}
+	}
+
+	if typ != recordCommit {
+		if err := entry.readChange(buf, version); err != nil {
+			return nil, err
+		}
+		if typ == recordCreateTable && version >= 4 || typ == recordAlterTable && version >= 5 {
+			schema, err := readString(buf)
+			if err != nil {
+				return nil, err
+			}
+			entry.Schema = schema
+		}
+	} else {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(buf.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		entry.Changes = make([]*LogEntry, n)
+		for i := range entry.Changes {
+			t, err := buf.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			change := &LogEntry{LSN: lsn, Time: entry.Time, Operation: "PUT"}
+			switch recordType(t) {
+			case recordPut:
+			case recordDelete:
+				change.Operation = "DELETE"
+			default:
+				return nil, fmt.Errorf("unknown change type %d in commit record", t)
+			}
+			if err := change.readChange(buf, version); err != nil {
+				return nil, err
+			}
+			entry.Changes[i] = change
+		}
+	}
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes in record payload", buf.Len())
+	}
+	return entry, nil
+}
+
+// readChange reads the table, key, value and old value of the entry from buf.
+func (entry *LogEntry) readChange(buf *bytes.Reader, version byte) error {
+	table, err := readString(buf)
+	if err != nil {
+		return err
+	}
+	key, err := binary.ReadVarint(buf)
+	if err != nil {
+		return err
+	}
+	value, err := readString(buf)
+	if err != nil {
+		return err
+	}
+	if version >= 3 {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if n-1 > uint64(buf.Len()) {
+				return io.ErrUnexpectedEOF
+			}
+			old := make([]byte, n-1)
+			buf.Read(old)
+			oldValue := string(old)
+			entry.OldValue = &oldValue
+		}
+	}
+	entry.Table, entry.Key, entry.Value = table, int(key), value
+	return nil
+}
+
+func readString(buf *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(buf.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	data := make([]byte, n)
+	buf.Read(data)
+	return string(data), nil
+}
+
+// encodeRecord frames a payload as a log record.
+func encodeRecord(lsn uint64, typ recordType, payload []byte) []byte {
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(record[8:16], lsn)
+	record[16] = byte(typ)
+	copy(record[recordHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+// recordAAD returns the part of a record header an encrypted payload is bound to.
+func recordAAD(lsn uint64, typ recordType) []byte {
+	aad := make([]byte, 9)
+	binary.LittleEndian.PutUint64(aad[0:8], lsn)
+	aad[8] = byte(typ)
+	return aad
+}
+
+// encodeLogHeader returns the header of a log file whose first record has LSN base+1.
+func encodeLogHeader(base uint64) []byte {
+	header := make([]byte, logHeaderSize)
+	copy(header, logMagic)
+	binary.LittleEndian.PutUint64(header[8:16], base)
+	return header
+}
+
+// logRecord is a record read back from the log, with its payload still encoded.
+type logRecord struct {
+	lsn     uint64
+	typ     recordType
+	payload []byte
+	version byte // Format version of the file the record was read from.
+}
+
+// errTornRecord signals a record that was only partially written before a crash.
+var errTornRecord = errors.New("torn log record")
+
+// recordReader reads the records of a log file in order, checking their framing,
+// checksums and LSNs.
+type recordReader struct {
+	r       *bufio.Reader
+	f       io.ReadSeeker
+	size    int64 // Size of the file.
+	off     int64 // Offset of the next record.
+	lsn     uint64
+	version byte // Format version of the file.
+}
+
+// newRecordReader reads the header of the log in f, whose size is given, and returns
+// a reader positioned at its first record.
+func newRecordReader(f io.ReadSeeker, size int64) (*recordReader, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: reading log header: %v", ErrCorruptLog, err)
+	}
+	if string(header[:7]) != logMagicPrefix || header[7] < 1 || header[7] > logVersion {
+		return nil, fmt.Errorf("%w: bad log header", ErrCorruptLog)
+	}
+	return &recordReader{
+		r:       r,
+		f:       f,
+		size:    size,
+		off:     logHeaderSize,
+		lsn:     binary.LittleEndian.Uint64(header[8:16]),
+		version: header[7],
+	}, nil
+}
+
+// next returns the next record. It returns io.EOF at the end of the log, errTornRecord
+// when the log ends with a partially written record, and an error wrapping ErrCorruptLog
+// when a damaged record is followed by more data.
+//
+// A crash can only damage the last record: one extending past the end of the file, or
+// failing its checksum with nothing but zeros after it, is taken for a torn write.
+func (rr *recordReader) next() (*logRecord, error) {
+	if rr.off == rr.size {
+		return nil, io.EOF
+	}
+	if rr.size-rr.off < recordHeaderSize {
+		return nil, errTornRecord
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(rr.r, header); err != nil {
+		return nil, err
+	}
+	length := int64(binary.LittleEndian.Uint32(header[0:4]))
+	end := rr.off + recordHeaderSize + length
+	if end > rr.size {
+		return nil, errTornRecord
+	}
+
+	record := make([]byte, recordHeaderSize+length)
+	copy(record, header)
+	if _, err := io.ReadFull(rr.r, record[recordHeaderSize:]); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record[8:]) != binary.LittleEndian.Uint32(record[4:8]) {
+		torn := end == rr.size
+		if !torn {
+			var err error
+			if torn, err = rr.zerosFrom(rr.off); err != nil {
+				return nil, err
+			}
+		}
+		if torn {
+			return nil, errTornRecord
+		}
+		return nil, fmt.Errorf("%w at offset %d: checksum mismatch", ErrCorruptLog, rr.off)
+	}
+
+	lsn := binary.LittleEndian.Uint64(record[8:16])
+	if lsn != rr.lsn+1 {
+		return nil, fmt.Errorf("%w at offset %d: expected LSN %d, found %d", ErrCorruptLog, rr.off, rr.lsn+1, lsn)
+	}
+
+	rr.off = end
+	rr.lsn = lsn
+	return &logRecord{lsn: lsn, typ: recordType(record[16]), payload: record[recordHeaderSize:], version: rr.version}, nil
+}
+
+// zerosFrom reports whether every byte of the file from off on is zero. It moves the
+// file offset, so reading stops after it.
+func (rr *recordReader) zerosFrom(off int64) (bool, error) {
+	if _, err := rr.f.Seek(off, io.SeekStart); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := rr.f.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+)
+
+// DefaultSegmentSize is the size a log segment grows to before a new one is started,
+// unless Options.SegmentSize says otherwise.
+const DefaultSegmentSize = 16 << 20
+
+const segmentExt = ".wal"
+
+// SegmentedLog is a write-ahead log split into numbered segment files under a directory.
+//
+// Records are appended to the active segment, the last one. Once it outgrows the
+// segment size it is synced and closed, and a new segment continues the LSN sequence.
+// Each segment is named after the LSN of its first record and carries the LSN before it
+// in its header, like a standalone log file. Closed segments are copied to the archive
+// directory, if one is configured, and removed once a checkpoint covers all their records.
+type SegmentedLog struct {
+	mu          sync.Mutex // Guards the fields below; held while the active segment is replaced.
+	dir         string
+	opts        Options
+	segmentSize int64
+	closed      []segment // Closed segments, oldest first.
+	active      *AppendOnlyLog
+	err         error // Set when rotation left the log without an active segment.
+}
+
+// segment describes a closed segment file.
+type segment struct {
+	name     string
+	base     uint64 // LSN before its first record.
+	size     int64
+	archived bool
+}
+
+// segmentName returns the file name of the segment whose first record has LSN base+1.
+func segmentName(base uint64) string {
+	return fmt.Sprintf("%016x%s", base+1, segmentExt)
+}
+
+// openSegmentedLog opens the log directory at path, creating it if needed. A log kept in
+// a single file at path by earlier versions becomes the first segment of the directory.
+func openSegmentedLog(path string, opts Options) (*SegmentedLog, error) {
+	if err := migrateSingleFileLog(path, opts.Cipher); err != nil {
+		return nil, fmt.Errorf("failed to migrate log %s: %w", path, err)
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if opts.ArchiveDir != "" {
+		if err := os.MkdirAll(opts.ArchiveDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log archive: %w", err)
+		}
+	}
+	// Temporary files are left by a rotation or an archive copy interrupted by a crash.
+	for _, dir := range []string{path, opts.ArchiveDir} {
+		if dir == "" {
+			continue
+		}
+		if err := removeTempFiles(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &SegmentedLog{dir: path, opts: opts, segmentSize: opts.SegmentSize}
+	if s.segmentSize <= 0 {
+		s.segmentSize = DefaultSegmentSize
+	}
+
+	segments, err := listSegments(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		if err := createSegment(path, 0, opts.Cipher); err != nil {
+			return nil, err
+		}
+		segments = []segment{{name: segmentName(0)}}
+	}
+
+	// Segments left over from before a crash may not have reached the archive yet;
+	// copying them again is harmless.
+	last := segments[len(segments)-1]
+	s.closed = segments[:len(segments)-1]
+	if s.active, err = openLog(filepath.Join(path, last.name), opts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// listSegments returns the segments in dir, oldest first, with their base LSNs taken from
+// their names.
+func listSegments(dir string) ([]segment, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, de := range dirEntries {
+		name := de.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil || first == 0 {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{name: name, base: first - 1, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].base < segments[j].base })
+	return segments, nil
+}
+
+// removeTempFiles removes the temporary files in dir.
+func removeTempFiles(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+	return nil
+}
+
+// findSegments returns the segments found in dirs, oldest first, along with their paths.
+// Segments present in several directories are listed once, from the first of them.
+func findSegments(dirs []string) ([]segment, map[string]string, error) {
+	paths := make(map[string]string)
+	var segments []segment
+	for _, dir := range dirs {
+		found, err := listSegments(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, seg := range found {
+			if _, ok := paths[seg.name]; !ok {
+				paths[seg.name] = filepath.Join(dir, seg.name)
+				segments = append(segments, seg)
+			}
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].base < segments[j].base })
+	return segments, paths, nil
+}
+
+// createSegment writes an empty segment whose first record will get LSN base+1.
+// The segment appears in dir complete or not at all.
+func createSegment(dir string, base uint64, c *encryption.Cipher) error {
+	name := filepath.Join(dir, segmentName(base))
+	if err := writeLogFile(name+".tmp", base, nil, c); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the creation, renaming and removal of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// enqueue queues an entry in the active segment. See AppendOnlyLog.enqueue.
+func (s *SegmentedLog) enqueue(entry *LogEntry) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.active.enqueue(entry)
+}
+
+// wait blocks until the record with the given LSN is written, then starts a new segment
+// if the active one is full. Records of closed segments were all written when they closed.
+func (s *SegmentedLog) wait(lsn uint64) error {
+	s.mu.Lock()
+	active := s.active
+	s.mu.Unlock()
+
+	if err := active.wait(lsn); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil && s.active.Size() >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			// The record itself is safe; only later appends are affected.
+			fmt.Printf("Warning: log segment rotation failed: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// rotate closes the active segment and starts the next one. The caller holds mu.
+func (s *SegmentedLog) rotate() error {
+	old := s.active
+	if err := old.Close(); err != nil {
+		s.err = fmt.Errorf("log unusable after failed segment rotation: %w", err)
+		return err
+	}
+	s.closed = append(s.closed, segment{name: segmentName(old.baseLSN()), base: old.baseLSN(), size: old.Size()})
+
+	next := old.LastLSN()
+	if err := createSegment(s.dir, next, s.opts.Cipher); err != nil {
+		s.err = fmt.Errorf("log unusable after failed segment rotation: %w", err)
+		return err
+	}
+	active, err := openLog(filepath.Join(s.dir, segmentName(next)), s.opts)
+	if err != nil {
+		s.err = fmt.Errorf("log unusable after failed segment rotation: %w", err)
+		return err
+	}
+	s.active = active
+
+	if err := s.archive(); err != nil {
+		fmt.Printf("Warning: failed to archive log segment: %v\n", err)
+	}
+	return nil
+}
+
+// archive copies the closed segments not archived yet to the archive directory.
+// The caller holds mu.
+func (s *SegmentedLog) archive() error {
+	if s.opts.ArchiveDir == "" {
+		return nil
+	}
+	for i := range s.closed {
+		seg := &s.closed[i]
+		if seg.archived {
+			continue
+		}
+		if err := copyFile(filepath.Join(s.dir, seg.name), filepath.Join(s.opts.ArchiveDir, seg.name)); err != nil {
+			return err
+		}
+		seg.archived = true
+	}
+	return syncDir(s.opts.ArchiveDir)
+}
+
+// copyFile copies src to dst through a temporary file, so dst is either complete or absent.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// DiscardThrough removes the segments holding only records at or below lsn, closing the
+// active segment first if that applies to it. Segments are archived before they are removed.
+func (s *SegmentedLog) DiscardThrough(lsn uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.active.LastLSN() > s.active.baseLSN() && s.active.LastLSN() <= lsn {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := s.archive(); err != nil {
+		return fmt.Errorf("failed to archive log segments: %w", err)
+	}
+
+	// Segments are removed oldest first, so a crash leaves the newer ones in sequence.
+	for len(s.closed) > 0 {
+		next := s.active.baseLSN()
+		if len(s.closed) > 1 {
+			next = s.closed[1].base
+		}
+		if next > lsn {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, s.closed[0].name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		s.closed = s.closed[1:]
+	}
+	return syncDir(s.dir)
+}
+
+// Reset removes every segment and starts an empty log whose next record gets LSN base+1.
+// Segments are archived before they are removed. A crash during Reset leaves a suffix of
+// the old segments, or an empty log.
+func (s *SegmentedLog) Reset(base uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.active.Close(); err != nil {
+		s.err = fmt.Errorf("log unusable after failed reset: %w", err)
+		return err
+	}
+	if s.active.LastLSN() > s.active.baseLSN() {
+		s.closed = append(s.closed, segment{name: segmentName(s.active.baseLSN()), base: s.active.baseLSN(), size: s.active.Size()})
+	} else {
+		os.Remove(filepath.Join(s.dir, segmentName(s.active.baseLSN())))
+	}
+
+	err := s.archive()
+	for err == nil && len(s.closed) > 0 {
+		if err = os.Remove(filepath.Join(s.dir, s.closed[0].name)); err == nil {
+			s.closed = s.closed[1:]
+		}
+	}
+	if err == nil {
+		err = createSegment(s.dir, base, s.opts.Cipher)
+	}
+	if err == nil {
+		s.active, err = openLog(filepath.Join(s.dir, segmentName(base)), s.opts)
+	}
+	if err != nil {
+		s.err = fmt.Errorf("log unusable after failed reset: %w", err)
+		return err
+	}
+	return nil
+}
+
+// Replay reads the entries of every segment in LSN order. A torn record is only
+// tolerated at the end of the active segment; gaps between segments are reported
+// as ErrCorruptLog.
+func (s *SegmentedLog) Replay() ([]*LogEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var entries []*LogEntry
+	for i, seg := range s.closed {
+		next := s.active.baseLSN()
+		if i+1 < len(s.closed) {
+			next = s.closed[i+1].base
+		}
+		_, last, err := ReadSegment(filepath.Join(s.dir, seg.name), s.opts.Cipher, func(entry *LogEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if last != next {
+			return nil, fmt.Errorf("%w: segment %s ends at LSN %d but the next one starts after LSN %d", ErrCorruptLog, seg.name, last, next)
+		}
+	}
+
+	active, err := s.active.Replay()
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, active...), nil
+}
+
+// ReadSegment reads the records of a closed log segment, such as an archived one, passing
+// the decoded entries to fn. It returns the LSN before the first record of the segment and
+// the LSN of its last one. Since a closed segment was synced before the next one started,
+// any damage, including a torn record at its end, is reported as ErrCorruptLog.
+func ReadSegment(path string, c *encryption.Cipher, fn func(*LogEntry) error) (base, last uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	rr, err := newRecordReader(f, info.Size())
+	if err != nil {
+		return 0, 0, err
+	}
+	base = rr.lsn
+
+	for {
+		rec, err := rr.next()
+		if err == io.EOF {
+			return base, rr.lsn, nil
+		}
+		if err == errTornRecord {
+			return 0, 0, fmt.Errorf("%w: segment %s: truncated record at offset %d", ErrCorruptLog, filepath.Base(path), rr.off)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		entry, err := openRecord(c, rec)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: LSN %d: %v", ErrCorruptLog, rec.lsn, err)
+		}
+		if err := fn(entry); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// LastLSN returns the LSN of the last record appended to the log.
+func (s *SegmentedLog) LastLSN() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.LastLSN()
+}
+
+// baseLSN returns the LSN preceding the first record in the oldest segment.
+func (s *SegmentedLog) baseLSN() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.closed) > 0 {
+		return s.closed[0].base
+	}
+	return s.active.baseLSN()
+}
+
+// Size returns the total size of the segments in bytes.
+func (s *SegmentedLog) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := s.active.Size()
+	for _, seg := range s.closed {
+		size += seg.size
+	}
+	return size
+}
+
+// Segments returns the file names of the segments, oldest first.
+func (s *SegmentedLog) Segments() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.closed)+1)
+	for _, seg := range s.closed {
+		names = append(names, seg.name)
+	}
+	return append(names, segmentName(s.active.baseLSN()))
+}
+
+// Close writes the records still queued and closes the active segment.
+func (s *SegmentedLog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.Close()
+}
+
+// migrateSingleFileLog moves a log kept in a single file at path into a directory at the
+// same path, where it becomes the first segment. The file is renamed aside first, so a
+// crash part way is finished by the next open.
+func migrateSingleFileLog(path string, c *encryption.Cipher) error {
+	aside := path + ".segment"
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && !info.IsDir():
+		if err := migrateLegacyLog(path, c); err != nil {
+			return err
+		}
+		if err := os.Rename(path, aside); err != nil {
+			return err
+		}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	if _, err := os.Stat(aside); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	// Reading the log repairs a torn tail and yields its base LSN.
+	single, err := openLog(aside, Options{Cipher: c})
+	if err != nil {
+		return err
+	}
+	base := single.baseLSN()
+	if err := single.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(aside, filepath.Join(path, segmentName(base))); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
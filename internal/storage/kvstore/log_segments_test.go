@@ -0,0 +1,180 @@
+package kvstore_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// openSegmentedStore opens a store in dir whose log rotates every segmentSize bytes.
+func openSegmentedStore(t *testing.T, dir string, segmentSize int64, archiveDir string) (*kvstore.BTreeKVStore, disk.DiskManager) {
+	t.Helper()
+	diskManager, err := disk.NewFileDiskManager(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	store, err := kvstore.NewBTreeKVStoreWithOptions(3, diskManager, filepath.Join(dir, "wal"), kvstore.Options{
+		SegmentSize: segmentSize,
+		ArchiveDir:  archiveDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return store, diskManager
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	return names
+}
+
+func TestLogRotatesAndArchivesSegments(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := filepath.Join(dir, "archive")
+	store, diskManager := openSegmentedStore(t, dir, 1024, archiveDir)
+
+	table := "segmented"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for key := 0; key < 200; key++ {
+		if err := store.Put(table, key, fmt.Sprintf("value%d", key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if n := len(segmentFiles(t, filepath.Join(dir, "wal"))); n < 5 {
+		t.Fatalf("Expected the log to rotate into several segments, got %d", n)
+	}
+
+	// A checkpoint covers every record, so only a fresh segment remains.
+	lsn, err := store.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if n := len(segmentFiles(t, filepath.Join(dir, "wal"))); n != 1 {
+		t.Fatalf("Expected a single segment after the checkpoint, got %d", n)
+	}
+
+	// The archive holds every record in order.
+	var next uint64
+	for _, name := range segmentFiles(t, archiveDir) {
+		base, last, err := kvstore.ReadSegment(name, nil, func(entry *kvstore.LogEntry) error {
+			next++
+			if entry.LSN != next {
+				return fmt.Errorf("expected LSN %d, got %d", next, entry.LSN)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to read archived segment %s: %v", name, err)
+		}
+		if base >= last {
+			t.Fatalf("Expected archived segment %s to hold records, it spans %d-%d", name, base, last)
+		}
+	}
+	if next != lsn {
+		t.Fatalf("Expected the archive to end at LSN %d, got %d", lsn, next)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	diskManager.Close()
+
+	reopened, diskManager := openSegmentedStore(t, dir, 1024, archiveDir)
+	defer diskManager.Close()
+	defer reopened.Close()
+	for key := 0; key < 200; key++ {
+		assertGet(t, reopened, table, key, fmt.Sprintf("value%d", key))
+	}
+}
+
+func TestRecoveryReplaysEverySegment(t *testing.T) {
+	dir := t.TempDir()
+	store, diskManager := openSegmentedStore(t, dir, 512, "")
+
+	table := "segmented"
+	if err := store.CreateTableName(table, 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	for key := 0; key < 100; key++ {
+		if err := store.Put(table, key, fmt.Sprintf("value%d", key)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	segments := segmentFiles(t, filepath.Join(dir, "wal"))
+	diskManager.Close()
+
+	// Abandoned without a checkpoint, as after a crash.
+	reopened, diskManager := openSegmentedStore(t, dir, 512, "")
+	for key := 0; key < 100; key++ {
+		assertGet(t, reopened, table, key, fmt.Sprintf("value%d", key))
+	}
+	diskManager.Close()
+
+	// A segment missing from the middle of the log is corruption, not a shorter log.
+	if err := os.Remove(segments[len(segments)/2]); err != nil {
+		t.Fatalf("Failed to remove segment: %v", err)
+	}
+	diskManager, err := disk.NewFileDiskManager(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatalf("Failed to create DiskManager: %v", err)
+	}
+	defer diskManager.Close()
+	damaged, err := kvstore.NewBTreeKVStore(3, diskManager, filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatalf("Failed to create KVStore: %v", err)
+	}
+	if err := damaged.Load(); !errors.Is(err, kvstore.ErrCorruptLog) {
+		t.Fatalf("Expected ErrCorruptLog for a missing segment, got %v", err)
+	}
+}
+
+func TestSingleFileLogMigratedToSegments(t *testing.T) {
+	dir := t.TempDir()
+	store, diskManager := openSegmentedStore(t, dir, 0, "")
+	if err := store.CreateTableName("numbers", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	// Abandoned without a checkpoint, so the records of the old log are not covered by one.
+	diskManager.Close()
+
+	// Replace the log directory with a log written by an earlier version.
+	logPath := filepath.Join(dir, "wal")
+	if err := os.RemoveAll(logPath); err != nil {
+		t.Fatalf("Failed to remove log: %v", err)
+	}
+	log, err := kvstore.NewAppendOnlyLog(logPath)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	appendEntries(t, log,
+		&kvstore.LogEntry{Operation: "PUT", Table: "numbers", Key: 1, Value: "one"},
+		&kvstore.LogEntry{Operation: "PUT", Table: "numbers", Key: 2, Value: "two"},
+	)
+	log.Close()
+
+	reopened, diskManager := openSegmentedStore(t, dir, 0, "")
+	defer diskManager.Close()
+	defer reopened.Close()
+	assertGet(t, reopened, "numbers", 1, "one")
+	assertGet(t, reopened, "numbers", 2, "two")
+	if n := len(segmentFiles(t, logPath)); n != 1 {
+		t.Fatalf("Expected the old log to become one segment, got %d", n)
+	}
+}
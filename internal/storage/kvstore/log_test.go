@@ -1,10 +1,20 @@
 package kvstore_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
 	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
 )
 
@@ -75,6 +85,23 @@ func TestSerialization(t *testing.T) {
 
 }
 
+func TestSerializationKeepsOldValue(t *testing.T) {
+	for _, old := range []string{"", "before"} {
+		entry := &kvstore.LogEntry{Operation: "PUT", Key: 1, Value: "after", Table: "t", OldValue: &old}
+		data, err := entry.Serialize()
+		if err != nil {
+			t.Fatalf("Failed to serialize log entry: %v", err)
+		}
+		decoded, err := kvstore.DeserializeLogEntry(data)
+		if err != nil {
+			t.Fatalf("Failed to deserialize log entry: %v", err)
+		}
+		if decoded.OldValue == nil || *decoded.OldValue != old {
+			t.Fatalf("Expected old value %q, got %v", old, decoded.OldValue)
+		}
+	}
+}
+
 func TestClose(t *testing.T) {
 	// Create a temporary log file
 	tmpfile, err := os.CreateTemp("", "append_only_log_test")
@@ -217,3 +244,384 @@ func TestConcurrentAppend(t *testing.T) {
 		}
 	}
 }
+
+func TestEncryptedAppendOnlyLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "encrypted.log")
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{1}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+
+	log, err := kvstore.NewEncryptedAppendOnlyLog(filename, c)
+	if err != nil {
+		t.Fatalf("Failed to create encrypted log: %v", err)
+	}
+	entry := &kvstore.LogEntry{Operation: "PUT", Key: 1, Value: "customer secret", Table: "customers"}
+	if err := log.Append(entry); err != nil {
+		t.Fatalf("Failed to append log entry: %v", err)
+	}
+	log.Close()
+
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if bytes.Contains(raw, []byte("customer secret")) || bytes.Contains(raw, []byte("customers")) {
+		t.Fatalf("Expected log record to be encrypted on disk")
+	}
+
+	log, err = kvstore.NewEncryptedAppendOnlyLog(filename, c)
+	if err != nil {
+		t.Fatalf("Failed to reopen encrypted log: %v", err)
+	}
+	defer log.Close()
+
+	replayed, err := log.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	if len(replayed) != 1 || !reflect.DeepEqual(replayed[0], entry) {
+		t.Fatalf("Expected %+v, got %+v", entry, replayed)
+	}
+}
+
+func TestRekeyLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rekey.log")
+
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	entry := &kvstore.LogEntry{Operation: "PUT", Key: 7, Value: "seven", Table: "numbers"}
+	if err := log.Append(entry); err != nil {
+		t.Fatalf("Failed to append log entry: %v", err)
+	}
+	log.Close()
+
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{2}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	if err := kvstore.RekeyLog(filename, nil, c); err != nil {
+		t.Fatalf("Failed to rekey log: %v", err)
+	}
+
+	log, err = kvstore.NewEncryptedAppendOnlyLog(filename, c)
+	if err != nil {
+		t.Fatalf("Failed to open encrypted log: %v", err)
+	}
+	defer log.Close()
+
+	replayed, err := log.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	if len(replayed) != 1 || !reflect.DeepEqual(replayed[0], entry) {
+		t.Fatalf("Expected %+v, got %+v", entry, replayed)
+	}
+}
+
+func appendEntries(t *testing.T, log *kvstore.AppendOnlyLog, entries ...*kvstore.LogEntry) {
+	t.Helper()
+	for _, entry := range entries {
+		if err := log.Append(entry); err != nil {
+			t.Fatalf("Failed to append log entry: %v", err)
+		}
+	}
+}
+
+func replayLog(t *testing.T, filename string) []*kvstore.LogEntry {
+	t.Helper()
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	defer log.Close()
+
+	entries, err := log.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	return entries
+}
+
+func TestAppendAssignsLSNs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "lsn.log")
+
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		entry := &kvstore.LogEntry{Operation: "PUT", Key: i, Value: "v", Table: "t"}
+		appendEntries(t, log, entry)
+		if entry.LSN != uint64(i) {
+			t.Fatalf("Expected LSN %d, got %d", i, entry.LSN)
+		}
+	}
+	log.Close()
+
+	// Numbering continues after reopening.
+	log, err = kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+	entry := &kvstore.LogEntry{Operation: "DELETE", Key: 1, Table: "t"}
+	appendEntries(t, log, entry)
+	log.Close()
+	if entry.LSN != 4 {
+		t.Fatalf("Expected LSN 4 after reopening, got %d", entry.LSN)
+	}
+
+	for i, entry := range replayLog(t, filename) {
+		if entry.LSN != uint64(i+1) {
+			t.Fatalf("Expected LSN %d at position %d, got %d", i+1, i, entry.LSN)
+		}
+	}
+}
+
+func TestAppendRecordsTime(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "time.log")
+
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	before := time.Now()
+	appendEntries(t, log, &kvstore.LogEntry{Operation: "PUT", Key: 1, Value: "v", Table: "t"})
+	after := time.Now()
+	log.Close()
+
+	replayed := replayLog(t, filename)
+	if len(replayed) != 1 || replayed[0].Time.Before(before) || replayed[0].Time.After(after) {
+		t.Fatalf("Expected an entry logged between %v and %v, got %+v", before, after, replayed)
+	}
+}
+
+func TestVersion1LogUpgraded(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "v1.log")
+
+	// A version 1 log based at LSN 4, holding one PUT of key 7 in table "t" without a time.
+	payload := []byte{1, 't', 14, 3, 'o', 'l', 'd'}
+	record := make([]byte, 17+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(record[8:16], 5)
+	record[16] = 1
+	copy(record[17:], payload)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	header := append([]byte("LGDBWAL\x01"), 4, 0, 0, 0, 0, 0, 0, 0)
+	if err := os.WriteFile(filename, append(header, record...), 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	appendEntries(t, log, &kvstore.LogEntry{Operation: "PUT", Key: 8, Value: "new", Table: "t"})
+	log.Close()
+
+	replayed := replayLog(t, filename)
+	if len(replayed) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(replayed))
+	}
+	if old := replayed[0]; old.LSN != 5 || old.Key != 7 || old.Value != "old" || !old.Time.IsZero() {
+		t.Fatalf("Expected the version 1 entry unchanged, got %+v", old)
+	}
+	if added := replayed[1]; added.LSN != 6 || added.Value != "new" || added.Time.IsZero() {
+		t.Fatalf("Expected the new entry at LSN 6 with a time, got %+v", added)
+	}
+}
+
+func TestReplayLargeEntry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "large.log")
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	entry := &kvstore.LogEntry{Operation: "PUT", Key: 1, Value: strings.Repeat("x", 256*1024), Table: "blobs"}
+	appendEntries(t, log, entry)
+	log.Close()
+
+	replayed := replayLog(t, filename)
+	if len(replayed) != 1 || !reflect.DeepEqual(replayed[0], entry) {
+		t.Fatalf("Expected the large entry back, got %d entries", len(replayed))
+	}
+}
+
+func TestReplayDiscardsTornTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "torn.log")
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	appendEntries(t, log,
+		&kvstore.LogEntry{Operation: "PUT", Key: 1, Value: "one", Table: "t"},
+		&kvstore.LogEntry{Operation: "PUT", Key: 2, Value: "two", Table: "t"},
+		&kvstore.LogEntry{Operation: "PUT", Key: 3, Value: "three", Table: "t"},
+	)
+	log.Close()
+
+	// Cut the last record short, as a crash in the middle of its write would.
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat log: %v", err)
+	}
+	if err := os.Truncate(filename, info.Size()-4); err != nil {
+		t.Fatalf("Failed to truncate log: %v", err)
+	}
+
+	log, err = kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen log with a torn tail: %v", err)
+	}
+	replayed, err := log.Replay()
+	if err != nil {
+		t.Fatalf("Failed to replay log: %v", err)
+	}
+	if len(replayed) != 2 {
+		t.Fatalf("Expected 2 entries before the torn record, got %d", len(replayed))
+	}
+
+	// A record appended after recovery replaces the torn one instead of following it.
+	entry := &kvstore.LogEntry{Operation: "PUT", Key: 4, Value: "four", Table: "t"}
+	appendEntries(t, log, entry)
+	log.Close()
+	if entry.LSN != 3 {
+		t.Fatalf("Expected the torn LSN to be reused, got %d", entry.LSN)
+	}
+
+	replayed = replayLog(t, filename)
+	if len(replayed) != 3 || !reflect.DeepEqual(replayed[2], entry) {
+		t.Fatalf("Expected the new entry after the surviving ones, got %+v", replayed)
+	}
+}
+
+func TestReplayReportsMidLogCorruption(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "corrupt.log")
+	log, err := kvstore.NewAppendOnlyLog(filename)
+	if err != nil {
+		t.Fatalf("Failed to create log: %v", err)
+	}
+	appendEntries(t, log,
+		&kvstore.LogEntry{Operation: "PUT", Key: 1, Value: "first", Table: "t"},
+		&kvstore.LogEntry{Operation: "PUT", Key: 2, Value: "second", Table: "t"},
+		&kvstore.LogEntry{Operation: "PUT", Key: 3, Value: "third", Table: "t"},
+	)
+	log.Close()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	i := bytes.Index(data, []byte("second"))
+	data[i] ^= 0xff
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	if _, err := kvstore.NewAppendOnlyLog(filename); !errors.Is(err, kvstore.ErrCorruptLog) {
+		t.Fatalf("Expected ErrCorruptLog, got %v", err)
+	}
+}
+
+func TestReplayWithWrongKeyFails(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "encrypted.log")
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{3}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	log, err := kvstore.NewEncryptedAppendOnlyLog(filename, c)
+	if err != nil {
+		t.Fatalf("Failed to create encrypted log: %v", err)
+	}
+	appendEntries(t, log, &kvstore.LogEntry{Operation: "PUT", Key: 1, Value: "secret", Table: "t"})
+	log.Close()
+
+	other, err := encryption.NewCipher(bytes.Repeat([]byte{4}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	log, err = kvstore.NewEncryptedAppendOnlyLog(filename, other)
+	if err != nil {
+		t.Fatalf("Failed to open encrypted log: %v", err)
+	}
+	defer log.Close()
+	if _, err := log.Replay(); !errors.Is(err, kvstore.ErrCorruptLog) {
+		t.Fatalf("Expected replay with the wrong key to fail, got %v", err)
+	}
+}
+
+func TestLegacyJSONLogMigrated(t *testing.T) {
+	c, err := encryption.NewCipher(bytes.Repeat([]byte{5}, encryption.KeySize))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	long := strings.Repeat("y", 100*1024)
+	lines := []string{
+		`{"operation":"PUT","key":1,"value":"one","table":"t"}`,
+		`{"operation":"PUT","key":2,"value":"` + long + `","table":"t"}`,
+		`not json`,
+		`{"operation":"DELETE","key":1,"table":"t"}`,
+	}
+
+	for _, tt := range []struct {
+		name   string
+		cipher *encryption.Cipher
+	}{{"plaintext", nil}, {"encrypted", c}} {
+		t.Run(tt.name, func(t *testing.T) {
+			var content bytes.Buffer
+			for _, line := range lines {
+				if tt.cipher != nil {
+					sealed, err := tt.cipher.Seal([]byte(line), nil)
+					if err != nil {
+						t.Fatalf("Failed to seal line: %v", err)
+					}
+					line = base64.StdEncoding.EncodeToString(sealed)
+				}
+				content.WriteString(line + "\n")
+			}
+			filename := filepath.Join(t.TempDir(), "legacy.log")
+			if err := os.WriteFile(filename, content.Bytes(), 0644); err != nil {
+				t.Fatalf("Failed to write legacy log: %v", err)
+			}
+
+			var log *kvstore.AppendOnlyLog
+			if tt.cipher != nil {
+				log, err = kvstore.NewEncryptedAppendOnlyLog(filename, tt.cipher)
+			} else {
+				log, err = kvstore.NewAppendOnlyLog(filename)
+			}
+			if err != nil {
+				t.Fatalf("Failed to open legacy log: %v", err)
+			}
+			defer log.Close()
+
+			replayed, err := log.Replay()
+			if err != nil {
+				t.Fatalf("Failed to replay migrated log: %v", err)
+			}
+			want := []kvstore.LogEntry{
+				{LSN: 1, Operation: "PUT", Key: 1, Value: "one", Table: "t"},
+				{LSN: 2, Operation: "PUT", Key: 2, Value: long, Table: "t"},
+				{LSN: 3, Operation: "DELETE", Key: 1, Table: "t"},
+			}
+			if len(replayed) != len(want) {
+				t.Fatalf("Expected %d entries, got %d", len(want), len(replayed))
+			}
+			for i := range want {
+				if !reflect.DeepEqual(*replayed[i], want[i]) {
+					t.Fatalf("Entry %d: expected %+v, got %+v", i, want[i], *replayed[i])
+				}
+			}
+
+			raw, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("Failed to read log: %v", err)
+			}
+			if bytes.Contains(raw, []byte(`"operation"`)) {
+				t.Fatalf("Expected the log to be rewritten in the binary format")
+			}
+		})
+	}
+}
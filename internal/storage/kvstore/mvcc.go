@@ -0,0 +1,206 @@
+package kvstore
+
+import (
+	"errors"
+	"sync"
+)
+
+// The trees hold the latest version of every key, and the LSN of the record that wrote a
+// version is its commit timestamp. A snapshot pins an LSN: it sees every change logged up
+// to it and none after. For a snapshot to keep seeing a key written after it, each write
+// made while snapshots are active records the version it replaces, tagged with the LSN
+// of the write, in the store's versionStore. A snapshot reading the key takes the oldest
+// replaced version tagged after its LSN, or the tree's version if there is none.
+//
+// Writers record the replaced version before applying the write to the tree, and readers
+// search the tree before the versionStore, so a reader that finds a write in the tree also
+// finds the version it replaced. Replaced versions are collected once no active snapshot
+// is older than the write that replaced them.
+//
+// Changes to the tables themselves are not versioned: a snapshot sees no keys in a table
+// created after it, and a dropped table is gone for every snapshot.
+
+var (
+	// ErrConflict is returned by Commit when a key the transaction writes was committed by
+	// another writer after the transaction began. The transaction can be retried.
+	ErrConflict = errors.New("kvstore: transaction conflicts with a concurrent commit")
+
+	// ErrSnapshotReleased is returned when a snapshot is read after it was released.
+	ErrSnapshotReleased = errors.New("kvstore: snapshot already released")
+)
+
+// version is a value of a key replaced by a later write.
+type version struct {
+	lsn   uint64  // LSN of the write that replaced the value.
+	value *string // Value the key had before; nil if it had none.
+}
+
+// versionStore keeps the replaced versions that active snapshots may still read.
+type versionStore struct {
+	mu        sync.Mutex
+	snapshots map[uint64]int      // Number of active snapshots pinned at each LSN.
+	chains    map[txKey][]version // Replaced versions of each key, oldest first.
+	history   []txKey             // Keys of the replaced versions, in LSN order, for collection.
+}
+
+func newVersionStore() *versionStore {
+	return &versionStore{
+		snapshots: make(map[uint64]int),
+		chains:    make(map[txKey][]version),
+	}
+}
+
+// record keeps the version that the write of a change replaces, if a snapshot may read it.
+// The caller holds writeMu and has set the change's LSN and OldValue.
+func (vs *versionStore) record(change *LogEntry) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if len(vs.snapshots) == 0 {
+		return
+	}
+	key := txKey{change.Table, change.Key}
+	vs.chains[key] = append(vs.chains[key], version{lsn: change.LSN, value: change.OldValue})
+	vs.history = append(vs.history, key)
+}
+
+// at returns the version of a key a snapshot at lsn sees, if a later write replaced it.
+func (vs *versionStore) at(key txKey, lsn uint64) (version, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for _, v := range vs.chains[key] {
+		if v.lsn > lsn {
+			return v, true
+		}
+	}
+	return version{}, false
+}
+
+// writtenAfter reports whether a key was written after lsn, which an active snapshot pins.
+func (vs *versionStore) writtenAfter(key txKey, lsn uint64) bool {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	chain := vs.chains[key]
+	return len(chain) > 0 && chain[len(chain)-1].lsn > lsn
+}
+
+// pin registers a snapshot at lsn.
+func (vs *versionStore) pin(lsn uint64) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.snapshots[lsn]++
+}
+
+// unpin releases a snapshot at lsn and collects the versions no remaining snapshot reads.
+func (vs *versionStore) unpin(lsn uint64) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.snapshots[lsn]--; vs.snapshots[lsn] == 0 {
+		delete(vs.snapshots, lsn)
+	}
+
+	oldest, active := uint64(0), len(vs.snapshots) > 0
+	for pinned := range vs.snapshots {
+		if oldest == 0 || pinned < oldest {
+			oldest = pinned
+		}
+	}
+	// Versions are recorded in LSN order, so the oldest ones lead both the history and
+	// each chain.
+	for len(vs.history) > 0 {
+		key := vs.history[0]
+		chain := vs.chains[key]
+		if active && chain[0].lsn > oldest {
+			break
+		}
+		if len(chain) == 1 {
+			delete(vs.chains, key)
+		} else {
+			vs.chains[key] = chain[1:]
+		}
+		vs.history = vs.history[1:]
+	}
+}
+
+// MVCCStats reports the state of the store's multi-version concurrency control.
+type MVCCStats struct {
+	Snapshots int // Active snapshots, including those of open transactions.
+	Versions  int // Replaced versions kept for them.
+}
+
+// MVCCStats returns the number of active snapshots and of the versions kept for them.
+func (kv *BTreeKVStore) MVCCStats() MVCCStats {
+	kv.versions.mu.Lock()
+	defer kv.versions.mu.Unlock()
+	stats := MVCCStats{Versions: len(kv.versions.history)}
+	for _, n := range kv.versions.snapshots {
+		stats.Snapshots += n
+	}
+	return stats
+}
+
+// Snapshot is a consistent, read-only view of the store as of the last change logged when
+// it was taken. Reading it neither blocks writers nor is affected by them. A snapshot must
+// be released once done with, so the versions it keeps alive can be collected.
+type Snapshot struct {
+	kv       *BTreeKVStore
+	lsn      uint64
+	mu       sync.Mutex
+	released bool
+}
+
+// Snapshot takes a snapshot of the store.
+func (kv *BTreeKVStore) Snapshot() *Snapshot {
+	// Every change logged is applied by the time writeMu is free, so the snapshot sees
+	// each change up to its LSN in full.
+	kv.writeMu.Lock()
+	defer kv.writeMu.Unlock()
+	lsn := kv.log.LastLSN()
+	kv.versions.pin(lsn)
+	return &Snapshot{kv: kv, lsn: lsn}
+}
+
+// LSN returns the LSN of the last change the snapshot sees.
+func (s *Snapshot) LSN() uint64 {
+	return s.lsn
+}
+
+// Get retrieves the value a key had when the snapshot was taken.
+func (s *Snapshot) Get(table string, key int) (string, bool, error) {
+	s.mu.Lock()
+	released := s.released
+	s.mu.Unlock()
+	if released {
+		return "", false, ErrSnapshotReleased
+	}
+
+	bt, err := s.kv.table(table)
+	if err != nil {
+		return "", false, err
+	}
+	if meta, ok := s.kv.catalog.Get(table); ok && meta.CreateLSN > s.lsn {
+		return "", false, nil
+	}
+
+	value, found := bt.Search(key)
+	if v, ok := s.kv.versions.at(txKey{table, key}, s.lsn); ok {
+		if v.value == nil {
+			return "", false, nil
+		}
+		return *v.value, true, nil
+	}
+	if !found {
+		return "", false, nil
+	}
+	return value.(string), true, nil
+}
+
+// Release releases the snapshot. Releasing it again has no effect.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.kv.versions.unpin(s.lsn)
+}
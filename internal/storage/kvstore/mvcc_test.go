@@ -0,0 +1,199 @@
+package kvstore_test
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+func assertSnapshotGet(t *testing.T, snapshot *kvstore.Snapshot, table string, key int, expected string) {
+	t.Helper()
+	value, found, err := snapshot.Get(table, key)
+	if err != nil {
+		t.Fatalf("Snapshot GET failed: %v", err)
+	}
+	if !found || value != expected {
+		t.Fatalf("Expected '%s' in the snapshot, got '%s' (found %v)", expected, value, found)
+	}
+}
+
+func assertSnapshotMissing(t *testing.T, snapshot *kvstore.Snapshot, table string, key int) {
+	t.Helper()
+	value, found, err := snapshot.Get(table, key)
+	if err != nil {
+		t.Fatalf("Snapshot GET failed: %v", err)
+	}
+	if found {
+		t.Fatalf("Expected key %d to be missing in the snapshot, found value '%s'", key, value)
+	}
+}
+
+func TestSnapshotIsolatesReads(t *testing.T) {
+	store, diskManager := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer diskManager.Close()
+	defer store.Close()
+
+	if err := store.CreateTableName("users", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	store.Put("users", 1, "alice")
+	store.Put("users", 2, "bob")
+
+	first := store.Snapshot()
+	store.Put("users", 1, "alicia")
+	store.Delete("users", 2)
+	store.Put("users", 3, "carol")
+	if err := store.CreateTableName("emails", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	store.Put("emails", 1, "alicia@example.com")
+
+	second := store.Snapshot()
+	store.Put("users", 1, "ally")
+
+	assertSnapshotGet(t, first, "users", 1, "alice")
+	assertSnapshotGet(t, first, "users", 2, "bob")
+	assertSnapshotMissing(t, first, "users", 3)
+	assertSnapshotMissing(t, first, "emails", 1)
+	assertSnapshotGet(t, second, "users", 1, "alicia")
+	assertSnapshotMissing(t, second, "users", 2)
+	assertSnapshotGet(t, second, "emails", 1, "alicia@example.com")
+	assertGet(t, store, "users", 1, "ally")
+
+	if stats := store.MVCCStats(); stats.Snapshots != 2 || stats.Versions != 5 {
+		t.Fatalf("Expected 2 snapshots keeping 5 versions, got %+v", stats)
+	}
+
+	// Only the versions replaced after the oldest remaining snapshot are kept.
+	first.Release()
+	first.Release()
+	if stats := store.MVCCStats(); stats.Snapshots != 1 || stats.Versions != 1 {
+		t.Fatalf("Expected 1 snapshot keeping 1 version, got %+v", stats)
+	}
+	assertSnapshotGet(t, second, "users", 1, "alicia")
+	if _, _, err := first.Get("users", 1); !errors.Is(err, kvstore.ErrSnapshotReleased) {
+		t.Fatalf("Expected ErrSnapshotReleased, got %v", err)
+	}
+
+	second.Release()
+	if stats := store.MVCCStats(); stats != (kvstore.MVCCStats{}) {
+		t.Fatalf("Expected no versions kept, got %+v", stats)
+	}
+	store.Put("users", 1, "al")
+	if stats := store.MVCCStats(); stats.Versions != 0 {
+		t.Fatalf("Expected no versions kept without snapshots, got %+v", stats)
+	}
+}
+
+func TestTxWriteConflict(t *testing.T) {
+	store, diskManager := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer diskManager.Close()
+	defer store.Close()
+
+	if err := store.CreateTableName("counters", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	store.Put("counters", 1, "0")
+
+	first, second, other := store.Begin(), store.Begin(), store.Begin()
+	first.Put("counters", 1, "1")
+	second.Put("counters", 1, "1")
+	other.Put("counters", 2, "1")
+	store.Put("counters", 3, "outside")
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if value, _, _ := second.Get("counters", 1); value != "1" {
+		t.Fatalf("Expected the transaction to read its own write, got %q", value)
+	}
+	if err := second.Commit(); !errors.Is(err, kvstore.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if err := other.Commit(); err != nil {
+		t.Fatalf("Commit of other keys failed: %v", err)
+	}
+	assertGet(t, store, "counters", 1, "1")
+	assertGet(t, store, "counters", 2, "1")
+
+	// Retried on a newer snapshot, the transaction sees the commit and goes through.
+	retry := store.Begin()
+	value, _, _ := retry.Get("counters", 1)
+	n, _ := strconv.Atoi(value)
+	retry.Put("counters", 1, strconv.Itoa(n+1))
+	if err := retry.Commit(); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	assertGet(t, store, "counters", 1, "2")
+	if stats := store.MVCCStats(); stats != (kvstore.MVCCStats{}) {
+		t.Fatalf("Expected finished transactions to release their snapshots, got %+v", stats)
+	}
+}
+
+// TestSnapshotReadsWhileWriting moves amounts between two accounts in transactions while
+// readers check that every snapshot sees the same total.
+func TestSnapshotReadsWhileWriting(t *testing.T) {
+	store, diskManager := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer diskManager.Close()
+	defer store.Close()
+
+	if err := store.CreateTableName("accounts", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	store.Put("accounts", 1, "100")
+	store.Put("accounts", 2, "0")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			tx := store.Begin()
+			tx.Put("accounts", 1, strconv.Itoa(100-i%100))
+			tx.Put("accounts", 2, strconv.Itoa(i%100))
+			if err := tx.Commit(); err != nil {
+				t.Errorf("Commit failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := store.Snapshot()
+				total := 0
+				for key := 1; key <= 2; key++ {
+					value, _, err := snapshot.Get("accounts", key)
+					if err != nil {
+						t.Errorf("Snapshot GET failed: %v", err)
+					}
+					n, _ := strconv.Atoi(value)
+					total += n
+				}
+				snapshot.Release()
+				if total != 100 {
+					t.Errorf("Snapshot at LSN %d saw a total of %d", snapshot.LSN(), total)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stats := store.MVCCStats(); stats != (kvstore.MVCCStats{}) {
+		t.Fatalf("Expected every version to be collected, got %+v", stats)
+	}
+}
@@ -0,0 +1,38 @@
+package kvstore
+
+import "fmt"
+
+// Replicate applies a change logged by another store, the primary, logging it here under
+// the same LSN and time. The log of a replica therefore continues the primary's: its last
+// LSN is where replication resumes, and once promoted the replica numbers its own changes
+// after it. Changes must be replicated in LSN order, without gaps; one that does not follow
+// the last LSN logged fails with ErrLSNOutOfOrder.
+func (kv *BTreeKVStore) Replicate(entry *LogEntry) error {
+	if entry.LSN == 0 {
+		return fmt.Errorf("replicated change to table %s has no LSN", entry.Table)
+	}
+
+	switch entry.Operation {
+	case "PUT":
+		return kv.put(entry)
+	case "DELETE":
+		return kv.delete(entry)
+	case "CREATE_TABLE":
+		return kv.createTable(entry)
+	case "DROP_TABLE":
+		return kv.dropTable(entry)
+	case "ALTER_TABLE":
+		return kv.alterTable(entry)
+	case "RENAME_TABLE":
+		return kv.renameTable(entry)
+	case "COMMIT":
+		return kv.commitChanges(entry)
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Operation)
+	}
+}
+
+// LastLSN returns the LSN of the last change logged.
+func (kv *BTreeKVStore) LastLSN() uint64 {
+	return kv.log.LastLSN()
+}
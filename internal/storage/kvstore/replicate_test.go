@@ -0,0 +1,84 @@
+package kvstore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+func TestReplicateContinuesPrimaryLog(t *testing.T) {
+	primary, primaryDisk := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer primaryDisk.Close()
+	defer primary.Close()
+
+	if err := primary.CreateTableWithCompression("users", 3, compression.LZ); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := primary.CreateTableName("scratch", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		if err := primary.Put("users", i, "user"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := primary.Delete("users", 7); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := primary.SetCompression("users", compression.Flate); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+	if err := primary.DropTable("scratch"); err != nil {
+		t.Fatalf("DropTable failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	replica, replicaDisk := openSegmentedStore(t, dir, 0, "")
+	defer replicaDisk.Close()
+
+	sub := primary.Subscribe(0)
+	defer sub.Close()
+	var last kvstore.LogEntry
+	for replica.LastLSN() < primary.LastLSN() {
+		// Entries are shared with other subscribers, so the replica gets a copy.
+		last = *nextChange(t, sub)
+		entry := last
+		if err := replica.Replicate(&entry); err != nil {
+			t.Fatalf("Replicate of LSN %d failed: %v", entry.LSN, err)
+		}
+	}
+
+	for _, lsn := range []uint64{last.LSN, last.LSN + 2} {
+		entry := kvstore.LogEntry{LSN: lsn, Operation: "PUT", Table: "users", Key: 1, Value: "skipped"}
+		if err := replica.Replicate(&entry); !errors.Is(err, kvstore.ErrLSNOutOfOrder) {
+			t.Fatalf("Expected ErrLSNOutOfOrder for LSN %d, got %v", lsn, err)
+		}
+	}
+	assertGet(t, replica, "users", 1, "user")
+	assertNotFound(t, replica, "users", 7)
+	if replica.IsTableExists("scratch") {
+		t.Fatalf("Expected the dropped table to be gone from the replica")
+	}
+
+	// Promoted, the replica numbers its own changes after the primary's.
+	if err := replica.Put("users", 21, "local"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if replica.LastLSN() != primary.LastLSN()+1 {
+		t.Fatalf("Expected the local change at LSN %d, got %d", primary.LastLSN()+1, replica.LastLSN())
+	}
+	if err := replica.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, reopenedDisk := openSegmentedStore(t, dir, 0, "")
+	defer reopenedDisk.Close()
+	defer reopened.Close()
+	if reopened.LastLSN() != primary.LastLSN()+1 {
+		t.Fatalf("Expected the reopened replica at LSN %d, got %d", primary.LastLSN()+1, reopened.LastLSN())
+	}
+	assertGet(t, reopened, "users", 21, "local")
+	assertGet(t, reopened, "users", 20, "user")
+}
@@ -0,0 +1,294 @@
+package kvstore
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/btree"
+)
+
+// ErrTxDone is returned when a transaction is used after it was committed or rolled back.
+var ErrTxDone = errors.New("kvstore: transaction already committed or rolled back")
+
+// Tx is a transaction over several keys, possibly in several tables. Its puts and deletes
+// are buffered until Commit, which logs them as a single commit record and applies them
+// together, so after a crash either all of them are recovered or none. Reads see the
+// transaction's own writes, and otherwise a snapshot taken when the transaction began.
+//
+// Commit locks the keys written only while it applies them, and fails with ErrConflict if
+// another writer committed one of them since the transaction began, so concurrent
+// transactions never overwrite each other's writes unseen. A transaction started with
+// BeginOptimistic validates the keys it read the same way. A pessimistic transaction
+// instead locks keys or tables up front with Lock, LockTable or GetLocked, and holds the
+// locks until it ends; reads made under a lock see the latest committed data, and keys
+// locked exclusively are not checked for conflicts. Waiting for a lock fails after the
+// store's lock timeout, and a transaction aborted to break a deadlock fails with a
+// *DeadlockError and is rolled back.
+//
+// A Tx must not be used from several goroutines at once, and must be committed or rolled
+// back to release its snapshot and locks.
+type Tx struct {
+	kv        *BTreeKVStore
+	id        uint64              // Owner of the transaction's locks.
+	snapshot  *Snapshot           // Nil for a batch, which neither reads nor checks for conflicts.
+	writes    map[txKey]*LogEntry // Last put or delete of each key written.
+	reads     map[txKey]bool      // Keys read from the snapshot, validated by Commit; nil unless optimistic.
+	exclusive map[txKey]bool      // Keys locked exclusively, or in a table locked exclusively (key -1).
+	done      bool
+}
+
+type txKey struct {
+	table string
+	key   int
+}
+
+// Begin starts a transaction on a snapshot of the store.
+func (kv *BTreeKVStore) Begin() *Tx {
+	tx := kv.batch()
+	tx.snapshot = kv.Snapshot()
+	return tx
+}
+
+// BeginOptimistic starts an optimistic transaction on a snapshot of the store. On top of
+// the keys it writes, Commit validates the keys it read with Get: if another writer
+// committed one of them since the transaction began, Commit fails with ErrConflict, so
+// the transaction commits only if it read nothing stale. Retried until it commits, it
+// behaves as if it ran alone.
+func (kv *BTreeKVStore) BeginOptimistic() *Tx {
+	tx := kv.Begin()
+	tx.reads = make(map[txKey]bool)
+	return tx
+}
+
+// batch returns a transaction without a snapshot, which only writes.
+func (kv *BTreeKVStore) batch() *Tx {
+	return &Tx{
+		kv:        kv,
+		id:        kv.locks.newOwner(),
+		writes:    make(map[txKey]*LogEntry),
+		exclusive: make(map[txKey]bool),
+	}
+}
+
+// ID returns the transaction's ID, which identifies it in a DeadlockError.
+func (tx *Tx) ID() uint64 {
+	return tx.id
+}
+
+// Put buffers the insertion or update of a key until the transaction commits.
+func (tx *Tx) Put(table string, key int, value string) error {
+	return tx.write(&LogEntry{Operation: "PUT", Table: table, Key: key, Value: value})
+}
+
+// Delete buffers the removal of a key until the transaction commits.
+func (tx *Tx) Delete(table string, key int) error {
+	return tx.write(&LogEntry{Operation: "DELETE", Table: table, Key: key})
+}
+
+func (tx *Tx) write(entry *LogEntry) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if _, err := tx.kv.table(entry.Table); err != nil {
+		return err
+	}
+	tx.writes[txKey{entry.Table, entry.Key}] = entry
+	return nil
+}
+
+// Get returns the value of a key as the transaction sees it.
+func (tx *Tx) Get(table string, key int) (string, bool, error) {
+	if tx.done {
+		return "", false, ErrTxDone
+	}
+	if entry, ok := tx.writes[txKey{table, key}]; ok {
+		return entry.Value, entry.Operation == "PUT", nil
+	}
+	if tx.snapshot == nil {
+		return tx.kv.Get(table, key)
+	}
+	if tx.reads != nil {
+		tx.reads[txKey{table, key}] = true
+	}
+	return tx.snapshot.Get(table, key)
+}
+
+// Lock locks a key in the given mode until the transaction ends. A shared lock keeps
+// others from writing the key, an exclusive one also from locking it.
+func (tx *Tx) Lock(table string, key int, mode LockMode) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if _, err := tx.kv.table(table); err != nil {
+		return err
+	}
+	if err := tx.kv.locks.lockKey(tx.id, table, key, mode); err != nil {
+		return tx.abortIf(err)
+	}
+	if mode == LockExclusive {
+		tx.exclusive[txKey{table, key}] = true
+	}
+	return nil
+}
+
+// LockTable locks a whole table in the given mode until the transaction ends.
+func (tx *Tx) LockTable(table string, mode LockMode) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if _, err := tx.kv.table(table); err != nil {
+		return err
+	}
+	if err := tx.kv.locks.acquire(tx.id, tableResource(table), mode); err != nil {
+		return tx.abortIf(err)
+	}
+	if mode == LockExclusive {
+		tx.exclusive[txKey{table, -1}] = true
+	}
+	return nil
+}
+
+// GetLocked locks a key in the given mode like Lock, then returns its latest committed
+// value, or the transaction's own write of it. It is the read of SELECT ... FOR UPDATE.
+func (tx *Tx) GetLocked(table string, key int, mode LockMode) (string, bool, error) {
+	if err := tx.Lock(table, key, mode); err != nil {
+		return "", false, err
+	}
+	if entry, ok := tx.writes[txKey{table, key}]; ok {
+		return entry.Value, entry.Operation == "PUT", nil
+	}
+	return tx.kv.Get(table, key)
+}
+
+// abortIf rolls the transaction back if err is a deadlock it was chosen to break, and
+// returns err.
+func (tx *Tx) abortIf(err error) error {
+	var deadlock *DeadlockError
+	if errors.As(err, &deadlock) && deadlock.Tx == tx.id {
+		tx.Rollback()
+	}
+	return err
+}
+
+// Commit applies the transaction's writes. They are durable once Commit returns.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.release()
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	changes := make([]*LogEntry, 0, len(tx.writes))
+	for _, entry := range tx.writes {
+		changes = append(changes, entry)
+	}
+	slices.SortFunc(changes, func(a, b *LogEntry) int {
+		return cmp.Or(cmp.Compare(a.Table, b.Table), cmp.Compare(a.Key, b.Key))
+	})
+
+	// Keys written are locked exclusively and keys only read in shared mode. Locked in
+	// order, the keys of concurrent commits cannot deadlock among themselves.
+	keys := make([]txKey, 0, len(tx.writes)+len(tx.reads))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	for key := range tx.reads {
+		if _, written := tx.writes[key]; !written {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b txKey) int {
+		return cmp.Or(cmp.Compare(a.table, b.table), cmp.Compare(a.key, b.key))
+	})
+	for _, key := range keys {
+		mode := LockShared
+		if _, written := tx.writes[key]; written {
+			mode = LockExclusive
+		}
+		if err := tx.kv.locks.lockKey(tx.id, key.table, key.key, mode); err != nil {
+			return err
+		}
+	}
+	tx.writes = nil
+
+	// With the keys locked, no one else writes them until the commit is applied.
+	if tx.snapshot != nil {
+		for _, key := range keys {
+			if !tx.reads[key] && (tx.exclusive[key] || tx.exclusive[txKey{key.table, -1}]) {
+				continue
+			}
+			if tx.kv.versions.writtenAfter(key, tx.snapshot.LSN()) {
+				return ErrConflict
+			}
+		}
+	}
+	return tx.kv.commitChanges(&LogEntry{Operation: "COMMIT", Changes: changes})
+}
+
+// Rollback discards the transaction's writes.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.writes = nil
+	tx.release()
+	return nil
+}
+
+// release releases the transaction's locks and snapshot.
+func (tx *Tx) release() {
+	tx.kv.locks.release(tx.id)
+	if tx.snapshot != nil {
+		tx.snapshot.Release()
+	}
+}
+
+// commitChanges logs a commit record and applies its changes in memory like logAndApply,
+// then waits until the record is written. Each key may appear once in the record.
+func (kv *BTreeKVStore) commitChanges(entry *LogEntry) error {
+	trees := make([]*btree.BTree, len(entry.Changes))
+	for i, change := range entry.Changes {
+		bt, err := kv.table(change.Table)
+		if err != nil {
+			return err
+		}
+		trees[i] = bt
+	}
+
+	kv.writeMu.Lock()
+	for i, change := range entry.Changes {
+		change.OldValue = nil
+		if old, found := trees[i].Search(change.Key); found {
+			value := old.(string)
+			change.OldValue = &value
+		}
+	}
+	lsn, err := kv.log.enqueue(entry)
+	if err != nil {
+		kv.writeMu.Unlock()
+		return err
+	}
+	// Each tree takes its writes at once, so a flush never sees part of them.
+	var order []*btree.BTree
+	writes := make(map[*btree.BTree][]btree.Write)
+	for i, change := range entry.Changes {
+		change.LSN, change.Time = lsn, entry.Time
+		kv.versions.record(change)
+		if _, ok := writes[trees[i]]; !ok {
+			order = append(order, trees[i])
+		}
+		writes[trees[i]] = append(writes[trees[i]], btree.Write{Key: change.Key, Value: change.Value, Delete: change.Operation == "DELETE"})
+	}
+	for _, bt := range order {
+		bt.ApplyAt(writes[bt], lsn)
+	}
+	kv.feed.publish(entry)
+	kv.writeMu.Unlock()
+
+	return kv.awaitLog(lsn)
+}
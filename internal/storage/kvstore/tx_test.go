@@ -0,0 +1,200 @@
+package kvstore_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+func TestTxCommitsWritesTogether(t *testing.T) {
+	store, diskManager := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer diskManager.Close()
+	defer store.Close()
+
+	for _, table := range []string{"accounts", "audit"} {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+	if err := store.Put("accounts", 1, "100"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put("accounts", 2, "0"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	before := store.LastLSN()
+
+	tx := store.Begin()
+	for _, write := range []func() error{
+		func() error { return tx.Put("accounts", 1, "60") },
+		func() error { return tx.Put("accounts", 2, "40") },
+		func() error { return tx.Put("audit", 1, "moved 40") },
+		func() error { return tx.Put("audit", 2, "draft") },
+		func() error { return tx.Delete("audit", 2) },
+	} {
+		if err := write(); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := tx.Put("missing", 1, "x"); err == nil {
+		t.Fatalf("Expected a write to a missing table to fail")
+	}
+
+	if value, found, _ := tx.Get("accounts", 1); !found || value != "60" {
+		t.Fatalf("Expected the transaction to see its own write, got %q", value)
+	}
+	if _, found, _ := tx.Get("audit", 2); found {
+		t.Fatalf("Expected the transaction to see its own delete")
+	}
+	assertGet(t, store, "accounts", 1, "100")
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if store.LastLSN() != before+1 {
+		t.Fatalf("Expected a single commit record, got LSNs %d to %d", before, store.LastLSN())
+	}
+	assertGet(t, store, "accounts", 1, "60")
+	assertGet(t, store, "accounts", 2, "40")
+	assertGet(t, store, "audit", 1, "moved 40")
+	assertNotFound(t, store, "audit", 2)
+	if err := tx.Commit(); !errors.Is(err, kvstore.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+
+	rolledBack := store.Begin()
+	if err := rolledBack.Put("accounts", 1, "0"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := rolledBack.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	assertGet(t, store, "accounts", 1, "60")
+	if err := rolledBack.Put("accounts", 1, "0"); !errors.Is(err, kvstore.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+}
+
+// TestTxRecoveredAllOrNothing crashes after a commit with one of its tables flushed, then
+// again with the commit record torn: the transaction comes back whole, then not at all.
+func TestTxRecoveredAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := openSegmentedStore(t, dir, 0, "")
+	for _, table := range []string{"from", "to"} {
+		if err := store.CreateTableName(table, 3); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+		if err := store.Put(table, 1, "before"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	tx := store.Begin()
+	tx.Put("from", 1, "after")
+	tx.Put("to", 1, "after")
+	tx.Put("to", 2, "after")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := store.Flush("from"); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Crash: the store is abandoned without closing it.
+	recovered, diskManager := openSegmentedStore(t, dir, 0, "")
+	assertGet(t, recovered, "from", 1, "after")
+	assertGet(t, recovered, "to", 1, "after")
+	assertGet(t, recovered, "to", 2, "after")
+	if stats := recovered.RecoveryStats(); stats.Replayed == 0 {
+		t.Fatalf("Expected the commit to be replayed, got %+v", stats)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	diskManager.Close()
+
+	store, _ = openSegmentedStore(t, dir, 0, "")
+	tx = store.Begin()
+	tx.Put("from", 1, "lost")
+	tx.Put("to", 1, "lost")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	// Crash part way through writing the commit record.
+	segments := segmentFiles(t, filepath.Join(dir, "wal"))
+	last := segments[len(segments)-1]
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if err := os.Truncate(last, info.Size()-5); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	recovered, diskManager = openSegmentedStore(t, dir, 0, "")
+	defer diskManager.Close()
+	defer recovered.Close()
+	assertGet(t, recovered, "from", 1, "after")
+	assertGet(t, recovered, "to", 1, "after")
+}
+
+// TestOptimisticTxValidatesReads runs two transactions that each read one key and write the
+// other: without read validation both commit, with it the second fails.
+func TestOptimisticTxValidatesReads(t *testing.T) {
+	store, diskManager := openSegmentedStore(t, t.TempDir(), 0, "")
+	defer diskManager.Close()
+	defer store.Close()
+
+	if err := store.CreateTableName("doctors", 3); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	store.Put("doctors", 1, "on call")
+	store.Put("doctors", 2, "on call")
+
+	for _, test := range []struct {
+		begin    func() *kvstore.Tx
+		conflict bool
+	}{
+		{store.Begin, false},
+		{store.BeginOptimistic, true},
+	} {
+		first, second := test.begin(), test.begin()
+		if value, _, _ := first.Get("doctors", 2); value == "on call" {
+			first.Put("doctors", 1, "off")
+		}
+		if value, _, _ := second.Get("doctors", 1); value == "on call" {
+			second.Put("doctors", 2, "off")
+		}
+		if err := first.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		err := second.Commit()
+		if test.conflict && !errors.Is(err, kvstore.ErrConflict) {
+			t.Fatalf("Expected the stale read to conflict, got %v", err)
+		}
+		if !test.conflict && err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		store.Put("doctors", 1, "on call")
+		store.Put("doctors", 2, "on call")
+	}
+
+	// Reads of keys no one wrote since do not conflict, and neither do read-only commits.
+	tx := store.BeginOptimistic()
+	tx.Get("doctors", 1)
+	tx.Put("doctors", 2, "off")
+	store.Put("doctors", 3, "on call")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	readOnly := store.BeginOptimistic()
+	readOnly.Get("doctors", 1)
+	store.Put("doctors", 1, "off")
+	if err := readOnly.Commit(); err != nil {
+		t.Fatalf("Read-only commit failed: %v", err)
+	}
+}
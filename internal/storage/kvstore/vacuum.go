@@ -0,0 +1,69 @@
+package kvstore
+
+import "slices"
+
+// maxVacuumPasses bounds the number of commits a single Vacuum makes. Moving a node
+// also rewrites its ancestors, which may not all fit below the target in one pass.
+const maxVacuumPasses = 8
+
+// VacuumStats reports the effect of a Vacuum.
+type VacuumStats struct {
+	PagesBefore int32 // Pages in the database file before the vacuum.
+	PagesAfter  int32 // Pages in the database file after the vacuum.
+	PagesMoved  int   // Pages rewritten to move live data toward the start of the file.
+}
+
+// Vacuum compacts the database file after deletes and dropped tables.
+//
+// If live data needs N pages, every node stored at page N or beyond is copied to a free
+// page below N, together with the ancestors pointing at it, and the new roots are committed
+// exactly like a flush. Once no live page is left past the target the file is truncated
+// after the last live page. Reads and writes keep being served while it runs, and a crash
+// leaves the file in the last committed state, with any unreachable pages reclaimed on Load.
+func (kv *BTreeKVStore) Vacuum() (VacuumStats, error) {
+	kv.flushMu.Lock()
+	defer kv.flushMu.Unlock()
+
+	// Every table must be in memory so none of its pages is mistaken for free space.
+	for _, name := range kv.catalog.List() {
+		if _, err := kv.table(name); err != nil {
+			return VacuumStats{}, err
+		}
+	}
+
+	// Pages freed before the store was opened are only known once reclaimed.
+	kv.reclaimUnreachablePages()
+
+	stats := VacuumStats{PagesBefore: kv.diskManager.GetLastAllocatedPageID() + 1}
+
+	for pass := 0; pass < maxVacuumPasses; pass++ {
+		target := int32(len(kv.livePages()))
+
+		names := kv.tableNames()
+		moved := 0
+		for _, name := range names {
+			kv.tablesMu.RLock()
+			bt := kv.tables[name]
+			kv.tablesMu.RUnlock()
+			moved += bt.Relocate(target)
+		}
+
+		// The catalog page is rewritten by every commit, so it moves along with any table.
+		moveCatalog := slices.Max(kv.catalog.Pages()) >= target
+		if moved == 0 && !moveCatalog {
+			break
+		}
+
+		if err := kv.commit(names, moveCatalog); err != nil {
+			return stats, err
+		}
+		stats.PagesMoved += moved + 1
+	}
+
+	last := slices.Max(kv.livePages())
+	if err := kv.diskManager.Truncate(last + 1); err != nil {
+		return stats, err
+	}
+	stats.PagesAfter = last + 1
+	return stats, nil
+}
@@ -0,0 +1,71 @@
+package lsmtree
+
+// bloom is a Bloom filter over the keys of an SSTable. A lookup of a key the filter does
+// not contain skips the SSTable without reading it.
+type bloom struct {
+	bits []byte
+	k    int // Bits set per key.
+}
+
+// newBloom returns a filter of the keys with the given hashes, using bitsPerKey bits for
+// each: 10 gives about a 1% false positive rate.
+func newBloom(hashes []uint64, bitsPerKey int) bloom {
+	k := bitsPerKey * 69 / 100 // bitsPerKey * ln 2 minimizes false positives.
+	k = max(1, min(k, 30))
+	n := max(64, len(hashes)*bitsPerKey)
+	b := bloom{bits: make([]byte, (n+7)/8), k: k}
+	for _, h := range hashes {
+		b.add(h)
+	}
+	return b
+}
+
+func (b bloom) add(h uint64) {
+	n := uint64(len(b.bits)) * 8
+	delta := h>>33 | h<<31
+	for i := 0; i < b.k; i++ {
+		bit := h % n
+		b.bits[bit/8] |= 1 << (bit % 8)
+		h += delta
+	}
+}
+
+// mayContain reports whether the key with hash h may be in the filter.
+func (b bloom) mayContain(h uint64) bool {
+	n := uint64(len(b.bits)) * 8
+	if n == 0 {
+		return true
+	}
+	delta := h>>33 | h<<31
+	for i := 0; i < b.k; i++ {
+		bit := h % n
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// encode returns the filter as stored in an SSTable: k, then the bits.
+func (b bloom) encode() []byte {
+	return append([]byte{byte(b.k)}, b.bits...)
+}
+
+func decodeBloom(data []byte) bloom {
+	if len(data) == 0 {
+		return bloom{}
+	}
+	return bloom{k: int(data[0]), bits: data[1:]}
+}
+
+// hashKey returns the hash of a key the filter is built from (the SplitMix64 finalizer).
+func hashKey(key int) uint64 {
+	h := uint64(key)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
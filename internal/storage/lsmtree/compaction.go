@@ -0,0 +1,544 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CompactionStrategy decides which SSTables are merged together in the background.
+type CompactionStrategy int
+
+const (
+	// Leveled keeps level 0 for flushed tables and, below it, levels of non-overlapping
+	// tables, each level LevelSizeMultiplier times larger than the one above. A full level
+	// merges a table into the tables it overlaps on the next level. Reads look at few
+	// tables and little space is wasted on overwritten values, at the cost of rewriting
+	// data more often.
+	Leveled CompactionStrategy = iota
+
+	// SizeTiered merges runs of tables of similar sizes into one larger table. Data is
+	// rewritten less often than with Leveled, but reads look at more tables and
+	// overwritten values take space for longer.
+	SizeTiered
+)
+
+// ParseCompactionStrategy returns the strategy with the given name, as written in a
+// configuration file: "leveled" or "size-tiered".
+func ParseCompactionStrategy(name string) (CompactionStrategy, error) {
+	switch strings.ToLower(strings.ReplaceAll(name, "_", "-")) {
+	case "", "leveled":
+		return Leveled, nil
+	case "size-tiered", "tiered":
+		return SizeTiered, nil
+	default:
+		return 0, fmt.Errorf("unknown compaction strategy %q", name)
+	}
+}
+
+func (s CompactionStrategy) String() string {
+	if s == SizeTiered {
+		return "size-tiered"
+	}
+	return "leveled"
+}
+
+// numLevels is the number of levels of a leveled tree; data is never compacted out of
+// the last one.
+const numLevels = 7
+
+// errCompactionAborted stops a compaction when the tree is closed.
+var errCompactionAborted = errors.New("compaction aborted")
+
+// compaction is a merge of SSTables picked by a strategy.
+type compaction struct {
+	level          int        // Level of the inputs.
+	output         int        // Level the merged tables go to.
+	inputs         []*sstable // Tables of level, newest first.
+	next           []*sstable // Tables of the output level overlapping the inputs (leveled).
+	move           bool       // The single input moves to the output level without a rewrite.
+	dropTombstones bool       // No older table holds the keys, so deletes need no tombstone.
+	split          bool       // Split the output into tables of about TableSize.
+}
+
+// tables returns every table the compaction reads, newest first.
+func (c *compaction) tables() []*sstable {
+	return append(append([]*sstable(nil), c.inputs...), c.next...)
+}
+
+// compactor runs the compactions the tree needs, after every flush and compaction, until
+// the tree is closed.
+func (l *LSMTree) compactor() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.compactWake:
+		case <-l.done:
+			return
+		}
+		for {
+			ran, err := l.compactOnce()
+			if err != nil || !ran {
+				break
+			}
+		}
+	}
+}
+
+// Compact runs the compactions the tree needs now, such as with DisableCompaction set,
+// until the strategy finds nothing more to merge.
+func (l *LSMTree) Compact() error {
+	for {
+		ran, err := l.compactOnce()
+		if err != nil {
+			return err
+		}
+		if !ran {
+			return nil
+		}
+	}
+}
+
+// compactOnce runs the compaction the strategy picks, if any, reporting whether it ran.
+// A failed compaction stops writes, like a failed flush.
+func (l *LSMTree) compactOnce() (bool, error) {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return false, ErrClosed
+	}
+	if l.bgErr != nil {
+		err := l.bgErr
+		l.mu.Unlock()
+		return false, err
+	}
+	var c *compaction
+	if l.opts.Compaction == SizeTiered {
+		c = l.pickSizeTiered()
+	} else {
+		c = l.pickLeveled()
+	}
+	l.mu.Unlock()
+	if c == nil {
+		return false, nil
+	}
+
+	var outputs []*sstable
+	var dropped int64
+	if c.move {
+		outputs = c.inputs
+	} else {
+		var err error
+		if outputs, dropped, err = l.runCompaction(c); err != nil {
+			if errors.Is(err, errCompactionAborted) {
+				return false, ErrClosed
+			}
+			l.mu.Lock()
+			l.bgErr = fmt.Errorf("failed to compact: %w", err)
+			l.changed.Broadcast()
+			l.mu.Unlock()
+			return false, l.bgErr
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.changed.Broadcast()
+	levels := l.install(c, outputs)
+	if err := l.saveManifest(levels, l.logStart); err != nil {
+		l.bgErr = err
+		if !c.move {
+			for _, t := range outputs {
+				t.close()
+				os.Remove(t.path)
+			}
+		}
+		return false, err
+	}
+	l.levels = levels
+
+	if !c.move {
+		var read, written int64
+		for _, t := range c.tables() {
+			read += t.size
+			t.close()
+			os.Remove(t.path)
+		}
+		for _, t := range outputs {
+			written += t.size
+		}
+		l.stats.Compactions++
+		l.stats.CompactionBytesRead += read
+		l.stats.CompactionBytesWritten += written
+		l.stats.TombstonesDropped += dropped
+	} else {
+		l.stats.TrivialMoves++
+	}
+	return true, nil
+}
+
+// pickLeveled picks the compaction of the leveled strategy: all of level 0 once it has
+// L0CompactionTrigger tables, otherwise a table of the level furthest over its size.
+// The caller holds mu.
+func (l *LSMTree) pickLeveled() *compaction {
+	if len(l.levels[0]) >= l.opts.L0CompactionTrigger {
+		c := &compaction{level: 0, output: 1, inputs: l.levels[0]}
+		return l.expand(c)
+	}
+
+	best, bestScore := 0, 1.0
+	for level := 1; level < numLevels-1; level++ {
+		score := float64(levelBytes(l.levels[level])) / float64(l.maxLevelBytes(level))
+		if score >= bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if best == 0 {
+		return nil
+	}
+
+	// Take turns through the key space of the level, so every table gets compacted.
+	tables := l.levels[best]
+	i := sort.Search(len(tables), func(i int) bool { return tables[i].smallest > l.compactFrom[best] })
+	if i == len(tables) {
+		i = 0
+	}
+	l.compactFrom[best] = tables[i].largest
+	return l.expand(&compaction{level: best, output: best + 1, inputs: tables[i : i+1]})
+}
+
+// expand adds to a leveled compaction the tables of the output level it overlaps, and
+// decides how to run it. The caller holds mu.
+func (l *LSMTree) expand(c *compaction) *compaction {
+	smallest, largest := keyRange(c.inputs)
+	c.next = overlapping(l.levels[c.output], smallest, largest)
+	c.split = true
+	if len(c.inputs) == 1 && len(c.next) == 0 {
+		c.move = true
+		return c
+	}
+	// Older values of the keys could only be on deeper levels.
+	c.dropTombstones = true
+	for level := c.output + 1; level < len(l.levels); level++ {
+		if len(overlapping(l.levels[level], smallest, largest)) > 0 {
+			c.dropTombstones = false
+		}
+	}
+	return c
+}
+
+// pickSizeTiered picks the compaction of the size-tiered strategy: the first run of at
+// least L0CompactionTrigger consecutive tables of level 0 whose sizes are within half of
+// their mean. Tables are merged only with their neighbors in age, so the merged table
+// takes their place in the newest-first order. The caller holds mu.
+func (l *LSMTree) pickSizeTiered() *compaction {
+	tables := l.levels[0]
+	trigger := l.opts.L0CompactionTrigger
+	for start := 0; start+trigger <= len(tables); start++ {
+		end, total := start+1, tables[start].size
+		for end < len(tables) {
+			mean := float64(total+tables[end].size) / float64(end-start+1)
+			if !similar(tables[start:end+1], mean) {
+				break
+			}
+			total += tables[end].size
+			end++
+		}
+		if end-start >= trigger {
+			return l.tiered(start, end)
+		}
+	}
+	// Tables of too different sizes pile up: merge them all rather than stall writes
+	// for good.
+	if len(tables) >= l.opts.L0StopWritesTrigger {
+		return l.tiered(0, len(tables))
+	}
+	return nil
+}
+
+// tiered returns the size-tiered compaction of level 0 tables start to end. The caller
+// holds mu.
+func (l *LSMTree) tiered(start, end int) *compaction {
+	c := &compaction{level: 0, output: 0, inputs: l.levels[0][start:end]}
+	if end == len(l.levels[0]) {
+		// The oldest table is merged; deeper levels only exist if the tree was leveled before.
+		smallest, largest := keyRange(c.inputs)
+		c.dropTombstones = true
+		for level := 1; level < len(l.levels); level++ {
+			if len(overlapping(l.levels[level], smallest, largest)) > 0 {
+				c.dropTombstones = false
+			}
+		}
+	}
+	return c
+}
+
+// similar reports whether every table's size is within half of mean.
+func similar(tables []*sstable, mean float64) bool {
+	for _, t := range tables {
+		if float64(t.size) < mean/2 || float64(t.size) > mean*3/2 {
+			return false
+		}
+	}
+	return true
+}
+
+// runCompaction merges the tables of a compaction into new tables, dropping overwritten
+// values and, if it can, tombstones. It returns the new tables and the number of
+// tombstones dropped.
+func (l *LSMTree) runCompaction(c *compaction) ([]*sstable, int64, error) {
+	var its []iterator
+	for _, t := range c.tables() {
+		its = append(its, t.iterator())
+	}
+	it := newMergingIterator(its)
+	throttle := newThrottle(l.opts.CompactionBytesPerSecond, l.done)
+
+	var outputs []*sstable
+	var w *sstableWriter
+	var num uint64
+	var dropped int64
+	fail := func(err error) ([]*sstable, int64, error) {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.close()
+			os.Remove(t.path)
+		}
+		return nil, 0, err
+	}
+	finish := func() error {
+		cur := w
+		w = nil
+		if err := cur.finish(); err != nil {
+			return err
+		}
+		t, err := openSSTable(cur.path, num)
+		if err != nil {
+			os.Remove(cur.path)
+			return err
+		}
+		outputs = append(outputs, t)
+		return nil
+	}
+
+	for it.next() {
+		e := it.entry()
+		if e.deleted && c.dropTombstones {
+			dropped++
+			continue
+		}
+		if w == nil {
+			num = l.allocFile()
+			var err error
+			if w, err = newSSTableWriter(l.path(num, "sst"), l.opts); err != nil {
+				return fail(err)
+			}
+		}
+		before := w.size()
+		if err := w.add(e); err != nil {
+			return fail(err)
+		}
+		if err := throttle.wait(int64(w.size() - before)); err != nil {
+			return fail(err)
+		}
+		if c.split && w.size() >= uint64(l.opts.TableSize) {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		return fail(err)
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := syncDir(l.dir); err != nil {
+		return fail(err)
+	}
+	return outputs, dropped, nil
+}
+
+// install returns the levels with the tables of a compaction replaced by its outputs.
+// Tables flushed while it ran stay at the front of level 0. The caller holds mu.
+func (l *LSMTree) install(c *compaction, outputs []*sstable) [][]*sstable {
+	levels := make([][]*sstable, len(l.levels))
+	copy(levels, l.levels)
+	replaced := make(map[*sstable]bool)
+	for _, t := range c.tables() {
+		replaced[t] = true
+	}
+
+	if c.output == c.level {
+		// Size-tiered: the merged table takes the place of the run.
+		var tables []*sstable
+		for _, t := range levels[c.level] {
+			if t == c.inputs[0] {
+				tables = append(tables, outputs...)
+			}
+			if !replaced[t] {
+				tables = append(tables, t)
+			}
+		}
+		levels[c.level] = tables
+		return levels
+	}
+
+	levels[c.level] = without(levels[c.level], replaced)
+	tables := append(without(levels[c.output], replaced), outputs...)
+	sort.Slice(tables, func(i, j int) bool { return tables[i].smallest < tables[j].smallest })
+	levels[c.output] = tables
+	return levels
+}
+
+// without returns the tables that are not in replaced, in a new slice.
+func without(tables []*sstable, replaced map[*sstable]bool) []*sstable {
+	var kept []*sstable
+	for _, t := range tables {
+		if !replaced[t] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// maxLevelBytes returns the size a level of a leveled tree may reach before it is
+// compacted into the next one.
+func (l *LSMTree) maxLevelBytes(level int) int64 {
+	size := l.opts.LevelSizeBase
+	for i := 1; i < level; i++ {
+		size *= int64(l.opts.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// keyRange returns the smallest and largest keys of tables.
+func keyRange(tables []*sstable) (int, int) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		smallest = min(smallest, t.smallest)
+		largest = max(largest, t.largest)
+	}
+	return smallest, largest
+}
+
+// overlapping returns the tables holding keys between smallest and largest.
+func overlapping(tables []*sstable, smallest, largest int) []*sstable {
+	var found []*sstable
+	for _, t := range tables {
+		if t.largest >= smallest && t.smallest <= largest {
+			found = append(found, t)
+		}
+	}
+	return found
+}
+
+func levelBytes(tables []*sstable) int64 {
+	var n int64
+	for _, t := range tables {
+		n += t.size
+	}
+	return n
+}
+
+// throttle limits the rate a compaction writes at, so it leaves disk bandwidth to
+// flushes and reads.
+type throttle struct {
+	rate    int64 // Bytes per second; zero for no limit.
+	start   time.Time
+	written int64
+	done    <-chan struct{}
+}
+
+func newThrottle(rate int64, done <-chan struct{}) *throttle {
+	return &throttle{rate: rate, start: time.Now(), done: done}
+}
+
+// wait accounts for n more bytes written, sleeping until the rate allows them. It fails
+// with errCompactionAborted once done is closed.
+func (t *throttle) wait(n int64) error {
+	if t.rate <= 0 {
+		select {
+		case <-t.done:
+			return errCompactionAborted
+		default:
+			return nil
+		}
+	}
+	t.written += n
+	due := t.start.Add(time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.done:
+		return errCompactionAborted
+	}
+}
+
+// Stats reports the shape of a tree and the work its flushes and compactions did since it
+// was opened.
+type Stats struct {
+	Levels []LevelStats // Level 0 first.
+
+	UserBytes              int64 // Bytes of keys and values written with Put and Delete.
+	FlushBytes             int64 // Bytes of the SSTables written by flushes.
+	CompactionBytesRead    int64 // Bytes of the SSTables merged by compactions.
+	CompactionBytesWritten int64 // Bytes of the SSTables written by compactions.
+
+	Flushes           int
+	Compactions       int
+	TrivialMoves      int   // Tables moved to the next level without a rewrite.
+	TombstonesDropped int64 // Tombstones compacted away at the bottom of the tree.
+
+	WriteStalls    int           // Writes that waited for flushes or compactions.
+	WriteStallTime time.Duration // Time writes spent waiting.
+}
+
+// LevelStats describes a level of a tree.
+type LevelStats struct {
+	Tables int
+	Bytes  int64
+}
+
+// WriteAmplification returns the bytes written to SSTables, by flushes and compactions,
+// per byte flushed from memtables. It is 1 until compactions rewrite data.
+func (s Stats) WriteAmplification() float64 {
+	if s.FlushBytes == 0 {
+		return 0
+	}
+	return float64(s.FlushBytes+s.CompactionBytesWritten) / float64(s.FlushBytes)
+}
+
+// Stats returns the current shape of the tree and the work done since it was opened.
+func (l *LSMTree) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := l.stats
+	last := 0
+	for level, tables := range l.levels {
+		if len(tables) > 0 {
+			last = level
+		}
+	}
+	stats.Levels = make([]LevelStats, last+1)
+	for level := range stats.Levels {
+		stats.Levels[level] = LevelStats{Tables: len(l.levels[level]), Bytes: levelBytes(l.levels[level])}
+	}
+	return stats
+}
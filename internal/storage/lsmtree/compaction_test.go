@@ -0,0 +1,411 @@
+package lsmtree_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/lsmtree"
+)
+
+// writeRounds overwrites keys 0 to keys-1 rounds times, then deletes every seventh key.
+func writeRounds(t *testing.T, lsm *lsmtree.LSMTree, keys, rounds int) {
+	t.Helper()
+	for round := 0; round < rounds; round++ {
+		for key := 0; key < keys; key++ {
+			if err := lsm.Put(key, fmt.Sprintf("v%d-%d", round, key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for key := 0; key < keys; key += 7 {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkRounds checks the keys written by writeRounds have their last value.
+func checkRounds(t *testing.T, lsm *lsmtree.LSMTree, keys, rounds int) {
+	t.Helper()
+	for key := 0; key < keys; key++ {
+		value, found, err := lsm.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key%7 == 0 {
+			if found {
+				t.Fatalf("deleted key %d has value %q", key, value)
+			}
+		} else if want := fmt.Sprintf("v%d-%d", rounds-1, key); !found || value != want {
+			t.Fatalf("key %d has value %q (found %v), want %q", key, value, found, want)
+		}
+	}
+	scanned := 0
+	if err := lsm.Scan(func(key int, value string) bool { scanned++; return true }); err != nil {
+		t.Fatal(err)
+	}
+	if want := keys - (keys+6)/7; scanned != want {
+		t.Fatalf("scanned %d keys, want %d", scanned, want)
+	}
+}
+
+func TestLSMTreeCompactionStrategies(t *testing.T) {
+	for _, strategy := range []lsmtree.CompactionStrategy{lsmtree.Leveled, lsmtree.SizeTiered} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := lsmtree.Options{
+				Degree:              4,
+				MemtableSize:        2 << 10,
+				BlockSize:           256,
+				Compaction:          strategy,
+				LevelSizeBase:       8 << 10,
+				LevelSizeMultiplier: 2,
+			}
+			lsm, err := lsmtree.Open(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const keys, rounds = 1500, 4
+			writeRounds(t, lsm, keys, rounds)
+			if err := lsm.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := lsm.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			checkRounds(t, lsm, keys, rounds)
+
+			stats := lsm.Stats()
+			if stats.Compactions == 0 {
+				t.Fatal("expected compactions")
+			}
+			var tables int
+			for _, level := range stats.Levels {
+				tables += level.Tables
+			}
+			if strategy == lsmtree.Leveled && stats.Levels[0].Tables >= lsmtree.DefaultL0CompactionTrigger {
+				t.Fatalf("level 0 still has %d tables", stats.Levels[0].Tables)
+			}
+			if tables*2 > stats.Flushes {
+				t.Fatalf("%d tables left from %d flushes", tables, stats.Flushes)
+			}
+			if strategy == lsmtree.Leveled && len(stats.Levels) < 3 {
+				t.Fatalf("expected data to reach level 2, got levels %+v", stats.Levels)
+			}
+			if strategy == lsmtree.SizeTiered && len(stats.Levels) != 1 {
+				t.Fatalf("size-tiered compaction keeps every table on level 0, got %+v", stats.Levels)
+			}
+			if wa := stats.WriteAmplification(); wa <= 1 {
+				t.Fatalf("write amplification %.2f, want above 1 after compactions", wa)
+			}
+			if stats.CompactionBytesRead < stats.CompactionBytesWritten {
+				t.Fatalf("compactions read %d bytes and wrote %d; overwrites should shrink the data",
+					stats.CompactionBytesRead, stats.CompactionBytesWritten)
+			}
+
+			// Only the tables of the manifest are left.
+			files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+			if len(files) != tables {
+				t.Fatalf("%d SSTable files for %d live tables", len(files), tables)
+			}
+
+			if err := lsm.Close(); err != nil {
+				t.Fatal(err)
+			}
+			lsm, err = lsmtree.Open(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lsm.Close()
+			checkRounds(t, lsm, keys, rounds)
+		})
+	}
+}
+
+func TestLSMTreeDropsTombstonesAtTheBottom(t *testing.T) {
+	opts := lsmtree.Options{MemtableSize: 4 << 10, DisableCompaction: true}
+	lsm, err := lsmtree.Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for key := 0; key < 500; key++ {
+		if err := lsm.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 500; key++ {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := lsm.Stats().Levels[0].Tables; got < lsmtree.DefaultL0CompactionTrigger {
+		t.Fatalf("expected at least %d tables on level 0, got %d", lsmtree.DefaultL0CompactionTrigger, got)
+	}
+
+	// Level 1 is the bottom of the tree: the deleted keys and their tombstones vanish.
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	stats := lsm.Stats()
+	if stats.TombstonesDropped != 500 {
+		t.Fatalf("dropped %d tombstones, want 500", stats.TombstonesDropped)
+	}
+	if len(stats.Levels) != 1 || stats.Levels[0].Tables != 0 {
+		t.Fatalf("expected an empty tree, got levels %+v", stats.Levels)
+	}
+	if _, found, _ := lsm.Get(10); found {
+		t.Fatal("deleted key 10 is back")
+	}
+}
+
+func TestLSMTreeManifest(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := lsmtree.Open(dir, smallTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRounds(t, lsm, 300, 2)
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tree written before there was a manifest has its tables on level 0, newest
+	// numbered highest.
+	if err := os.Remove(filepath.Join(dir, "MANIFEST")); err != nil {
+		t.Fatal(err)
+	}
+	// A table the manifest does not list, such as the output of an interrupted
+	// compaction, is not part of the tree.
+	orphan := filepath.Join(dir, "999999.sst")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = lsmtree.Open(dir, smallTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRounds(t, lsm, 300, 2)
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "MANIFEST")); err != nil {
+		t.Fatalf("expected a manifest after opening: %v", err)
+	}
+
+	if err := os.WriteFile(orphan, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = lsmtree.Open(dir, smallTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	checkRounds(t, lsm, 300, 2)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("expected the orphan table to be removed, got %v", err)
+	}
+}
+
+func TestLSMTreeCompactionCrash(t *testing.T) {
+	opts := lsmtree.Options{MemtableSize: 2 << 10, DisableCompaction: true}
+	dir := t.TempDir()
+	lsm, err := lsmtree.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 500; key++ {
+		if err := lsm.Put(key, "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 500; key += 3 {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := 500; key < 600; key++ {
+		if err := lsm.Put(key, "v2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := tablesIn(t, dir)
+	snapshot := t.TempDir()
+	copyFiles(t, dir, snapshot, "*")
+
+	// The compaction drops the tombstones of the deleted keys along with their values.
+	lsm, err = lsmtree.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if lsm.Stats().TombstonesDropped == 0 {
+		t.Fatal("expected the compaction to drop tombstones")
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after := tablesIn(t, dir)
+
+	// A crash leaves the tables of the compaction written but not in the manifest, or
+	// in the manifest with the tables they replace not yet removed. Either way only the
+	// tables of the manifest are read, and the others removed.
+	for _, crash := range []struct {
+		name     string
+		manifest bool
+		tables   []string
+	}{
+		{"before-manifest", false, before},
+		{"before-removal", true, after},
+	} {
+		t.Run(crash.name, func(t *testing.T) {
+			crashed := t.TempDir()
+			copyFiles(t, snapshot, crashed, "*")
+			copyFiles(t, dir, crashed, "*.sst")
+			if crash.manifest {
+				copyFiles(t, dir, crashed, "MANIFEST")
+			}
+
+			lsm, err := lsmtree.Open(crashed, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lsm.Close()
+			if got := tablesIn(t, crashed); fmt.Sprint(got) != fmt.Sprint(crash.tables) {
+				t.Fatalf("tables %v after reopening, want %v", got, crash.tables)
+			}
+			check := func() {
+				t.Helper()
+				for key := 0; key < 600; key++ {
+					value, found, err := lsm.Get(key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want := "v1"
+					if key >= 500 {
+						want = "v2"
+					}
+					if key < 500 && key%3 == 0 {
+						if found {
+							t.Fatalf("deleted key %d is back with value %q", key, value)
+						}
+					} else if !found || value != want {
+						t.Fatalf("key %d has value %q (found %v), want %q", key, value, found, want)
+					}
+				}
+			}
+			check()
+
+			// The compaction can run again from where the crash left the tree.
+			if err := lsm.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			check()
+		})
+	}
+}
+
+// tablesIn returns the names of the SSTable files in dir, sorted.
+func tablesIn(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
+}
+
+// copyFiles copies the files of src matching pattern into dst, replacing those there.
+func copyFiles(t *testing.T, src, dst, pattern string) {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(src, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, filepath.Base(path)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLSMTreeThrottlesCompactions(t *testing.T) {
+	opts := lsmtree.Options{MemtableSize: 8 << 10, DisableCompaction: true, CompactionBytesPerSecond: 32 << 10}
+	lsm, err := lsmtree.Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	writeRounds(t, lsm, 1000, 1)
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	stats := lsm.Stats()
+	if stats.Compactions == 0 {
+		t.Fatal("expected a compaction")
+	}
+	// The last block and the index of an output go out unthrottled, so allow some slack.
+	want := time.Duration(stats.CompactionBytesWritten) * time.Second / time.Duration(opts.CompactionBytesPerSecond) / 2
+	if elapsed < want {
+		t.Fatalf("compaction of %d bytes took %v, want at least %v", stats.CompactionBytesWritten, elapsed, want)
+	}
+}
+
+func TestParseCompactionStrategy(t *testing.T) {
+	for name, want := range map[string]lsmtree.CompactionStrategy{
+		"":            lsmtree.Leveled,
+		"leveled":     lsmtree.Leveled,
+		"size-tiered": lsmtree.SizeTiered,
+		"SIZE_TIERED": lsmtree.SizeTiered,
+	} {
+		got, err := lsmtree.ParseCompactionStrategy(name)
+		if err != nil || got != want {
+			t.Fatalf("ParseCompactionStrategy(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := lsmtree.ParseCompactionStrategy("universal"); err == nil {
+		t.Fatal("expected an error for an unknown strategy")
+	}
+}
@@ -0,0 +1,109 @@
+package lsmtree
+
+import "container/heap"
+
+// iterator yields entries in key order.
+type iterator interface {
+	next() bool
+	entry() entry
+	err() error
+}
+
+// sliceIterator yields the entries of a slice, such as a memtable's.
+type sliceIterator struct {
+	entries []entry
+	pos     int
+}
+
+func newSliceIterator(entries []entry) *sliceIterator {
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+func (it *sliceIterator) next() bool {
+	it.pos++
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) entry() entry { return it.entries[it.pos] }
+
+func (it *sliceIterator) err() error { return nil }
+
+// mergingIterator merges iterators given newest first into one yielding every key once,
+// with its entry from the newest iterator that has it. Tombstones are yielded too.
+type mergingIterator struct {
+	heap mergeHeap
+	cur  entry
+	fail error
+}
+
+func newMergingIterator(its []iterator) *mergingIterator {
+	m := &mergingIterator{}
+	for age, it := range its {
+		m.push(it, age)
+	}
+	heap.Init(&m.heap)
+	return m
+}
+
+// push adds an iterator to the heap at its next entry, unless it has none.
+func (m *mergingIterator) push(it iterator, age int) {
+	if it.next() {
+		m.heap = append(m.heap, mergeSource{it: it, age: age})
+	} else if err := it.err(); err != nil && m.fail == nil {
+		m.fail = err
+	}
+}
+
+func (m *mergingIterator) next() bool {
+	if m.fail != nil || len(m.heap) == 0 {
+		return false
+	}
+	m.cur = m.heap[0].it.entry()
+	// Skip the older entries of the same key.
+	for len(m.heap) > 0 && m.heap[0].it.entry().key == m.cur.key {
+		src := m.heap[0]
+		if src.it.next() {
+			heap.Fix(&m.heap, 0)
+			continue
+		}
+		heap.Pop(&m.heap)
+		if err := src.it.err(); err != nil {
+			m.fail = err
+			return false
+		}
+	}
+	return true
+}
+
+func (m *mergingIterator) entry() entry { return m.cur }
+
+func (m *mergingIterator) err() error { return m.fail }
+
+type mergeSource struct {
+	it  iterator
+	age int // Position among the merged iterators; lower is newer.
+}
+
+// mergeHeap orders sources by their current key, then newest first.
+type mergeHeap []mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].it.entry().key, h[j].it.entry().key
+	if a != b {
+		return a < b
+	}
+	return h[i].age < h[j].age
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -1,58 +1,718 @@
 package lsmtree
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCorrupt is returned when a log file or SSTable fails its checks.
+var ErrCorrupt = errors.New("lsmtree: corrupt file")
+
+// ErrClosed is returned by operations on a closed tree.
+var ErrClosed = errors.New("lsmtree: tree closed")
 
-	"github.com/rafaelmgr12/litegodb/internal/storage/btree"
+// Defaults for the zero values of Options.
+const (
+	DefaultDegree              = 32
+	DefaultMemtableSize        = 4 << 20
+	DefaultBlockSize           = 4 << 10
+	DefaultBloomBitsPerKey     = 10
+	DefaultL0CompactionTrigger = 4
+	DefaultL0StopWritesTrigger = 12
+	DefaultLevelSizeMultiplier = 10
 )
 
-// LSMTree represents a Log-Structured Merge Tree.
+// maxImmutableMemtables is the number of full memtables waiting to be flushed at which
+// writes wait for the flush to catch up.
+const maxImmutableMemtables = 2
+
+// Options configures an LSMTree. The zero value gives the defaults.
+type Options struct {
+	// Degree is the degree of the memtable B-Tree. Zero means DefaultDegree.
+	Degree int
+
+	// MemtableSize is the approximate size in bytes the memtable reaches before it is
+	// frozen and flushed to an SSTable. Zero means DefaultMemtableSize.
+	MemtableSize int
+
+	// BlockSize is the size in bytes of the data blocks of SSTables, the unit they are
+	// read in. Zero means DefaultBlockSize.
+	BlockSize int
+
+	// BloomBitsPerKey sizes the Bloom filter of each SSTable. Zero means
+	// DefaultBloomBitsPerKey, for about 1% false positives.
+	BloomBitsPerKey int
+
+	// SyncWrites makes every Put and Delete wait until its log record is on stable storage.
+	// Without it a write survives a process crash but may be lost on power failure.
+	SyncWrites bool
+
+	// Compaction is the strategy of the background compactions.
+	Compaction CompactionStrategy
+
+	// DisableCompaction stops background compactions, leaving them to Compact. Writes
+	// then never wait for compactions.
+	DisableCompaction bool
+
+	// L0CompactionTrigger is the number of tables on level 0 that starts a compaction
+	// of level 0, and the number of similar tables size-tiered compaction merges. Zero
+	// means DefaultL0CompactionTrigger; it is at least 2.
+	L0CompactionTrigger int
+
+	// L0StopWritesTrigger is the number of tables on level 0 at which writes wait for
+	// compactions to catch up. Zero means DefaultL0StopWritesTrigger.
+	L0StopWritesTrigger int
+
+	// LevelSizeBase is the size in bytes level 1 of a leveled tree may reach before it is
+	// compacted into level 2. Zero means 10 times MemtableSize.
+	LevelSizeBase int64
+
+	// LevelSizeMultiplier is how many times larger each level of a leveled tree may grow
+	// than the level above it. Zero means DefaultLevelSizeMultiplier.
+	LevelSizeMultiplier int
+
+	// TableSize is the size in bytes leveled compactions split their output into. Zero
+	// means MemtableSize.
+	TableSize int
+
+	// CompactionBytesPerSecond limits the rate compactions write at, leaving disk
+	// bandwidth to flushes and reads. Zero means no limit.
+	CompactionBytesPerSecond int64
+}
+
+func (o Options) withDefaults() Options {
+	if o.Degree == 0 {
+		o.Degree = DefaultDegree
+	}
+	if o.MemtableSize == 0 {
+		o.MemtableSize = DefaultMemtableSize
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.BloomBitsPerKey == 0 {
+		o.BloomBitsPerKey = DefaultBloomBitsPerKey
+	}
+	if o.L0CompactionTrigger == 0 {
+		o.L0CompactionTrigger = DefaultL0CompactionTrigger
+	}
+	o.L0CompactionTrigger = max(o.L0CompactionTrigger, 2)
+	if o.L0StopWritesTrigger == 0 {
+		o.L0StopWritesTrigger = DefaultL0StopWritesTrigger
+	}
+	o.L0StopWritesTrigger = max(o.L0StopWritesTrigger, o.L0CompactionTrigger)
+	if o.LevelSizeBase == 0 {
+		o.LevelSizeBase = 10 * int64(o.MemtableSize)
+	}
+	if o.LevelSizeMultiplier == 0 {
+		o.LevelSizeMultiplier = DefaultLevelSizeMultiplier
+	}
+	if o.TableSize == 0 {
+		o.TableSize = o.MemtableSize
+	}
+	return o
+}
+
+// LSMTree is a Log-Structured Merge Tree kept in a directory. Writes go to a log file and
+// an in-memory memtable. A full memtable is frozen and flushed in the background to a
+// sorted SSTable file on level 0, and its log file removed. Reads look in the memtable,
+// then the frozen memtables and the SSTables, newest first, so the latest write of a key
+// wins and a delete, recorded as a tombstone, hides older values. Background compactions
+// merge SSTables, following Options.Compaction, so reads keep looking at few of them.
+//
+// The directory holds numbered files, NNNNNN.wal logs and NNNNNN.sst tables, and the
+// MANIFEST listing the tables of each level and the logs flushed to them. Logs left by an
+// earlier process and not flushed are replayed into the memtable on open.
 type LSMTree struct {
-	memtable *btree.BTree // In-memory B-Tree
-	wal      *os.File     // Write-ahead log
+	dir  string
+	opts Options
+
+	mu          sync.RWMutex
+	changed     *sync.Cond     // Signaled on mu when a flush or compaction ends.
+	memtable    *memtable      // Takes the writes.
+	wal         *wal           // Log of the memtable's writes.
+	immutable   []*memtable    // Frozen memtables waiting to be flushed, oldest first.
+	levels      [][]*sstable   // Level 0 newest first, deeper levels in key order.
+	compactFrom [numLevels]int // Key after which the next compaction of each level starts.
+	nextFile    uint64         // Number of the next log file or SSTable.
+	logStart    uint64         // Logs numbered below it are flushed to SSTables.
+	bgErr       error          // Error that stopped flushes or compactions; later writes fail with it.
+	stats       Stats
+	closed      bool
+
+	compactMu   sync.Mutex    // Held while a compaction runs.
+	wake        chan struct{} // Wakes the flusher.
+	compactWake chan struct{} // Wakes the compactor.
+	done        chan struct{} // Closed to stop the flusher and compactor.
+	wg          sync.WaitGroup
 }
 
-// NewLSMTree initializes a new LSMTree
-func NewLSMTree(walPath string, degree int) (*LSMTree, error) {
-	wal, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+// Open opens the tree in dir, creating the directory if needed, and replays the logs
+// of writes not yet flushed to SSTables.
+func Open(dir string, opts Options) (*LSMTree, error) {
+	opts = opts.withDefaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	l := &LSMTree{
+		dir:         dir,
+		opts:        opts,
+		levels:      make([][]*sstable, numLevels),
+		wake:        make(chan struct{}, 1),
+		compactWake: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	l.changed = sync.NewCond(&l.mu)
+	for level := range l.compactFrom {
+		l.compactFrom[level] = math.MinInt
+	}
+
+	if err := l.openTables(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+	all, _, err := l.listFiles()
 	if err != nil {
+		l.closeTables()
 		return nil, err
 	}
-	return &LSMTree{
-		memtable: btree.NewBTree(degree),
-		wal:      wal,
-	}, nil
+	// A log whose writes were flushed is left if the process ended before removing it;
+	// replaying it would bring back values the tables have since replaced.
+	var wals []uint64
+	for _, num := range all {
+		if num < l.logStart {
+			os.Remove(l.path(num, "wal"))
+		} else {
+			wals = append(wals, num)
+		}
+	}
+
+	// Only the newest log written to can end in a torn record, since a log is synced
+	// before the next one takes writes.
+	newest := -1
+	for i, num := range wals {
+		info, err := os.Stat(l.path(num, "wal"))
+		if err != nil {
+			l.closeTables()
+			return nil, fmt.Errorf("failed to read log: %w", err)
+		}
+		if info.Size() > 0 {
+			newest = i
+		}
+	}
+
+	l.memtable = newMemtable(opts.Degree)
+	for i, num := range wals {
+		path := l.path(num, "wal")
+		err := replayWAL(path, i >= newest, func(op byte, key int, value string) {
+			if op == opDelete {
+				l.memtable.delete(key)
+			} else {
+				l.memtable.put(key, value)
+			}
+		})
+		if err != nil {
+			l.closeTables()
+			return nil, err
+		}
+		l.memtable.wals = append(l.memtable.wals, num)
+	}
+	if l.wal, err = l.newWAL(); err != nil {
+		l.closeTables()
+		return nil, err
+	}
+	l.memtable.wals = append(l.memtable.wals, l.wal.num)
+
+	l.wg.Add(2)
+	go l.flusher()
+	go l.compactor()
+	if !opts.DisableCompaction {
+		l.compactWake <- struct{}{}
+	}
+	return l, nil
 }
 
-// Insert adds a key-value pair to the LSMTree
-func (l *LSMTree) Insert(key int, value string) error {
-	// Write to Wal
-	if _, err := l.wal.WriteString(fmt.Sprintf("%d:%s\n", key, value)); err != nil {
+// openTables opens the SSTables the manifest lists, and removes the ones it does not.
+// Without a manifest, the tables are those of a tree written before there was one: all
+// on level 0, newer tables numbered higher.
+func (l *LSMTree) openTables() error {
+	_, nums, err := l.listFiles()
+	if err != nil {
 		return err
 	}
-	if err := l.wal.Sync(); err != nil {
+	m, ok, err := readManifest(l.dir)
+	if err != nil {
 		return err
 	}
+	if !ok {
+		m = &manifest{levels: [][]uint64{nil}}
+		for i := len(nums) - 1; i >= 0; i-- {
+			m.levels[0] = append(m.levels[0], nums[i])
+		}
+	}
+	if len(m.levels) > numLevels {
+		return fmt.Errorf("%w: manifest has %d levels", ErrCorrupt, len(m.levels))
+	}
+	l.nextFile = max(l.nextFile, m.nextFile)
+	l.logStart = m.logStart
 
-	// Insert into memtable
-	l.memtable.Insert(key, value)
-	// TODO: Trigger a flush to disk if memtable size exceeds threshold
+	live := make(map[uint64]bool)
+	for level, tables := range m.levels {
+		for _, num := range tables {
+			t, err := openSSTable(l.path(num, "sst"), num)
+			if err != nil {
+				return err
+			}
+			l.levels[level] = append(l.levels[level], t)
+			live[num] = true
+		}
+	}
+	for _, num := range nums {
+		if !live[num] {
+			os.Remove(l.path(num, "sst"))
+		}
+	}
+	if !ok {
+		return l.saveManifest(l.levels, l.logStart)
+	}
 	return nil
 }
 
-// Search finds a key in the LSMTree
-func (l *LSMTree) Search(key int) (string, bool) {
-	value, found := l.memtable.Search(key)
-	if found {
-		return value.(string), true
+// saveManifest records levels as the tables of the tree, holding the writes of the logs
+// numbered below logStart. The caller holds mu, or is the only user of l.
+func (l *LSMTree) saveManifest(levels [][]*sstable, logStart uint64) error {
+	m := &manifest{nextFile: l.nextFile, logStart: logStart}
+	for _, tables := range levels {
+		nums := make([]uint64, len(tables))
+		for i, t := range tables {
+			nums[i] = t.num
+		}
+		m.levels = append(m.levels, nums)
+	}
+	return writeManifest(l.dir, m)
+}
+
+// allocFile returns the number of a new file.
+func (l *LSMTree) allocFile() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	num := l.nextFile
+	l.nextFile++
+	return num
+}
+
+// listFiles returns the numbers of the log files and SSTables in the directory, in
+// ascending order, removing what is left of SSTables being written when a process ended.
+func (l *LSMTree) listFiles() (wals, tables []uint64, err error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read directory: %w", err)
 	}
-	// TODO: Search in SSTables
-	return "", false
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(l.dir, name))
+			continue
+		}
+		if name == manifestName {
+			continue
+		}
+		base, ext, ok := strings.Cut(name, ".")
+		num, err := strconv.ParseUint(base, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		switch ext {
+		case "wal":
+			wals = append(wals, num)
+		case "sst":
+			tables = append(tables, num)
+		default:
+			continue
+		}
+		l.nextFile = max(l.nextFile, num+1)
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+	sort.Slice(tables, func(i, j int) bool { return tables[i] < tables[j] })
+	return wals, tables, nil
+}
+
+func (l *LSMTree) path(num uint64, ext string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d.%s", num, ext))
+}
+
+// newWAL creates the next log file. The caller holds mu, or is the only user of l.
+func (l *LSMTree) newWAL() (*wal, error) {
+	w, err := createWAL(l.path(l.nextFile, "wal"), l.nextFile, l.opts.SyncWrites)
+	if err != nil {
+		return nil, err
+	}
+	l.nextFile++
+	if err := syncDir(l.dir); err != nil {
+		w.close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Put sets the value of key.
+func (l *LSMTree) Put(key int, value string) error {
+	return l.write(opPut, key, value)
+}
+
+// Delete removes key, recording a tombstone that hides its older values.
+func (l *LSMTree) Delete(key int) error {
+	return l.write(opDelete, key, "")
+}
+
+func (l *LSMTree) write(op byte, key int, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.makeRoom(); err != nil {
+		return err
+	}
+	if err := l.wal.append(op, key, value); err != nil {
+		return err
+	}
+	l.stats.UserBytes += int64(8 + len(value))
+	if op == opDelete {
+		l.memtable.delete(key)
+	} else {
+		l.memtable.put(key, value)
+	}
+	return nil
 }
 
-// Flush memtable to an SSTable
+// makeRoom freezes the memtable if it is full, first waiting for the flushes to catch up
+// if too many memtables are already waiting, and for the compactions to catch up if
+// level 0 has too many tables. The caller holds mu.
+func (l *LSMTree) makeRoom() error {
+	var stalled time.Time
+	defer func() {
+		if !stalled.IsZero() {
+			l.stats.WriteStalls++
+			l.stats.WriteStallTime += time.Since(stalled)
+		}
+	}()
+	for {
+		if l.closed {
+			return ErrClosed
+		}
+		if l.bgErr != nil {
+			return l.bgErr
+		}
+		if l.memtable.size < l.opts.MemtableSize {
+			return nil
+		}
+		stall := len(l.immutable) >= maxImmutableMemtables ||
+			!l.opts.DisableCompaction && len(l.levels[0]) >= l.opts.L0StopWritesTrigger
+		if !stall {
+			return l.freeze()
+		}
+		if stalled.IsZero() {
+			stalled = time.Now()
+		}
+		l.changed.Wait()
+	}
+}
+
+// freeze queues the memtable for flushing and starts a new one with a new log file.
+// The caller holds mu.
+func (l *LSMTree) freeze() error {
+	w, err := l.newWAL()
+	if err != nil {
+		return err
+	}
+	if err := l.wal.close(); err != nil {
+		w.close()
+		os.Remove(w.path)
+		return err
+	}
+	l.immutable = append(l.immutable, l.memtable)
+	l.memtable = newMemtable(l.opts.Degree)
+	l.memtable.wals = []uint64{w.num}
+	l.wal = w
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flusher writes frozen memtables to SSTables, oldest first, until the tree is closed.
+func (l *LSMTree) flusher() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.wake:
+		case <-l.done:
+			return
+		}
+		for l.flushOne() {
+		}
+	}
+}
+
+// flushOne flushes the oldest frozen memtable to level 0, reporting whether there may
+// be more.
+func (l *LSMTree) flushOne() bool {
+	l.mu.Lock()
+	if l.closed || l.bgErr != nil || len(l.immutable) == 0 {
+		l.mu.Unlock()
+		return false
+	}
+	mem := l.immutable[0]
+	num := l.nextFile
+	l.nextFile++
+	l.mu.Unlock()
+
+	t, err := l.writeSSTable(mem, num)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.changed.Broadcast()
+	if err != nil {
+		l.bgErr = fmt.Errorf("failed to flush memtable: %w", err)
+		return false
+	}
+	// Memtables are flushed in order, so every log up to the memtable's last is flushed.
+	levels := l.levels
+	if t != nil {
+		levels = make([][]*sstable, len(l.levels))
+		copy(levels, l.levels)
+		levels[0] = append([]*sstable{t}, l.levels[0]...)
+	}
+	logStart := mem.wals[len(mem.wals)-1] + 1
+	if err := l.saveManifest(levels, logStart); err != nil {
+		l.bgErr = fmt.Errorf("failed to flush memtable: %w", err)
+		if t != nil {
+			t.close()
+			os.Remove(t.path)
+		}
+		return false
+	}
+	l.levels = levels
+	l.logStart = logStart
+	if t != nil {
+		l.stats.Flushes++
+		l.stats.FlushBytes += t.size
+	}
+	l.immutable = l.immutable[1:]
+
+	// The writes are in the SSTable now.
+	for _, num := range mem.wals {
+		if err := os.Remove(l.path(num, "wal")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			l.bgErr = fmt.Errorf("failed to remove flushed log: %w", err)
+			return false
+		}
+	}
+	if !l.opts.DisableCompaction {
+		select {
+		case l.compactWake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// writeSSTable writes the entries of a memtable to the SSTable numbered num and opens it.
+// An empty memtable gives no table.
+func (l *LSMTree) writeSSTable(mem *memtable, num uint64) (*sstable, error) {
+	entries := mem.entries()
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	path := l.path(num, "sst")
+	w, err := newSSTableWriter(path, l.opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := w.add(e); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+	if err := syncDir(l.dir); err != nil {
+		return nil, err
+	}
+	return openSSTable(path, num)
+}
+
+// Get returns the value of key, if it has one.
+func (l *LSMTree) Get(key int) (string, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return "", false, ErrClosed
+	}
+
+	if e, ok := l.memtable.get(key); ok {
+		return e.value, !e.deleted, nil
+	}
+	for i := len(l.immutable) - 1; i >= 0; i-- {
+		if e, ok := l.immutable[i].get(key); ok {
+			return e.value, !e.deleted, nil
+		}
+	}
+	for level, tables := range l.levels {
+		if level > 0 {
+			// Deeper levels have at most one table holding the key.
+			i := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= key })
+			tables = tables[i:min(i+1, len(tables))]
+		}
+		for _, t := range tables {
+			e, ok, err := t.get(key)
+			if err != nil {
+				return "", false, err
+			}
+			if ok {
+				return e.value, !e.deleted, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// Scan calls fn with every key and its value in ascending key order, until fn returns
+// false. fn must not write to the tree.
+func (l *LSMTree) Scan(fn func(key int, value string) bool) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	its := []iterator{newSliceIterator(l.memtable.entries())}
+	for i := len(l.immutable) - 1; i >= 0; i-- {
+		its = append(its, newSliceIterator(l.immutable[i].entries()))
+	}
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			its = append(its, t.iterator())
+		}
+	}
+	it := newMergingIterator(its)
+	for it.next() {
+		if e := it.entry(); !e.deleted && !fn(e.key, e.value) {
+			return nil
+		}
+	}
+	return it.err()
+}
+
+// Flush freezes the memtable, unless it is empty, and waits until every frozen memtable
+// is written to an SSTable.
 func (l *LSMTree) Flush() error {
-	// TODO: Serialize memtable to a disk as an SSTable
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if !l.memtable.empty() {
+		for len(l.immutable) >= maxImmutableMemtables && l.bgErr == nil && !l.closed {
+			l.changed.Wait()
+		}
+		if l.bgErr != nil {
+			return l.bgErr
+		}
+		if err := l.freeze(); err != nil {
+			return err
+		}
+	}
+	for len(l.immutable) > 0 && l.bgErr == nil && !l.closed {
+		l.changed.Wait()
+	}
+	if l.closed {
+		return ErrClosed
+	}
+	return l.bgErr
+}
+
+// Close stops the flushes and compactions and closes the files of the tree. Writes not yet flushed stay
+// in their log files and are replayed when the tree is opened again.
+func (l *LSMTree) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.changed.Broadcast()
+	l.mu.Unlock()
+
+	close(l.done)
+	l.wg.Wait()
+
+	err := l.wal.close()
+	if cerr := l.closeTables(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (l *LSMTree) closeTables() error {
+	var err error
+	for _, tables := range l.levels {
+		for _, t := range tables {
+			if cerr := t.close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	l.levels = nil
+	return err
+}
+
+// NewLSMTree opens the tree in the directory at path, with memtables of B-trees of the
+// given degree.
+//
+// Deprecated: Use Open. The path named a single log file before the tree had SSTables;
+// it now names the directory of the tree, and such a log file is not read.
+func NewLSMTree(path string, degree int) (*LSMTree, error) {
+	return Open(path, Options{Degree: degree})
+}
+
+// Insert adds or replaces the value of key.
+//
+// Deprecated: Use Put.
+func (l *LSMTree) Insert(key int, value string) error {
+	return l.Put(key, value)
+}
+
+// Search returns the value of key, and whether it was found. A key whose SSTable cannot
+// be read is reported as not found.
+//
+// Deprecated: Use Get, which reports read errors.
+func (l *LSMTree) Search(key int) (string, bool) {
+	value, found, err := l.Get(key)
+	if err != nil {
+		return "", false
+	}
+	return value, found
+}
+
+// syncDir syncs a directory, making the files created in or removed from it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
 	return nil
 }
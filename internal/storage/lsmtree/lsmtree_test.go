@@ -1,16 +1,22 @@
 package lsmtree_test
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/rafaelmgr12/litegodb/internal/storage/lsmtree"
 )
 
 func TestLSMTreeInsertAndSearch(t *testing.T) {
-	lsm, err := lsmtree.NewLSMTree("test.wal", 2)
+	lsm, err := lsmtree.NewLSMTree(filepath.Join(t.TempDir(), "test.wal"), 2)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer lsm.Close()
 
 	if err := lsm.Insert(10, "ten"); err != nil {
 		t.Fatal(err)
@@ -29,3 +35,431 @@ func TestLSMTreeInsertAndSearch(t *testing.T) {
 		t.Fatalf("expected to find 'twenty', found %s", value)
 	}
 }
+
+func TestLSMTreePutAndGet(t *testing.T) {
+	lsm, err := lsmtree.Open(t.TempDir(), lsmtree.Options{Degree: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	if err := lsm.Put(10, "ten"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Put(20, "twenty"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, found, err := lsm.Get(10)
+	if err != nil || !found || value != "ten" {
+		t.Fatalf("expected to find 'ten', found %s (%v)", value, err)
+	}
+
+	value, found, err = lsm.Get(20)
+	if err != nil || !found || value != "twenty" {
+		t.Fatalf("expected to find 'twenty', found %s (%v)", value, err)
+	}
+}
+
+// smallTables gives memtables that fill after a few dozen writes, and keeps every table
+// they are flushed to.
+var smallTables = lsmtree.Options{Degree: 4, MemtableSize: 2 << 10, BlockSize: 256, DisableCompaction: true}
+
+func TestLSMTreeOverwritesAcrossSSTables(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := lsmtree.Open(dir, smallTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every round overwrites the keys written before, spreading their versions over
+	// many SSTables; the last round deletes every seventh key.
+	const keys, rounds = 300, 6
+	for round := 0; round < rounds; round++ {
+		for key := 0; key < keys; key++ {
+			if err := lsm.Put(key, fmt.Sprintf("v%d-%d", round, key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for key := 0; key < keys; key += 7 {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(tables) < 10 {
+		t.Fatalf("expected many SSTables, got %d", len(tables))
+	}
+
+	check := func(lsm *lsmtree.LSMTree) {
+		t.Helper()
+		for key := 0; key < keys; key++ {
+			value, found, err := lsm.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fmt.Sprintf("v%d-%d", rounds-1, key)
+			if key%7 == 0 {
+				if found {
+					t.Fatalf("deleted key %d has value %q", key, value)
+				}
+			} else if !found || value != want {
+				t.Fatalf("key %d has value %q (found %v), want %q", key, value, found, want)
+			}
+		}
+		if _, found, _ := lsm.Get(keys); found {
+			t.Fatalf("found key %d, never written", keys)
+		}
+
+		next := 0
+		err := lsm.Scan(func(key int, value string) bool {
+			for next%7 == 0 {
+				next++
+			}
+			if key != next || value != fmt.Sprintf("v%d-%d", rounds-1, key) {
+				t.Fatalf("scanned key %d = %q, want key %d", key, value, next)
+			}
+			next++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != keys {
+			t.Fatalf("scan ended before key %d", next)
+		}
+	}
+	check(lsm)
+
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = lsmtree.Open(dir, smallTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	check(lsm)
+}
+
+func TestLSMTreeReplaysLogOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := lsmtree.Open(dir, lsmtree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 100; key++ {
+		if err := lsm.Put(key, fmt.Sprint(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Delete(50); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tables, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(tables) != 0 {
+		t.Fatalf("the memtable should not have been flushed, found %v", tables)
+	}
+
+	// A record cut short by a crash is dropped.
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(logs) != 1 {
+		t.Fatalf("expected one log file, found %v", logs)
+	}
+	f, err := os.OpenFile(logs[0], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 200, 0, 0, 0, 1})
+	f.Close()
+
+	lsm, err = lsmtree.Open(dir, lsmtree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 100; key++ {
+		value, found, err := lsm.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == 50 {
+			if found {
+				t.Fatalf("deleted key 50 has value %q", value)
+			}
+		} else if !found || value != fmt.Sprint(key) {
+			t.Fatalf("key %d has value %q (found %v)", key, value, found)
+		}
+	}
+
+	// Writes after the replay, and the replayed ones, reach an SSTable together.
+	if err := lsm.Put(100, "100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if logs, _ := filepath.Glob(filepath.Join(dir, "*.wal")); len(logs) != 1 {
+		t.Fatalf("flushed logs should be removed, found %v", logs)
+	}
+
+	lsm, err = lsmtree.Open(dir, lsmtree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if value, found, err := lsm.Get(100); err != nil || !found || value != "100" {
+		t.Fatalf("key 100 has value %q (found %v, %v)", value, found, err)
+	}
+	if _, found, _ := lsm.Get(50); found {
+		t.Fatal("the tombstone of key 50 was lost in the flush")
+	}
+}
+
+func TestLSMTreeSkipsFlushedLogs(t *testing.T) {
+	dir := t.TempDir()
+	opts := lsmtree.Options{DisableCompaction: true, L0CompactionTrigger: 2}
+	lsm, err := lsmtree.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 10; key++ {
+		if err := lsm.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(logs) != 1 {
+		t.Fatalf("expected one log, found %v", logs)
+	}
+	oldLog, err := os.ReadFile(logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Newer values and deletes replace the old ones, and the compaction drops the deleted
+	// keys with their tombstones.
+	for key := 0; key < 5; key++ {
+		if err := lsm.Put(key, "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := 5; key < 10; key++ {
+		if err := lsm.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if lsm.Stats().TombstonesDropped != 5 {
+		t.Fatalf("dropped %d tombstones, want 5", lsm.Stats().TombstonesDropped)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash before the flushed log was removed leaves it behind.
+	if err := os.WriteFile(logs[0], oldLog, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lsm, err = lsmtree.Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	for key := 0; key < 10; key++ {
+		value, found, err := lsm.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key < 5 && (!found || value != "new") {
+			t.Fatalf("key %d has value %q (found %v), want \"new\"", key, value, found)
+		}
+		if key >= 5 && found {
+			t.Fatalf("deleted key %d is back with value %q", key, value)
+		}
+	}
+	if _, err := os.Stat(logs[0]); !os.IsNotExist(err) {
+		t.Fatalf("expected the flushed log to be removed, got %v", err)
+	}
+}
+
+func TestLSMTreeDetectsCorruptLog(t *testing.T) {
+	// Each open replays the logs left and starts a new one, so the second round of
+	// writes goes to a second log.
+	dir := t.TempDir()
+	for round := 0; round < 2; round++ {
+		lsm, err := lsmtree.Open(dir, lsmtree.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := 0; key < 10; key++ {
+			if err := lsm.Put(round*10+key, "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := lsm.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(logs) != 2 {
+		t.Fatalf("expected two logs, found %v", logs)
+	}
+	original, err := os.ReadFile(logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage in the middle of a log is not a torn write: the records after it were
+	// acknowledged, so opening fails rather than dropping them.
+	damaged := append([]byte(nil), original...)
+	damaged[len(damaged)/2] ^= 0xff
+	if err := os.WriteFile(logs[0], damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsmtree.Open(dir, lsmtree.Options{}); !errors.Is(err, lsmtree.ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for a damaged record mid-log, got %v", err)
+	}
+
+	// Neither is a torn record at the end of a log followed by a log with writes.
+	if err := os.WriteFile(logs[0], original[:len(original)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsmtree.Open(dir, lsmtree.Options{}); !errors.Is(err, lsmtree.ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for a torn log before the newest, got %v", err)
+	}
+
+	// Nor a damaged last record followed by anything but zeros.
+	if err := os.WriteFile(logs[0], original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	last, err := os.ReadFile(logs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	last[len(last)-1] ^= 0xff
+	if err := os.WriteFile(logs[1], append(last, 1, 0, 0, 0, 0, 0, 0, 0, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lsmtree.Open(dir, lsmtree.Options{}); !errors.Is(err, lsmtree.ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt for a damaged record before more data, got %v", err)
+	}
+
+	// Zeros after the last record, and a damaged record ending the newest log, are what
+	// a crash leaves behind; only that record is lost.
+	last[len(last)-1] ^= 0xff
+	if err := os.WriteFile(logs[1], append(last, make([]byte, 64)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check := func(lost int) {
+		t.Helper()
+		lsm, err := lsmtree.Open(dir, lsmtree.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lsm.Close()
+		for key := 0; key < 20; key++ {
+			_, found, err := lsm.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := key != lost; found != want {
+				t.Fatalf("key %d found %v, want %v", key, found, want)
+			}
+		}
+	}
+	check(-1)
+	last[len(last)-1] ^= 0xff
+	if err := os.WriteFile(logs[1], last, 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(19)
+}
+
+func TestLSMTreeDetectsCorruptSSTable(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := lsmtree.Open(dir, lsmtree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := 0; key < 10; key++ {
+		if err := lsm.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lsm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lsm.Close()
+
+	tables, _ := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if len(tables) != 1 {
+		t.Fatalf("expected one SSTable, found %v", tables)
+	}
+	f, err := os.OpenFile(tables[0], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, 2)
+	f.Close()
+
+	lsm, err = lsmtree.Open(dir, lsmtree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+	if _, _, err := lsm.Get(3); !errors.Is(err, lsmtree.ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt reading a corrupt block, got %v", err)
+	}
+}
+
+func TestLSMTreeReadsWhileFlushing(t *testing.T) {
+	lsm, err := lsmtree.Open(t.TempDir(), smallTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	// Readers see every key written before they started, whichever memtable or
+	// SSTable holds it at the time.
+	const keys = 2000
+	var wg sync.WaitGroup
+	written := make(chan int, keys)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range written {
+				value, found, err := lsm.Get(key)
+				if err != nil || !found || value != fmt.Sprint(key) {
+					t.Errorf("key %d has value %q (found %v, %v)", key, value, found, err)
+					return
+				}
+			}
+		}()
+	}
+	for key := 0; key < keys; key++ {
+		if err := lsm.Put(key, fmt.Sprint(key)); err != nil {
+			t.Fatal(err)
+		}
+		written <- key
+	}
+	close(written)
+	wg.Wait()
+}
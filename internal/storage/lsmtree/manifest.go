@@ -0,0 +1,130 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// The manifest records the live SSTables of the tree, level by level, and the logs
+// already flushed to them:
+//
+//	magic (8 bytes) | next file number (8) | log start (8) | levels (4) |
+//	for each level: tables (4), then the number of each table (8 each) |
+//	checksum (4)
+//
+// Logs numbered below the log start hold writes flushed to the tables; they are not
+// replayed, and are removed on open if a crash left them. Manifests written before the
+// log start was recorded have the first magic and no log start, which reads as 0.
+//
+// Level 0 lists its tables newest first; the deeper levels in key order. The manifest is
+// replaced as a whole, through a temporary file renamed over it, whenever a flush or
+// compaction changes the tables. An SSTable it does not list is not part of the tree:
+// it is left by a flush or compaction interrupted before the manifest recorded it, or
+// by a compaction that replaced it, and is removed on open.
+
+const manifestName = "MANIFEST"
+
+const (
+	manifestMagicV1 = 0x314e414d_4244474c // "LGDBMAN1" read little-endian.
+	manifestMagic   = 0x324e414d_4244474c // "LGDBMAN2" read little-endian.
+)
+
+// manifest is the content of the manifest file.
+type manifest struct {
+	nextFile uint64
+	logStart uint64     // Number of the first log not flushed.
+	levels   [][]uint64 // Table numbers of each level.
+}
+
+// readManifest reads the manifest in dir, reporting whether there is one.
+func readManifest(dir string) (*manifest, bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	header := 20
+	if len(data) >= 8 && binary.LittleEndian.Uint64(data) == manifestMagic {
+		header = 28
+	} else if len(data) < 8 || binary.LittleEndian.Uint64(data) != manifestMagicV1 {
+		return nil, false, fmt.Errorf("%w: bad manifest", ErrCorrupt)
+	}
+	if len(data) < header+4 {
+		return nil, false, fmt.Errorf("%w: manifest cut short", ErrCorrupt)
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, false, fmt.Errorf("%w: manifest checksum mismatch", ErrCorrupt)
+	}
+
+	m := &manifest{nextFile: binary.LittleEndian.Uint64(body[8:])}
+	if header == 28 {
+		m.logStart = binary.LittleEndian.Uint64(body[16:])
+	}
+	levels := binary.LittleEndian.Uint32(body[header-4:])
+	body = body[header:]
+	for i := uint32(0); i < levels; i++ {
+		if len(body) < 4 {
+			return nil, false, fmt.Errorf("%w: manifest cut short", ErrCorrupt)
+		}
+		n := int(binary.LittleEndian.Uint32(body))
+		body = body[4:]
+		if len(body) < n*8 {
+			return nil, false, fmt.Errorf("%w: manifest cut short", ErrCorrupt)
+		}
+		nums := make([]uint64, n)
+		for j := range nums {
+			nums[j] = binary.LittleEndian.Uint64(body[j*8:])
+		}
+		body = body[n*8:]
+		m.levels = append(m.levels, nums)
+	}
+	return m, true, nil
+}
+
+// writeManifest durably replaces the manifest in dir with m.
+func writeManifest(dir string, m *manifest) error {
+	data := binary.LittleEndian.AppendUint64(nil, manifestMagic)
+	data = binary.LittleEndian.AppendUint64(data, m.nextFile)
+	data = binary.LittleEndian.AppendUint64(data, m.logStart)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(m.levels)))
+	for _, nums := range m.levels {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(nums)))
+		for _, num := range nums {
+			data = binary.LittleEndian.AppendUint64(data, num)
+		}
+	}
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+
+	path := filepath.Join(dir, manifestName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to sync manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to install manifest: %w", err)
+	}
+	return syncDir(dir)
+}
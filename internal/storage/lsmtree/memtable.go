@@ -0,0 +1,71 @@
+package lsmtree
+
+import (
+	"github.com/rafaelmgr12/litegodb/internal/storage/btree"
+)
+
+// entry is a key with its latest value, or a tombstone if the key was deleted.
+type entry struct {
+	key     int
+	value   string
+	deleted bool
+}
+
+// tombstone is the memtable value of a deleted key. It shadows the key in older memtables
+// and SSTables, and is written to SSTables in turn.
+type tombstone struct{}
+
+// entryOverhead is the approximate memory a memtable entry takes besides its value.
+const entryOverhead = 32
+
+// memtable holds the latest writes in memory, sorted by key, along with the log files
+// that make them durable until the memtable is flushed to an SSTable.
+type memtable struct {
+	tree *btree.BTree
+	size int      // Approximate bytes of the writes applied, overwritten ones included.
+	wals []uint64 // Numbers of the log files holding the writes, oldest first.
+}
+
+func newMemtable(degree int) *memtable {
+	return &memtable{tree: btree.NewBTree(degree)}
+}
+
+func (m *memtable) put(key int, value string) {
+	m.tree.Insert(key, value)
+	m.size += entryOverhead + len(value)
+}
+
+func (m *memtable) delete(key int) {
+	m.tree.Insert(key, tombstone{})
+	m.size += entryOverhead
+}
+
+// get returns the entry of key, if the memtable has one.
+func (m *memtable) get(key int) (entry, bool) {
+	value, found := m.tree.Search(key)
+	if !found {
+		return entry{}, false
+	}
+	if _, deleted := value.(tombstone); deleted {
+		return entry{key: key, deleted: true}, true
+	}
+	return entry{key: key, value: value.(string)}, true
+}
+
+// entries returns the entries of the memtable in key order.
+func (m *memtable) entries() []entry {
+	var entries []entry
+	m.tree.Ascend(func(key int, value interface{}) bool {
+		if _, deleted := value.(tombstone); deleted {
+			entries = append(entries, entry{key: key, deleted: true})
+		} else {
+			entries = append(entries, entry{key: key, value: value.(string)})
+		}
+		return true
+	})
+	return entries
+}
+
+func (m *memtable) empty() bool {
+	return m.size == 0
+}
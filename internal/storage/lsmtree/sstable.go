@@ -0,0 +1,363 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// An SSTable is an immutable file of entries sorted by key:
+//
+//	data block | ... | data block | bloom block | index block | footer
+//
+// A data block holds consecutive entries, each a key (varint), a flags byte (1 for a
+// tombstone), the value length (uvarint) and the value. The bloom block holds the Bloom
+// filter of every key, and the index block the last key, offset and length of each data
+// block. Every block ends with the CRC-32 of its contents. The fixed-size footer locates
+// the bloom and index blocks, and gives the number of entries and the key range.
+
+// sstableMagic ends every SSTable.
+const sstableMagic = 0x31545353_4244474c // "LGDBSST1" read little-endian.
+
+const footerSize = 8 * 8
+
+const flagTombstone byte = 1
+
+// blockHandle locates a data block of an SSTable.
+type blockHandle struct {
+	lastKey int
+	offset  uint64
+	length  uint64 // Including the checksum.
+}
+
+// sstableWriter writes an SSTable from entries added in key order. The table is written
+// to a temporary file, and only appears at its path once finished.
+type sstableWriter struct {
+	f          *os.File
+	path       string
+	blockSize  int
+	bitsPerKey int
+
+	block    []byte
+	blockKey int // Last key of the block being built.
+	offset   uint64
+	index    []blockHandle
+	hashes   []uint64
+	count    int
+	smallest int
+	largest  int
+}
+
+func newSSTableWriter(path string, opts Options) (*sstableWriter, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sstable: %w", err)
+	}
+	return &sstableWriter{f: f, path: path, blockSize: opts.BlockSize, bitsPerKey: opts.BloomBitsPerKey}, nil
+}
+
+// add appends an entry, whose key must be greater than the keys of the ones added before.
+func (w *sstableWriter) add(e entry) error {
+	if w.count == 0 {
+		w.smallest = e.key
+	} else if e.key <= w.largest {
+		return fmt.Errorf("sstable keys out of order: %d after %d", e.key, w.largest)
+	}
+	w.largest = e.key
+	w.count++
+	w.hashes = append(w.hashes, hashKey(e.key))
+
+	var flags byte
+	if e.deleted {
+		flags = flagTombstone
+	}
+	w.block = binary.AppendVarint(w.block, int64(e.key))
+	w.block = append(w.block, flags)
+	w.block = binary.AppendUvarint(w.block, uint64(len(e.value)))
+	w.block = append(w.block, e.value...)
+	w.blockKey = e.key
+	if len(w.block) >= w.blockSize {
+		return w.finishBlock()
+	}
+	return nil
+}
+
+// size returns the number of bytes written so far.
+func (w *sstableWriter) size() uint64 {
+	return w.offset + uint64(len(w.block))
+}
+
+func (w *sstableWriter) finishBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	handle, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	handle.lastKey = w.blockKey
+	w.index = append(w.index, handle)
+	w.block = w.block[:0]
+	return nil
+}
+
+// writeBlock appends data and its checksum to the file.
+func (w *sstableWriter) writeBlock(data []byte) (blockHandle, error) {
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	if _, err := w.f.Write(data); err != nil {
+		return blockHandle{}, fmt.Errorf("failed to write sstable: %w", err)
+	}
+	handle := blockHandle{offset: w.offset, length: uint64(len(data))}
+	w.offset += uint64(len(data))
+	return handle, nil
+}
+
+// finish writes the bloom and index blocks and the footer, syncs the table and moves it
+// to its path.
+func (w *sstableWriter) finish() error {
+	if err := w.finishBlock(); err != nil {
+		w.abort()
+		return err
+	}
+	bloomBlock, err := w.writeBlock(newBloom(w.hashes, w.bitsPerKey).encode())
+	if err != nil {
+		w.abort()
+		return err
+	}
+	var index []byte
+	index = binary.AppendUvarint(index, uint64(len(w.index)))
+	for _, h := range w.index {
+		index = binary.AppendVarint(index, int64(h.lastKey))
+		index = binary.AppendUvarint(index, h.offset)
+		index = binary.AppendUvarint(index, h.length)
+	}
+	indexBlock, err := w.writeBlock(index)
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	footer := make([]byte, 0, footerSize)
+	for _, v := range []uint64{
+		bloomBlock.offset, bloomBlock.length, indexBlock.offset, indexBlock.length,
+		uint64(w.count), uint64(w.smallest), uint64(w.largest), sstableMagic,
+	} {
+		footer = binary.LittleEndian.AppendUint64(footer, v)
+	}
+	if _, err := w.f.Write(footer); err != nil {
+		w.abort()
+		return fmt.Errorf("failed to write sstable: %w", err)
+	}
+
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return fmt.Errorf("failed to sync sstable: %w", err)
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("failed to close sstable: %w", err)
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("failed to install sstable: %w", err)
+	}
+	return nil
+}
+
+// abort gives up on the table and removes its temporary file.
+func (w *sstableWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// sstable is an open SSTable, with its index and Bloom filter in memory.
+type sstable struct {
+	num      uint64 // File number; a newer table has a higher one.
+	path     string
+	f        *os.File
+	size     int64
+	index    []blockHandle
+	filter   bloom
+	count    int
+	smallest int
+	largest  int
+}
+
+// openSSTable opens the SSTable at path and reads its index and Bloom filter.
+func openSSTable(path string, num uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sstable: %w", err)
+	}
+	t := &sstable{num: num, path: path, f: f}
+	if err := t.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sstable) load() error {
+	info, err := t.f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open sstable: %w", err)
+	}
+	t.size = info.Size()
+	if t.size < footerSize {
+		return fmt.Errorf("%w: sstable %s is too short", ErrCorrupt, t.path)
+	}
+	footer := make([]byte, footerSize)
+	if _, err := t.f.ReadAt(footer, t.size-footerSize); err != nil {
+		return fmt.Errorf("failed to read sstable %s: %w", t.path, err)
+	}
+	field := func(i int) uint64 { return binary.LittleEndian.Uint64(footer[i*8:]) }
+	if field(7) != sstableMagic {
+		return fmt.Errorf("%w: sstable %s has no footer", ErrCorrupt, t.path)
+	}
+	t.count = int(field(4))
+	t.smallest = int(int64(field(5)))
+	t.largest = int(int64(field(6)))
+
+	bloomData, err := t.readBlock(blockHandle{offset: field(0), length: field(1)})
+	if err != nil {
+		return err
+	}
+	t.filter = decodeBloom(bloomData)
+
+	index, err := t.readBlock(blockHandle{offset: field(2), length: field(3)})
+	if err != nil {
+		return err
+	}
+	n, k := binary.Uvarint(index)
+	if k <= 0 {
+		return fmt.Errorf("%w: sstable %s has a bad index", ErrCorrupt, t.path)
+	}
+	index = index[k:]
+	t.index = make([]blockHandle, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var h blockHandle
+		lastKey, k1 := binary.Varint(index)
+		if k1 <= 0 {
+			return fmt.Errorf("%w: sstable %s has a bad index", ErrCorrupt, t.path)
+		}
+		offset, k2 := binary.Uvarint(index[k1:])
+		if k2 <= 0 {
+			return fmt.Errorf("%w: sstable %s has a bad index", ErrCorrupt, t.path)
+		}
+		length, k3 := binary.Uvarint(index[k1+k2:])
+		if k3 <= 0 {
+			return fmt.Errorf("%w: sstable %s has a bad index", ErrCorrupt, t.path)
+		}
+		h.lastKey, h.offset, h.length = int(lastKey), offset, length
+		t.index = append(t.index, h)
+		index = index[k1+k2+k3:]
+	}
+	return nil
+}
+
+// readBlock reads a block and checks its checksum, returning its contents.
+func (t *sstable) readBlock(h blockHandle) ([]byte, error) {
+	if h.length < 4 || h.offset+h.length > uint64(t.size) {
+		return nil, fmt.Errorf("%w: sstable %s has a block out of bounds", ErrCorrupt, t.path)
+	}
+	data := make([]byte, h.length)
+	if _, err := t.f.ReadAt(data, int64(h.offset)); err != nil {
+		return nil, fmt.Errorf("failed to read sstable %s: %w", t.path, err)
+	}
+	data, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, fmt.Errorf("%w: sstable %s has a bad block at offset %d", ErrCorrupt, t.path, h.offset)
+	}
+	return data, nil
+}
+
+// get returns the entry of key, if the table has one.
+func (t *sstable) get(key int) (entry, bool, error) {
+	if key < t.smallest || key > t.largest || !t.filter.mayContain(hashKey(key)) {
+		return entry{}, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+	data, err := t.readBlock(t.index[i])
+	if err != nil {
+		return entry{}, false, err
+	}
+	for len(data) > 0 {
+		e, n, err := decodeEntry(data)
+		if err != nil {
+			return entry{}, false, fmt.Errorf("%w: sstable %s", err, t.path)
+		}
+		if e.key == key {
+			return e, true, nil
+		}
+		if e.key > key {
+			break
+		}
+		data = data[n:]
+	}
+	return entry{}, false, nil
+}
+
+// decodeEntry decodes the entry at the start of a data block, returning its length.
+func decodeEntry(data []byte) (entry, int, error) {
+	key, k := binary.Varint(data)
+	if k <= 0 || k >= len(data) {
+		return entry{}, 0, fmt.Errorf("%w: bad entry", ErrCorrupt)
+	}
+	flags := data[k]
+	length, l := binary.Uvarint(data[k+1:])
+	if l <= 0 || length > uint64(len(data)-k-1-l) {
+		return entry{}, 0, fmt.Errorf("%w: bad entry", ErrCorrupt)
+	}
+	start := k + 1 + l
+	e := entry{key: int(key), value: string(data[start : start+int(length)]), deleted: flags&flagTombstone != 0}
+	return e, start + int(length), nil
+}
+
+func (t *sstable) close() error {
+	return t.f.Close()
+}
+
+// sstableIterator reads the entries of an SSTable in key order, a block at a time.
+type sstableIterator struct {
+	t     *sstable
+	block int    // Index of the next block to read.
+	data  []byte // Rest of the current block.
+	cur   entry
+	fail  error
+}
+
+func (t *sstable) iterator() *sstableIterator {
+	return &sstableIterator{t: t}
+}
+
+func (it *sstableIterator) next() bool {
+	if it.fail != nil {
+		return false
+	}
+	for len(it.data) == 0 {
+		if it.block == len(it.t.index) {
+			return false
+		}
+		it.data, it.fail = it.t.readBlock(it.t.index[it.block])
+		if it.fail != nil {
+			return false
+		}
+		it.block++
+	}
+	e, n, err := decodeEntry(it.data)
+	if err != nil {
+		it.fail = fmt.Errorf("%w: sstable %s", err, it.t.path)
+		return false
+	}
+	it.cur, it.data = e, it.data[n:]
+	return true
+}
+
+func (it *sstableIterator) entry() entry { return it.cur }
+
+func (it *sstableIterator) err() error { return it.fail }
@@ -0,0 +1,144 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A log file holds the writes of one memtable, each in a record:
+//
+//	checksum (4 bytes) | payload length (4 bytes) | op (1 byte) | key (varint) | value
+//
+// The checksum is the CRC-32 of the payload. A record cut short by a crash ends the log;
+// see replayWAL.
+
+// The operations of log records.
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+const walHeaderSize = 8
+
+// wal is the log file the writes to the active memtable are appended to.
+type wal struct {
+	f    *os.File
+	path string
+	num  uint64
+	sync bool
+	buf  []byte
+}
+
+// createWAL creates an empty log file numbered num at path.
+func createWAL(path string, num uint64, sync bool) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log: %w", err)
+	}
+	return &wal{f: f, path: path, num: num, sync: sync}, nil
+}
+
+// append writes a record to the log, and syncs it if the log syncs writes.
+func (w *wal) append(op byte, key int, value string) error {
+	payload := w.buf[:0]
+	payload = append(payload, make([]byte, walHeaderSize)...)
+	payload = append(payload, op)
+	payload = binary.AppendVarint(payload, int64(key))
+	payload = append(payload, value...)
+	binary.LittleEndian.PutUint32(payload[0:4], crc32.ChecksumIEEE(payload[walHeaderSize:]))
+	binary.LittleEndian.PutUint32(payload[4:8], uint32(len(payload)-walHeaderSize))
+	w.buf = payload
+
+	if _, err := w.f.Write(payload); err != nil {
+		return fmt.Errorf("failed to write log: %w", err)
+	}
+	if w.sync {
+		if err := w.f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log: %w", err)
+		}
+	}
+	return nil
+}
+
+// close syncs and closes the log, whose memtable takes no more writes.
+func (w *wal) close() error {
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("failed to sync log: %w", err)
+	}
+	return w.f.Close()
+}
+
+// replayWAL calls apply with every record of the log file at path, in order.
+//
+// A crash can only damage the last record of the newest log written to: one extending
+// past the end of the file, or failing its checksum with nothing but zeros after it, is
+// taken for a torn write and truncated away if tail is set. Any other damaged record is
+// reported as ErrCorrupt rather than dropped with the acknowledged writes after it.
+func replayWAL(path string, tail bool, apply func(op byte, key int, value string)) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read log %s: %w", path, err)
+	}
+
+	off := 0
+	for off < len(data) {
+		if len(data)-off < walHeaderSize {
+			break
+		}
+		sum := binary.LittleEndian.Uint32(data[off:])
+		n := int(binary.LittleEndian.Uint32(data[off+4:]))
+		if n > len(data)-off-walHeaderSize {
+			break
+		}
+		payload := data[off+walHeaderSize : off+walHeaderSize+n]
+		if n < 2 || crc32.ChecksumIEEE(payload) != sum {
+			if off+walHeaderSize+n == len(data) || zeros(data[off:]) {
+				break
+			}
+			return fmt.Errorf("%w: log %s at offset %d fails its checksum", ErrCorrupt, path, off)
+		}
+		key, k := binary.Varint(payload[1:])
+		if k <= 0 {
+			return fmt.Errorf("%w: log %s at offset %d", ErrCorrupt, path, off)
+		}
+		switch op := payload[0]; op {
+		case opPut, opDelete:
+			apply(op, int(key), string(payload[1+k:]))
+		default:
+			return fmt.Errorf("%w: log %s at offset %d has operation %d", ErrCorrupt, path, off, op)
+		}
+		off += walHeaderSize + n
+	}
+
+	if off < len(data) {
+		if !tail {
+			return fmt.Errorf("%w: log %s is torn at offset %d, but newer logs hold writes", ErrCorrupt, path, off)
+		}
+		if err := f.Truncate(int64(off)); err != nil {
+			return fmt.Errorf("failed to truncate torn log %s: %w", path, err)
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// zeros reports whether every byte of data is zero.
+func zeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
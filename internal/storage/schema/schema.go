@@ -0,0 +1,485 @@
+// Package schema describes the typed columns of a table and encodes its rows.
+//
+// A table with a schema is still a B-Tree from int keys to values: its primary key,
+// which must be an INT column, is the key, and the other columns of a row are encoded
+// together as a tuple in the value.
+//
+// Rows are not rewritten when columns change. A column added to a table reads as its
+// default in the rows written before, and a dropped column keeps its slot in the tuple,
+// so existing rows still decode; see Compatible.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type is the type of a column. Its value is persisted in the catalog through the
+// column definitions, by name.
+type Type uint8
+
+const (
+	// Int is a signed 64-bit integer.
+	Int Type = iota + 1
+	// Text is a UTF-8 string.
+	Text
+	// Bool is true or false.
+	Bool
+)
+
+// ParseType returns the type with the given name, accepting the usual SQL synonyms.
+// A length, as in VARCHAR(255), is ignored.
+func ParseType(name string) (Type, error) {
+	base, _, _ := strings.Cut(strings.TrimSpace(name), "(")
+	switch strings.ToUpper(strings.TrimSpace(base)) {
+	case "INT", "INTEGER", "BIGINT", "SMALLINT", "TINYINT":
+		return Int, nil
+	case "TEXT", "VARCHAR", "CHAR", "STRING":
+		return Text, nil
+	case "BOOL", "BOOLEAN":
+		return Bool, nil
+	default:
+		return 0, fmt.Errorf("schema: unknown column type %q", name)
+	}
+}
+
+// String returns the canonical name of the type.
+func (t Type) String() string {
+	switch t {
+	case Int:
+		return "INT"
+	case Text:
+		return "TEXT"
+	case Bool:
+		return "BOOL"
+	default:
+		return fmt.Sprintf("Type(%d)", uint8(t))
+	}
+}
+
+// Column is a column of a table.
+type Column struct {
+	Name       string
+	Type       Type
+	PrimaryKey bool // The column holds the row's key; it is never NULL.
+	NotNull    bool // The column cannot be NULL.
+	Default    any  // Value of the column when none is given, of the column's type; nil for NULL.
+}
+
+// String returns the definition of the column, as in CREATE TABLE.
+func (c Column) String() string {
+	def := c.Name + " " + c.Type.String()
+	if c.PrimaryKey {
+		return def + " PRIMARY KEY"
+	}
+	if c.NotNull {
+		def += " NOT NULL"
+	}
+	if c.Default != nil {
+		def += " DEFAULT " + literal(c.Default)
+	}
+	return def
+}
+
+// literal returns the SQL literal of a value.
+func literal(v any) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	default:
+		return "NULL"
+	}
+}
+
+// checkValue returns an error unless v can be stored in column c.
+func (c Column) checkValue(v any) error {
+	if v == nil {
+		if c.NotNull {
+			return fmt.Errorf("schema: column %s cannot be NULL", c.Name)
+		}
+		return nil
+	}
+	ok := false
+	switch c.Type {
+	case Int:
+		_, ok = v.(int64)
+	case Text:
+		_, ok = v.(string)
+	case Bool:
+		_, ok = v.(bool)
+	}
+	if !ok {
+		return fmt.Errorf("schema: column %s is %s, got %T", c.Name, c.Type, v)
+	}
+	return nil
+}
+
+// Schema is the ordered list of columns of a table. It is immutable once created.
+//
+// Besides its columns, a schema keeps the slots of the columns dropped from the table,
+// which rows written before the drop still hold a value for.
+type Schema struct {
+	slots   []Column // Slots of the stored rows, in order, including dropped columns.
+	dropped []bool   // Whether each slot is a dropped column.
+	columns []int    // Slot of each column, in order.
+	key     int      // Slot of the primary key.
+}
+
+// New returns the schema with the given columns. Exactly one of them must be the
+// primary key, of type INT, and column names must be unique regardless of case.
+func New(columns []Column) (*Schema, error) {
+	return newSchema(columns, make([]bool, len(columns)))
+}
+
+// newSchema returns the schema with the given slots, of which the dropped ones are not
+// columns any more.
+func newSchema(slots []Column, dropped []bool) (*Schema, error) {
+	s := &Schema{slots: make([]Column, len(slots)), dropped: dropped, key: -1}
+	seen := make(map[string]bool)
+	for i, c := range slots {
+		if !isIdentifier(c.Name) {
+			return nil, fmt.Errorf("schema: invalid column name %q", c.Name)
+		}
+		if c.Type < Int || c.Type > Bool {
+			return nil, fmt.Errorf("schema: column %s has an invalid type", c.Name)
+		}
+		if c.PrimaryKey {
+			if dropped[i] {
+				return nil, fmt.Errorf("schema: primary key %s cannot be dropped", c.Name)
+			}
+			if s.key >= 0 {
+				return nil, fmt.Errorf("schema: columns %s and %s are both a primary key", s.slots[s.key].Name, c.Name)
+			}
+			if c.Type != Int {
+				return nil, fmt.Errorf("schema: primary key %s must be an INT, not %s", c.Name, c.Type)
+			}
+			if c.Default != nil {
+				return nil, fmt.Errorf("schema: primary key %s cannot have a default", c.Name)
+			}
+			s.key = i
+			c.NotNull = true
+		}
+		if c.Default != nil {
+			if err := c.checkValue(c.Default); err != nil {
+				return nil, fmt.Errorf("schema: invalid default for column %s: %w", c.Name, err)
+			}
+		}
+		s.slots[i] = c
+		if dropped[i] {
+			continue
+		}
+		if seen[strings.ToLower(c.Name)] {
+			return nil, fmt.Errorf("schema: duplicate column %s", c.Name)
+		}
+		seen[strings.ToLower(c.Name)] = true
+		s.columns = append(s.columns, i)
+	}
+	if s.key < 0 {
+		return nil, errors.New("schema: a table needs an INT PRIMARY KEY column")
+	}
+	return s, nil
+}
+
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		letter := r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the column definitions of the schema, as written in CREATE TABLE.
+func (s *Schema) String() string {
+	defs := make([]string, len(s.columns))
+	for i, slot := range s.columns {
+		defs[i] = s.slots[slot].String()
+	}
+	return strings.Join(defs, ", ")
+}
+
+// Definition returns the definitions of every slot of the schema, with the dropped
+// columns marked DROPPED, which Parse reads back. It is what the catalog stores.
+func (s *Schema) Definition() string {
+	defs := make([]string, len(s.slots))
+	for i, c := range s.slots {
+		defs[i] = c.String()
+		if s.dropped[i] {
+			defs[i] += " DROPPED"
+		}
+	}
+	return strings.Join(defs, ", ")
+}
+
+// Columns returns the columns of the schema in order.
+func (s *Schema) Columns() []Column {
+	columns := make([]Column, len(s.columns))
+	for i, slot := range s.columns {
+		columns[i] = s.slots[slot]
+	}
+	return columns
+}
+
+// Names returns the names of the columns in order.
+func (s *Schema) Names() []string {
+	names := make([]string, len(s.columns))
+	for i, slot := range s.columns {
+		names[i] = s.slots[slot].Name
+	}
+	return names
+}
+
+// Index returns the position of the column with the given name, regardless of case,
+// or -1 if there is none.
+func (s *Schema) Index(name string) int {
+	for i, slot := range s.columns {
+		if strings.EqualFold(s.slots[slot].Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Key returns the position of the primary key column.
+func (s *Schema) Key() int {
+	for i, slot := range s.columns {
+		if slot == s.key {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddColumn returns the schema with c added after the other columns. Rows written
+// before read c as its default, so a NOT NULL column needs one.
+func (s *Schema) AddColumn(c Column) (*Schema, error) {
+	if c.PrimaryKey {
+		return nil, fmt.Errorf("schema: cannot add primary key %s to a table", c.Name)
+	}
+	if c.NotNull && c.Default == nil {
+		return nil, fmt.Errorf("schema: column %s is NOT NULL and needs a default for existing rows", c.Name)
+	}
+	return newSchema(append(append([]Column(nil), s.slots...), c), append(append([]bool(nil), s.dropped...), false))
+}
+
+// DropColumn returns the schema without the column with the given name. Its slot stays
+// in the rows, which are not rewritten.
+func (s *Schema) DropColumn(name string) (*Schema, error) {
+	i := s.Index(name)
+	if i < 0 {
+		return nil, fmt.Errorf("schema: unknown column %s", name)
+	}
+	if s.columns[i] == s.key {
+		return nil, fmt.Errorf("schema: cannot drop primary key %s", s.slots[s.key].Name)
+	}
+	dropped := append([]bool(nil), s.dropped...)
+	dropped[s.columns[i]] = true
+	return newSchema(append([]Column(nil), s.slots...), dropped)
+}
+
+// Compatible returns an error unless rows written under s read correctly under next:
+// next must keep every slot of s, in order and of the same type, keep dropped slots
+// dropped and the primary key as it is, and may only add columns after them.
+func (s *Schema) Compatible(next *Schema) error {
+	if len(next.slots) < len(s.slots) || next.key != s.key {
+		return errors.New("schema: columns can only be added or dropped")
+	}
+	for i, c := range s.slots {
+		if n := next.slots[i]; !strings.EqualFold(n.Name, c.Name) || n.Type != c.Type {
+			return fmt.Errorf("schema: column %s cannot change to %s", c, n)
+		}
+		if s.dropped[i] && !next.dropped[i] {
+			return fmt.Errorf("schema: dropped column %s cannot come back", c.Name)
+		}
+	}
+	return nil
+}
+
+// Parse returns the schema given by comma-separated column definitions, as written in
+// CREATE TABLE: a name, a type, and optionally PRIMARY KEY, NOT NULL, NULL and DEFAULT
+// followed by a literal. Definitions read from Definition may also be marked DROPPED.
+func Parse(definitions string) (*Schema, error) {
+	defs, err := splitDefinitions(definitions)
+	if err != nil {
+		return nil, err
+	}
+	var columns []Column
+	var dropped []bool
+	for _, def := range defs {
+		c, drop, err := parseColumn(def)
+		if err != nil {
+			return nil, err
+		}
+		columns, dropped = append(columns, c), append(dropped, drop)
+	}
+	return newSchema(columns, dropped)
+}
+
+// splitDefinitions splits column definitions at the commas outside parentheses and
+// string literals.
+func splitDefinitions(definitions string) ([]string, error) {
+	var defs []string
+	depth, start, quoted := 0, 0, false
+	for i, r := range definitions {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			defs = append(defs, definitions[start:i])
+			start = i + 1
+		}
+	}
+	if quoted || depth != 0 {
+		return nil, fmt.Errorf("schema: unbalanced quotes or parentheses in %q", definitions)
+	}
+	if rest := definitions[start:]; strings.TrimSpace(rest) != "" || len(defs) > 0 {
+		defs = append(defs, rest)
+	}
+	return defs, nil
+}
+
+// ParseColumn parses a single column definition, as in ALTER TABLE ... ADD COLUMN.
+func ParseColumn(def string) (Column, error) {
+	c, dropped, err := parseColumn(def)
+	if err == nil && dropped {
+		err = fmt.Errorf("schema: unsupported constraint DROPPED on column %s", c.Name)
+	}
+	return c, err
+}
+
+// parseColumn parses a column definition and reports whether it is marked DROPPED.
+func parseColumn(def string) (Column, bool, error) {
+	tokens, err := tokenize(def)
+	if err != nil {
+		return Column{}, false, err
+	}
+	if len(tokens) < 2 {
+		return Column{}, false, fmt.Errorf("schema: invalid column definition %q", strings.TrimSpace(def))
+	}
+	typ, err := ParseType(tokens[1])
+	if err != nil {
+		return Column{}, false, err
+	}
+	c := Column{Name: strings.Trim(tokens[0], "`"), Type: typ}
+
+	dropped := false
+	rest := tokens[2:]
+	keyword := func(words ...string) bool {
+		if len(rest) < len(words) {
+			return false
+		}
+		for i, w := range words {
+			if !strings.EqualFold(rest[i], w) {
+				return false
+			}
+		}
+		rest = rest[len(words):]
+		return true
+	}
+	for len(rest) > 0 {
+		switch {
+		case keyword("PRIMARY", "KEY"):
+			c.PrimaryKey = true
+		case keyword("NOT", "NULL"):
+			c.NotNull = true
+		case keyword("NULL"):
+		case keyword("DROPPED"):
+			dropped = true
+		case keyword("DEFAULT"):
+			if len(rest) == 0 {
+				return Column{}, false, fmt.Errorf("schema: missing default for column %s", c.Name)
+			}
+			if c.Default, err = parseLiteral(rest[0], c.Type); err != nil {
+				return Column{}, false, fmt.Errorf("schema: invalid default for column %s: %w", c.Name, err)
+			}
+			rest = rest[1:]
+		default:
+			return Column{}, false, fmt.Errorf("schema: unsupported constraint %q on column %s", strings.Join(rest, " "), c.Name)
+		}
+	}
+	return c, dropped, nil
+}
+
+// tokenize splits a column definition into words, keeping string literals, with their
+// quotes, and a type's parenthesized length as single tokens.
+func tokenize(def string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(def); {
+		switch c := def[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			j := i + 1
+			for ; j < len(def); j++ {
+				if def[j] == '\'' {
+					if j+1 < len(def) && def[j+1] == '\'' {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(def) {
+				return nil, fmt.Errorf("schema: unterminated string in %q", def)
+			}
+			tokens = append(tokens, def[i:j+1])
+			i = j + 1
+		case c == '(' && len(tokens) > 0:
+			j := strings.IndexByte(def[i:], ')')
+			if j < 0 {
+				return nil, fmt.Errorf("schema: unbalanced parentheses in %q", def)
+			}
+			tokens[len(tokens)-1] += def[i : i+j+1]
+			i += j + 1
+		default:
+			j := i
+			for j < len(def) && !strings.ContainsRune(" \t\n\r'(", rune(def[j])) {
+				j++
+			}
+			tokens = append(tokens, def[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseLiteral returns the value of an SQL literal for a column of type t.
+func parseLiteral(token string, t Type) (any, error) {
+	if strings.EqualFold(token, "NULL") {
+		return nil, nil
+	}
+	switch t {
+	case Int:
+		return strconv.ParseInt(token, 10, 64)
+	case Bool:
+		switch strings.ToUpper(token) {
+		case "TRUE", "1":
+			return true, nil
+		case "FALSE", "0":
+			return false, nil
+		}
+	case Text:
+		if len(token) >= 2 && token[0] == '\'' && token[len(token)-1] == '\'' {
+			return strings.ReplaceAll(token[1:len(token)-1], "''", "'"), nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a %s literal", token, t)
+}
@@ -0,0 +1,149 @@
+package schema_test
+
+import (
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	s, err := schema.Parse("id INT PRIMARY KEY, name VARCHAR(64) NOT NULL, age integer, active BOOLEAN")
+	require.NoError(t, err)
+	assert.Equal(t, "id INT PRIMARY KEY, name TEXT NOT NULL, age INT, active BOOL", s.String())
+	assert.Equal(t, []string{"id", "name", "age", "active"}, s.Names())
+	assert.Equal(t, 0, s.Key())
+	assert.Equal(t, 2, s.Index("AGE"))
+	assert.Equal(t, -1, s.Index("email"))
+
+	again, err := schema.Parse(s.String())
+	require.NoError(t, err)
+	assert.Equal(t, s.Columns(), again.Columns())
+
+	for _, definitions := range []string{
+		"",
+		"name TEXT",
+		"id TEXT PRIMARY KEY",
+		"id INT PRIMARY KEY, other INT PRIMARY KEY",
+		"id INT PRIMARY KEY, ID INT",
+		"id INT PRIMARY KEY, price DECIMAL",
+		"id INT PRIMARY KEY, name TEXT UNIQUE",
+		"id INT PRIMARY KEY, 1st INT",
+	} {
+		_, err := schema.Parse(definitions)
+		assert.Error(t, err, definitions)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	s, err := schema.Parse("name TEXT, id INT PRIMARY KEY, age INT, active BOOL NOT NULL")
+	require.NoError(t, err)
+
+	for _, row := range []schema.Row{
+		{"alice", int64(1), int64(30), true},
+		{nil, int64(-2), nil, false},
+		{"", int64(3), int64(-1 << 62), true},
+	} {
+		tuple, err := s.Encode(row)
+		require.NoError(t, err)
+		decoded, err := s.Decode(int(row[1].(int64)), tuple)
+		require.NoError(t, err)
+		assert.Equal(t, row, decoded)
+	}
+
+	_, err = s.Encode(schema.Row{"alice", int64(1), "thirty", true})
+	assert.ErrorContains(t, err, "column age is INT")
+	_, err = s.Encode(schema.Row{"alice", int64(1), int64(30), nil})
+	assert.ErrorContains(t, err, "column active cannot be NULL")
+	_, err = s.Encode(schema.Row{"alice", int64(1)})
+	assert.Error(t, err)
+
+	_, err = s.Decode(1, "\x03\x00\x05ab")
+	assert.ErrorIs(t, err, schema.ErrCorruptTuple)
+}
+
+func TestDecodeRowWithFewerColumns(t *testing.T) {
+	old, err := schema.Parse("id INT PRIMARY KEY, name TEXT")
+	require.NoError(t, err)
+	tuple, err := old.Encode(schema.Row{int64(7), "bob"})
+	require.NoError(t, err)
+
+	// Columns added after the row was written read as NULL.
+	s, err := schema.Parse("id INT PRIMARY KEY, name TEXT, age INT")
+	require.NoError(t, err)
+	row, err := s.Decode(7, tuple)
+	require.NoError(t, err)
+	assert.Equal(t, schema.Row{int64(7), "bob", nil}, row)
+}
+
+func TestAddAndDropColumns(t *testing.T) {
+	s, err := schema.Parse("id INT PRIMARY KEY, name TEXT, age INT")
+	require.NoError(t, err)
+	tuple, err := s.Encode(schema.Row{int64(7), "bob", int64(40)})
+	require.NoError(t, err)
+
+	_, err = s.AddColumn(schema.Column{Name: "active", Type: schema.Bool, NotNull: true})
+	assert.ErrorContains(t, err, "needs a default")
+	_, err = s.AddColumn(schema.Column{Name: "AGE", Type: schema.Int})
+	assert.ErrorContains(t, err, "duplicate column")
+	_, err = s.DropColumn("id")
+	assert.ErrorContains(t, err, "cannot drop primary key")
+	_, err = s.DropColumn("email")
+	assert.ErrorContains(t, err, "unknown column")
+
+	added, err := s.AddColumn(schema.Column{Name: "note", Type: schema.Text, Default: "it's new"})
+	require.NoError(t, err)
+	altered, err := added.DropColumn("age")
+	require.NoError(t, err)
+	require.NoError(t, s.Compatible(altered))
+	assert.Error(t, altered.Compatible(s))
+	assert.Equal(t, "id INT PRIMARY KEY, name TEXT, note TEXT DEFAULT 'it''s new'", altered.String())
+	assert.Equal(t, []string{"id", "name", "note"}, altered.Names())
+
+	// Old rows read the added column as its default and skip the dropped one.
+	row, err := altered.Decode(7, tuple)
+	require.NoError(t, err)
+	assert.Equal(t, schema.Row{int64(7), "bob", "it's new"}, row)
+
+	// The dropped column keeps its slot, so it can be added again as a new column.
+	again, err := schema.Parse(altered.Definition())
+	require.NoError(t, err)
+	assert.Equal(t, altered.Definition(), again.Definition())
+	readded, err := again.AddColumn(schema.Column{Name: "age", Type: schema.Text})
+	require.NoError(t, err)
+	require.NoError(t, altered.Compatible(readded))
+	row, err = readded.Decode(7, tuple)
+	require.NoError(t, err)
+	assert.Equal(t, schema.Row{int64(7), "bob", "it's new", nil}, row)
+
+	tuple, err = readded.Encode(schema.Row{int64(8), "eve", "hi", "young"})
+	require.NoError(t, err)
+	row, err = readded.Decode(8, tuple)
+	require.NoError(t, err)
+	assert.Equal(t, schema.Row{int64(8), "eve", "hi", "young"}, row)
+
+	changed, err := schema.Parse("id INT PRIMARY KEY, name INT, age INT")
+	require.NoError(t, err)
+	assert.Error(t, s.Compatible(changed), "a column changing type")
+}
+
+func TestParseDefaults(t *testing.T) {
+	s, err := schema.Parse("id INT PRIMARY KEY, n INT NOT NULL DEFAULT -3, t TEXT DEFAULT 'a, (b)', b BOOL DEFAULT false, x INT DEFAULT NULL")
+	require.NoError(t, err)
+	columns := s.Columns()
+	assert.Equal(t, int64(-3), columns[1].Default)
+	assert.Equal(t, "a, (b)", columns[2].Default)
+	assert.Equal(t, false, columns[3].Default)
+	assert.Nil(t, columns[4].Default)
+
+	for _, definitions := range []string{
+		"id INT PRIMARY KEY DEFAULT 1",
+		"id INT PRIMARY KEY, n INT DEFAULT 'one'",
+		"id INT PRIMARY KEY, t TEXT DEFAULT 'open",
+		"id INT PRIMARY KEY, b BOOL DEFAULT",
+	} {
+		_, err := schema.Parse(definitions)
+		assert.Error(t, err, definitions)
+	}
+}
@@ -0,0 +1,145 @@
+package schema
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Row holds the values of a row, one per column in schema order: an int64 for INT, a
+// string for TEXT, a bool for BOOL, or nil for NULL.
+type Row []any
+
+// ErrCorruptTuple is returned when a stored row cannot be decoded.
+var ErrCorruptTuple = errors.New("schema: corrupt tuple")
+
+// A row is stored as a tuple of the slots of its schema other than the primary key, in
+// order, including the slots of dropped columns, which hold NULL in new rows:
+//
+//	count uvarint | null bitmap [(count+7)/8]byte | values
+//
+// Bit i of the bitmap, least significant first, is set when the i-th value is NULL;
+// NULL values take no further space. An INT is a varint, a TEXT a uvarint length and
+// its bytes, and a BOOL a single byte. Columns past the count, added to the table
+// after the row was written, read as their default.
+
+// Check returns an error unless row has a value of the right type for every column,
+// and no NULL in a column that does not allow it.
+func (s *Schema) Check(row Row) error {
+	if len(row) != len(s.columns) {
+		return fmt.Errorf("schema: expected %d values, got %d", len(s.columns), len(row))
+	}
+	for i, slot := range s.columns {
+		if err := s.slots[slot].checkValue(row[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode checks a row and returns the tuple stored as its value. The primary key is
+// stored as the row's key instead.
+func (s *Schema) Encode(row Row) (string, error) {
+	if err := s.Check(row); err != nil {
+		return "", err
+	}
+
+	values := make(Row, len(s.slots))
+	for i, slot := range s.columns {
+		values[slot] = row[i]
+	}
+	values = append(values[:s.key], values[s.key+1:]...)
+
+	buf := binary.AppendUvarint(nil, uint64(len(values)))
+	nulls := len(buf)
+	buf = append(buf, make([]byte, (len(values)+7)/8)...)
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+			buf[nulls+i/8] |= 1 << (i % 8)
+		case int64:
+			buf = binary.AppendVarint(buf, v)
+		case string:
+			buf = binary.AppendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		case bool:
+			b := byte(0)
+			if v {
+				b = 1
+			}
+			buf = append(buf, b)
+		}
+	}
+	return string(buf), nil
+}
+
+// Decode returns the row stored under key as tuple.
+func (s *Schema) Decode(key int, tuple string) (Row, error) {
+	data := []byte(tuple)
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) || count >= uint64(len(s.slots)) {
+		return nil, ErrCorruptTuple
+	}
+	data = data[n:]
+	size := (int(count) + 7) / 8
+	if len(data) < size {
+		return nil, ErrCorruptTuple
+	}
+	nulls, data := data[:size], data[size:]
+
+	values := make(Row, len(s.slots))
+	values[s.key] = int64(key)
+	i := 0
+	for slot, c := range s.slots {
+		if slot == s.key {
+			continue
+		}
+		if i >= int(count) {
+			values[slot] = c.Default
+			continue
+		}
+		null := nulls[i/8]&(1<<(i%8)) != 0
+		i++
+		if null {
+			continue
+		}
+		switch c.Type {
+		case Int:
+			v, n := binary.Varint(data)
+			if n <= 0 {
+				return nil, ErrCorruptTuple
+			}
+			values[slot], data = v, data[n:]
+		case Text:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, ErrCorruptTuple
+			}
+			values[slot], data = string(data[n:n+int(length)]), data[n+int(length):]
+		case Bool:
+			if len(data) == 0 {
+				return nil, ErrCorruptTuple
+			}
+			values[slot], data = data[0] != 0, data[1:]
+		}
+	}
+	if len(data) != 0 {
+		return nil, ErrCorruptTuple
+	}
+
+	row := make(Row, len(s.columns))
+	for i, slot := range s.columns {
+		row[i] = values[slot]
+	}
+	return row, nil
+}
+
+// CheckTuple returns an error unless tuple, stored under key, is a row of the schema as
+// Encode returns it: it decodes, and its values suit their columns.
+func (s *Schema) CheckTuple(key int, tuple string) error {
+	row, err := s.Decode(key, tuple)
+	if err != nil {
+		return err
+	}
+	return s.Check(row)
+}
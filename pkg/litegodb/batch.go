@@ -0,0 +1,46 @@
+package litegodb
+
+// WriteBatch collects puts and deletes, possibly over several tables, for DB.Write to
+// apply atomically. When a key is written more than once, its last write wins. The zero
+// value is an empty batch ready to use.
+type WriteBatch struct {
+	ops []BatchOp
+}
+
+// BatchOp is a write of a WriteBatch.
+type BatchOp struct {
+	Op    string `json:"op"` // "put" or "delete".
+	Table string `json:"table"`
+	Key   int    `json:"key"`
+	Value string `json:"value,omitempty"` // Value written by a "put".
+}
+
+// NewWriteBatch returns an empty batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds the insertion or update of a key-value pair to the batch.
+func (b *WriteBatch) Put(table string, key int, value string) {
+	b.ops = append(b.ops, BatchOp{Op: "put", Table: table, Key: key, Value: value})
+}
+
+// Delete adds the removal of a key to the batch.
+func (b *WriteBatch) Delete(table string, key int) {
+	b.ops = append(b.ops, BatchOp{Op: "delete", Table: table, Key: key})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Ops returns the writes of the batch in the order they were added.
+func (b *WriteBatch) Ops() []BatchOp {
+	return b.ops
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
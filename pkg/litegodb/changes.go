@@ -0,0 +1,105 @@
+package litegodb
+
+import "github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+
+// localSubscription delivers the changes of a kvstore subscription as ChangeEvents.
+type localSubscription struct {
+	sub    *kvstore.Subscription
+	events chan ChangeEvent
+}
+
+func newLocalSubscription(sub *kvstore.Subscription) *localSubscription {
+	s := &localSubscription{sub: sub, events: make(chan ChangeEvent)}
+	go func() {
+		defer close(s.events)
+		for entry := range sub.Events() {
+			s.events <- changeEvent(entry)
+		}
+	}()
+	return s
+}
+
+// Events returns the channel the changes are delivered on.
+func (s *localSubscription) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Err returns the error that ended the subscription.
+func (s *localSubscription) Err() error {
+	return s.sub.Err()
+}
+
+// Close ends the subscription. Changes already taken from the store are dropped.
+func (s *localSubscription) Close() error {
+	s.sub.Close()
+	// Unblock the delivery of a change nobody reads any more.
+	go func() {
+		for range s.events {
+		}
+	}()
+	return nil
+}
+
+// changeEvent converts a logged change to the event delivered to subscribers.
+func changeEvent(entry *kvstore.LogEntry) ChangeEvent {
+	event := ChangeEvent{
+		LSN:       entry.LSN,
+		Time:      entry.Time,
+		Operation: entry.Operation,
+		Table:     entry.Table,
+	}
+	switch entry.Operation {
+	case "PUT":
+		value := entry.Value
+		event.Key, event.NewValue = entry.Key, &value
+	case "DELETE":
+		event.Key = entry.Key
+	case "CREATE_TABLE":
+		event.Degree, event.Compression, event.Schema = entry.Key, entry.Value, entry.Schema
+	case "ALTER_TABLE":
+		event.Compression, event.Schema = entry.Value, entry.Schema
+	case "RENAME_TABLE":
+		event.NewName = entry.Value
+	case "COMMIT":
+		event.Changes = make([]ChangeEvent, len(entry.Changes))
+		for i, change := range entry.Changes {
+			event.Changes[i] = changeEvent(change)
+		}
+	}
+	// The entry is shared with other subscribers, so the event gets its own copy.
+	if entry.OldValue != nil {
+		old := *entry.OldValue
+		event.OldValue = &old
+	}
+	return event
+}
+
+// logEntry converts an event back to the logged change it was made from, keeping its LSN
+// and time.
+func logEntry(event ChangeEvent) *kvstore.LogEntry {
+	entry := &kvstore.LogEntry{
+		LSN:       event.LSN,
+		Time:      event.Time,
+		Operation: event.Operation,
+		Table:     event.Table,
+		Key:       event.Key,
+	}
+	switch event.Operation {
+	case "PUT":
+		if event.NewValue != nil {
+			entry.Value = *event.NewValue
+		}
+	case "CREATE_TABLE":
+		entry.Key, entry.Value, entry.Schema = event.Degree, event.Compression, event.Schema
+	case "ALTER_TABLE":
+		entry.Value, entry.Schema = event.Compression, event.Schema
+	case "RENAME_TABLE":
+		entry.Value = event.NewName
+	case "COMMIT":
+		entry.Changes = make([]*kvstore.LogEntry, len(event.Changes))
+		for i, change := range event.Changes {
+			entry.Changes[i] = logEntry(change)
+		}
+	}
+	return entry
+}
@@ -4,9 +4,14 @@ package litegodb
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
 	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
 	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
 	"github.com/spf13/viper"
 )
@@ -14,40 +19,165 @@ import (
 // Config represents the configuration for the database.
 // It includes parameters for the B-Tree degree, file paths, and flush interval.
 type Config struct {
-	Degree     int           `mapstructure:"degree"`      // Degree of the B-Tree.
-	DBFile     string        `mapstructure:"db_file"`     // Path to the database file.
-	LogFile    string        `mapstructure:"log_file"`    // Path to the write-ahead log file.
-	FlushEvery time.Duration `mapstructure:"flush_every"` // Interval for periodic flushes.
-	Server     ServerConfig  `mapstructure:"server"`      // Server configuration.
+	Degree          int               `mapstructure:"degree"`           // Degree of the B-Tree.
+	DBFile          string            `mapstructure:"db_file"`          // Path to the database file.
+	LogFile         string            `mapstructure:"log_file"`         // Directory holding the write-ahead log segments; a single-file log found there is converted.
+	WALSegmentSize  int64             `mapstructure:"wal_segment_size"` // Size in bytes a write-ahead log segment reaches before the next one starts.
+	WALArchiveDir   string            `mapstructure:"wal_archive_dir"`  // Directory closed write-ahead log segments are copied to; empty disables archiving.
+	FlushEvery      time.Duration     `mapstructure:"flush_every"`      // Interval for periodic flushes.
+	SyncWrites      bool              `mapstructure:"sync_writes"`      // Sync the write-ahead log before acknowledging each write.
+	CheckpointEvery time.Duration     `mapstructure:"checkpoint_every"` // Interval between checkpoints; 0 disables periodic checkpoints.
+	CheckpointSize  int64             `mapstructure:"checkpoint_size"`  // Write-ahead log size in bytes that triggers a checkpoint; 0 disables it.
+	LockTimeout     time.Duration     `mapstructure:"lock_timeout"`     // How long to wait for a lock held by a transaction; 0 waits until granted or a deadlock is detected.
+	Server          ServerConfig      `mapstructure:"server"`           // Server configuration.
+	Encryption      EncryptionConfig  `mapstructure:"encryption"`       // Encryption at rest.
+	Compression     CompressionConfig `mapstructure:"compression"`      // Page compression for new tables.
+	Replication     ReplicationConfig `mapstructure:"replication"`      // Following a primary server as a read-only replica.
+
+	// DataDir holds one subdirectory per database, each with its own data file and
+	// write-ahead log, when a server serves several databases; see OpenDatabases. Empty
+	// serves the single database at DBFile and LogFile.
+	DataDir   string                    `mapstructure:"data_dir"`
+	Databases map[string]DatabaseConfig `mapstructure:"databases"` // Per-database settings, by database name.
+}
+
+// DatabaseConfig holds the settings of one database under DataDir.
+type DatabaseConfig struct {
+	// AuthToken gives access to this database only, besides the server's token, which
+	// gives access to all of them.
+	AuthToken string `mapstructure:"auth_token"`
 }
 
 type ServerConfig struct {
 	Port       int    `mapstructure:"port"`
 	EnableCORS bool   `mapstructure:"enable_cors"`
 	AuthToken  string `mapstructure:"auth_token"`
+	BackupDir  string `mapstructure:"backup_dir"` // Directory /admin/backup writes under; empty refuses backups over HTTP.
+}
+
+// EncryptionConfig selects the key used to encrypt pages and log records at rest.
+// The key is read from KeyFile if set, otherwise from the environment variable named by KeyEnv.
+// Encryption is disabled when both are empty.
+type EncryptionConfig struct {
+	KeyFile string `mapstructure:"key_file"`
+	KeyEnv  string `mapstructure:"key_env"`
+}
+
+// CompressionConfig selects the codec ("none", "lz" or "flate") used for the pages of new tables.
+// The choice is stored in the catalog when a table is created, so changing it later does not
+// affect existing tables. Table names in Tables are matched case-insensitively.
+type CompressionConfig struct {
+	Default string            `mapstructure:"default"` // Codec for tables not listed in Tables.
+	Tables  map[string]string `mapstructure:"tables"`  // Per-table codec overrides.
+}
+
+// ReplicationConfig makes the database a replica of the LiteGoDB server at Primary: it
+// streams the primary's changes from the LSN it last applied and logs them under the same
+// LSNs, and rejects writes until it is promoted. A replica starts from an empty database
+// or from a backup of the primary.
+type ReplicationConfig struct {
+	Primary    string        `mapstructure:"primary"`     // Base URL of the primary, such as http://db1:8080; empty for a primary.
+	AuthToken  string        `mapstructure:"auth_token"`  // Token the primary requires, if any.
+	RetryEvery time.Duration `mapstructure:"retry_every"` // Wait before reconnecting to the primary, and between checks of its position.
+	Database   string        `mapstructure:"database"`    // Database of the primary to follow; its default one if empty. Set for each database under DataDir.
+}
+
+// Options customizes how Open builds the storage stack. The zero value gives the default one.
+// The wrappers let tests observe or inject faults into every write the database makes.
+type Options struct {
+	// WrapDiskManager, if set, wraps the disk manager of the database file.
+	WrapDiskManager func(disk.DiskManager) disk.DiskManager
+
+	// WrapLogFile, if set, wraps the file backing each write-ahead log segment.
+	WrapLogFile func(kvstore.LogFile) kvstore.LogFile
 }
 
 // Open initializes and returns a new database instance based on the provided configuration file.
 // It sets up the disk manager, B-Tree key-value store, and periodic flush mechanism.
+// With a data_dir configured, it opens the default database under it.
 func Open(configPath string) (DB, *Config, error) {
+	return OpenWithOptions(configPath, Options{})
+}
+
+// OpenWithOptions is like Open but applies the given options.
+func OpenWithOptions(configPath string, opts Options) (DB, *Config, error) {
 	cfg, err := loadConfig(configPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
-	dm, err := disk.NewFileDiskManager(cfg.DBFile)
+	dbCfg := cfg
+	if cfg.DataDir != "" {
+		if dbCfg, err = cfg.database(DefaultDatabase); err != nil {
+			return nil, nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(dbCfg.DBFile), 0755); err != nil {
+			return nil, nil, fmt.Errorf("failed to create database %s: %w", DefaultDatabase, err)
+		}
+	}
+	db, err := openConfig(dbCfg, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create disk manager: %w", err)
+		return nil, nil, err
+	}
+	return db, cfg, nil
+}
+
+// openConfig opens the database described by cfg.
+func openConfig(cfg *Config, opts Options) (DB, error) {
+	cipher, err := cfg.Encryption.cipher()
+	if err != nil {
+		return nil, err
 	}
 
-	store, err := kvstore.NewBTreeKVStore(cfg.Degree, dm, cfg.LogFile)
+	codecs, err := cfg.Compression.codecs()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create store: %w", err)
+		return nil, err
+	}
+
+	fdm, err := newDiskManager(cfg.DBFile, cipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create disk manager: %w", err)
+	}
+
+	var dm disk.DiskManager = fdm
+	if opts.WrapDiskManager != nil {
+		dm = opts.WrapDiskManager(dm)
+	}
+
+	store, err := kvstore.NewBTreeKVStoreWithOptions(cfg.Degree, dm, cfg.LogFile, kvstore.Options{
+		Cipher:      cipher,
+		SyncWrites:  cfg.SyncWrites,
+		SegmentSize: cfg.WALSegmentSize,
+		ArchiveDir:  cfg.WALArchiveDir,
+		WrapLogFile: opts.WrapLogFile,
+		LockTimeout: cfg.LockTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store: %w", err)
+	}
+
+	// Bring the tables up to date with changes logged after their last flush.
+	if err := store.Load(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to recover store: %w", err)
 	}
 
 	store.StartPeriodicFlush(cfg.FlushEvery)
+	store.StartPeriodicCheckpoint(cfg.CheckpointEvery, cfg.CheckpointSize)
 
-	return &btreeAdapter{kv: store}, cfg, nil
+	db := &btreeAdapter{kv: store, codecs: codecs, cipher: cipher}
+	if cfg.Replication.Primary != "" {
+		db.replica.Store(startReplicator(store, cfg.Replication))
+	}
+	return db, nil
+}
+
+// newDiskManager opens the database file at path, encrypting its pages when c is not nil.
+func newDiskManager(path string, c *encryption.Cipher) (*disk.FileDiskManager, error) {
+	if c != nil {
+		return disk.NewEncryptedFileDiskManager(path, c)
+	}
+	return disk.NewFileDiskManager(path)
 }
 
 // loadConfig reads and parses the configuration file from the specified path.
@@ -60,12 +190,33 @@ func loadConfig(path string) (*Config, error) {
 	viper.SetDefault("degree", 2)
 	viper.SetDefault("db_file", "data.db")
 	viper.SetDefault("log_file", "wal.log")
+	viper.SetDefault("wal_segment_size", kvstore.DefaultSegmentSize)
+	viper.SetDefault("wal_archive_dir", "")
 	viper.SetDefault("flush_every", "10s")
+	viper.SetDefault("sync_writes", true)
+	viper.SetDefault("checkpoint_every", "5m")
+	viper.SetDefault("checkpoint_size", 64<<20)
+	viper.SetDefault("lock_timeout", "5s")
+	viper.SetDefault("data_dir", "")
 
 	// Default Server settings
 	viper.SetDefault("server.port", 8080)
 	viper.SetDefault("server.enable_cors", false)
 	viper.SetDefault("server.auth_token", "")
+	viper.SetDefault("server.backup_dir", "")
+
+	// Default compression settings
+	viper.SetDefault("compression.default", "none")
+
+	// Default encryption settings
+	viper.SetDefault("encryption.key_file", "")
+	viper.SetDefault("encryption.key_env", "")
+
+	// Default replication settings
+	viper.SetDefault("replication.primary", "")
+	viper.SetDefault("replication.auth_token", "")
+	viper.SetDefault("replication.retry_every", "1s")
+	viper.SetDefault("replication.database", "")
 
 	if err := viper.ReadInConfig(); err != nil {
 		fmt.Println("⚠️ Config file not found, using default values")
@@ -78,3 +229,40 @@ func loadConfig(path string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// cipher loads the configured key and returns the cipher built from it,
+// or nil when encryption is disabled.
+func (c EncryptionConfig) cipher() (*encryption.Cipher, error) {
+	key, err := encryption.LoadKey(c.KeyFile, c.KeyEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	if key == nil {
+		return nil, nil
+	}
+	return encryption.NewCipher(key)
+}
+
+// codecs parses the configured codec names and returns a lookup from table name to codec.
+func (c CompressionConfig) codecs() (func(table string) compression.Codec, error) {
+	def, err := compression.ParseCodec(c.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make(map[string]compression.Codec, len(c.Tables))
+	for table, name := range c.Tables {
+		codec, err := compression.ParseCodec(name)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", table, err)
+		}
+		overrides[strings.ToLower(table)] = codec
+	}
+
+	return func(table string) compression.Codec {
+		if codec, ok := overrides[strings.ToLower(table)]; ok {
+			return codec
+		}
+		return def
+	}, nil
+}
@@ -0,0 +1,29 @@
+package litegodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLoadShippedConfig checks that every setting of the config.yaml shipped with the
+// repository reaches Config, rather than being silently replaced by its default.
+func TestLoadShippedConfig(t *testing.T) {
+	cfg, err := loadConfig("../../config.yaml")
+	require.NoError(t, err)
+
+	require.Equal(t, 3, cfg.Degree)
+	require.Equal(t, "data/database.db", cfg.DBFile)
+	require.Equal(t, "data/wal", cfg.LogFile)
+	require.Equal(t, int64(16<<20), cfg.WALSegmentSize)
+	require.Equal(t, 2*time.Second, cfg.FlushEvery)
+	require.True(t, cfg.SyncWrites)
+	require.Equal(t, 5*time.Minute, cfg.CheckpointEvery)
+	require.Equal(t, int64(64<<20), cfg.CheckpointSize)
+	require.Equal(t, 5*time.Second, cfg.LockTimeout)
+	require.Equal(t, 8080, cfg.Server.Port)
+	require.True(t, cfg.Server.EnableCORS)
+	require.Equal(t, "none", cfg.Compression.Default)
+	require.Equal(t, time.Second, cfg.Replication.RetryEvery)
+}
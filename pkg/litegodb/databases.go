@@ -0,0 +1,218 @@
+package litegodb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultDatabase is the database used when none is named. It always exists.
+const DefaultDatabase = "default"
+
+// DatabaseHeader is the HTTP header naming the database a request to a server is for.
+// Without it a request uses the database in its "db" query parameter, or the default one.
+const DatabaseHeader = "X-LiteGoDB-Database"
+
+// ErrDatabaseNotFound is returned when a named database does not exist.
+var ErrDatabaseNotFound = errors.New("litegodb: database does not exist")
+
+// ErrDatabaseExists is returned when creating a database that already exists.
+var ErrDatabaseExists = errors.New("litegodb: database already exists")
+
+// Databases is the set of databases served together, such as by one server. Each is a
+// separate DB with its own tables, data file and write-ahead log, kept in its own
+// subdirectory of the configured data_dir:
+//
+//	<data_dir>/<name>/data.db
+//	<data_dir>/<name>/wal/
+//
+// Database names are case-insensitive identifiers. On a replica, every database follows
+// the database of the same name on the primary.
+type Databases struct {
+	cfg  *Config // Nil when serving a single database opened elsewhere.
+	opts Options
+
+	mu  sync.Mutex
+	dbs map[string]DB
+}
+
+// OpenDatabases opens every database under the data_dir of the configuration file,
+// creating the default one if needed. Without a data_dir, it serves the single database
+// of the configuration as the default one, and no database can be created.
+func OpenDatabases(configPath string) (*Databases, *Config, error) {
+	return OpenDatabasesWithOptions(configPath, Options{})
+}
+
+// OpenDatabasesWithOptions is like OpenDatabases but applies the given options to every
+// database it opens.
+func OpenDatabasesWithOptions(configPath string, opts Options) (*Databases, *Config, error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if cfg.DataDir == "" {
+		db, err := openConfig(cfg, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return SingleDatabase(db), cfg, nil
+	}
+
+	d := &Databases{cfg: cfg, opts: opts, dbs: make(map[string]DB)}
+	if err := d.openAll(); err != nil {
+		d.Close()
+		return nil, nil, err
+	}
+	return d, cfg, nil
+}
+
+// SingleDatabase returns the set holding only db, as the default database.
+func SingleDatabase(db DB) *Databases {
+	return &Databases{dbs: map[string]DB{DefaultDatabase: db}}
+}
+
+// openAll opens the default database and every other one found under the data directory.
+func (d *Databases) openAll() error {
+	if err := os.MkdirAll(d.cfg.DataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	entries, err := os.ReadDir(d.cfg.DataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	names := []string{DefaultDatabase}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != DefaultDatabase && validDatabaseName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	for _, name := range names {
+		if err := d.open(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open opens the database called name under the data directory, creating it if needed.
+// The caller must hold mu, or be the only user of d.
+func (d *Databases) open(name string) error {
+	cfg, err := d.cfg.database(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.DBFile), 0755); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", name, err)
+	}
+	db, err := openConfig(cfg, d.opts)
+	if err != nil {
+		return fmt.Errorf("failed to open database %s: %w", name, err)
+	}
+	d.dbs[name] = db
+	return nil
+}
+
+// Get returns the database called name, or the default one if name is empty.
+func (d *Databases) Get(name string) (DB, error) {
+	name = canonicalDatabaseName(name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseNotFound, name)
+	}
+	return db, nil
+}
+
+// Create creates a database called name and returns it. On a replica, the new database
+// follows the primary's database of the same name.
+func (d *Databases) Create(name string) (DB, error) {
+	name = canonicalDatabaseName(name)
+	if !validDatabaseName(name) {
+		return nil, fmt.Errorf("invalid database name %q", name)
+	}
+	if d.cfg == nil {
+		return nil, fmt.Errorf("creating databases needs a data_dir")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.dbs[name]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseExists, name)
+	}
+	if err := d.open(name); err != nil {
+		return nil, err
+	}
+	return d.dbs[name], nil
+}
+
+// Names returns the names of the databases in alphabetical order.
+func (d *Databases) Names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.dbs))
+	for name := range d.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes every database.
+func (d *Databases) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for name, db := range d.dbs {
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close database %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// database returns the configuration of the database called name under DataDir.
+func (c *Config) database(name string) (*Config, error) {
+	if !validDatabaseName(name) {
+		return nil, fmt.Errorf("invalid database name %q", name)
+	}
+	db := *c
+	dir := filepath.Join(c.DataDir, name)
+	db.DBFile = filepath.Join(dir, "data.db")
+	db.LogFile = filepath.Join(dir, "wal")
+	if c.WALArchiveDir != "" {
+		db.WALArchiveDir = filepath.Join(c.WALArchiveDir, name)
+	}
+	if c.Replication.Primary != "" {
+		db.Replication.Database = name
+	}
+	return &db, nil
+}
+
+// canonicalDatabaseName returns the name database names are compared by.
+func canonicalDatabaseName(name string) string {
+	if name == "" {
+		return DefaultDatabase
+	}
+	return strings.ToLower(name)
+}
+
+// validDatabaseName reports whether name can name a database, and its directory: a
+// lowercase identifier of at most 64 characters.
+func validDatabaseName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i, r := range name {
+		letter := r == '_' || 'a' <= r && r <= 'z'
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
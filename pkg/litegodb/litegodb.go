@@ -2,6 +2,46 @@
 // key-value database using a B-Tree as the underlying storage mechanism.
 package litegodb
 
+import (
+	"errors"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// ErrReadOnly is returned by writes to a replica, which only applies the changes of its primary.
+var ErrReadOnly = errors.New("litegodb: replica is read-only")
+
+// ErrInvalidRow is returned by writes to a table with a schema whose value is not one of
+// its rows, encoded with Schema.Encode.
+var ErrInvalidRow = errors.New("litegodb: value is not a row of the table's schema")
+
+// ErrTxDone is returned when a transaction is used after it was committed or rolled back.
+var ErrTxDone = kvstore.ErrTxDone
+
+// ErrConflict is returned by Tx.Commit when another writer committed one of the keys the
+// transaction writes, or for an optimistic transaction one it read, after it began. Nothing
+// of the transaction is applied; it can be retried, as DB.Update does.
+var ErrConflict = kvstore.ErrConflict
+
+// ErrLockTimeout is returned when a lock is not granted within the configured lock_timeout.
+// The transaction stays open.
+var ErrLockTimeout = kvstore.ErrLockTimeout
+
+// DeadlockError is returned to the transaction aborted to break a deadlock between
+// transactions waiting for each other's locks. The transaction is rolled back.
+type DeadlockError = kvstore.DeadlockError
+
+// LockMode is the mode of a lock taken by a transaction.
+type LockMode = kvstore.LockMode
+
+const (
+	// LockShared lets other transactions read the locked key or table, but not write it.
+	LockShared = kvstore.LockShared
+	// LockExclusive keeps other transactions from locking or writing the key or table.
+	LockExclusive = kvstore.LockExclusive
+)
+
 // DB defines the interface for interacting with the database.
 // It includes methods for basic CRUD operations, table management, and lifecycle management.
 type DB interface {
@@ -21,12 +61,171 @@ type DB interface {
 	// CreateTable creates a new table with the specified degree.
 	CreateTable(table string, degree int) error
 
+	// CreateTableWithSchema creates a table whose rows have the typed columns of s, as
+	// CREATE TABLE does. It fails if the table already exists.
+	CreateTableWithSchema(table string, s *Schema) error
+
+	// Schema returns the schema of a table, or nil if it maps keys to plain string values.
+	Schema(table string) (*Schema, error)
+
 	// DropTable deletes the specified table and all its data.
 	DropTable(table string) error
 
+	// RenameTable gives a table a new name, as ALTER TABLE ... RENAME TO does.
+	RenameTable(table, newName string) error
+
+	// AddColumn adds a column to a table with a schema. Rows already stored are not
+	// rewritten: they read the new column as its Default, which a NOT NULL column needs.
+	AddColumn(table string, column Column) error
+
+	// DropColumn removes a column other than the primary key from a table with a schema.
+	DropColumn(table, column string) error
+
+	// SetCompression changes the codec of the table's pages: "none", "lz" or "flate".
+	// Pages already on disk keep theirs until they are rewritten.
+	SetCompression(table, codec string) error
+
+	// Write applies the puts and deletes of a batch atomically, as a single change: after
+	// a crash either all of them are recovered or none. Tables that do not exist are
+	// created for the batch's puts.
+	Write(batch *WriteBatch) error
+
+	// Begin starts a transaction over any number of keys and tables.
+	Begin() (Tx, error)
+
+	// BeginOptimistic starts an optimistic transaction: on top of the keys it writes, Commit
+	// checks that no key it read was committed by another writer since it began, and fails
+	// with ErrConflict otherwise. Nothing is locked before Commit.
+	BeginOptimistic() (Tx, error)
+
+	// Update runs fn in an optimistic transaction and commits it, running fn again in a
+	// new transaction if the commit conflicts. fn may run several times and must not have
+	// effects outside the transaction. An error returned by fn rolls the transaction back
+	// and is returned as is.
+	Update(fn func(tx Tx) error) error
+
 	// Load reloads the database from disk.
 	Load() error
 
+	// Vacuum compacts the database file, giving back the space left by deletes and dropped tables.
+	Vacuum() (VacuumStats, error)
+
+	// Checkpoint flushes every table and trims the write-ahead log, so recovery only replays
+	// later changes. It returns the LSN of the last change covered by the checkpoint.
+	Checkpoint() (uint64, error)
+
+	// Backup writes a consistent copy of the database file to path, which must not exist,
+	// and returns the LSN of the last change it holds. Together with the write-ahead log
+	// segments archived from then on, it is the base for a point-in-time Restore.
+	Backup(path string) (uint64, error)
+
+	// Subscribe streams the changes made after fromLSN to the given tables, or to every
+	// table if none is given, in LSN order. Storing the LSN of the last change handled and
+	// subscribing from it later resumes the stream, even across restarts, as long as the
+	// write-ahead log still holds the changes in between.
+	Subscribe(fromLSN uint64, tables ...string) (Subscription, error)
+
+	// ReplicationStatus reports whether the database is a primary or a replica and, for a
+	// replica, how far it is behind its primary.
+	ReplicationStatus() (ReplicationStatus, error)
+
+	// Promote turns a replica into a primary: it stops following its primary and accepts
+	// writes, numbering them after the last change it replicated.
+	Promote() error
+
 	// Close closes the database and releases all resources.
 	Close() error
 }
+
+// VacuumStats reports the effect of a Vacuum.
+type VacuumStats struct {
+	PagesBefore int `json:"pages_before"` // Pages in the database file before the vacuum.
+	PagesAfter  int `json:"pages_after"`  // Pages in the database file after the vacuum.
+	PagesMoved  int `json:"pages_moved"`  // Pages rewritten to move live data toward the start of the file.
+}
+
+// Tx is a transaction started with DB.Begin. Its writes are buffered until Commit, which
+// makes them durable together: after a crash either all of them are recovered or none.
+// Reads see the transaction's own writes, and otherwise a snapshot of the database taken
+// by Begin, unaffected by later writes; a transaction that only reads is a consistent
+// view across many Gets. Commit fails with ErrConflict if a key the transaction writes
+// was committed by another writer since it began.
+//
+// Keys or whole tables can also be locked up front, for workflows that must not conflict:
+// locks are held until the transaction ends, reads made under them see the latest
+// committed data, and keys locked exclusively never fail with ErrConflict. Waiting for a
+// lock fails with ErrLockTimeout after the configured lock_timeout; a transaction aborted
+// to break a deadlock fails with a *DeadlockError.
+//
+// A Tx must not be used from several goroutines at once, and must be committed or rolled
+// back so its locks are released and the versions kept for its snapshot can be collected.
+type Tx interface {
+	// Put inserts or updates a key-value pair in the specified table when the transaction
+	// commits. Unlike DB.Put, it does not create the table, which must already exist.
+	Put(table string, key int, value string) error
+
+	// Get retrieves the value associated with the given key in the specified table.
+	Get(table string, key int) (string, bool, error)
+
+	// Delete removes the key-value pair associated with the given key when the transaction commits.
+	Delete(table string, key int) error
+
+	// GetForUpdate locks a key exclusively until the transaction ends, then returns its
+	// latest committed value, like SELECT ... FOR UPDATE.
+	GetForUpdate(table string, key int) (string, bool, error)
+
+	// Lock locks a key in the given mode until the transaction ends.
+	Lock(table string, key int, mode LockMode) error
+
+	// LockTable locks a whole table in the given mode until the transaction ends.
+	LockTable(table string, mode LockMode) error
+
+	// Commit applies the transaction's writes as a single change.
+	Commit() error
+
+	// Rollback discards the transaction's writes.
+	Rollback() error
+}
+
+// ChangeEvent is a change delivered by a Subscription.
+type ChangeEvent struct {
+	LSN       uint64    `json:"lsn"`                 // Log sequence number of the change.
+	Time      time.Time `json:"time"`                // Time the change was logged; zero if unknown.
+	Operation string    `json:"op"`                  // "PUT", "DELETE", "COMMIT", "CREATE_TABLE", "DROP_TABLE", "ALTER_TABLE" or "RENAME_TABLE".
+	Table     string    `json:"table"`               // Table changed.
+	Key       int       `json:"key"`                 // Key written, for "PUT" and "DELETE".
+	OldValue  *string   `json:"old_value,omitempty"` // Value before a "PUT" or "DELETE"; nil if the key had none or it is unknown.
+	NewValue  *string   `json:"new_value,omitempty"` // Value written by a "PUT".
+
+	Degree      int           `json:"degree,omitempty"`      // Degree of the table's tree, for "CREATE_TABLE".
+	Compression string        `json:"compression,omitempty"` // Codec of the table's pages, for "CREATE_TABLE", and for "ALTER_TABLE" if it changed.
+	Schema      string        `json:"schema,omitempty"`      // Column definitions of a table with a schema, for "CREATE_TABLE", and for "ALTER_TABLE" if they changed.
+	NewName     string        `json:"new_name,omitempty"`    // Name the table was given, for "RENAME_TABLE".
+	Changes     []ChangeEvent `json:"changes,omitempty"`     // Puts and deletes of a "COMMIT", which share its LSN and time.
+}
+
+// Subscription is a stream of changes opened with DB.Subscribe.
+type Subscription interface {
+	// Events returns the channel the changes are delivered on. It is closed when the
+	// subscription ends.
+	Events() <-chan ChangeEvent
+
+	// Err returns the error that ended the subscription once Events is closed, or nil
+	// if it was closed.
+	Err() error
+
+	// Close ends the subscription.
+	Close() error
+}
+
+// ReplicationStatus describes the replication role of a database.
+type ReplicationStatus struct {
+	Role       string  `json:"role"`                  // "primary" or "replica".
+	LSN        uint64  `json:"lsn"`                   // LSN of the last change logged; for a replica, the last one applied.
+	Primary    string  `json:"primary,omitempty"`     // URL of the primary a replica follows.
+	PrimaryLSN uint64  `json:"primary_lsn,omitempty"` // LSN of the last change of the primary, as last seen by the replica.
+	Lag        uint64  `json:"lag"`                   // Changes of the primary the replica has not applied yet.
+	LagSeconds float64 `json:"lag_seconds"`           // Time since the replica last had every change of the primary; 0 while it has.
+	Streaming  bool    `json:"streaming"`             // Whether a replica is receiving changes from its primary.
+	Error      string  `json:"error,omitempty"`       // Why a replica is not streaming, if it is not.
+}
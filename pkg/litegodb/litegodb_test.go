@@ -1,8 +1,14 @@
 package litegodb_test
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -33,7 +39,7 @@ flush_every: 1s
 		_ = db.Close()
 		_ = os.Remove(configFile)
 		_ = os.Remove(dbFile)
-		_ = os.Remove(logFile)
+		_ = os.RemoveAll(logFile)
 	}
 
 	return db, teardown
@@ -146,6 +152,342 @@ func TestDropTable(t *testing.T) {
 	assert.False(t, found)
 }
 
+func TestVacuum(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	for key := 0; key < 500; key++ {
+		assert.NoError(t, db.Put("scratch", key, "temporary"))
+	}
+	assert.NoError(t, db.Flush("scratch"))
+	assert.NoError(t, db.Put("users", 1, "rafael"))
+	assert.NoError(t, db.Flush("users"))
+	assert.NoError(t, db.DropTable("scratch"))
+
+	stats, err := db.Vacuum()
+	assert.NoError(t, err)
+	assert.Less(t, stats.PagesAfter, stats.PagesBefore)
+
+	val, found, err := db.Get("users", 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "rafael", val)
+}
+
+func TestCheckpoint(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	for key := 0; key < 10; key++ {
+		assert.NoError(t, db.Put("users", key, "value"))
+	}
+	lsn, err := db.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), lsn, "the CREATE TABLE record and the puts")
+
+	// Nothing new was logged, so the checkpoint stays where it is.
+	again, err := db.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, lsn, again)
+
+	val, found, err := db.Get("users", 3)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "value", val)
+}
+
+func TestBackup(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	for key := 0; key < 10; key++ {
+		assert.NoError(t, db.Put("users", key, "value"))
+	}
+	path := filepath.Join(t.TempDir(), "backup.db")
+	lsn, err := db.Backup(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), lsn, "the CREATE TABLE record and the puts")
+
+	// An existing backup is never overwritten.
+	_, err = db.Backup(path)
+	assert.Error(t, err)
+}
+
+func TestSubscribe(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	sub, err := db.Subscribe(0, "users")
+	assert.NoError(t, err)
+	defer sub.Close()
+
+	assert.NoError(t, db.Put("users", 1, "old"))
+	assert.NoError(t, db.Put("users", 1, "new"))
+	assert.NoError(t, db.Put("others", 1, "skipped"))
+	assert.NoError(t, db.Delete("users", 1))
+
+	var events []litegodb.ChangeEvent
+	for len(events) < 4 {
+		select {
+		case event := <-sub.Events():
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %d events", len(events))
+		}
+	}
+
+	assert.Equal(t, "CREATE_TABLE", events[0].Operation)
+	assert.Equal(t, 3, events[0].Degree)
+	assert.Equal(t, "none", events[0].Compression)
+	assert.Equal(t, "PUT", events[1].Operation)
+	assert.Nil(t, events[1].OldValue)
+	assert.Equal(t, "old", *events[1].NewValue)
+	assert.Equal(t, "old", *events[2].OldValue)
+	assert.Equal(t, "new", *events[2].NewValue)
+	assert.Equal(t, "DELETE", events[3].Operation)
+	assert.Equal(t, "new", *events[3].OldValue)
+	assert.Nil(t, events[3].NewValue)
+	assert.Equal(t, events[1].LSN+1, events[2].LSN)
+}
+
+func TestTransaction(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	assert.NoError(t, db.Put("accounts", 1, "100"))
+	sub, err := db.Subscribe(0, "accounts")
+	assert.NoError(t, err)
+	defer sub.Close()
+
+	// A transaction does not create tables, which would outlive a rollback.
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	assert.ErrorContains(t, tx.Put("transfers", 1, "1->2: 40"), "does not exist")
+	assert.NoError(t, tx.Rollback())
+	assert.ErrorContains(t, db.Delete("transfers", 1), "does not exist")
+	assert.NoError(t, db.CreateTable("transfers", 3))
+
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Put("accounts", 1, "60"))
+	assert.NoError(t, tx.Put("accounts", 2, "40"))
+	assert.NoError(t, tx.Put("transfers", 1, "1->2: 40"))
+
+	value, found, err := tx.Get("accounts", 2)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "40", value)
+	_, found, _ = db.Get("accounts", 2)
+	assert.False(t, found, "uncommitted write visible outside the transaction")
+
+	assert.NoError(t, tx.Commit())
+	assert.ErrorIs(t, tx.Commit(), litegodb.ErrTxDone)
+	value, _, _ = db.Get("transfers", 1)
+	assert.Equal(t, "1->2: 40", value)
+
+	// The commit reaches subscribers as one event, with the changes to their tables.
+	var commit litegodb.ChangeEvent
+	for commit.Operation != "COMMIT" {
+		select {
+		case commit = <-sub.Events():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the commit")
+		}
+	}
+	assert.Len(t, commit.Changes, 2)
+	assert.Equal(t, "100", *commit.Changes[0].OldValue)
+	assert.Equal(t, "60", *commit.Changes[0].NewValue)
+	assert.Equal(t, commit.LSN, commit.Changes[1].LSN)
+
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Delete("accounts", 1))
+	assert.NoError(t, tx.Rollback())
+	value, _, _ = db.Get("accounts", 1)
+	assert.Equal(t, "60", value)
+
+	// A transaction reads from its snapshot, and conflicts with commits made since.
+	tx, err = db.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("accounts", 1, "0"))
+	value, _, _ = tx.Get("accounts", 1)
+	assert.Equal(t, "60", value)
+	assert.NoError(t, tx.Put("accounts", 1, "61"))
+	assert.ErrorIs(t, tx.Commit(), litegodb.ErrConflict)
+	value, _, _ = db.Get("accounts", 1)
+	assert.Equal(t, "0", value)
+}
+
+func TestLocking(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(configFile, []byte(`
+db_file: "`+filepath.Join(dir, "data.db")+`"
+log_file: "`+filepath.Join(dir, "wal")+`"
+lock_timeout: 50ms
+`), 0644))
+	db, cfg, err := litegodb.Open(configFile)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, 50*time.Millisecond, cfg.LockTimeout)
+
+	assert.NoError(t, db.Put("accounts", 1, "100"))
+	first, err := db.Begin()
+	assert.NoError(t, err)
+	value, found, err := first.GetForUpdate("accounts", 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "100", value)
+
+	second, err := db.Begin()
+	assert.NoError(t, err)
+	_, _, err = second.GetForUpdate("accounts", 1)
+	assert.ErrorIs(t, err, litegodb.ErrLockTimeout)
+	assert.ErrorIs(t, second.LockTable("accounts", litegodb.LockShared), litegodb.ErrLockTimeout)
+	assert.ErrorIs(t, db.Put("accounts", 1, "0"), litegodb.ErrLockTimeout)
+
+	// A batch that times out leaves no trace of the tables it created.
+	batch := litegodb.NewWriteBatch()
+	batch.Put("ledger", 1, "-10")
+	batch.Put("accounts", 1, "90")
+	assert.ErrorIs(t, db.Write(batch), litegodb.ErrLockTimeout)
+	assert.ErrorContains(t, db.Delete("ledger", 1), "does not exist")
+
+	assert.NoError(t, first.Put("accounts", 1, "90"))
+	assert.NoError(t, first.Commit())
+	value, _, err = second.GetForUpdate("accounts", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "90", value)
+	assert.NoError(t, second.Rollback())
+}
+
+func TestUpdate(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	assert.NoError(t, db.Put("counters", 1, "0"))
+	increment := func(tx litegodb.Tx) error {
+		value, _, err := tx.Get("counters", 1)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(value)
+		return tx.Put("counters", 1, strconv.Itoa(n+1))
+	}
+
+	// Concurrent increments conflict and are retried until each one counts.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				assert.NoError(t, db.Update(increment))
+			}
+		}()
+	}
+	wg.Wait()
+	value, _, _ := db.Get("counters", 1)
+	assert.Equal(t, "20", value)
+
+	failed := errors.New("failed")
+	err := db.Update(func(tx litegodb.Tx) error {
+		tx.Put("counters", 1, "0")
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	value, _, _ = db.Get("counters", 1)
+	assert.Equal(t, "20", value)
+
+	// An optimistic transaction conflicts on a key it only read.
+	tx, err := db.BeginOptimistic()
+	assert.NoError(t, err)
+	_, _, _ = tx.Get("counters", 1)
+	assert.NoError(t, tx.Put("counters", 2, "copy"))
+	assert.NoError(t, db.Put("counters", 1, "21"))
+	assert.ErrorIs(t, tx.Commit(), litegodb.ErrConflict)
+}
+
+func TestWriteBatch(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	assert.NoError(t, db.Put("users", 3, "carol"))
+
+	batch := litegodb.NewWriteBatch()
+	batch.Put("users", 1, "alice")
+	batch.Put("emails", 1, "alice@example.com")
+	batch.Delete("users", 3)
+	assert.Equal(t, 3, batch.Len())
+	assert.NoError(t, db.Write(batch))
+
+	value, found, err := db.Get("emails", 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "alice@example.com", value)
+	_, found, _ = db.Get("users", 3)
+	assert.False(t, found)
+
+	// A batch deleting from a missing table fails without creating the tables it writes.
+	batch.Reset()
+	batch.Put("profiles", 1, "admin")
+	batch.Delete("missing", 1)
+	assert.Error(t, db.Write(batch))
+	_, found, _ = db.Get("profiles", 1)
+	assert.False(t, found)
+
+	// So does a batch with an operation other than a put or delete.
+	for _, op := range []string{"Put", "del"} {
+		batch.Reset()
+		batch.Put("profiles", 1, "admin")
+		batch.Delete("users", 1)
+		batch.Ops()[1].Op = op
+		assert.ErrorContains(t, db.Write(batch), "unknown batch operation")
+	}
+	_, found, _ = db.Get("profiles", 1)
+	assert.False(t, found)
+}
+
+func TestPutChecksSchema(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	s, err := litegodb.ParseSchema("id INT PRIMARY KEY, name TEXT NOT NULL, age INT")
+	assert.NoError(t, err)
+	assert.NoError(t, db.CreateTableWithSchema("people", s))
+	row, err := s.Encode(litegodb.Row{int64(1), "alice", int64(30)})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("people", 1, row))
+
+	// A raw string is not a row, whichever way it is written.
+	assert.ErrorIs(t, db.Put("people", 2, "bob"), litegodb.ErrInvalidRow)
+	batch := litegodb.NewWriteBatch()
+	batch.Put("other", 1, "plain")
+	batch.Put("people", 2, "bob")
+	assert.ErrorIs(t, db.Write(batch), litegodb.ErrInvalidRow)
+	_, found, _ := db.Get("other", 1)
+	assert.False(t, found, "a rejected batch writes nothing")
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	assert.ErrorIs(t, tx.Put("people", 2, "bob"), litegodb.ErrInvalidRow)
+	assert.NoError(t, tx.Rollback())
+
+	// Nor is a tuple with a NULL in a NOT NULL column, or one with extra bytes.
+	null := litegodb.Row{int64(2), nil, int64(40)}
+	noName, err := litegodb.NewSchema([]litegodb.Column{s.Columns()[0], {Name: "name", Type: litegodb.TypeText}, s.Columns()[2]})
+	assert.NoError(t, err)
+	tuple, err := noName.Encode(null)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, db.Put("people", 2, tuple), litegodb.ErrInvalidRow)
+	assert.ErrorIs(t, db.Put("people", 1, row+"x"), litegodb.ErrInvalidRow)
+
+	value, _, err := db.Get("people", 1)
+	assert.NoError(t, err)
+	got, err := s.Decode(1, value)
+	assert.NoError(t, err)
+	assert.Equal(t, litegodb.Row{int64(1), "alice", int64(30)}, got)
+}
+
 func TestPutAutoCreatesTable(t *testing.T) {
 	db, teardown := setupTestDB(t)
 	defer teardown()
@@ -158,3 +500,131 @@ func TestPutAutoCreatesTable(t *testing.T) {
 	assert.True(t, found)
 	assert.Equal(t, "value", val)
 }
+
+func TestOpenWithEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	dbFile := filepath.Join(dir, "encrypted.db")
+	logFile := filepath.Join(dir, "encrypted.log")
+
+	t.Setenv("LITEGODB_TEST_KEY", strings.Repeat("ab", 32))
+	err := os.WriteFile(configFile, []byte(`
+degree: 2
+db_file: "`+dbFile+`"
+log_file: "`+logFile+`"
+flush_every: 1s
+encryption:
+  key_env: LITEGODB_TEST_KEY
+`), 0644)
+	assert.NoError(t, err)
+
+	db, _, err := litegodb.Open(configFile)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("customers", 1, "top secret"))
+	assert.NoError(t, db.Close())
+
+	segments, err := filepath.Glob(filepath.Join(logFile, "*"))
+	assert.NoError(t, err)
+	for _, file := range append([]string{dbFile}, segments...) {
+		raw, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(raw), "top secret")
+	}
+
+	db, _, err = litegodb.Open(configFile)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Load())
+
+	val, found, err := db.Get("customers", 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "top secret", val)
+}
+
+func TestOpenWithCompression(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+
+	err := os.WriteFile(configFile, []byte(`
+degree: 2
+db_file: "`+filepath.Join(dir, "compressed.db")+`"
+log_file: "`+filepath.Join(dir, "compressed.log")+`"
+flush_every: 1s
+compression:
+  default: none
+  tables:
+    documents: flate
+`), 0644)
+	assert.NoError(t, err)
+
+	db, _, err := litegodb.Open(configFile)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Five of these values only fit in a page when compressed.
+	value := strings.Repeat(`{"status":"active"},`, 60)
+	for key := 1; key <= 5; key++ {
+		assert.NoError(t, db.Put("documents", key, value))
+	}
+
+	val, found, err := db.Get("documents", 5)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, value, val)
+}
+
+func TestDatabases(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(configFile, []byte(`
+degree: 3
+data_dir: "`+filepath.Join(dir, "data")+`"
+`), 0644))
+
+	dbs, cfg, err := litegodb.OpenDatabases(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "data"), cfg.DataDir)
+	assert.Equal(t, []string{litegodb.DefaultDatabase}, dbs.Names())
+
+	analytics, err := dbs.Create("Analytics")
+	assert.NoError(t, err)
+	assert.NoError(t, analytics.Put("events", 1, "click"))
+	_, err = dbs.Create("analytics")
+	assert.ErrorIs(t, err, litegodb.ErrDatabaseExists)
+	_, err = dbs.Create("../escape")
+	assert.Error(t, err)
+	_, err = dbs.Get("missing")
+	assert.ErrorIs(t, err, litegodb.ErrDatabaseNotFound)
+
+	// Each database keeps its own tables, in its own directory.
+	db, err := dbs.Get("")
+	assert.NoError(t, err)
+	_, _, err = db.Get("events", 1)
+	assert.Error(t, err, "the default database has no events table")
+	assert.FileExists(t, filepath.Join(dir, "data", "analytics", "data.db"))
+	assert.NoError(t, dbs.Close())
+
+	// Reopened, the server finds every database again.
+	dbs, _, err = litegodb.OpenDatabases(configFile)
+	assert.NoError(t, err)
+	defer dbs.Close()
+	assert.Equal(t, []string{"analytics", litegodb.DefaultDatabase}, dbs.Names())
+	analytics, err = dbs.Get("ANALYTICS")
+	assert.NoError(t, err)
+	value, _, err := analytics.Get("events", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "click", value)
+}
+
+func TestSingleDatabase(t *testing.T) {
+	db, teardown := setupTestDB(t)
+	defer teardown()
+
+	dbs := litegodb.SingleDatabase(db)
+	got, err := dbs.Get(litegodb.DefaultDatabase)
+	assert.NoError(t, err)
+	assert.Equal(t, db, got)
+	_, err = dbs.Create("analytics")
+	assert.EqualError(t, err, "creating databases needs a data_dir")
+}
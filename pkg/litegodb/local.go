@@ -2,27 +2,60 @@ package litegodb
 
 import (
 	"fmt"
+	"os"
+	"sync/atomic"
 
+	"github.com/rafaelmgr12/litegodb/internal/storage/compression"
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
 	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
 )
 
 // btreeAdapter is an implementation of the DB interface that uses a B-Tree
 // as the underlying storage mechanism.
 type btreeAdapter struct {
-	kv *kvstore.BTreeKVStore
+	kv     *kvstore.BTreeKVStore
+	codecs func(table string) compression.Codec // Codec for newly created tables.
+	cipher *encryption.Cipher                   // Page cipher, also used for backups; nil without encryption.
+
+	replica atomic.Pointer[replicator] // Follows the primary while the database is a replica; nil for a primary.
+}
+
+// readOnly returns ErrReadOnly while the database is a replica.
+func (b *btreeAdapter) readOnly() error {
+	if b.replica.Load() != nil {
+		return ErrReadOnly
+	}
+	return nil
 }
 
 // Put inserts or updates a key-value pair in the specified table.
 // If the table does not exist, it is automatically created.
 func (b *btreeAdapter) Put(table string, key int, value string) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
 	if exists := b.kv.IsTableExists(table); !exists {
-		if err := b.kv.CreateTableName(table, 3); err != nil {
+		if err := b.kv.CreateTableWithCompression(table, 3, b.codecs(table)); err != nil {
 			return fmt.Errorf("failed to create table %s: %w", table, err)
 		}
+	} else if err := b.checkRow(table, key, value); err != nil {
+		return err
 	}
 	return b.kv.Put(table, key, value)
 }
 
+// checkRow returns ErrInvalidRow if table has a schema and value is not one of its rows.
+func (b *btreeAdapter) checkRow(table string, key int, value string) error {
+	s, err := b.kv.TableSchema(table)
+	if err != nil || s == nil {
+		return err
+	}
+	if err := s.CheckTuple(key, value); err != nil {
+		return fmt.Errorf("%w: table %s, key %d: %v", ErrInvalidRow, table, key, err)
+	}
+	return nil
+}
+
 // Get retrieves the value associated with the given key in the specified table.
 func (b *btreeAdapter) Get(table string, key int) (string, bool, error) {
 	return b.kv.Get(table, key)
@@ -30,6 +63,9 @@ func (b *btreeAdapter) Get(table string, key int) (string, bool, error) {
 
 // Delete removes the key-value pair associated with the given key in the specified table.
 func (b *btreeAdapter) Delete(table string, key int) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
 	return b.kv.Delete(table, key)
 }
 
@@ -38,25 +74,278 @@ func (b *btreeAdapter) Flush(table string) error {
 	return b.kv.Flush(table)
 }
 
+// Write applies a batch of writes atomically.
+// Tables that do not exist are created before the batch is applied.
+func (b *btreeAdapter) Write(batch *WriteBatch) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
+	// Check every operation and table before creating any, so an invalid batch changes nothing.
+	created := make(map[string]bool)
+	for _, op := range batch.Ops() {
+		if op.Op != "put" && op.Op != "delete" {
+			return fmt.Errorf("unknown batch operation %q", op.Op)
+		}
+		if op.Op == "put" && !b.kv.IsTableExists(op.Table) {
+			created[op.Table] = true
+		}
+	}
+	for _, op := range batch.Ops() {
+		if op.Op == "delete" && !created[op.Table] && !b.kv.IsTableExists(op.Table) {
+			return fmt.Errorf("table %s does not exist", op.Table)
+		}
+		if op.Op == "put" && !created[op.Table] {
+			if err := b.checkRow(op.Table, op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+	}
+	// Tables are created ahead of the batch, so those created for a batch that fails are
+	// dropped again.
+	var made []string
+	dropMade := func() {
+		for _, table := range made {
+			b.kv.DropTable(table)
+		}
+	}
+	for table := range created {
+		if err := b.kv.CreateTableWithCompression(table, 3, b.codecs(table)); err != nil {
+			dropMade()
+			return fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+		made = append(made, table)
+	}
+
+	writes := make([]*kvstore.LogEntry, 0, batch.Len())
+	for _, op := range batch.Ops() {
+		entry := &kvstore.LogEntry{Operation: "PUT", Table: op.Table, Key: op.Key, Value: op.Value}
+		if op.Op == "delete" {
+			entry = &kvstore.LogEntry{Operation: "DELETE", Table: op.Table, Key: op.Key}
+		}
+		writes = append(writes, entry)
+	}
+	if err := b.kv.WriteBatch(writes); err != nil {
+		dropMade()
+		return err
+	}
+	return nil
+}
+
+// Begin starts a transaction.
+func (b *btreeAdapter) Begin() (Tx, error) {
+	if err := b.readOnly(); err != nil {
+		return nil, err
+	}
+	return &localTx{db: b, tx: b.kv.Begin()}, nil
+}
+
+// BeginOptimistic starts a transaction that also validates its reads on commit.
+func (b *btreeAdapter) BeginOptimistic() (Tx, error) {
+	if err := b.readOnly(); err != nil {
+		return nil, err
+	}
+	return &localTx{db: b, tx: b.kv.BeginOptimistic()}, nil
+}
+
+// Update runs fn in optimistic transactions until one commits.
+func (b *btreeAdapter) Update(fn func(tx Tx) error) error {
+	return update(b.BeginOptimistic, fn)
+}
+
+// localTx is a transaction of a btreeAdapter.
+type localTx struct {
+	db *btreeAdapter
+	tx *kvstore.Tx
+}
+
+// Put buffers a write. The table must exist: creating it here would take effect at once,
+// outside the transaction, and outlive a rollback.
+func (t *localTx) Put(table string, key int, value string) error {
+	if !t.db.kv.IsTableExists(table) {
+		return fmt.Errorf("table %s does not exist", table)
+	}
+	if err := t.db.checkRow(table, key, value); err != nil {
+		return err
+	}
+	return t.tx.Put(table, key, value)
+}
+
+// Get retrieves a value as the transaction sees it.
+func (t *localTx) Get(table string, key int) (string, bool, error) {
+	return t.tx.Get(table, key)
+}
+
+// GetForUpdate locks a key exclusively and returns its latest committed value.
+func (t *localTx) GetForUpdate(table string, key int) (string, bool, error) {
+	return t.tx.GetLocked(table, key, kvstore.LockExclusive)
+}
+
+// Lock locks a key in the given mode until the transaction ends.
+func (t *localTx) Lock(table string, key int, mode LockMode) error {
+	return t.tx.Lock(table, key, mode)
+}
+
+// LockTable locks a whole table in the given mode until the transaction ends.
+func (t *localTx) LockTable(table string, mode LockMode) error {
+	return t.tx.LockTable(table, mode)
+}
+
+// Delete buffers the removal of a key.
+func (t *localTx) Delete(table string, key int) error {
+	return t.tx.Delete(table, key)
+}
+
+// Commit applies the buffered writes together.
+func (t *localTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback discards the buffered writes.
+func (t *localTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
 // Load reloads the database from disk.
 func (b *btreeAdapter) Load() error {
 	return b.kv.Load()
 }
 
+// Vacuum compacts the database file while it keeps serving requests.
+func (b *btreeAdapter) Vacuum() (VacuumStats, error) {
+	stats, err := b.kv.Vacuum()
+	if err != nil {
+		return VacuumStats{}, err
+	}
+	return VacuumStats{
+		PagesBefore: int(stats.PagesBefore),
+		PagesAfter:  int(stats.PagesAfter),
+		PagesMoved:  stats.PagesMoved,
+	}, nil
+}
+
+// Checkpoint flushes every table and trims the write-ahead log.
+func (b *btreeAdapter) Checkpoint() (uint64, error) {
+	return b.kv.Checkpoint()
+}
+
+// Backup writes a consistent copy of the database file to path, encrypted like the original.
+func (b *btreeAdapter) Backup(path string) (uint64, error) {
+	if _, err := os.Stat(path); err == nil {
+		return 0, fmt.Errorf("backup %s already exists", path)
+	}
+
+	dst, err := newDiskManager(path, b.cipher)
+	if err != nil {
+		return 0, err
+	}
+	lsn, err := b.kv.Backup(dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// Subscribe streams the changes logged after fromLSN to the given tables.
+func (b *btreeAdapter) Subscribe(fromLSN uint64, tables ...string) (Subscription, error) {
+	return newLocalSubscription(b.kv.Subscribe(fromLSN, tables...)), nil
+}
+
+// ReplicationStatus reports the role of the database and, for a replica, its lag.
+func (b *btreeAdapter) ReplicationStatus() (ReplicationStatus, error) {
+	if r := b.replica.Load(); r != nil {
+		return r.status(), nil
+	}
+	return ReplicationStatus{Role: "primary", LSN: b.kv.LastLSN()}, nil
+}
+
+// Promote stops following the primary and starts accepting writes.
+func (b *btreeAdapter) Promote() error {
+	r := b.replica.Load()
+	if r == nil {
+		return fmt.Errorf("database is not a replica")
+	}
+	// Stop first, so no replicated change is logged after a local one.
+	r.stop()
+	b.replica.CompareAndSwap(r, nil)
+	return nil
+}
+
 // Close closes the database and releases all resources.
 func (b *btreeAdapter) Close() error {
+	if r := b.replica.Load(); r != nil {
+		r.stop()
+	}
 	return b.kv.Close()
 }
 
 // CreateTable creates a new table with the specified degree.
 func (b *btreeAdapter) CreateTable(table string, degree int) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
 	if _, exists, _ := b.kv.Get(table, 0); exists {
 		return nil
 	}
-	return b.kv.CreateTableName(table, degree)
+	return b.kv.CreateTableWithCompression(table, degree, b.codecs(table))
+}
+
+// CreateTableWithSchema creates a table whose rows have the typed columns of s.
+func (b *btreeAdapter) CreateTableWithSchema(table string, s *Schema) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
+	return b.kv.CreateTableWithSchema(table, 3, b.codecs(table), s)
+}
+
+// Schema returns the schema of a table, or nil for a key-value table.
+func (b *btreeAdapter) Schema(table string) (*Schema, error) {
+	return b.kv.TableSchema(table)
 }
 
 // DropTable deletes the specified table and all its data.
 func (b *btreeAdapter) DropTable(table string) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
 	return b.kv.DropTable(table)
 }
+
+// RenameTable gives a table a new name.
+func (b *btreeAdapter) RenameTable(table, newName string) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
+	return b.kv.RenameTable(table, newName)
+}
+
+// AddColumn adds a column to a table with a schema.
+func (b *btreeAdapter) AddColumn(table string, column Column) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
+	return b.kv.AddColumn(table, column)
+}
+
+// DropColumn removes a column from a table with a schema.
+func (b *btreeAdapter) DropColumn(table, column string) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
+	return b.kv.DropColumn(table, column)
+}
+
+// SetCompression changes the codec of a table's pages.
+func (b *btreeAdapter) SetCompression(table, codec string) error {
+	if err := b.readOnly(); err != nil {
+		return err
+	}
+	c, err := compression.ParseCodec(codec)
+	if err != nil {
+		return err
+	}
+	return b.kv.SetCompression(table, c)
+}
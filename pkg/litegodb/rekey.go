@@ -0,0 +1,73 @@
+package litegodb
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/disk"
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// RekeyOptions lists the files of a database to re-encrypt with a new key. Everything
+// encrypted with the old key must be listed, including the archived log segments and the
+// base backups a point-in-time restore needs, or they can only be read with the old key.
+type RekeyOptions struct {
+	DBFile   string   // Database file.
+	LogFile  string   // Write-ahead log directory, or a single-file log; skipped if it does not exist.
+	WALDirs  []string // Archives of write-ahead log segments, such as wal_archive_dir.
+	Backups  []string // Base backups made with DB.Backup.
+	OldKey   EncryptionConfig
+	NewKey   EncryptionConfig
+	Progress func(path string) // Called after each file or directory is rekeyed; may be nil.
+}
+
+// Rekey re-encrypts the files of a database offline, replacing the old key with the new
+// one. An empty old key reads plaintext files and an empty new key writes them back in
+// plaintext. Each file is replaced only once it is completely rewritten, but files rekeyed
+// before a failure keep the new key, so a failed Rekey is resumed by listing the
+// remaining files only.
+func Rekey(opts RekeyOptions) error {
+	oldCipher, err := opts.OldKey.cipher()
+	if err != nil {
+		return fmt.Errorf("old key: %w", err)
+	}
+	newCipher, err := opts.NewKey.cipher()
+	if err != nil {
+		return fmt.Errorf("new key: %w", err)
+	}
+	done := func(path string) {
+		if opts.Progress != nil {
+			opts.Progress(path)
+		}
+	}
+
+	pages := append([]string{opts.DBFile}, opts.Backups...)
+	for _, path := range pages {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range opts.WALDirs {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range pages {
+		if err := disk.Rekey(path, oldCipher, newCipher); err != nil {
+			return fmt.Errorf("failed to rekey %s: %w", path, err)
+		}
+		done(path)
+	}
+	logs := opts.WALDirs
+	if _, err := os.Stat(opts.LogFile); err == nil {
+		logs = append([]string{opts.LogFile}, logs...)
+	}
+	for _, path := range logs {
+		if err := kvstore.RekeyLog(path, oldCipher, newCipher); err != nil {
+			return fmt.Errorf("failed to rekey %s: %w", path, err)
+		}
+		done(path)
+	}
+	return nil
+}
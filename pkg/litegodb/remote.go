@@ -2,9 +2,13 @@ package litegodb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -17,13 +21,49 @@ type remoteAdapter struct {
 // OpenRemote opens a connection to a remote LiteGoDB server.
 // It returns a DB interface that can be used to interact with the remote database.
 func OpenRemote(baseURL string) (DB, error) {
+	return openRemote(baseURL, "", ""), nil
+}
+
+// OpenRemoteDatabase opens a connection to the database called database on a remote
+// LiteGoDB server serving several, authenticating with token unless it is empty.
+func OpenRemoteDatabase(baseURL, database, token string) (DB, error) {
+	return openRemote(baseURL, token, database), nil
+}
+
+// openRemote returns a client of the server at baseURL that authenticates with token,
+// and uses the database called database, unless they are empty.
+func openRemote(baseURL, token, database string) *remoteAdapter {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
+	header := make(http.Header)
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if database != "" {
+		header.Set(DatabaseHeader, database)
+	}
+	if len(header) > 0 {
+		client.Transport = &headerTransport{header: header, base: http.DefaultTransport}
+	}
 	return &remoteAdapter{
 		baseURL:    baseURL,
 		httpClient: client,
-	}, nil
+	}
+}
+
+// headerTransport adds headers, such as a bearer token, to every request.
+type headerTransport struct {
+	header http.Header
+	base   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
 }
 
 // Put stores a key-value pair in the specified table on the remote LiteGoDB server.
@@ -92,6 +132,21 @@ func (r *remoteAdapter) CreateTable(table string, degree int) error {
 	return nil
 }
 
+// CreateTableWithSchema creates a table with typed columns on the remote LiteGoDB server,
+// by running CREATE TABLE through its SQL endpoint.
+// It returns an error if the operation fails.
+func (r *remoteAdapter) CreateTableWithSchema(table string, s *Schema) error {
+	return r.post("/sql", map[string]interface{}{
+		"query": fmt.Sprintf("CREATE TABLE %s (%s)", table, s),
+	})
+}
+
+// Schema is not supported by the remote client; rows of tables with a schema are read
+// through the server's SQL endpoint, which decodes them.
+func (r *remoteAdapter) Schema(table string) (*Schema, error) {
+	return nil, fmt.Errorf("table schemas are not supported by the remote client")
+}
+
 // DropTable simulates dropping the specified table on the remote LiteGoDB server.
 // This function is optional and can be implemented in the future if server-side support is added.
 // It returns an error if the operation fails.
@@ -100,6 +155,58 @@ func (r *remoteAdapter) DropTable(table string) error {
 	return nil
 }
 
+// RenameTable renames a table on the remote LiteGoDB server, through its SQL endpoint.
+func (r *remoteAdapter) RenameTable(table, newName string) error {
+	return r.post("/sql", map[string]interface{}{
+		"query": fmt.Sprintf("ALTER TABLE %s RENAME TO %s", table, newName),
+	})
+}
+
+// AddColumn adds a column to a table on the remote LiteGoDB server, through its SQL endpoint.
+func (r *remoteAdapter) AddColumn(table string, column Column) error {
+	return r.post("/sql", map[string]interface{}{
+		"query": fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column),
+	})
+}
+
+// DropColumn removes a column from a table on the remote LiteGoDB server, through its
+// SQL endpoint.
+func (r *remoteAdapter) DropColumn(table, column string) error {
+	return r.post("/sql", map[string]interface{}{
+		"query": fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column),
+	})
+}
+
+// SetCompression changes the codec of a table's pages on the remote LiteGoDB server,
+// through its SQL endpoint.
+func (r *remoteAdapter) SetCompression(table, codec string) error {
+	return r.post("/sql", map[string]interface{}{
+		"query": fmt.Sprintf("ALTER TABLE %s SET compression = '%s'", table, codec),
+	})
+}
+
+// Write sends a batch of writes to the remote LiteGoDB server, which applies them atomically.
+// It returns an error if the operation fails.
+func (r *remoteAdapter) Write(batch *WriteBatch) error {
+	return r.post("/batch", map[string]interface{}{"ops": batch.Ops()})
+}
+
+// Begin is not supported by the remote client; transactions are available over the
+// server's WebSocket protocol.
+func (r *remoteAdapter) Begin() (Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported by the remote client")
+}
+
+// BeginOptimistic is not supported by the remote client, like Begin.
+func (r *remoteAdapter) BeginOptimistic() (Tx, error) {
+	return r.Begin()
+}
+
+// Update is not supported by the remote client, which has no transactions.
+func (r *remoteAdapter) Update(fn func(tx Tx) error) error {
+	return update(r.BeginOptimistic, fn)
+}
+
 // Load simulates loading the remote LiteGoDB.
 // This function is not needed in the remote client since the remote server handles persistence.
 // It returns an error if the operation fails.
@@ -108,6 +215,147 @@ func (r *remoteAdapter) Load() error {
 	return nil
 }
 
+// Vacuum asks the remote LiteGoDB server to compact its database file.
+// It returns the server's statistics, or an error if the operation fails.
+func (r *remoteAdapter) Vacuum() (VacuumStats, error) {
+	resp, err := r.httpClient.Post(r.baseURL+"/admin/vacuum", "application/json", nil)
+	if err != nil {
+		return VacuumStats{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return VacuumStats{}, fmt.Errorf("vacuum failed: %s", resp.Status)
+	}
+
+	var stats VacuumStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return VacuumStats{}, err
+	}
+	return stats, nil
+}
+
+// Checkpoint asks the remote LiteGoDB server to checkpoint its database.
+// It returns the checkpoint LSN, or an error if the operation fails.
+func (r *remoteAdapter) Checkpoint() (uint64, error) {
+	resp, err := r.httpClient.Post(r.baseURL+"/admin/checkpoint", "application/json", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("checkpoint failed: %s", resp.Status)
+	}
+
+	var result struct {
+		LSN uint64 `json:"lsn"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.LSN, nil
+}
+
+// Backup asks the remote LiteGoDB server to back up its database file to path, relative
+// to the server's backup_dir. It returns the LSN of the backup, or an error if the
+// operation fails.
+func (r *remoteAdapter) Backup(path string) (uint64, error) {
+	data, err := json.Marshal(map[string]string{"path": path})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.httpClient.Post(r.baseURL+"/admin/backup", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("backup failed: %s", resp.Status)
+	}
+
+	var result struct {
+		LSN uint64 `json:"lsn"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.LSN, nil
+}
+
+// Subscribe streams the changes made after fromLSN to the given tables from the remote
+// LiteGoDB server, which sends them as newline-delimited JSON.
+func (r *remoteAdapter) Subscribe(fromLSN uint64, tables ...string) (Subscription, error) {
+	return r.subscribe(context.Background(), fromLSN, tables...)
+}
+
+// subscribe is like Subscribe, but the stream also ends when ctx is done.
+func (r *remoteAdapter) subscribe(parent context.Context, fromLSN uint64, tables ...string) (*remoteSubscription, error) {
+	query := url.Values{"from": {strconv.FormatUint(fromLSN, 10)}}
+	for _, table := range tables {
+		query.Add("table", table)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseURL+"/changes?"+query.Encode(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	// The stream stays open for as long as the subscription, past the client's timeout.
+	client := &http.Client{Transport: r.httpClient.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("subscribe failed: %s", resp.Status)
+	}
+
+	sub := &remoteSubscription{events: make(chan ChangeEvent), cancel: cancel}
+	go sub.read(ctx, resp.Body)
+	return sub, nil
+}
+
+// ReplicationStatus asks the remote LiteGoDB server for its replication role and lag.
+func (r *remoteAdapter) ReplicationStatus() (ReplicationStatus, error) {
+	resp, err := r.httpClient.Get(r.baseURL + "/replication")
+	if err != nil {
+		return ReplicationStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ReplicationStatus{}, fmt.Errorf("replication status failed: %s", resp.Status)
+	}
+
+	var status ReplicationStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return ReplicationStatus{}, err
+	}
+	return status, nil
+}
+
+// Promote asks the remote LiteGoDB server, a replica, to become a primary.
+func (r *remoteAdapter) Promote() error {
+	resp, err := r.httpClient.Post(r.baseURL+"/admin/promote", "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("promote failed: %s", resp.Status)
+	}
+	return nil
+}
+
 // Close simulates closing the connection to the remote LiteGoDB.
 // Since there is no persistent connection, this function does nothing.
 // It returns an error if the operation fails.
@@ -131,9 +379,63 @@ func (r *remoteAdapter) post(path string, body map[string]interface{}) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	// The server answers /put with 201 Created, and other writes with 200 OK.
+	if resp.StatusCode/100 != 2 {
 		return fmt.Errorf("post %s failed: %s", path, resp.Status)
 	}
 
 	return nil
 }
+
+// remoteSubscription delivers the changes streamed by a LiteGoDB server.
+type remoteSubscription struct {
+	events chan ChangeEvent
+	cancel context.CancelFunc
+	err    error
+}
+
+// read decodes the stream until it ends. A line carrying an error ends the subscription
+// with it.
+func (s *remoteSubscription) read(ctx context.Context, body io.ReadCloser) {
+	defer close(s.events)
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var line struct {
+			ChangeEvent
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&line); err != nil {
+			if ctx.Err() == nil {
+				s.err = fmt.Errorf("change stream ended: %w", err)
+			}
+			return
+		}
+		if line.Error != "" {
+			s.err = fmt.Errorf("change stream failed: %s", line.Error)
+			return
+		}
+		select {
+		case s.events <- line.ChangeEvent:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Events returns the channel the changes are delivered on.
+func (s *remoteSubscription) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Err returns the error that ended the subscription.
+func (s *remoteSubscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription and the stream.
+func (s *remoteSubscription) Close() error {
+	s.cancel()
+	return nil
+}
@@ -93,3 +93,152 @@ func TestRemoteAdapter_PutGetDelete(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, found)
 }
+
+func TestRemoteAdapter_Write(t *testing.T) {
+	var received []litegodb.BatchOp
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/batch" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Ops []litegodb.BatchOp `json:"ops"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		received = req.Ops
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	remoteDB, err := litegodb.OpenRemote(server.URL)
+	assert.NoError(t, err)
+
+	batch := litegodb.NewWriteBatch()
+	batch.Put("users", 1, "rafael")
+	batch.Delete("users", 2)
+	assert.NoError(t, remoteDB.Write(batch))
+	assert.Equal(t, batch.Ops(), received)
+}
+
+func TestRemoteAdapter_Vacuum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/vacuum" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"pages_before":12,"pages_after":5,"pages_moved":3}`))
+	}))
+	defer server.Close()
+
+	remoteDB, err := litegodb.OpenRemote(server.URL)
+	assert.NoError(t, err)
+
+	stats, err := remoteDB.Vacuum()
+	assert.NoError(t, err)
+	assert.Equal(t, litegodb.VacuumStats{PagesBefore: 12, PagesAfter: 5, PagesMoved: 3}, stats)
+}
+
+func TestRemoteAdapter_Checkpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/checkpoint" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"lsn":42}`))
+	}))
+	defer server.Close()
+
+	remoteDB, err := litegodb.OpenRemote(server.URL)
+	assert.NoError(t, err)
+
+	lsn, err := remoteDB.Checkpoint()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), lsn)
+}
+
+func TestRemoteAdapter_Backup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/backup" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req["path"] != "/backups/base.db" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"lsn":7}`))
+	}))
+	defer server.Close()
+
+	remoteDB, err := litegodb.OpenRemote(server.URL)
+	assert.NoError(t, err)
+
+	lsn, err := remoteDB.Backup("/backups/base.db")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), lsn)
+}
+
+func TestRemoteAdapter_Subscribe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/changes" || r.URL.Query().Get("from") != "5" || r.URL.Query().Get("table") != "users" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write([]byte(`{"lsn":6,"op":"PUT","table":"users","key":1,"new_value":"one"}` + "\n"))
+		w.Write([]byte(`{"lsn":7,"op":"DELETE","table":"users","key":1,"old_value":"one"}` + "\n"))
+		w.Write([]byte(`{"error":"changes no longer retained"}` + "\n"))
+	}))
+	defer server.Close()
+
+	remoteDB, err := litegodb.OpenRemote(server.URL)
+	assert.NoError(t, err)
+
+	sub, err := remoteDB.Subscribe(5, "users")
+	assert.NoError(t, err)
+	defer sub.Close()
+
+	var events []litegodb.ChangeEvent
+	for event := range sub.Events() {
+		events = append(events, event)
+	}
+	assert.Len(t, events, 2)
+	assert.Equal(t, uint64(6), events[0].LSN)
+	assert.Equal(t, "one", *events[0].NewValue)
+	assert.Equal(t, "DELETE", events[1].Operation)
+	assert.Equal(t, "one", *events[1].OldValue)
+	assert.ErrorContains(t, sub.Err(), "changes no longer retained")
+}
+
+func TestRemoteAdapter_Replication(t *testing.T) {
+	promoted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/replication" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"role":"replica","lsn":40,"primary":"http://db1:8080","primary_lsn":42,"lag":2,"lag_seconds":0.5,"streaming":true}`))
+		case r.URL.Path == "/admin/promote" && r.Method == http.MethodPost:
+			promoted = true
+			w.Write([]byte(`{"role":"primary","lsn":40,"lag":0,"lag_seconds":0,"streaming":false}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	remoteDB, err := litegodb.OpenRemote(server.URL)
+	assert.NoError(t, err)
+
+	status, err := remoteDB.ReplicationStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, litegodb.ReplicationStatus{
+		Role: "replica", LSN: 40, Primary: "http://db1:8080", PrimaryLSN: 42, Lag: 2, LagSeconds: 0.5, Streaming: true,
+	}, status)
+
+	assert.NoError(t, remoteDB.Promote())
+	assert.True(t, promoted)
+}
@@ -0,0 +1,161 @@
+package litegodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// replicator keeps a replica up to date with its primary. It subscribes to the primary's
+// change stream from the last LSN the replica logged and replicates every change, so a
+// restarted replica picks up where it stopped. When the stream fails it reconnects after
+// a pause; a replica whose changes the primary no longer retains stays behind until it is
+// rebuilt from a backup of the primary.
+type replicator struct {
+	kv      *kvstore.BTreeKVStore
+	url     string
+	primary *remoteAdapter
+	retry   time.Duration
+
+	ctx  context.Context // Done once the replicator is stopped.
+	stop func()          // Stops the replicator.
+	done chan struct{}   // Closed when the last change is replicated after stopping.
+
+	mu         sync.Mutex
+	primaryLSN uint64    // Last LSN of the primary seen in its stream or status.
+	caughtUp   time.Time // Last time the replica had every change of the primary seen.
+	streaming  bool
+	err        error // Why the last stream ended.
+}
+
+// startReplicator starts following the primary configured in cfg.
+func startReplicator(kv *kvstore.BTreeKVStore, cfg ReplicationConfig) *replicator {
+	retry := cfg.RetryEvery
+	if retry <= 0 {
+		retry = time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &replicator{
+		kv:       kv,
+		url:      cfg.Primary,
+		primary:  openRemote(cfg.Primary, cfg.AuthToken, cfg.Database),
+		retry:    retry,
+		ctx:      ctx,
+		done:     make(chan struct{}),
+		caughtUp: time.Now(),
+	}
+	r.stop = func() {
+		cancel()
+		<-r.done
+	}
+	go r.watch()
+	go r.run()
+	return r
+}
+
+// run streams changes from the primary until the replicator is stopped, reconnecting
+// whenever the stream ends.
+func (r *replicator) run() {
+	defer close(r.done)
+
+	for {
+		err := r.follow()
+		r.mu.Lock()
+		r.streaming, r.err = false, err
+		r.mu.Unlock()
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(r.retry):
+		}
+	}
+}
+
+// follow replicates the changes of one subscription to the primary. It returns nil
+// once the replicator is stopped.
+func (r *replicator) follow() error {
+	sub, err := r.primary.subscribe(r.ctx, r.kv.LastLSN())
+	if r.ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", r.url, err)
+	}
+	defer sub.Close()
+
+	r.mu.Lock()
+	r.streaming, r.err = true, nil
+	r.mu.Unlock()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return nil
+		case event, ok := <-sub.Events():
+			if !ok {
+				if err := sub.Err(); err != nil {
+					return err
+				}
+				return errors.New("primary closed the change stream")
+			}
+			if err := r.kv.Replicate(logEntry(event)); err != nil {
+				return fmt.Errorf("failed to replicate LSN %d: %w", event.LSN, err)
+			}
+			r.observe(event.LSN)
+		}
+	}
+}
+
+// watch polls the primary's position until the replicator is stopped, so the lag is
+// known while changes are on their way.
+func (r *replicator) watch() {
+	ticker := time.NewTicker(r.retry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if status, err := r.primary.ReplicationStatus(); err == nil {
+				r.observe(status.LSN)
+			}
+		}
+	}
+}
+
+// observe records that the primary has logged up to lsn.
+func (r *replicator) observe(lsn uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.primaryLSN = max(r.primaryLSN, lsn)
+	if r.kv.LastLSN() >= r.primaryLSN {
+		r.caughtUp = time.Now()
+	}
+}
+
+// status reports how far the replica is behind its primary.
+func (r *replicator) status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := ReplicationStatus{
+		Role:       "replica",
+		LSN:        r.kv.LastLSN(),
+		Primary:    r.url,
+		PrimaryLSN: r.primaryLSN,
+		Streaming:  r.streaming,
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	if status.PrimaryLSN > status.LSN {
+		status.Lag = status.PrimaryLSN - status.LSN
+		status.LagSeconds = time.Since(r.caughtUp).Seconds()
+	}
+	return status
+}
@@ -0,0 +1,104 @@
+package litegodb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/encryption"
+	"github.com/rafaelmgr12/litegodb/internal/storage/kvstore"
+)
+
+// RestoreOptions describes a point-in-time restore: a base backup made with DB.Backup,
+// the write-ahead log segments to replay on top of it, and where to stop.
+type RestoreOptions struct {
+	Backup  string   // Base backup of the database file.
+	WALDirs []string // Directories holding the segments to replay, such as wal_archive_dir.
+	DBFile  string   // Database file to create; it must not exist.
+	LogFile string   // Write-ahead log directory of the restored database; it must not exist.
+
+	TargetLSN  uint64    // Last change to replay; 0 replays up to the end of the log.
+	TargetTime time.Time // Only changes made at or before this time are replayed; zero sets no limit.
+
+	Encryption EncryptionConfig // Key of the backup and the segments, which the restored database keeps.
+}
+
+// Restore builds a new database from a base backup and the write-ahead log segments made
+// after it, replaying changes up to the target LSN or time. The restored database is
+// checkpointed, so it opens without the segments. It returns the LSN of the last change
+// replayed.
+func Restore(opts RestoreOptions) (uint64, error) {
+	for _, path := range []string{opts.DBFile, opts.LogFile} {
+		if _, err := os.Stat(path); err == nil {
+			return 0, fmt.Errorf("restore target %s already exists", path)
+		}
+	}
+
+	cipher, err := opts.Encryption.cipher()
+	if err != nil {
+		return 0, err
+	}
+	if err := copyFile(opts.Backup, opts.DBFile); err != nil {
+		os.Remove(opts.DBFile)
+		return 0, fmt.Errorf("failed to copy backup: %w", err)
+	}
+
+	lsn, err := restoreCopy(opts, cipher)
+	if err != nil {
+		// Leave nothing half restored behind.
+		os.Remove(opts.DBFile)
+		os.RemoveAll(opts.LogFile)
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// restoreCopy replays the log onto the copy of the backup at opts.DBFile.
+func restoreCopy(opts RestoreOptions, cipher *encryption.Cipher) (uint64, error) {
+	dm, err := newDiskManager(opts.DBFile, cipher)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create disk manager: %w", err)
+	}
+
+	// Closing the store closes the disk manager too.
+	store, err := kvstore.NewBTreeKVStoreWithOptions(3, dm, opts.LogFile, kvstore.Options{Cipher: cipher, SyncWrites: true})
+	if err != nil {
+		dm.Close()
+		return 0, fmt.Errorf("failed to create store: %w", err)
+	}
+	if err := store.Load(); err != nil {
+		store.Close()
+		return 0, fmt.Errorf("failed to load backup: %w", err)
+	}
+
+	lsn, err := store.Restore(opts.WALDirs, kvstore.RestoreTarget{LSN: opts.TargetLSN, Time: opts.TargetTime})
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// copyFile copies the file at src to a new file at dst and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package litegodb
+
+import "github.com/rafaelmgr12/litegodb/internal/storage/schema"
+
+// Schema is the ordered list of typed columns of a table created with
+// CreateTableWithSchema. Exactly one column is the INT primary key, which is the key
+// rows are stored under; the other columns are stored together, encoded, as its value.
+type Schema = schema.Schema
+
+// Column is a column of a Schema.
+type Column = schema.Column
+
+// ColumnType is the type of a Column.
+type ColumnType = schema.Type
+
+const (
+	// TypeInt is a signed 64-bit integer, held in a Row as an int64.
+	TypeInt = schema.Int
+	// TypeText is a string.
+	TypeText = schema.Text
+	// TypeBool is true or false.
+	TypeBool = schema.Bool
+)
+
+// Row holds the values of a row of a table with a schema, one per column in order: an
+// int64, string or bool, or nil for NULL. Schema.Encode turns it into the value stored
+// under its key, and Schema.Decode turns that value back into a Row.
+type Row = schema.Row
+
+// NewSchema returns the schema with the given columns.
+func NewSchema(columns []Column) (*Schema, error) {
+	return schema.New(columns)
+}
+
+// ParseSchema returns the schema given by column definitions as written in CREATE TABLE,
+// such as "id INT PRIMARY KEY, name TEXT NOT NULL, active BOOL".
+func ParseSchema(definitions string) (*Schema, error) {
+	return schema.Parse(definitions)
+}
+
+// ParseColumn returns the column given by a single definition, as written in
+// ALTER TABLE ... ADD COLUMN, such as "email TEXT NOT NULL DEFAULT 'unknown'".
+func ParseColumn(definition string) (Column, error) {
+	return schema.ParseColumn(definition)
+}
@@ -0,0 +1,43 @@
+package litegodb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// updateAttempts is how many times Update runs its function before giving up on conflicts.
+const updateAttempts = 10
+
+// update runs fn in optimistic transactions started by begin until one commits, fn fails,
+// or updateAttempts transactions conflicted. Between attempts it waits a random, growing
+// delay, so transactions that conflicted with each other do not retry in lockstep.
+func update(begin func() (Tx, error), fn func(tx Tx) error) error {
+	var err error
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(rand.Int64N(int64(time.Millisecond) << min(attempt, 6))))
+		}
+
+		var tx Tx
+		if tx, err = begin(); err != nil {
+			return err
+		}
+		if err = fn(tx); err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+		if !retryable(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %w", updateAttempts, err)
+}
+
+// retryable reports whether a transaction that failed with err may commit if run again.
+func retryable(err error) bool {
+	var deadlock *DeadlockError
+	return errors.Is(err, ErrConflict) || errors.As(err, &deadlock)
+}
@@ -0,0 +1,56 @@
+package integrations
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/rafaelmgr12/litegodb/internal/server"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBatch applies write batches through the REST endpoint, the remote client and the
+// WebSocket protocol.
+func TestBatch(t *testing.T) {
+	db, url := startReplicationServer(t, writeReplicationConfig(t, t.TempDir(), "batch", ""))
+
+	resp := postJSON(t, url+"/batch", map[string]interface{}{"ops": []map[string]interface{}{
+		{"op": "put", "table": "users", "key": 1, "value": "alice"},
+		{"op": "put", "table": "emails", "key": 1, "value": "alice@example.com"},
+	}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	requireValue(t, db, "emails", 1, "alice@example.com")
+
+	resp = postJSON(t, url+"/batch", map[string]interface{}{"ops": []map[string]interface{}{
+		{"op": "put", "table": "users", "key": 2, "value": "bob"},
+		{"op": "drop", "table": "users"},
+	}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	requireMissing(t, db, "users", 2)
+
+	remote, err := litegodb.OpenRemote(url)
+	require.NoError(t, err)
+	batch := litegodb.NewWriteBatch()
+	batch.Put("users", 2, "bob")
+	batch.Delete("users", 1)
+	require.NoError(t, remote.Write(batch))
+	requireValue(t, db, "users", 2, "bob")
+	requireMissing(t, db, "users", 1)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(server.WSRequest{Op: "batch", Ops: []litegodb.BatchOp{
+		{Op: "put", Table: "users", Key: 3, Value: "carol"},
+		{Op: "delete", Table: "users", Key: 2},
+	}}))
+	var wsResp server.WSResponse
+	require.NoError(t, conn.ReadJSON(&wsResp))
+	require.Equal(t, "ok", wsResp.Status, wsResp.Message)
+	requireValue(t, db, "users", 3, "carol")
+	requireMissing(t, db, "users", 2)
+}
@@ -0,0 +1,206 @@
+package integrations
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/storage/faultinject"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	crashRunsPerFault = 10
+	crashWorkloadOps  = 300
+	crashTables       = 3
+	crashKeys         = 60
+)
+
+// TestCrashRecovery runs randomized workloads against a database whose files crash at
+// a random write, reopens it and checks that every acknowledged write survived.
+func TestCrashRecovery(t *testing.T) {
+	for _, fault := range faultinject.Faults {
+		for seed := int64(1); seed <= crashRunsPerFault; seed++ {
+			t.Run(fmt.Sprintf("%s/seed-%d", fault, seed), func(t *testing.T) {
+				runCrashWorkload(t, fault, seed)
+			})
+		}
+	}
+}
+
+// crashModel tracks the state clients were told about. A nil value is a deleted key.
+type crashModel struct {
+	acked map[string]map[int]*string
+
+	// The operation that was running when the crash happened. It may or may not have
+	// survived, so either outcome is accepted for its key.
+	inflight      bool
+	inflightTable string
+	inflightKey   int
+	inflightValue *string
+}
+
+func (m *crashModel) ack(table string, key int, value *string) {
+	if m.acked[table] == nil {
+		m.acked[table] = make(map[int]*string)
+	}
+	m.acked[table][key] = value
+}
+
+func runCrashWorkload(t *testing.T, fault faultinject.Fault, seed int64) {
+	dir := t.TempDir()
+	configPath := writeCrashConfig(t, dir)
+
+	rng := rand.New(rand.NewSource(seed))
+	injector := faultinject.NewInjector(seed)
+	injector.CrashAt(1+rng.Intn(2*crashWorkloadOps), fault)
+
+	db, _, err := litegodb.OpenWithOptions(configPath, litegodb.Options{
+		WrapDiskManager: injector.WrapDiskManager,
+		WrapLogFile:     injector.WrapFile,
+	})
+	require.NoError(t, err)
+
+	model := &crashModel{acked: make(map[string]map[int]*string)}
+	for op := 0; op < crashWorkloadOps && !injector.Crashed(); op++ {
+		table := fmt.Sprintf("table%d", rng.Intn(crashTables))
+		key := rng.Intn(crashKeys)
+		_, exists := model.acked[table]
+
+		model.inflightTable = ""
+
+		var err error
+		switch n := rng.Intn(100); {
+		case n < 60 || !exists:
+			value := fmt.Sprintf("%d:%s", op, strings.Repeat("x", rng.Intn(200)))
+			model.inflightTable, model.inflightKey, model.inflightValue = table, key, &value
+			if err = db.Put(table, key, value); err == nil {
+				model.ack(table, key, &value)
+			}
+		case n < 85:
+			model.inflightTable, model.inflightKey, model.inflightValue = table, key, nil
+			if err = db.Delete(table, key); err == nil {
+				model.ack(table, key, nil)
+			}
+		case n < 94:
+			err = db.Flush(table)
+		case n < 97:
+			_, err = db.Checkpoint()
+		default:
+			_, err = db.Vacuum()
+		}
+
+		if err != nil {
+			require.True(t, injector.Crashed(), "operation failed without a crash: %v", err)
+			model.inflight = true
+		}
+	}
+
+	// Crash the process if the chosen write was never reached.
+	require.NoError(t, injector.Crash(fault))
+	require.NoError(t, injector.Err())
+
+	recovered, _, err := litegodb.Open(configPath)
+	require.NoError(t, err, "reopening after %s at write %d", fault, injector.Writes())
+	verifyCrashModel(t, recovered, model)
+
+	// New writes must follow the recovered log, not a torn record left at its end,
+	// so they survive another restart together with the recovered state.
+	model.settle(t, recovered)
+	for table := range model.acked {
+		for i := 0; i < crashKeys/4; i++ {
+			key := rng.Intn(crashKeys)
+			value := fmt.Sprintf("after:%d", i)
+			require.NoError(t, recovered.Put(table, key, value))
+			model.ack(table, key, &value)
+		}
+	}
+	require.NoError(t, recovered.Close())
+
+	reopened, _, err := litegodb.Open(configPath)
+	require.NoError(t, err, "reopening after recovery")
+	defer reopened.Close()
+	verifyCrashModel(t, reopened, model)
+}
+
+// settle replaces the uncertain outcome of the in-flight operation with what recovery
+// made of it, so the model is exact again.
+func (m *crashModel) settle(t *testing.T, db litegodb.DB) {
+	if m.inflight && m.inflightTable != "" {
+		if value, found, err := db.Get(m.inflightTable, m.inflightKey); err == nil {
+			m.ack(m.inflightTable, m.inflightKey, foundValue(value, found))
+		}
+	}
+	m.inflight = false
+}
+
+func verifyCrashModel(t *testing.T, db litegodb.DB, model *crashModel) {
+	for table, keys := range model.acked {
+		for key, want := range keys {
+			value, found, err := db.Get(table, key)
+			require.NoError(t, err, "table %s", table)
+
+			if matches(value, found, want) {
+				continue
+			}
+			if model.inflight && table == model.inflightTable && key == model.inflightKey &&
+				matches(value, found, model.inflightValue) {
+				continue
+			}
+			t.Fatalf("table %s key %d: expected %s, got %s", table, key, describe(want), describe(foundValue(value, found)))
+		}
+	}
+
+	// A key whose first write was in flight is either absent or has the new value.
+	if model.inflight && model.inflightValue != nil {
+		if _, acked := model.acked[model.inflightTable][model.inflightKey]; !acked {
+			value, found, err := db.Get(model.inflightTable, model.inflightKey)
+			if err == nil && found {
+				require.Equal(t, *model.inflightValue, value)
+			}
+		}
+	}
+}
+
+func matches(value string, found bool, want *string) bool {
+	if want == nil {
+		return !found
+	}
+	return found && value == *want
+}
+
+func foundValue(value string, found bool) *string {
+	if !found {
+		return nil
+	}
+	return &value
+}
+
+func describe(value *string) string {
+	if value == nil {
+		return "no value"
+	}
+	v := *value
+	if len(v) > 16 {
+		v = v[:16] + "..."
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+func writeCrashConfig(t *testing.T, dir string) string {
+	configPath := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`
+degree: 3
+db_file: %q
+log_file: %q
+flush_every: 1h
+sync_writes: true
+wal_segment_size: 4096
+`, filepath.Join(dir, "data.db"), filepath.Join(dir, "wal.log"))
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	return configPath
+}
@@ -0,0 +1,172 @@
+package integrations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/internal/server"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDatabases serves several databases from one server: each has its own tables and
+// auth token, queries can name tables of other databases, new databases are created over
+// SQL, and a replica follows the databases of the same name on its primary.
+func TestDatabases(t *testing.T) {
+	dir := t.TempDir()
+	primary, primaryURL := startDatabasesServer(t, writeDatabasesConfig(t, dir, "primary", ""))
+
+	// Only the server's token creates databases.
+	resp := sqlRequest(t, primaryURL, "analytics", "analytics-token", "SELECT * FROM events WHERE `key` = 1")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = sqlRequest(t, primaryURL, "", "admin-token", "CREATE DATABASE analytics")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = sqlRequest(t, primaryURL, "analytics", "analytics-token", "CREATE DATABASE sales")
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, []string{"analytics", litegodb.DefaultDatabase}, primary.Names())
+
+	// A database token opens its database, and no other.
+	analytics, err := litegodb.OpenRemoteDatabase(primaryURL, "analytics", "analytics-token")
+	require.NoError(t, err)
+	require.NoError(t, analytics.Put("events", 1, "click"))
+	requireValue(t, analytics, "events", 1, "click")
+	other, err := litegodb.OpenRemoteDatabase(primaryURL, litegodb.DefaultDatabase, "analytics-token")
+	require.NoError(t, err)
+	require.Error(t, other.Put("events", 1, "click"))
+	resp = postJSON(t, primaryURL+"/admin/checkpoint?db=analytics", nil)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// VACUUM over SQL is an administrative statement, like /admin/vacuum.
+	resp = sqlRequest(t, primaryURL, "analytics", "analytics-token", "VACUUM")
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	resp = sqlRequest(t, primaryURL, "analytics", "admin-token", "VACUUM")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = sqlRequest(t, primaryURL, "ANALYTICS", "", "SELECT * FROM events WHERE `key` = 1")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Tables of the default database are separate, and reachable with qualified names.
+	db, err := primary.Get("")
+	require.NoError(t, err)
+	require.NoError(t, db.Put("users", 1, "alice"))
+	resp = sqlRequest(t, primaryURL, "", "admin-token", "SELECT `key`, `value` FROM analytics.events WHERE `key` = 1")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result struct {
+		Result map[string]interface{} `json:"result"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(t, "click", result.Result["value"])
+	resp = sqlRequest(t, primaryURL, "analytics", "analytics-token", "SELECT `key`, `value` FROM `default`.users WHERE `key` = 1")
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	// The replica follows the primary's analytics database once it has one of its own.
+	replica, replicaURL := startDatabasesServer(t, writeDatabasesConfig(t, dir, "replica", primaryURL))
+	resp = sqlRequest(t, replicaURL, "", "admin-token", "CREATE DATABASE analytics")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	replicaAnalytics, err := replica.Get("analytics")
+	require.NoError(t, err)
+	primaryAnalytics, err := primary.Get("analytics")
+	require.NoError(t, err)
+	waitForReplica(t, replicaAnalytics, primaryAnalytics)
+	requireValue(t, replicaAnalytics, "events", 1, "click")
+	replicaDefault, err := replica.Get("")
+	require.NoError(t, err)
+	waitForReplica(t, replicaDefault, db)
+	requireValue(t, replicaDefault, "users", 1, "alice")
+}
+
+// TestDatabaseTokenWithoutServerToken checks that the token of a database is needed to
+// use it when the server has no token of its own, whichever way its name is written.
+func TestDatabaseTokenWithoutServerToken(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`
+degree: 3
+data_dir: %q
+flush_every: 1h
+databases:
+  teama:
+    auth_token: secret
+`, filepath.Join(dir, "data"))
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	dbs, url := startDatabasesServer(t, configPath)
+	_, err := dbs.Create("teama")
+	require.NoError(t, err)
+
+	for _, path := range []string{"/get?db=teama&table=t&key=1", "/get?db=TeamA&table=t&key=1"} {
+		resp, err := http.Get(url + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode, path)
+	}
+	resp := sqlRequest(t, url, "TeamA", "wrong", "SELECT * FROM t WHERE `key` = 1")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	teamA, err := litegodb.OpenRemoteDatabase(url, "teama", "secret")
+	require.NoError(t, err)
+	require.NoError(t, teamA.Put("t", 1, "one"))
+	requireValue(t, teamA, "t", 1, "one")
+
+	// The default database has no token, so it stays open.
+	open, err := litegodb.OpenRemoteDatabase(url, "", "")
+	require.NoError(t, err)
+	require.NoError(t, open.Put("t", 1, "one"))
+}
+
+// startDatabasesServer opens the databases configured at configPath and serves them on
+// loopback until the test ends.
+func startDatabasesServer(t *testing.T, configPath string) (*litegodb.Databases, string) {
+	t.Helper()
+	dbs, cfg, err := litegodb.OpenDatabases(configPath)
+	require.NoError(t, err)
+	ts := httptest.NewServer(server.NewServerWithDatabases(dbs, cfg).Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		dbs.Close()
+	})
+	return dbs, ts.URL
+}
+
+// sqlRequest runs query on the server at url against database, with token.
+func sqlRequest(t *testing.T, url, database, token, query string) *http.Response {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{"query": query})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, url+"/sql", bytes.NewReader(data))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if database != "" {
+		req.Header.Set(litegodb.DatabaseHeader, database)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// writeDatabasesConfig writes the configuration of the server called name in dir, with
+// its databases under a data directory, a replica of primary unless it is empty.
+func writeDatabasesConfig(t *testing.T, dir, name, primary string) string {
+	configPath := filepath.Join(dir, name+".yaml")
+	config := fmt.Sprintf(`
+degree: 3
+data_dir: %q
+flush_every: 1h
+server:
+  auth_token: admin-token
+databases:
+  analytics:
+    auth_token: analytics-token
+replication:
+  primary: %q
+  auth_token: admin-token
+  retry_every: 50ms
+`, filepath.Join(dir, name), primary)
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	return configPath
+}
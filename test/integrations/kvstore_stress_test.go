@@ -18,7 +18,7 @@ const (
 
 func setupStressKVStore(t *testing.T) (*kvstore.BTreeKVStore, func()) {
 	_ = os.Remove(stressDbFile)
-	_ = os.Remove(stressLogFile)
+	_ = os.RemoveAll(stressLogFile)
 
 	diskManager, err := disk.NewFileDiskManager(stressDbFile)
 	require.NoError(t, err)
@@ -30,7 +30,7 @@ func setupStressKVStore(t *testing.T) (*kvstore.BTreeKVStore, func()) {
 		kvStore.Close()
 		diskManager.Close()
 		os.Remove(stressDbFile)
-		os.Remove(stressLogFile)
+		os.RemoveAll(stressLogFile)
 	}
 
 	return kvStore, cleanup
@@ -12,7 +12,7 @@ import (
 
 func setupKVStore(t *testing.T, dbFile, logFile string) (*kvstore.BTreeKVStore, func()) {
 	_ = os.Remove(dbFile)
-	_ = os.Remove(logFile)
+	_ = os.RemoveAll(logFile)
 
 	diskManager, err := disk.NewFileDiskManager(dbFile)
 	if err != nil {
@@ -28,7 +28,7 @@ func setupKVStore(t *testing.T, dbFile, logFile string) (*kvstore.BTreeKVStore,
 		kvStore.Close()
 		diskManager.Close()
 		os.Remove(dbFile)
-		os.Remove(logFile)
+		os.RemoveAll(logFile)
 	}
 
 	return kvStore, cleanup
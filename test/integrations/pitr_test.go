@@ -0,0 +1,243 @@
+package integrations
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/stretchr/testify/require"
+)
+
+const pitrKeys = 50
+
+// TestPointInTimeRecovery takes a base backup, keeps writing until a bad delete wipes the
+// table, then restores the backup to several points of the archived log.
+func TestPointInTimeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	db, _, err := litegodb.Open(writePITRConfig(t, dir, "live", archive, ""))
+	require.NoError(t, err)
+
+	table := "accounts"
+	for key := 0; key < pitrKeys; key++ {
+		require.NoError(t, db.Put(table, key, fmt.Sprintf("v1-%d", key)))
+	}
+	backup := filepath.Join(dir, "base.db")
+	backupLSN, err := db.Backup(backup)
+	require.NoError(t, err)
+
+	// Each write is one record, so key k is updated at LSN backupLSN+1+k.
+	for key := 0; key < pitrKeys; key++ {
+		require.NoError(t, db.Put(table, key, fmt.Sprintf("v2-%d", key)))
+	}
+	beforeDelete := time.Now()
+	lsnBeforeDelete := backupLSN + pitrKeys
+
+	for key := 0; key < pitrKeys; key++ {
+		require.NoError(t, db.Delete(table, key))
+	}
+	require.NoError(t, db.Put(table, 1000, "after"))
+	require.NoError(t, db.Close())
+
+	tests := []struct {
+		name   string
+		lsn    uint64
+		time   time.Time
+		verify func(t *testing.T, db litegodb.DB)
+	}{
+		{"target-lsn", lsnBeforeDelete, time.Time{}, func(t *testing.T, db litegodb.DB) {
+			for key := 0; key < pitrKeys; key++ {
+				requireValue(t, db, table, key, fmt.Sprintf("v2-%d", key))
+			}
+			requireMissing(t, db, table, 1000)
+		}},
+		{"target-time", 0, beforeDelete, func(t *testing.T, db litegodb.DB) {
+			for key := 0; key < pitrKeys; key++ {
+				requireValue(t, db, table, key, fmt.Sprintf("v2-%d", key))
+			}
+			requireMissing(t, db, table, 1000)
+		}},
+		{"mid-update", backupLSN + 17, time.Time{}, func(t *testing.T, db litegodb.DB) {
+			for key := 0; key < pitrKeys; key++ {
+				want := fmt.Sprintf("v1-%d", key)
+				if key < 17 {
+					want = fmt.Sprintf("v2-%d", key)
+				}
+				requireValue(t, db, table, key, want)
+			}
+		}},
+		{"end-of-log", 0, time.Time{}, func(t *testing.T, db litegodb.DB) {
+			for key := 0; key < pitrKeys; key++ {
+				requireMissing(t, db, table, key)
+			}
+			requireValue(t, db, table, 1000, "after")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "restored-" + tt.name
+			lsn, err := litegodb.Restore(litegodb.RestoreOptions{
+				Backup:     backup,
+				WALDirs:    []string{archive},
+				DBFile:     filepath.Join(dir, name+".db"),
+				LogFile:    filepath.Join(dir, name+"-wal"),
+				TargetLSN:  tt.lsn,
+				TargetTime: tt.time,
+			})
+			require.NoError(t, err)
+			if tt.lsn != 0 {
+				require.Equal(t, tt.lsn, lsn)
+			}
+
+			restored, _, err := litegodb.Open(writePITRConfig(t, dir, name, "", ""))
+			require.NoError(t, err)
+			defer restored.Close()
+			tt.verify(t, restored)
+		})
+	}
+
+	_, err = litegodb.Restore(litegodb.RestoreOptions{
+		Backup:    backup,
+		WALDirs:   []string{archive},
+		DBFile:    filepath.Join(dir, "beyond.db"),
+		LogFile:   filepath.Join(dir, "beyond-wal"),
+		TargetLSN: 1 << 40,
+	})
+	require.Error(t, err, "restoring past the end of the log")
+	require.NoFileExists(t, filepath.Join(dir, "beyond.db"))
+}
+
+// TestPointInTimeRecoveryAfterRekey rotates the encryption key of a database together with
+// its archived segments and base backup, and restores it with the new key only.
+func TestPointInTimeRecoveryAfterRekey(t *testing.T) {
+	t.Setenv("LITEGODB_TEST_OLD_KEY", strings.Repeat("a1", 32))
+	t.Setenv("LITEGODB_TEST_NEW_KEY", strings.Repeat("b2", 32))
+	oldKey := litegodb.EncryptionConfig{KeyEnv: "LITEGODB_TEST_OLD_KEY"}
+	newKey := litegodb.EncryptionConfig{KeyEnv: "LITEGODB_TEST_NEW_KEY"}
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	db, _, err := litegodb.Open(writePITRConfig(t, dir, "live", archive, oldKey.KeyEnv))
+	require.NoError(t, err)
+	table := "accounts"
+	for key := 0; key < pitrKeys; key++ {
+		require.NoError(t, db.Put(table, key, fmt.Sprintf("v1-%d", key)))
+	}
+	backup := filepath.Join(dir, "base.db")
+	_, err = db.Backup(backup)
+	require.NoError(t, err)
+	for key := 0; key < pitrKeys; key++ {
+		require.NoError(t, db.Put(table, key, fmt.Sprintf("v2-%d", key)))
+	}
+	require.NoError(t, db.Close())
+	segments, _ := filepath.Glob(filepath.Join(archive, "*"))
+	require.NotEmpty(t, segments, "archived segments")
+
+	require.NoError(t, litegodb.Rekey(litegodb.RekeyOptions{
+		DBFile:  filepath.Join(dir, "live.db"),
+		LogFile: filepath.Join(dir, "live-wal"),
+		WALDirs: []string{archive},
+		Backups: []string{backup},
+		OldKey:  oldKey,
+		NewKey:  newKey,
+	}))
+
+	restore := func(name string, key litegodb.EncryptionConfig) error {
+		_, err := litegodb.Restore(litegodb.RestoreOptions{
+			Backup:     backup,
+			WALDirs:    []string{archive},
+			DBFile:     filepath.Join(dir, name+".db"),
+			LogFile:    filepath.Join(dir, name+"-wal"),
+			Encryption: key,
+		})
+		return err
+	}
+	require.Error(t, restore("retired", oldKey), "restoring with the retired key")
+	require.NoError(t, restore("restored", newKey))
+
+	for _, name := range []string{"live", "restored"} {
+		db, _, err := litegodb.Open(writePITRConfig(t, dir, name, "", newKey.KeyEnv))
+		require.NoError(t, err)
+		for key := 0; key < pitrKeys; key++ {
+			requireValue(t, db, table, key, fmt.Sprintf("v2-%d", key))
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+// TestBackupOverHTTP checks backups over HTTP stay under the configured backup_dir.
+func TestBackupOverHTTP(t *testing.T) {
+	dir := t.TempDir()
+	backups := filepath.Join(dir, "backups")
+	_, disabledURL := startReplicationServer(t, writeReplicationConfig(t, dir, "disabled", ""))
+	resp := postJSON(t, disabledURL+"/admin/backup", map[string]string{"path": "base.db"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode, "without a backup_dir")
+
+	configPath := filepath.Join(dir, "live.yaml")
+	config := fmt.Sprintf(`
+degree: 3
+db_file: %q
+log_file: %q
+flush_every: 1h
+server:
+  backup_dir: %q
+`, filepath.Join(dir, "live.db"), filepath.Join(dir, "live-wal"), backups)
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	db, url := startReplicationServer(t, configPath)
+	require.NoError(t, db.Put("accounts", 1, "alice"))
+
+	for _, path := range []string{filepath.Join(dir, "outside.db"), "../outside.db", "nested/../../outside.db"} {
+		resp := postJSON(t, url+"/admin/backup", map[string]string{"path": path})
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+	require.NoFileExists(t, filepath.Join(dir, "outside.db"))
+
+	remote, err := litegodb.OpenRemote(url)
+	require.NoError(t, err)
+	for _, path := range []string{"base.db", "nightly/base.db"} {
+		_, err := remote.Backup(path)
+		require.NoError(t, err, path)
+		require.FileExists(t, filepath.Join(backups, path))
+	}
+}
+
+// writePITRConfig writes the configuration of the database called name in dir, encrypted
+// with the key in the environment variable keyEnv unless it is empty.
+func writePITRConfig(t *testing.T, dir, name, archive, keyEnv string) string {
+	configPath := filepath.Join(dir, name+".yaml")
+	config := fmt.Sprintf(`
+degree: 3
+db_file: %q
+log_file: %q
+flush_every: 1h
+wal_segment_size: 1024
+wal_archive_dir: %q
+encryption:
+  key_env: %q
+`, filepath.Join(dir, name+".db"), filepath.Join(dir, name+"-wal"), archive, keyEnv)
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	return configPath
+}
+
+func requireValue(t *testing.T, db litegodb.DB, table string, key int, want string) {
+	t.Helper()
+	value, found, err := db.Get(table, key)
+	require.NoError(t, err)
+	require.True(t, found, "key %d missing", key)
+	require.Equal(t, want, value, "key %d", key)
+}
+
+func requireMissing(t *testing.T, db litegodb.DB, table string, key int) {
+	t.Helper()
+	_, found, err := db.Get(table, key)
+	require.NoError(t, err)
+	require.False(t, found, "key %d should be missing", key)
+}
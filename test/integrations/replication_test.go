@@ -0,0 +1,149 @@
+package integrations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rafaelmgr12/litegodb/internal/server"
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReplication runs a primary and a replica server on loopback: the replica follows the
+// primary's writes, serves reads, rejects writes, resumes after a restart and takes over
+// once promoted.
+func TestReplication(t *testing.T) {
+	dir := t.TempDir()
+	primary, primaryURL := startReplicationServer(t, writeReplicationConfig(t, dir, "primary", ""))
+
+	table := "users"
+	for key := 0; key < 20; key++ {
+		require.NoError(t, primary.Put(table, key, fmt.Sprintf("v1-%d", key)))
+	}
+
+	require.NoError(t, primary.CreateTable("audit", 3))
+	tx, err := primary.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(table, 100, "moved"))
+	require.NoError(t, tx.Put("audit", 1, "moved to 100"))
+	require.NoError(t, tx.Commit())
+
+	replicaConfig := writeReplicationConfig(t, dir, "replica", primaryURL)
+	replica, replicaURL := startReplicationServer(t, replicaConfig)
+	waitForReplica(t, replica, primary)
+	requireValue(t, replica, table, 19, "v1-19")
+	requireValue(t, replica, table, 100, "moved")
+	requireValue(t, replica, "audit", 1, "moved to 100")
+
+	status, err := replica.ReplicationStatus()
+	require.NoError(t, err)
+	require.Equal(t, "replica", status.Role)
+	require.Equal(t, primaryURL, status.Primary)
+	require.True(t, status.Streaming)
+	require.Zero(t, status.Lag)
+
+	// Reads are served over HTTP and SQL; writes are refused.
+	resp, err := http.Get(replicaURL + "/get?table=users&key=3")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Result map[string]interface{} `json:"result"`
+	}
+	resp = postJSON(t, replicaURL+"/sql", map[string]string{"query": "SELECT `key`, `value` FROM users WHERE `key` = 3"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	require.Equal(t, "v1-3", result.Result["value"])
+
+	resp = postJSON(t, replicaURL+"/put", map[string]interface{}{"table": table, "key": 1, "value": "local"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.ErrorIs(t, replica.Put(table, 1, "local"), litegodb.ErrReadOnly)
+	_, err = replica.Begin()
+	require.ErrorIs(t, err, litegodb.ErrReadOnly)
+
+	// A restarted replica resumes from the last change it applied.
+	require.NoError(t, replica.Close())
+	for key := 0; key < 20; key++ {
+		require.NoError(t, primary.Put(table, key, fmt.Sprintf("v2-%d", key)))
+	}
+	require.NoError(t, primary.Delete(table, 0))
+	replica, replicaURL = startReplicationServer(t, replicaConfig)
+	waitForReplica(t, replica, primary)
+	requireValue(t, replica, table, 19, "v2-19")
+	requireMissing(t, replica, table, 0)
+
+	// Promoted, the replica accepts writes and numbers them after the primary's changes.
+	primaryStatus, err := primary.ReplicationStatus()
+	require.NoError(t, err)
+	resp = postJSON(t, replicaURL+"/admin/promote", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, replica.Put(table, 101, "after failover"))
+	status, err = replica.ReplicationStatus()
+	require.NoError(t, err)
+	require.Equal(t, "primary", status.Role)
+	require.Equal(t, primaryStatus.LSN+1, status.LSN)
+	require.Error(t, replica.Promote(), "promoting a primary")
+}
+
+// startReplicationServer opens the database configured at configPath and serves it on
+// loopback until the test ends.
+func startReplicationServer(t *testing.T, configPath string) (litegodb.DB, string) {
+	t.Helper()
+	db, cfg, err := litegodb.Open(configPath)
+	require.NoError(t, err)
+	ts := httptest.NewServer(server.NewServer(db, cfg).Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		db.Close()
+	})
+	return db, ts.URL
+}
+
+// waitForReplica waits until replica has applied every change of primary.
+func waitForReplica(t *testing.T, replica, primary litegodb.DB) {
+	t.Helper()
+	want, err := primary.ReplicationStatus()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		status, err := replica.ReplicationStatus()
+		return err == nil && status.LSN == want.LSN
+	}, 10*time.Second, 10*time.Millisecond, "replica did not reach LSN %d", want.LSN)
+}
+
+func postJSON(t *testing.T, url string, body interface{}) *http.Response {
+	t.Helper()
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	return resp
+}
+
+// writeReplicationConfig writes the configuration of the database called name in dir,
+// a replica of primary unless it is empty.
+func writeReplicationConfig(t *testing.T, dir, name, primary string) string {
+	configPath := filepath.Join(dir, name+".yaml")
+	config := fmt.Sprintf(`
+degree: 3
+db_file: %q
+log_file: %q
+flush_every: 1h
+replication:
+  primary: %q
+  retry_every: 50ms
+`, filepath.Join(dir, name+".db"), filepath.Join(dir, name+"-wal"), primary)
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0644))
+	return configPath
+}
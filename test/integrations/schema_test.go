@@ -0,0 +1,132 @@
+package integrations
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/rafaelmgr12/litegodb/pkg/litegodb"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTypedTables creates a table with a schema over SQL and through the remote client,
+// reads typed rows back over SQL, and checks the schema survives a restart and reaches
+// a replica.
+func TestTypedTables(t *testing.T) {
+	dir := t.TempDir()
+	config := writeReplicationConfig(t, dir, "primary", "")
+	db, url := startReplicationServer(t, config)
+
+	sql := func(url, query string) (int, json.RawMessage) {
+		t.Helper()
+		resp := postJSON(t, url+"/sql", map[string]string{"query": query})
+		defer resp.Body.Close()
+		var body struct {
+			Result json.RawMessage `json:"result"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Result
+	}
+
+	status, _ := sql(url, "CREATE TABLE users (id INT PRIMARY KEY, name TEXT, age INT, active BOOL)")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = sql(url, "INSERT INTO users (id, name, age, active) VALUES (1, 'alice', 30, true)")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = sql(url, "INSERT INTO users (id, name, age) VALUES (2, 'bob', 'old')")
+	require.Equal(t, http.StatusInternalServerError, status, "a value of the wrong type")
+
+	status, result := sql(url, "SELECT name, age, active FROM users WHERE id = 1")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"columns":["name","age","active"],"rows":[["alice",30,true]]}`, string(result))
+
+	remote, err := litegodb.OpenRemote(url)
+	require.NoError(t, err)
+	events, err := litegodb.ParseSchema("id INT PRIMARY KEY, kind TEXT NOT NULL")
+	require.NoError(t, err)
+	require.NoError(t, remote.CreateTableWithSchema("events", events))
+	require.Error(t, remote.CreateTableWithSchema("events", events), "the table already exists")
+	s, err := db.Schema("events")
+	require.NoError(t, err)
+	require.Equal(t, events.String(), s.String())
+
+	replica, _ := startReplicationServer(t, writeReplicationConfig(t, dir, "replica", url))
+	waitForReplica(t, replica, db)
+	s, err = replica.Schema("users")
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	value, found, err := replica.Get("users", 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	row, err := s.Decode(1, value)
+	require.NoError(t, err)
+	require.Equal(t, litegodb.Row{int64(1), "alice", int64(30), true}, row)
+
+	require.NoError(t, db.Close())
+	_, url = startReplicationServer(t, config)
+	status, result = sql(url, "SELECT * FROM users WHERE id = 1")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"columns":["id","name","age","active"],"rows":[[1,"alice",30,true]]}`, string(result))
+}
+
+// TestAlterTable renames a table and changes its columns over SQL and through the remote
+// client, and checks the changes reach a replica and survive a restart.
+func TestAlterTable(t *testing.T) {
+	dir := t.TempDir()
+	config := writeReplicationConfig(t, dir, "primary", "")
+	db, url := startReplicationServer(t, config)
+
+	sql := func(url, query string) (int, json.RawMessage) {
+		t.Helper()
+		resp := postJSON(t, url+"/sql", map[string]string{"query": query})
+		defer resp.Body.Close()
+		var body struct {
+			Result json.RawMessage `json:"result"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Result
+	}
+
+	for _, query := range []string{
+		"CREATE TABLE users (id INT PRIMARY KEY, name TEXT, age INT)",
+		"INSERT INTO users (id, name, age) VALUES (1, 'alice', 30)",
+		"ALTER TABLE users ADD COLUMN active BOOL NOT NULL DEFAULT true",
+		"ALTER TABLE users DROP COLUMN age",
+		"ALTER TABLE users SET compression = 'lz'",
+	} {
+		status, _ := sql(url, query)
+		require.Equal(t, http.StatusOK, status, query)
+	}
+	status, _ := sql(url, "ALTER TABLE users DROP COLUMN id")
+	require.Equal(t, http.StatusInternalServerError, status, "dropping the primary key")
+
+	remote, err := litegodb.OpenRemote(url)
+	require.NoError(t, err)
+	require.NoError(t, remote.RenameTable("users", "people"))
+	email, err := litegodb.ParseColumn("email TEXT DEFAULT 'unknown'")
+	require.NoError(t, err)
+	require.NoError(t, remote.AddColumn("people", email))
+
+	status, result := sql(url, "SELECT * FROM people WHERE id = 1")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"columns":["id","name","active","email"],"rows":[[1,"alice",true,"unknown"]]}`, string(result))
+	status, _ = sql(url, "SELECT * FROM users WHERE id = 1")
+	require.Equal(t, http.StatusInternalServerError, status, "the old name is gone")
+
+	replica, _ := startReplicationServer(t, writeReplicationConfig(t, dir, "replica", url))
+	waitForReplica(t, replica, db)
+	s, err := replica.Schema("people")
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	value, found, err := replica.Get("people", 1)
+	require.NoError(t, err)
+	require.True(t, found)
+	row, err := s.Decode(1, value)
+	require.NoError(t, err)
+	require.Equal(t, litegodb.Row{int64(1), "alice", true, "unknown"}, row)
+
+	require.NoError(t, db.Close())
+	_, url = startReplicationServer(t, config)
+	status, result = sql(url, "SELECT name, email FROM people WHERE id = 1")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"columns":["name","email"],"rows":[["alice","unknown"]]}`, string(result))
+}
@@ -0,0 +1,111 @@
+package integrations
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/rafaelmgr12/litegodb/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// TestWebSocketTransactions runs transactions over the WebSocket protocol, both as
+// transaction objects and through SQL.
+func TestWebSocketTransactions(t *testing.T) {
+	dir := t.TempDir()
+	db, url := startReplicationServer(t, writeReplicationConfig(t, dir, "ws", ""))
+	require.NoError(t, db.Put("accounts", 1, "100"))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	call := func(req server.WSRequest) server.WSResponse {
+		t.Helper()
+		require.NoError(t, conn.WriteJSON(req))
+		var resp server.WSResponse
+		require.NoError(t, conn.ReadJSON(&resp))
+		return resp
+	}
+
+	begun := call(server.WSRequest{Op: "begin"})
+	require.Equal(t, "ok", begun.Status)
+	require.NotZero(t, begun.Tx)
+	require.Equal(t, "ok", call(server.WSRequest{Op: "put", Tx: begun.Tx, Table: "accounts", Key: 1, Value: "60"}).Status)
+	require.Equal(t, "ok", call(server.WSRequest{Op: "put", Tx: begun.Tx, Table: "accounts", Key: 2, Value: "40"}).Status)
+
+	require.Equal(t, "60", call(server.WSRequest{Op: "get", Tx: begun.Tx, Table: "accounts", Key: 1}).Value)
+	require.Equal(t, "100", call(server.WSRequest{Op: "get", Table: "accounts", Key: 1}).Value)
+
+	require.Equal(t, "ok", call(server.WSRequest{Op: "commit", Tx: begun.Tx}).Status)
+	requireValue(t, db, "accounts", 1, "60")
+	requireValue(t, db, "accounts", 2, "40")
+	require.Equal(t, "error", call(server.WSRequest{Op: "commit", Tx: begun.Tx}).Status)
+
+	for _, query := range []string{"BEGIN", "DELETE FROM accounts WHERE `key` = 2", "ROLLBACK"} {
+		resp := call(server.WSRequest{Op: "sql", Query: query})
+		require.Equal(t, "ok", resp.Status, "%s: %s", query, resp.Message)
+	}
+	requireValue(t, db, "accounts", 2, "40")
+
+	// An optimistic transaction fails to commit after a key it read changed.
+	optimistic := call(server.WSRequest{Op: "begin", Optimistic: true})
+	require.Equal(t, "40", call(server.WSRequest{Op: "get", Tx: optimistic.Tx, Table: "accounts", Key: 2}).Value)
+	require.Equal(t, "ok", call(server.WSRequest{Op: "put", Tx: optimistic.Tx, Table: "accounts", Key: 3, Value: "40"}).Status)
+	require.NoError(t, db.Put("accounts", 2, "41"))
+	resp := call(server.WSRequest{Op: "commit", Tx: optimistic.Tx})
+	require.Equal(t, "error", resp.Status)
+	require.Contains(t, resp.Message, "conflict")
+	require.NoError(t, db.Put("accounts", 2, "40"))
+
+	// Transactions left open are rolled back when the connection closes.
+	open := call(server.WSRequest{Op: "begin"})
+	require.Equal(t, "ok", call(server.WSRequest{Op: "delete", Tx: open.Tx, Table: "accounts", Key: 2}).Status)
+	require.NoError(t, conn.Close())
+	requireValue(t, db, "accounts", 2, "40")
+}
+
+// TestWebSocketDeadlock locks two keys in opposite orders from two connections: the
+// younger transaction is rolled back and the older one goes through.
+func TestWebSocketDeadlock(t *testing.T) {
+	db, url := startReplicationServer(t, writeReplicationConfig(t, t.TempDir(), "deadlock", ""))
+	require.NoError(t, db.Put("accounts", 1, "100"))
+	require.NoError(t, db.Put("accounts", 2, "100"))
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	sql := func(conn *websocket.Conn, query string) server.WSResponse {
+		t.Helper()
+		require.NoError(t, conn.WriteJSON(server.WSRequest{Op: "sql", Query: query}))
+		var resp server.WSResponse
+		require.NoError(t, conn.ReadJSON(&resp))
+		return resp
+	}
+	older, younger := dial(), dial()
+
+	require.Equal(t, "ok", sql(older, "BEGIN").Status)
+	require.Equal(t, "ok", sql(younger, "BEGIN").Status)
+	require.Equal(t, "ok", sql(older, "SELECT * FROM accounts WHERE `key` = 1 FOR UPDATE").Status)
+	require.Equal(t, "ok", sql(younger, "SELECT * FROM accounts WHERE `key` = 2 FOR UPDATE").Status)
+
+	// The older transaction waits for key 2; the younger one closes the cycle.
+	require.NoError(t, older.WriteJSON(server.WSRequest{Op: "sql", Query: "SELECT * FROM accounts WHERE `key` = 2 FOR UPDATE"}))
+	resp := sql(younger, "SELECT * FROM accounts WHERE `key` = 1 FOR UPDATE")
+	require.Equal(t, "error", resp.Status)
+	require.Contains(t, resp.Message, "deadlock")
+
+	var granted server.WSResponse
+	require.NoError(t, older.ReadJSON(&granted))
+	require.Equal(t, "ok", granted.Status, granted.Message)
+	require.Equal(t, "ok", sql(older, "INSERT INTO accounts VALUES (2, '150')").Status)
+	require.Equal(t, "ok", sql(older, "COMMIT").Status)
+	requireValue(t, db, "accounts", 2, "150")
+
+	// The rolled back session can start over.
+	require.Equal(t, "ok", sql(younger, "BEGIN").Status)
+	require.Equal(t, "ok", sql(younger, "ROLLBACK").Status)
+}